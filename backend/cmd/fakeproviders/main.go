@@ -0,0 +1,61 @@
+// Command fakeproviders runs the fake Gmail and Microsoft Graph servers, seeds
+// their mailboxes and prints the environment that points the server at them,
+// for working on ingestion and OAuth without real accounts.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"email-harvester/internal/providers/gmail/gmailtest"
+	"email-harvester/internal/providers/outlook/outlooktest"
+)
+
+func main() {
+	messages := flag.Int("messages", 25, "messages to seed into each mailbox")
+	pageSize := flag.Int("page-size", 10, "items per list, history and delta page")
+	flag.Parse()
+
+	gmailServer := gmailtest.NewServer()
+	defer gmailServer.Close()
+	gmailServer.PageSize = *pageSize
+
+	graphServer := outlooktest.NewServer()
+	defer graphServer.Close()
+	graphServer.PageSize = *pageSize
+
+	start := time.Now().Add(-time.Duration(*messages) * time.Hour)
+	for n := 0; n < *messages; n++ {
+		date := start.Add(time.Duration(n) * time.Hour)
+		gmailServer.AddMessage(gmailtest.Message{
+			From:    fmt.Sprintf("Sender %d <sender%d@example.com>", n%5, n%5),
+			To:      gmailServer.User.Email,
+			Subject: fmt.Sprintf("Gmail message %d", n+1),
+			Date:    date,
+			Text:    fmt.Sprintf("Body of Gmail message %d.", n+1),
+		})
+		graphServer.AddMessage(outlooktest.Message{
+			From:     outlooktest.Recipient{Name: fmt.Sprintf("Sender %d", n%5), Address: fmt.Sprintf("sender%d@example.com", n%5)},
+			To:       []outlooktest.Recipient{{Address: graphServer.User.Mail}},
+			Subject:  fmt.Sprintf("Outlook message %d", n+1),
+			Received: date,
+			Body:     fmt.Sprintf("Body of Outlook message %d.", n+1),
+		})
+	}
+
+	fmt.Println("# Fake providers are running; start the server with:")
+	fmt.Printf("GOOGLE_AUTH_URL=%s/o/oauth2/v2/auth\n", gmailServer.URL)
+	fmt.Printf("GOOGLE_TOKEN_URL=%s/token\n", gmailServer.URL)
+	fmt.Printf("GOOGLE_USERINFO_URL=%s/oauth2/v2/userinfo\n", gmailServer.URL)
+	fmt.Printf("GMAIL_API_URL=%s/\n", gmailServer.URL)
+	fmt.Printf("MICROSOFT_AUTHORITY_HOST=%s\n", graphServer.URL)
+	fmt.Printf("GRAPH_API_URL=%s/v1.0\n", graphServer.URL)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+}
@@ -0,0 +1,72 @@
+// Command fakepush sends a Gmail notification to the push endpoint the way a
+// Pub/Sub push subscription would, for exercising push handling locally. The
+// server must have GMAIL_PUSH_VERIFICATION_TOKEN set to the same token.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"email-harvester/internal/services"
+)
+
+func main() {
+	endpoint := flag.String("url", "http://localhost:8080/api/webhooks/gmail", "push endpoint URL")
+	email := flag.String("email", "", "Gmail address of the account that changed")
+	historyID := flag.Uint64("history-id", uint64(time.Now().Unix()), "historyId to notify")
+	token := flag.String("token", os.Getenv("GMAIL_PUSH_VERIFICATION_TOKEN"), "verification token configured on the server")
+	flag.Parse()
+
+	if *email == "" || *token == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := json.Marshal(services.GmailNotification{EmailAddress: *email, HistoryID: *historyID})
+	if err != nil {
+		fmt.Printf("Failed to encode notification: %v\n", err)
+		os.Exit(1)
+	}
+
+	var push services.PubSubPushRequest
+	push.Message.Data = base64.StdEncoding.EncodeToString(data)
+	push.Message.MessageID = fmt.Sprintf("fake-%d", time.Now().UnixNano())
+	push.Message.PublishTime = time.Now().UTC()
+	push.Subscription = "projects/local/subscriptions/fakepush"
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		fmt.Printf("Failed to encode push request: %v\n", err)
+		os.Exit(1)
+	}
+
+	target, err := url.Parse(*endpoint)
+	if err != nil {
+		fmt.Printf("Invalid URL: %v\n", err)
+		os.Exit(1)
+	}
+	query := target.Query()
+	query.Set("token", *token)
+	target.RawQuery = query.Encode()
+
+	resp, err := http.Post(target.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Failed to send push: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s %s\n", resp.Status, bytes.TrimSpace(respBody))
+	if resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"email-harvester/internal/blob"
+	"email-harvester/internal/config"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/services"
+	"email-harvester/internal/store"
+)
+
+func main() {
+	format := flag.String("format", services.ImportFormatMbox, "archive format: mbox, eml or maildir")
+	archive := flag.String("archive", "default", "name of the archive account to import into")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-format mbox|eml|maildir] [-archive name] path...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Initialize monitoring
+	monitor, err := monitoring.NewMonitor(cfg.Monitoring)
+	if err != nil {
+		fmt.Printf("Failed to initialize monitoring: %v\n", err)
+		os.Exit(1)
+	}
+	defer monitor.Shutdown()
+
+	// Initialize store
+	db, err := store.NewStore(store.StoreConfig{
+		Type:           store.StoreType(cfg.Store.Type),
+		MongoURI:       cfg.MongoDB.URI,
+		MongoDatabase:  cfg.MongoDB.Database,
+		CosmosEndpoint: cfg.CosmosDB.Endpoint,
+		CosmosKey:      cfg.CosmosDB.Key,
+		CosmosDatabase: cfg.CosmosDB.Database,
+		PostgresDSN:    cfg.Postgres.DSN,
+		SQLitePath:     cfg.SQLite.Path,
+	})
+	if err != nil {
+		fmt.Printf("Failed to initialize store: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	blobStore, err := blob.NewStore(blob.StoreType(cfg.BlobStore.Type), cfg.BlobStore.Path)
+	if err != nil {
+		fmt.Printf("Failed to initialize blob store: %v\n", err)
+		os.Exit(1)
+	}
+
+	importService := services.NewImportService(db, monitor)
+	importService.SetBlobStore(blobStore)
+	progress := func(p services.ImportProgress) {
+		fmt.Printf("\rprocessed %d, imported %d, skipped %d, failed %d",
+			p.Processed, p.Imported, p.Skipped, p.Failed)
+	}
+
+	for _, path := range flag.Args() {
+		fmt.Printf("Importing %s\n", path)
+
+		var err error
+		if *format == services.ImportFormatMaildir {
+			_, err = importService.ImportMaildir(ctx, *archive, path, progress)
+		} else {
+			err = importFile(ctx, importService, *archive, *format, path, progress)
+		}
+		fmt.Println()
+
+		if err != nil {
+			fmt.Printf("Failed to import %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// importFile imports a single mbox or EML file
+func importFile(ctx context.Context, importService *services.ImportService, archive, format, path string, progress func(services.ImportProgress)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = importService.Import(ctx, archive, format, f, progress)
+	return err
+}
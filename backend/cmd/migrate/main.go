@@ -0,0 +1,172 @@
+// Command migrate applies, reverts and lists the schema migrations of the
+// configured store:
+//
+//	migrate up        apply every pending migration
+//	migrate down [n]  revert the n most recent migrations, 1 by default
+//	migrate status    list the migrations and whether they are applied
+//
+// Concurrent runs, including PostgreSQL and SQLite servers migrating on
+// startup, wait for each other. The memory store has no schema.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"email-harvester/internal/config"
+	"email-harvester/internal/migrations"
+	"email-harvester/internal/store"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s up | down [n] | status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	command, n := flag.Arg(0), 1
+	switch {
+	case command == "down" && flag.NArg() == 2:
+		count, err := strconv.Atoi(flag.Arg(1))
+		if err != nil || count < 1 {
+			fmt.Printf("Invalid number of migrations: %s\n", flag.Arg(1))
+			os.Exit(2)
+		}
+		n = count
+	case (command == "up" || command == "down" || command == "status") && flag.NArg() == 1:
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	migrator, closeStore, err := newMigrator(ctx, cfg)
+	if err != nil {
+		fmt.Printf("Failed to initialize migrations: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeStore()
+
+	switch command {
+	case "up":
+		count, err := migrator.Up(ctx)
+		fmt.Printf("Applied %d migrations\n", count)
+		if err != nil {
+			fmt.Printf("Failed to apply migrations: %v\n", err)
+			closeStore()
+			os.Exit(1)
+		}
+	case "down":
+		count, err := migrator.Down(ctx, n)
+		fmt.Printf("Reverted %d migrations\n", count)
+		if err != nil {
+			fmt.Printf("Failed to revert migrations: %v\n", err)
+			closeStore()
+			os.Exit(1)
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			fmt.Printf("Failed to get migrations: %v\n", err)
+			closeStore()
+			os.Exit(1)
+		}
+		for _, status := range statuses {
+			fmt.Printf("%4d  %-32s  %s\n", status.Version, status.Name, describe(status))
+		}
+	}
+}
+
+// describe summarizes whether a migration is applied
+func describe(status migrations.MigrationStatus) string {
+	switch {
+	case status.Unknown:
+		return "applied " + status.AppliedAt.Format(time.RFC3339) + ", unknown to this version"
+	case status.Modified:
+		return "applied " + status.AppliedAt.Format(time.RFC3339) + ", modified since"
+	case status.Applied:
+		return "applied " + status.AppliedAt.Format(time.RFC3339)
+	default:
+		return "pending"
+	}
+}
+
+// newMigrator connects to the configured store's database and returns its
+// migrator along with a function that disconnects
+func newMigrator(ctx context.Context, cfg *config.Config) (*migrations.Migrator, func(), error) {
+	switch store.StoreType(cfg.Store.Type) {
+	case store.StoreTypeMongoDB:
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoDB.URI))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+		}
+		closeClient := func() { client.Disconnect(context.Background()) }
+		return migrations.NewMongoDBMigrator(client.Database(cfg.MongoDB.Database)), closeClient, nil
+
+	case store.StoreTypeCosmosDB:
+		cred, err := azcosmos.NewKeyCredential(cfg.CosmosDB.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create credential: %w", err)
+		}
+		client, err := azcosmos.NewClientWithKey(cfg.CosmosDB.Endpoint, cred, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		database, err := client.NewDatabase(cfg.CosmosDB.Database)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get database: %w", err)
+		}
+		migrator, err := migrations.NewCosmosDBMigrator(ctx, database)
+		if err != nil {
+			return nil, nil, err
+		}
+		return migrator, func() {}, nil
+
+	case store.StoreTypePostgres:
+		db, err := store.OpenPostgres(cfg.Postgres.DSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		migrator, err := migrations.NewSQLMigrator(ctx, db, migrations.DialectPostgres)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return migrator, func() { db.Close() }, nil
+
+	case store.StoreTypeSQLite:
+		db, err := store.OpenSQLite(cfg.SQLite.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		migrator, err := migrations.NewSQLMigrator(ctx, db, migrations.DialectSQLite)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return migrator, func() { db.Close() }, nil
+
+	default:
+		return nil, nil, fmt.Errorf("the %s store has no schema to migrate", cfg.Store.Type)
+	}
+}
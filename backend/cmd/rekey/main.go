@@ -0,0 +1,105 @@
+// Command rekey re-encrypts the credentials stored at rest under the primary
+// encryption key. To rotate keys, add the new key to ENCRYPTION_KEYS, make it
+// ENCRYPTION_KEY_ID, restart the server and run rekey; once it reports nothing
+// left to re-encrypt the old key can be removed. It also encrypts credentials
+// written before encryption was enabled.
+//
+// Accounts are rewritten in full, so stop the server's sync workers while it
+// runs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"email-harvester/internal/config"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/secrets"
+	"email-harvester/internal/services"
+	"email-harvester/internal/store"
+)
+
+func main() {
+	users := flag.Bool("users", true, "also re-encrypt users' 2FA secrets (MongoDB only)")
+	flag.Parse()
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Initialize monitoring
+	monitor, err := monitoring.NewMonitor(cfg.Monitoring)
+	if err != nil {
+		fmt.Printf("Failed to initialize monitoring: %v\n", err)
+		os.Exit(1)
+	}
+	defer monitor.Shutdown()
+
+	keyring, err := secrets.LoadKeyring(cfg.Encryption.KeyID, cfg.Encryption.Keys)
+	if err != nil {
+		fmt.Printf("Failed to load encryption keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Initialize store
+	db, err := store.NewStore(store.StoreConfig{
+		Type:           store.StoreType(cfg.Store.Type),
+		MongoURI:       cfg.MongoDB.URI,
+		MongoDatabase:  cfg.MongoDB.Database,
+		CosmosEndpoint: cfg.CosmosDB.Endpoint,
+		CosmosKey:      cfg.CosmosDB.Key,
+		CosmosDatabase: cfg.CosmosDB.Database,
+		PostgresDSN:    cfg.Postgres.DSN,
+		SQLitePath:     cfg.SQLite.Path,
+	})
+	if err != nil {
+		fmt.Printf("Failed to initialize store: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Re-encrypting under key %q\n", keyring.PrimaryKeyID())
+
+	accounts, err := store.NewEncryptedStore(db, keyring).RekeyAccounts(ctx)
+	fmt.Printf("Re-encrypted %d accounts\n", accounts)
+	if err != nil {
+		fmt.Printf("Failed to re-encrypt accounts: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Users are only kept in MongoDB
+	if !*users || store.StoreType(cfg.Store.Type) != store.StoreTypeMongoDB {
+		return
+	}
+	count, err := rekeyUsers(ctx, cfg, monitor, keyring)
+	fmt.Printf("Re-encrypted %d users\n", count)
+	if err != nil {
+		fmt.Printf("Failed to re-encrypt users: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// rekeyUsers re-encrypts the 2FA secrets in the users collection
+func rekeyUsers(ctx context.Context, cfg *config.Config, monitor *monitoring.Monitor, keyring *secrets.Keyring) (int, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoDB.URI))
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(context.Background())
+
+	userService := services.NewUserService(client.Database(cfg.MongoDB.Database), monitor)
+	userService.SetKeyring(keyring)
+	return userService.RekeyTwoFactorSecrets(ctx)
+}
@@ -14,10 +14,16 @@ import (
 	"github.com/go-chi/cors"
 	"go.uber.org/zap"
 
+	"email-harvester/internal/blob"
 	"email-harvester/internal/config"
 	"email-harvester/internal/handlers"
 	"email-harvester/internal/middleware/middleware"
 	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
+	"email-harvester/internal/providers/gmail"
+	"email-harvester/internal/providers/imap"
+	"email-harvester/internal/providers/outlook"
+	"email-harvester/internal/secrets"
 	"email-harvester/internal/services"
 	"email-harvester/internal/store"
 )
@@ -45,6 +51,12 @@ func main() {
 		store, err = store.NewMongoStore(cfg.MongoDB, monitor)
 	case "cosmos":
 		store, err = store.NewCosmosStore(cfg.CosmosDB, monitor)
+	case "postgres":
+		store, err = store.NewPostgresStore(cfg.Postgres.DSN)
+	case "sqlite":
+		store, err = store.NewSQLiteStore(cfg.SQLite.Path)
+	case "memory":
+		store = store.NewMemoryStore()
 	default:
 		err = fmt.Errorf("unsupported store type: %s", cfg.Store.Type)
 	}
@@ -53,19 +65,111 @@ func main() {
 	}
 	defer store.Close()
 
-	// Initialize services
-	oauthService, err := services.NewOAuthService(cfg, monitor)
+	// Credentials are encrypted at rest under the configured master keys
+	keyring, err := secrets.LoadKeyring(cfg.Encryption.KeyID, cfg.Encryption.Keys)
+	if err != nil {
+		monitor.LogFatal("Failed to load encryption keys", err)
+	}
+	store = store.NewEncryptedStore(store, keyring)
+
+	// Initialize blob store for attachments
+	blobStore, err := blob.NewStore(blob.StoreType(cfg.BlobStore.Type), cfg.BlobStore.Path)
 	if err != nil {
-		monitor.LogFatal("Failed to initialize OAuth service", err)
+		monitor.LogFatal("Failed to initialize blob store", err)
 	}
 
-	emailService := services.NewEmailService(store, monitor)
+	// Register the mail providers; "google" and "microsoft" are the names
+	// the OAuth routes have always used
+	registry := providers.NewRegistry()
+	registry.Register(gmail.New(gmail.Config{
+		ClientID:     cfg.OAuth.Google.ClientID,
+		ClientSecret: cfg.OAuth.Google.ClientSecret,
+		RedirectURL:  cfg.OAuth.Google.RedirectURL,
+		Scopes:       cfg.OAuth.Google.Scopes,
+		AuthURL:      cfg.OAuth.Google.AuthURL,
+		TokenURL:     cfg.OAuth.Google.TokenURL,
+		UserInfoURL:  cfg.OAuth.Google.UserInfoURL,
+		APIURL:       cfg.OAuth.Google.APIURL,
+	}), "google")
+	registry.Register(outlook.New(outlook.Config{
+		ClientID:     cfg.OAuth.Microsoft.ClientID,
+		ClientSecret: cfg.OAuth.Microsoft.ClientSecret,
+		RedirectURL:  cfg.OAuth.Microsoft.RedirectURL,
+		Scopes:       cfg.OAuth.Microsoft.Scopes,
+		Authority:    cfg.OAuth.Microsoft.Authority,
+		GraphURL:     cfg.OAuth.Microsoft.GraphURL,
+	}), "microsoft")
+	registry.Register(imap.New())
+
+	// Initialize services
+	oauthService := services.NewOAuthService(registry, monitor)
+	oauthService.SetStore(store)
+	emailService := services.NewEmailService(store, registry, monitor)
 	llmService := services.NewLLMService(cfg.Ollama, monitor)
+	importService := services.NewImportService(store, monitor)
+	emailService.SetBlobStore(blobStore)
+	importService.SetBlobStore(blobStore)
+
+	// Background work (sync scheduler, job workers, watch renewal) stops with the server
+	workCtx, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	if cfg.Sync.Enabled {
+		scheduler := services.NewSyncScheduler(store, emailService, monitor, services.SyncSchedulerConfig{
+			Interval:    cfg.Sync.Interval,
+			Jitter:      cfg.Sync.Jitter,
+			Timeout:     cfg.Sync.Timeout,
+			Concurrency: cfg.Sync.Concurrency,
+		})
+		go scheduler.Run(workCtx)
+	}
+
+	// Start the job workers
+	jobService := services.NewJobService(store, monitor, services.JobConfig{
+		Workers:           cfg.Jobs.Workers,
+		PollInterval:      cfg.Jobs.PollInterval,
+		VisibilityTimeout: cfg.Jobs.VisibilityTimeout,
+		MaxAttempts:       cfg.Jobs.MaxAttempts,
+		BackoffBase:       cfg.Jobs.BackoffBase,
+		BackoffMax:        cfg.Jobs.BackoffMax,
+	})
+	jobService.RegisterEmailHandlers(emailService, llmService)
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		jobService.Run(workCtx)
+	}()
+
+	// Receive Gmail push notifications and keep the watches alive
+	gmailPushService := services.NewGmailPushService(store, emailService, jobService, monitor, services.GmailPushConfig{
+		Topic:             cfg.GmailPush.Topic,
+		Audience:          cfg.GmailPush.Audience,
+		ServiceAccount:    cfg.GmailPush.ServiceAccount,
+		VerificationToken: cfg.GmailPush.VerificationToken,
+		RenewInterval:     cfg.GmailPush.RenewInterval,
+		RenewBefore:       cfg.GmailPush.RenewBefore,
+	})
+	if cfg.GmailPush.Topic != "" {
+		go gmailPushService.RunWatchRenewer(workCtx)
+	}
+
+	// Receive Graph change notifications and keep the subscriptions alive
+	outlookPushService := services.NewOutlookPushService(store, emailService, jobService, monitor, services.OutlookPushConfig{
+		NotificationURL: cfg.OutlookPush.NotificationURL,
+		RenewInterval:   cfg.OutlookPush.RenewInterval,
+		RenewBefore:     cfg.OutlookPush.RenewBefore,
+	})
+	if cfg.OutlookPush.NotificationURL != "" {
+		go outlookPushService.RunSubscriptionRenewer(workCtx)
+	}
 
 	// Initialize handlers
 	oauthHandler := handlers.NewOAuthHandler(oauthService, monitor)
 	emailHandler := handlers.NewEmailHandler(emailService, monitor)
+	threadHandler := handlers.NewThreadHandler(emailService, monitor)
 	accountHandler := handlers.NewAccountHandler(store, monitor)
+	importHandler := handlers.NewImportHandler(importService, monitor)
+	jobHandler := handlers.NewJobHandler(jobService, monitor)
+	webhookHandler := handlers.NewWebhookHandler(gmailPushService, outlookPushService, monitor)
 
 	// Create router
 	r := chi.NewRouter()
@@ -99,8 +203,11 @@ func main() {
 
 	// Routes
 	r.Route("/api", func(r chi.Router) {
-		// OAuth routes
-		oauthHandler.RegisterRoutes(r)
+		// OAuth routes connect mailboxes to the logged-in user
+		r.Group(func(r chi.Router) {
+			r.Use(handlers.Authenticator([]byte(cfg.Auth.JWTSecret)))
+			oauthHandler.RegisterRoutes(r)
+		})
 
 		// Account routes
 		accountHandler.RegisterRoutes(r)
@@ -108,6 +215,18 @@ func main() {
 		// Email routes
 		emailHandler.RegisterRoutes(r)
 
+		// Thread routes
+		threadHandler.RegisterRoutes(r)
+
+		// Archive import routes
+		importHandler.RegisterRoutes(r)
+
+		// Job queue routes
+		jobHandler.RegisterRoutes(r)
+
+		// Provider push notification routes
+		webhookHandler.RegisterRoutes(r)
+
 		// Health check
 		r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 			render.JSON(w, r, map[string]string{"status": "ok"})
@@ -141,6 +260,7 @@ func main() {
 
 	// Graceful shutdown
 	monitor.LogInfo("Shutting down server...")
+	stopWork()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -148,5 +268,11 @@ func main() {
 		monitor.LogError("Server forced to shutdown", err)
 	}
 
+	// Let running jobs record their outcome
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+	}
+
 	monitor.LogInfo("Server stopped")
 } 
\ No newline at end of file
@@ -68,6 +68,17 @@ func (h *Handler) AddAccount(c *gin.Context) {
 		return
 	}
 
+	// IMAP accounts have no OAuth flow and are created right away
+	if req.Provider == string(models.AccountTypeIMAP) {
+		account, err := h.emailService.AddIMAPAccount(c.Request.Context(), req.Email, req.IMAP, req.Password)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, account)
+		return
+	}
+
 	authURL, err := h.oauthService.GetAuthURL(req.Provider, req.Email)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -131,13 +142,13 @@ func (h *Handler) FetchEmails(c *gin.Context) {
 		return
 	}
 
-	emails, err := h.emailService.FetchEmails(c.Request.Context(), id)
+	result, err := h.emailService.FetchEmails(c.Request.Context(), id.Hex())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, emails)
+	c.JSON(http.StatusOK, result)
 }
 
 // ListEmails lists all emails with pagination
@@ -146,28 +157,23 @@ func (h *Handler) ListEmails(c *gin.Context) {
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 	accountID := c.Query("account_id")
 
-	var filter models.EmailFilter
+	var account *primitive.ObjectID
 	if accountID != "" {
 		id, err := primitive.ObjectIDFromHex(accountID)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account_id"})
 			return
 		}
-		filter.AccountID = &id
+		account = &id
 	}
 
-	emails, total, err := h.emailService.ListEmails(c.Request.Context(), filter, page, limit)
+	response, err := h.emailService.ListEmails(c.Request.Context(), c.Query("q"), account, page, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"emails": emails,
-		"total":  total,
-		"page":   page,
-		"limit":  limit,
-	})
+	c.JSON(http.StatusOK, response)
 }
 
 // GetEmail retrieves a specific email by ID
@@ -0,0 +1,45 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Store defines the interface for storing binary objects such as attachments.
+// Keys are opaque strings chosen by the caller.
+type Store interface {
+	// Put stores the content of r under key, replacing any existing blob
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the blob stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Exists reports whether a blob is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes the blob stored under key
+	Delete(ctx context.Context, key string) error
+}
+
+// StoreType represents the type of blob store to use
+type StoreType string
+
+const (
+	StoreTypeFilesystem StoreType = "fs"
+	StoreTypeMemory     StoreType = "memory"
+)
+
+// NewStore creates a new blob store instance. path is the root directory of a
+// filesystem store and is ignored otherwise.
+func NewStore(storeType StoreType, path string) (Store, error) {
+	switch storeType {
+	case StoreTypeFilesystem:
+		return NewFSStore(path)
+	case StoreTypeMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported blob store type: %s", storeType)
+	}
+}
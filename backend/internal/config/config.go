@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"email-harvester/internal/store"
@@ -17,7 +18,7 @@ type Config struct {
 
 	// Store configuration
 	Store struct {
-		Type string // "mongodb" or "cosmosdb"
+		Type string // "mongodb", "cosmosdb", "postgres", "sqlite" or "memory"
 	}
 	MongoDB struct {
 		URI      string
@@ -28,6 +29,65 @@ type Config struct {
 		Key      string
 		Database string
 	}
+	Postgres struct {
+		DSN string
+	}
+	SQLite struct {
+		Path string
+	}
+
+	// Blob store configuration for attachment contents
+	BlobStore struct {
+		Type string // "fs" or "memory"
+		Path string
+	}
+
+	// Background sync configuration
+	Sync struct {
+		Enabled     bool
+		Interval    time.Duration
+		Jitter      time.Duration
+		Timeout     time.Duration // Per account
+		Concurrency int
+	}
+
+	// Job queue configuration
+	Jobs struct {
+		Workers           int
+		PollInterval      time.Duration
+		VisibilityTimeout time.Duration
+		MaxAttempts       int
+		BackoffBase       time.Duration
+		BackoffMax        time.Duration
+	}
+
+	// Gmail push notification configuration; disabled without a topic
+	GmailPush struct {
+		Topic             string
+		Audience          string
+		ServiceAccount    string
+		VerificationToken string
+		RenewInterval     time.Duration
+		RenewBefore       time.Duration
+	}
+
+	// Outlook change notification configuration; disabled without a URL
+	OutlookPush struct {
+		NotificationURL string
+		RenewInterval   time.Duration
+		RenewBefore     time.Duration
+	}
+
+	// Authentication of API users
+	Auth struct {
+		JWTSecret string // HMAC key the login JWTs are signed with
+	}
+
+	// Encryption of credentials at rest
+	Encryption struct {
+		Keys  string // Master keys as comma-separated "<id>:<base64 32-byte key>"
+		KeyID string // Primary key that new values are encrypted under
+	}
 
 	// OAuth configuration
 	OAuth struct {
@@ -36,6 +96,10 @@ type Config struct {
 			ClientSecret string
 			RedirectURL  string
 			Scopes       []string
+			AuthURL      string
+			TokenURL     string
+			UserInfoURL  string
+			APIURL       string
 		}
 		Microsoft struct {
 			ClientID     string
@@ -44,6 +108,7 @@ type Config struct {
 			TenantID     string
 			Scopes       []string
 			Authority    string
+			GraphURL     string
 		}
 		Outlook struct {
 			ClientID     string
@@ -89,7 +154,9 @@ func Load() (*Config, error) {
 
 	// Store configuration
 	cfg.Store.Type = getEnv("STORE_TYPE", "mongodb")
-	if cfg.Store.Type != "mongodb" && cfg.Store.Type != "cosmosdb" {
+	switch cfg.Store.Type {
+	case "mongodb", "cosmosdb", "postgres", "sqlite", "memory":
+	default:
 		return nil, fmt.Errorf("invalid store type: %s", cfg.Store.Type)
 	}
 
@@ -102,23 +169,75 @@ func Load() (*Config, error) {
 	cfg.CosmosDB.Key = getEnv("COSMOS_KEY", "")
 	cfg.CosmosDB.Database = getEnv("COSMOS_DB", "email_harvester")
 
+	// PostgreSQL and SQLite configuration
+	cfg.Postgres.DSN = getEnv("POSTGRES_DSN", "")
+	cfg.SQLite.Path = getEnv("SQLITE_PATH", "email_harvester.db")
+
+	// Blob store configuration
+	cfg.BlobStore.Type = getEnv("BLOB_STORE_TYPE", "fs")
+	cfg.BlobStore.Path = getEnv("BLOB_STORE_PATH", "./data/blobs")
+
+	// Background sync configuration
+	cfg.Sync.Enabled = getBoolEnv("SYNC_ENABLED", true)
+	cfg.Sync.Interval = getDurationEnv("SYNC_INTERVAL", 5*time.Minute)
+	cfg.Sync.Jitter = getDurationEnv("SYNC_JITTER", 30*time.Second)
+	cfg.Sync.Timeout = getDurationEnv("SYNC_TIMEOUT", 10*time.Minute)
+	cfg.Sync.Concurrency = getIntEnv("SYNC_CONCURRENCY", 4)
+
+	// Job queue configuration
+	cfg.Jobs.Workers = getIntEnv("JOB_WORKERS", 2)
+	cfg.Jobs.PollInterval = getDurationEnv("JOB_POLL_INTERVAL", 2*time.Second)
+	cfg.Jobs.VisibilityTimeout = getDurationEnv("JOB_VISIBILITY_TIMEOUT", 15*time.Minute)
+	cfg.Jobs.MaxAttempts = getIntEnv("JOB_MAX_ATTEMPTS", 5)
+	cfg.Jobs.BackoffBase = getDurationEnv("JOB_BACKOFF_BASE", 30*time.Second)
+	cfg.Jobs.BackoffMax = getDurationEnv("JOB_BACKOFF_MAX", time.Hour)
+
+	// Gmail push notification configuration
+	cfg.GmailPush.Topic = getEnv("GMAIL_PUSH_TOPIC", "")
+	cfg.GmailPush.Audience = getEnv("GMAIL_PUSH_AUDIENCE", "")
+	cfg.GmailPush.ServiceAccount = getEnv("GMAIL_PUSH_SERVICE_ACCOUNT", "")
+	cfg.GmailPush.VerificationToken = getEnv("GMAIL_PUSH_VERIFICATION_TOKEN", "")
+	cfg.GmailPush.RenewInterval = getDurationEnv("GMAIL_WATCH_RENEW_INTERVAL", time.Hour)
+	cfg.GmailPush.RenewBefore = getDurationEnv("GMAIL_WATCH_RENEW_BEFORE", 24*time.Hour)
+
+	// Outlook change notification configuration
+	cfg.OutlookPush.NotificationURL = getEnv("GRAPH_NOTIFICATION_URL", "")
+	cfg.OutlookPush.RenewInterval = getDurationEnv("GRAPH_SUBSCRIPTION_RENEW_INTERVAL", time.Hour)
+	cfg.OutlookPush.RenewBefore = getDurationEnv("GRAPH_SUBSCRIPTION_RENEW_BEFORE", 24*time.Hour)
+
+	// Authentication configuration
+	cfg.Auth.JWTSecret = getEnv("JWT_SECRET", "")
+
+	// Encryption configuration
+	cfg.Encryption.Keys = getEnv("ENCRYPTION_KEYS", "")
+	cfg.Encryption.KeyID = getEnv("ENCRYPTION_KEY_ID", "")
+
 	// OAuth configuration
 	cfg.OAuth.Google.ClientID = getEnv("GOOGLE_CLIENT_ID", "")
 	cfg.OAuth.Google.ClientSecret = getEnv("GOOGLE_CLIENT_SECRET", "")
 	cfg.OAuth.Google.RedirectURL = getEnv("GOOGLE_REDIRECT_URL", "http://localhost:8080/api/v1/accounts/auth/callback")
 	cfg.OAuth.Google.Scopes = []string{
-		"https://www.googleapis.com/auth/gmail.readonly",
+		"https://www.googleapis.com/auth/gmail.modify", // Read, label and trash messages
 		"https://www.googleapis.com/auth/userinfo.email",
 		"https://www.googleapis.com/auth/userinfo.profile",
 	}
+	// Provider endpoints; overridden to point at fake servers
+	cfg.OAuth.Google.AuthURL = getEnv("GOOGLE_AUTH_URL", "https://accounts.google.com/o/oauth2/v2/auth")
+	cfg.OAuth.Google.TokenURL = getEnv("GOOGLE_TOKEN_URL", "https://oauth2.googleapis.com/token")
+	cfg.OAuth.Google.UserInfoURL = getEnv("GOOGLE_USERINFO_URL", "https://www.googleapis.com/oauth2/v2/userinfo")
+	cfg.OAuth.Google.APIURL = getEnv("GMAIL_API_URL", "https://gmail.googleapis.com/")
 
 	cfg.OAuth.Microsoft.ClientID = getEnv("MICROSOFT_CLIENT_ID", "")
 	cfg.OAuth.Microsoft.ClientSecret = getEnv("MICROSOFT_CLIENT_SECRET", "")
 	cfg.OAuth.Microsoft.RedirectURL = getEnv("MICROSOFT_REDIRECT_URL", "http://localhost:8080/api/v1/accounts/auth/callback")
 	cfg.OAuth.Microsoft.TenantID = getEnv("MICROSOFT_TENANT_ID", "common")
-	cfg.OAuth.Microsoft.Authority = fmt.Sprintf("https://login.microsoftonline.com/%s", cfg.OAuth.Microsoft.TenantID)
+	cfg.OAuth.Microsoft.Authority = fmt.Sprintf("%s/%s",
+		strings.TrimSuffix(getEnv("MICROSOFT_AUTHORITY_HOST", "https://login.microsoftonline.com"), "/"),
+		cfg.OAuth.Microsoft.TenantID)
+	cfg.OAuth.Microsoft.GraphURL = getEnv("GRAPH_API_URL", "https://graph.microsoft.com/v1.0")
 	cfg.OAuth.Microsoft.Scopes = []string{
-		"https://outlook.office.com/mail.read",
+		"https://graph.microsoft.com/Mail.ReadWrite",
+		"https://graph.microsoft.com/User.Read",
 		"offline_access",
 		"openid",
 		"profile",
@@ -171,6 +290,85 @@ func (c *Config) validate() error {
 		if c.CosmosDB.Key == "" {
 			return fmt.Errorf("COSMOS_KEY is required for Cosmos DB store")
 		}
+	case "postgres":
+		if c.Postgres.DSN == "" {
+			return fmt.Errorf("POSTGRES_DSN is required for PostgreSQL store")
+		}
+	case "sqlite":
+		if c.SQLite.Path == "" {
+			return fmt.Errorf("SQLITE_PATH is required for SQLite store")
+		}
+	}
+
+	// Validate blob store configuration
+	switch c.BlobStore.Type {
+	case "fs":
+		if c.BlobStore.Path == "" {
+			return fmt.Errorf("BLOB_STORE_PATH is required for the filesystem blob store")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("invalid blob store type: %s", c.BlobStore.Type)
+	}
+
+	// Validate background sync configuration
+	if c.Sync.Enabled {
+		if c.Sync.Interval <= 0 {
+			return fmt.Errorf("SYNC_INTERVAL must be positive")
+		}
+		if c.Sync.Jitter < 0 || c.Sync.Jitter >= c.Sync.Interval {
+			return fmt.Errorf("SYNC_JITTER must be between 0 and SYNC_INTERVAL")
+		}
+		if c.Sync.Concurrency < 1 {
+			return fmt.Errorf("SYNC_CONCURRENCY must be at least 1")
+		}
+	}
+
+	// Validate job queue configuration
+	if c.Jobs.Workers < 1 {
+		return fmt.Errorf("JOB_WORKERS must be at least 1")
+	}
+	if c.Jobs.PollInterval <= 0 || c.Jobs.VisibilityTimeout <= 0 {
+		return fmt.Errorf("JOB_POLL_INTERVAL and JOB_VISIBILITY_TIMEOUT must be positive")
+	}
+	if c.Jobs.MaxAttempts < 1 {
+		return fmt.Errorf("JOB_MAX_ATTEMPTS must be at least 1")
+	}
+	if c.Jobs.BackoffBase <= 0 || c.Jobs.BackoffMax < c.Jobs.BackoffBase {
+		return fmt.Errorf("JOB_BACKOFF_BASE must be positive and not above JOB_BACKOFF_MAX")
+	}
+
+	// Validate Gmail push configuration
+	if c.GmailPush.Topic != "" {
+		if c.GmailPush.Audience == "" && c.GmailPush.VerificationToken == "" {
+			return fmt.Errorf("GMAIL_PUSH_AUDIENCE or GMAIL_PUSH_VERIFICATION_TOKEN is required for Gmail push")
+		}
+		if c.GmailPush.RenewInterval <= 0 || c.GmailPush.RenewBefore <= c.GmailPush.RenewInterval {
+			return fmt.Errorf("GMAIL_WATCH_RENEW_BEFORE must be longer than GMAIL_WATCH_RENEW_INTERVAL")
+		}
+	}
+
+	// Validate Outlook change notification configuration
+	if c.OutlookPush.NotificationURL != "" {
+		if !strings.HasPrefix(c.OutlookPush.NotificationURL, "https://") {
+			return fmt.Errorf("GRAPH_NOTIFICATION_URL must be an https URL")
+		}
+		if c.OutlookPush.RenewInterval <= 0 || c.OutlookPush.RenewBefore <= c.OutlookPush.RenewInterval {
+			return fmt.Errorf("GRAPH_SUBSCRIPTION_RENEW_BEFORE must be longer than GRAPH_SUBSCRIPTION_RENEW_INTERVAL")
+		}
+	}
+
+	// Validate authentication configuration
+	if c.Auth.JWTSecret == "" {
+		return fmt.Errorf("JWT_SECRET is required")
+	}
+
+	// Validate encryption configuration
+	if c.Encryption.Keys == "" {
+		return fmt.Errorf("ENCRYPTION_KEYS is required")
+	}
+	if c.Encryption.KeyID == "" {
+		return fmt.Errorf("ENCRYPTION_KEY_ID is required")
 	}
 
 	// Validate OAuth configuration
@@ -228,6 +426,15 @@ func getIntEnv(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
+
 func getBoolEnv(key string, defaultValue bool) bool {
 	if value, exists := os.LookupEnv(key); exists {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
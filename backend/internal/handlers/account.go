@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/store"
+)
+
+// AccountHandler handles account-related HTTP requests
+type AccountHandler struct {
+	store   store.Store
+	monitor *monitoring.Monitor
+}
+
+// NewAccountHandler creates a new account handler
+func NewAccountHandler(store store.Store, monitor *monitoring.Monitor) *AccountHandler {
+	return &AccountHandler{
+		store:   store,
+		monitor: monitor,
+	}
+}
+
+// RegisterRoutes registers the account routes
+func (h *AccountHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/accounts", func(r chi.Router) {
+		r.Get("/sync-status", h.ListSyncStatus)
+		r.Get("/{id}/sync-status", h.GetSyncStatus)
+	})
+}
+
+// AccountSyncStatusResponse represents the background sync state of an account
+type AccountSyncStatusResponse struct {
+	AccountID  string             `json:"account_id"`
+	Provider   string             `json:"provider"`
+	Email      string             `json:"email"`
+	IsActive   bool               `json:"is_active"`
+	LastSyncAt time.Time          `json:"last_sync_at"`
+	Status     *models.SyncStatus `json:"status,omitempty"` // Nil until the first sync attempt
+}
+
+func newAccountSyncStatusResponse(account *models.Account) AccountSyncStatusResponse {
+	return AccountSyncStatusResponse{
+		AccountID:  account.ID.Hex(),
+		Provider:   account.Provider,
+		Email:      account.Email,
+		IsActive:   account.IsActive,
+		LastSyncAt: account.LastSyncAt,
+		Status:     account.SyncStatus,
+	}
+}
+
+// ListSyncStatus handles the request to list the sync status of every active account
+func (h *AccountHandler) ListSyncStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accounts, err := h.store.ListActiveAccounts(ctx)
+	if err != nil {
+		h.monitor.LogError("Failed to list accounts", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	statuses := make([]AccountSyncStatusResponse, 0, len(accounts))
+	for i := range accounts {
+		statuses = append(statuses, newAccountSyncStatusResponse(&accounts[i]))
+	}
+	render.JSON(w, r, statuses)
+}
+
+// GetSyncStatus handles the request to get the sync status of one account
+func (h *AccountHandler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid account id"})
+		return
+	}
+
+	account, err := h.store.GetAccount(ctx, accountID)
+	if err != nil {
+		h.monitor.LogError("Failed to get account", err,
+			zap.String("account_id", accountID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+	if account == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, ErrorResponse{Error: "Account not found"})
+		return
+	}
+
+	render.JSON(w, r, newAccountSyncStatusResponse(account))
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// userIDKey is the context key under which Authenticator stores the user ID
+type userIDKey struct{}
+
+// Authenticator returns a middleware that requires a bearer JWT signed with
+// secret and makes the user ID from its user_id claim available to handlers
+func Authenticator(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := parseUserToken(r.Header.Get("Authorization"), secret)
+			if err != nil {
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, ErrorResponse{Error: "Unauthorized"})
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey{}, userID)))
+		})
+	}
+}
+
+// userIDFromContext returns the ID of the authenticated user
+func userIDFromContext(ctx context.Context) (primitive.ObjectID, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(primitive.ObjectID)
+	return userID, ok
+}
+
+// parseUserToken verifies a "Bearer <jwt>" header and returns its user ID
+func parseUserToken(header string, secret []byte) (primitive.ObjectID, error) {
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return primitive.NilObjectID, errors.New("missing bearer token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	hex, _ := claims["user_id"].(string)
+	userID, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("invalid user_id claim: %w", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
+	"email-harvester/internal/search"
+	"email-harvester/internal/services"
+	"email-harvester/internal/store"
+)
+
+// EmailHandler handles email-related HTTP requests
+type EmailHandler struct {
+	emailService *services.EmailService
+	monitor      *monitoring.Monitor
+}
+
+// NewEmailHandler creates a new email handler
+func NewEmailHandler(emailService *services.EmailService, monitor *monitoring.Monitor) *EmailHandler {
+	return &EmailHandler{
+		emailService: emailService,
+		monitor:      monitor,
+	}
+}
+
+// RegisterRoutes registers the email routes
+func (h *EmailHandler) RegisterRoutes(r chi.Router) {
+	r.Get("/emails", h.ListEmails)
+	r.Get("/emails/search", h.SearchEmails)
+	r.Patch("/emails/{id}", h.UpdateEmail)
+	r.Delete("/emails/{id}", h.DeleteEmail)
+	r.Route("/emails/{id}/attachments", func(r chi.Router) {
+		r.Get("/", h.ListAttachments)
+		r.Get("/{attachmentID}", h.DownloadAttachment)
+	})
+}
+
+// ListEmails handles the request to list emails, newest first, filtered by
+// a Gmail-style search query and optionally one account. Pages are selected
+// with either a cursor from a previous response or a page number.
+func (h *EmailHandler) ListEmails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accountID, page, limit, ok := emailListParams(w, r)
+	if !ok {
+		return
+	}
+
+	var response *models.EmailListResponse
+	var err error
+	query := r.URL.Query().Get("q")
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		response, err = h.emailService.ListEmailsAfter(ctx, query, accountID, cursor, limit)
+	} else {
+		response, err = h.emailService.ListEmails(ctx, query, accountID, page, limit)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidQuery):
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		case errors.Is(err, store.ErrInvalidCursor):
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: "Invalid cursor"})
+		default:
+			h.monitor.LogError("Failed to list emails", err)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		}
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// SearchEmails handles the request for a ranked full-text search over the
+// emails' subject, sender and body, with the same query language as
+// ListEmails
+func (h *EmailHandler) SearchEmails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accountID, page, limit, ok := emailListParams(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := h.emailService.SearchEmails(ctx, r.URL.Query().Get("q"), accountID, page, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidQuery):
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		case errors.Is(err, services.ErrEmptySearch):
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: "Search query needs a word or phrase"})
+		default:
+			h.monitor.LogError("Failed to search emails", err)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		}
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// emailListParams reads the account, page and limit of an email listing. It
+// answers the request itself when they are invalid.
+func emailListParams(w http.ResponseWriter, r *http.Request) (*primitive.ObjectID, int, int, bool) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var accountID *primitive.ObjectID
+	if value := r.URL.Query().Get("account_id"); value != "" {
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: "Invalid account id"})
+			return nil, 0, 0, false
+		}
+		accountID = &id
+	}
+	return accountID, page, limit, true
+}
+
+// UpdateEmail handles the request to mark an email read or starred, on the
+// provider as well as locally
+func (h *EmailHandler) UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	emailID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid email id"})
+		return
+	}
+
+	var req providers.MessageUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	email, err := h.emailService.UpdateEmail(ctx, emailID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmailNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Email not found"})
+		case errors.Is(err, services.ErrAccountRevoked):
+			render.Status(r, http.StatusConflict)
+			render.JSON(w, r, ErrorResponse{Error: "Account must be reconnected"})
+		default:
+			h.monitor.LogError("Failed to update email", err,
+				zap.String("email_id", emailID.Hex()))
+			render.Status(r, http.StatusBadGateway)
+			render.JSON(w, r, ErrorResponse{Error: "Failed to update email"})
+		}
+		return
+	}
+
+	render.JSON(w, r, email)
+}
+
+// DeleteEmail handles the request to delete an email, on the provider as well
+// as locally
+func (h *EmailHandler) DeleteEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	emailID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid email id"})
+		return
+	}
+
+	if err := h.emailService.DeleteEmail(ctx, emailID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmailNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Email not found"})
+		case errors.Is(err, services.ErrAccountRevoked):
+			render.Status(r, http.StatusConflict)
+			render.JSON(w, r, ErrorResponse{Error: "Account must be reconnected"})
+		default:
+			h.monitor.LogError("Failed to delete email", err,
+				zap.String("email_id", emailID.Hex()))
+			render.Status(r, http.StatusBadGateway)
+			render.JSON(w, r, ErrorResponse{Error: "Failed to delete email"})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListAttachments handles the request to list the attachments of an email
+func (h *EmailHandler) ListAttachments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	emailID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid email id"})
+		return
+	}
+
+	attachments, err := h.emailService.ListAttachments(ctx, emailID)
+	if err != nil {
+		if errors.Is(err, services.ErrEmailNotFound) {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Email not found"})
+			return
+		}
+		h.monitor.LogError("Failed to list attachments", err,
+			zap.String("email_id", emailID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.JSON(w, r, attachments)
+}
+
+// DownloadAttachment handles the request to download an attachment's content
+func (h *EmailHandler) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	attachmentID := chi.URLParam(r, "attachmentID")
+
+	emailID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid email id"})
+		return
+	}
+
+	attachment, content, err := h.emailService.OpenAttachment(ctx, emailID, attachmentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmailNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Email not found"})
+		case errors.Is(err, services.ErrAttachmentNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Attachment not found"})
+		default:
+			h.monitor.LogError("Failed to open attachment", err,
+				zap.String("email_id", emailID.Hex()),
+				zap.String("attachment_id", attachmentID))
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		}
+		return
+	}
+	defer content.Close()
+
+	disposition := "attachment"
+	if attachment.Inline {
+		disposition = "inline"
+	}
+	if attachment.Filename != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename})
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("ETag", fmt.Sprintf("%q", attachment.SHA256))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if _, err := io.Copy(w, content); err != nil {
+		h.monitor.LogError("Failed to stream attachment", err,
+			zap.String("email_id", emailID.Hex()),
+			zap.String("attachment_id", attachmentID))
+	}
+}
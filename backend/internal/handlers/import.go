@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/services"
+)
+
+// ImportHandler handles archive import HTTP requests
+type ImportHandler struct {
+	importService *services.ImportService
+	monitor       *monitoring.Monitor
+}
+
+// NewImportHandler creates a new import handler
+func NewImportHandler(importService *services.ImportService, monitor *monitoring.Monitor) *ImportHandler {
+	return &ImportHandler{
+		importService: importService,
+		monitor:       monitor,
+	}
+}
+
+// RegisterRoutes registers the import routes
+func (h *ImportHandler) RegisterRoutes(r chi.Router) {
+	r.Post("/imports", h.Import)
+}
+
+// Import streams an uploaded archive into the store. The request body is the raw
+// archive (mbox, a single EML message, or a tar of a Maildir) selected by the
+// "format" query parameter. Progress is streamed back as newline-delimited JSON.
+func (h *ImportHandler) Import(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	format := r.URL.Query().Get("format")
+	archive := r.URL.Query().Get("archive")
+
+	switch format {
+	case services.ImportFormatMbox, services.ImportFormatEML, services.ImportFormatMaildir:
+	default:
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "format must be mbox, eml or maildir"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	progress := func(p services.ImportProgress) {
+		encoder.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if _, err := h.importService.Import(ctx, archive, format, r.Body, progress); err != nil {
+		h.monitor.LogError("Failed to import archive", err,
+			zap.String("format", format),
+			zap.String("archive", archive))
+		encoder.Encode(ErrorResponse{Error: err.Error()})
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/services"
+)
+
+// JobHandler handles job-related HTTP requests
+type JobHandler struct {
+	jobService *services.JobService
+	monitor    *monitoring.Monitor
+}
+
+// NewJobHandler creates a new job handler
+func NewJobHandler(jobService *services.JobService, monitor *monitoring.Monitor) *JobHandler {
+	return &JobHandler{
+		jobService: jobService,
+		monitor:    monitor,
+	}
+}
+
+// RegisterRoutes registers the job routes
+func (h *JobHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/jobs", func(r chi.Router) {
+		r.Post("/", h.EnqueueJob)
+		r.Get("/", h.ListJobs)
+		r.Get("/{id}", h.GetJob)
+		r.Post("/{id}/cancel", h.CancelJob)
+	})
+}
+
+// EnqueueJob handles the request to enqueue a job
+func (h *JobHandler) EnqueueJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.EnqueueJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	job, err := h.jobService.Enqueue(ctx, &req)
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownJobType) || errors.Is(err, services.ErrInvalidJobPayload) {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.monitor.LogError("Failed to enqueue job", err,
+			zap.String("type", string(req.Type)))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, job)
+}
+
+// ListJobs handles the request to list jobs, optionally filtered by type and status
+func (h *JobHandler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var filter models.JobFilter
+	if jobType := models.JobType(r.URL.Query().Get("type")); jobType != "" {
+		filter.Type = &jobType
+	}
+	if status := models.JobStatus(r.URL.Query().Get("status")); status != "" {
+		filter.Status = &status
+	}
+
+	jobs, total, err := h.jobService.ListJobs(ctx, filter, page, limit)
+	if err != nil {
+		h.monitor.LogError("Failed to list jobs", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.JSON(w, r, models.JobListResponse{
+		Jobs:  jobs,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	})
+}
+
+// GetJob handles the request to inspect a job
+func (h *JobHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid job id"})
+		return
+	}
+
+	job, err := h.jobService.GetJob(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Job not found"})
+			return
+		}
+		h.monitor.LogError("Failed to get job", err,
+			zap.String("job_id", jobID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.JSON(w, r, job)
+}
+
+// CancelJob handles the request to cancel a pending or running job
+func (h *JobHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	jobID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid job id"})
+		return
+	}
+
+	job, err := h.jobService.CancelJob(ctx, jobID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrJobNotFound):
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Job not found"})
+		case errors.Is(err, services.ErrJobFinished):
+			render.Status(r, http.StatusConflict)
+			render.JSON(w, r, ErrorResponse{Error: "Job already " + string(job.Status)})
+		default:
+			h.monitor.LogError("Failed to cancel job", err,
+				zap.String("job_id", jobID.Hex()))
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		}
+		return
+	}
+
+	render.JSON(w, r, job)
+}
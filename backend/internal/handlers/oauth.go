@@ -2,15 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"go.uber.org/zap"
 
-	"email-harvester/internal/monitoring"
 	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
 	"email-harvester/internal/services"
 )
 
@@ -32,7 +33,7 @@ func NewOAuthHandler(oauthService *services.OAuthService, monitor *monitoring.Mo
 func (h *OAuthHandler) RegisterRoutes(r chi.Router) {
 	r.Route("/oauth", func(r chi.Router) {
 		r.Get("/auth/{provider}", h.GetAuthURL)
-		r.Get("/callback/{provider}", h.HandleCallback)
+		r.Post("/callback/{provider}", h.HandleCallback)
 		r.Post("/refresh/{provider}", h.RefreshToken)
 	})
 }
@@ -52,22 +53,25 @@ func (h *OAuthHandler) GetAuthURL(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	provider := chi.URLParam(r, "provider")
 
-	// Generate a random state
-	state, err := generateRandomState()
-	if err != nil {
-		h.monitor.LogError("Failed to generate state", err)
-		render.Status(r, http.StatusInternalServerError)
-		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+	userID, ok := userIDFromContext(ctx)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, ErrorResponse{Error: "Unauthorized"})
 		return
 	}
 
 	// Get the authorization URL
-	authURL, err := h.oauthService.GetAuthURL(ctx, provider, state)
+	authURL, err := h.oauthService.GetAuthURL(ctx, userID, provider)
 	if err != nil {
 		h.monitor.LogError("Failed to get auth URL", err,
 			zap.String("provider", provider))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, ErrorResponse{Error: "Invalid provider"})
+		if errors.Is(err, providers.ErrUnknownProvider) || errors.Is(err, providers.ErrNotSupported) {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrorResponse{Error: "Invalid provider"})
+			return
+		}
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
 		return
 	}
 
@@ -80,11 +84,19 @@ type HandleCallbackRequest struct {
 	State string `json:"state" validate:"required"`
 }
 
-// HandleCallback handles the OAuth callback
+// HandleCallback handles the OAuth callback, connecting the mailbox to the
+// authenticated user's accounts
 func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	provider := chi.URLParam(r, "provider")
 
+	userID, ok := userIDFromContext(ctx)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
 	// Parse the request
 	var req HandleCallbackRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -95,12 +107,16 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle the callback
-	tokens, err := h.oauthService.HandleCallback(ctx, provider, req.Code)
+	tokens, err := h.oauthService.HandleCallback(ctx, userID, provider, req.Code, req.State)
 	if err != nil {
 		h.monitor.LogError("Failed to handle callback", err,
 			zap.String("provider", provider))
 		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, ErrorResponse{Error: "Invalid code"})
+		if errors.Is(err, services.ErrInvalidOAuthState) {
+			render.JSON(w, r, ErrorResponse{Error: "Invalid state"})
+		} else {
+			render.JSON(w, r, ErrorResponse{Error: "Invalid code"})
+		}
 		return
 	}
 
@@ -114,9 +130,18 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create account
-	account := &models.AccountCreate{
-		Provider:     provider,
+	// Accounts store the canonical provider ID, e.g. "gmail" for "google"
+	providerID, err := h.oauthService.ProviderID(provider)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid provider"})
+		return
+	}
+
+	// Save the account; reconnecting a mailbox updates its tokens
+	account, err := h.oauthService.SaveAccount(ctx, &models.AccountCreate{
+		UserID:       userID,
+		Provider:     providerID,
 		Email:        userInfo.Email,
 		Name:         userInfo.Name,
 		Picture:      userInfo.Picture,
@@ -124,19 +149,17 @@ func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		RefreshToken: tokens.RefreshToken,
 		ExpiresAt:    tokens.ExpiresAt,
 		TokenType:    tokens.TokenType,
+	})
+	if err != nil {
+		h.monitor.LogError("Failed to save account", err,
+			zap.String("provider", provider),
+			zap.String("user_id", userID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Failed to save account"})
+		return
 	}
 
-	// TODO: Save account to database
-	// For now, just return the tokens and user info
-	render.JSON(w, r, struct {
-		Tokens    *models.OAuthTokens `json:"tokens"`
-		UserInfo  *models.UserInfo    `json:"user_info"`
-		Account   *models.AccountCreate `json:"account"`
-	}{
-		Tokens:   tokens,
-		UserInfo: userInfo,
-		Account:  account,
-	})
+	render.JSON(w, r, account.ToResponse())
 }
 
 // RefreshTokenRequest represents the request to refresh an OAuth token
@@ -170,10 +193,3 @@ func (h *OAuthHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	render.JSON(w, r, tokens)
 }
-
-// generateRandomState generates a random state string for OAuth
-func generateRandomState() (string, error) {
-	// TODO: Implement proper state generation
-	// For now, just use a timestamp
-	return time.Now().Format(time.RFC3339Nano), nil
-} 
\ No newline at end of file
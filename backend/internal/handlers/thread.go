@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/services"
+)
+
+// ThreadHandler handles thread-related HTTP requests
+type ThreadHandler struct {
+	emailService *services.EmailService
+	monitor      *monitoring.Monitor
+}
+
+// NewThreadHandler creates a new thread handler
+func NewThreadHandler(emailService *services.EmailService, monitor *monitoring.Monitor) *ThreadHandler {
+	return &ThreadHandler{
+		emailService: emailService,
+		monitor:      monitor,
+	}
+}
+
+// RegisterRoutes registers the thread routes
+func (h *ThreadHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/threads", func(r chi.Router) {
+		r.Get("/", h.ListThreads)
+		r.Get("/{id}", h.GetThread)
+	})
+}
+
+// ListThreads handles the request to list threads by last activity,
+// optionally of one account
+func (h *ThreadHandler) ListThreads(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accountID, page, limit, ok := emailListParams(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := h.emailService.ListThreads(ctx, accountID, page, limit)
+	if err != nil {
+		h.monitor.LogError("Failed to list threads", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// GetThread handles the request to read a thread with its emails
+func (h *ThreadHandler) GetThread(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	threadID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid thread id"})
+		return
+	}
+
+	thread, err := h.emailService.GetThread(ctx, threadID)
+	if err != nil {
+		if errors.Is(err, services.ErrThreadNotFound) {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, ErrorResponse{Error: "Thread not found"})
+			return
+		}
+		h.monitor.LogError("Failed to get thread", err,
+			zap.String("thread_id", threadID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	render.JSON(w, r, thread)
+}
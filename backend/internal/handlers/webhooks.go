@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/services"
+)
+
+// WebhookHandler handles change notifications pushed by mail providers
+type WebhookHandler struct {
+	gmailPush   *services.GmailPushService
+	outlookPush *services.OutlookPushService
+	monitor     *monitoring.Monitor
+}
+
+// NewWebhookHandler creates a new webhook handler
+func NewWebhookHandler(gmailPush *services.GmailPushService, outlookPush *services.OutlookPushService, monitor *monitoring.Monitor) *WebhookHandler {
+	return &WebhookHandler{
+		gmailPush:   gmailPush,
+		outlookPush: outlookPush,
+		monitor:     monitor,
+	}
+}
+
+// RegisterRoutes registers the webhook routes
+func (h *WebhookHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Post("/gmail", h.HandleGmailPush)
+		r.Post("/graph/{accountID}", h.HandleGraphNotifications)
+	})
+}
+
+// HandleGmailPush handles a Gmail notification delivered by a Pub/Sub push
+// subscription. Any 2xx response acknowledges the message; anything else
+// makes Pub/Sub redeliver it.
+func (h *WebhookHandler) HandleGmailPush(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := h.gmailPush.VerifyPush(ctx, r.Header.Get("Authorization"), r.URL.Query().Get("token")); err != nil {
+		h.monitor.LogError("Rejected Gmail push", err)
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	var push services.PubSubPushRequest
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if err := h.gmailPush.HandlePush(ctx, &push); err != nil {
+		if errors.Is(err, services.ErrInvalidPush) {
+			// Redelivering a malformed message would not help
+			h.monitor.LogError("Dropping invalid Gmail push", err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.monitor.LogError("Failed to handle Gmail push", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleGraphNotifications handles Microsoft Graph change notifications for
+// an Outlook account. When a subscription is created Graph first validates
+// the endpoint by POSTing a validationToken it expects echoed back as plain
+// text. Graph retries notifications that are not acknowledged with a 2xx.
+func (h *WebhookHandler) HandleGraphNotifications(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("validationToken"); token != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(token))
+		return
+	}
+
+	accountID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "accountID"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid account ID"})
+		return
+	}
+
+	var req services.GraphNotificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if err := h.outlookPush.HandleNotifications(r.Context(), accountID, &req); err != nil {
+		if errors.Is(err, services.ErrPushUnauthorized) {
+			h.monitor.LogError("Rejected Graph notifications", err, zap.String("account_id", accountID.Hex()))
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ErrorResponse{Error: "Unauthorized"})
+			return
+		}
+		h.monitor.LogError("Failed to handle Graph notifications", err, zap.String("account_id", accountID.Hex()))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: "Internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
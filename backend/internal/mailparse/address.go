@@ -0,0 +1,144 @@
+package mailparse
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"email-harvester/internal/models"
+)
+
+// wordDecoder decodes RFC 2047 encoded-words in any charset known to the
+// WHATWG encoding index, not just the UTF-8 and ISO-8859-1 that mime supports
+var wordDecoder = &mime.WordDecoder{CharsetReader: CharsetReader}
+
+// addressParser parses address lists with the same encoded-word support
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// CharsetReader returns a reader that converts input from charset to UTF-8
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q: %w", charset, err)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// DecodeHeader decodes RFC 2047 encoded-words in an unstructured header such
+// as Subject. Undecodable input is returned as is.
+func DecodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(decoded)
+}
+
+// ParseAddressList parses an address header such as To or Cc. Display names may
+// be quoted and contain commas ("Doe, Jane" <jane@example.com>) or be
+// encoded-words. When the list as a whole is malformed, each entry is parsed
+// on its own so one bad address does not drop the others.
+func ParseAddressList(value string) []models.EmailAddress {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	if list, err := addressParser.ParseList(value); err == nil {
+		return toEmailAddresses(list)
+	}
+
+	var addresses []models.EmailAddress
+	for _, entry := range splitAddressList(value) {
+		if addr, err := addressParser.Parse(entry); err == nil {
+			addresses = append(addresses, models.EmailAddress{Name: addr.Name, Address: strings.ToLower(addr.Address)})
+			continue
+		}
+		if addr := looseAddress(entry); addr.Address != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// Addresses returns just the address part of each entry
+func Addresses(list []models.EmailAddress) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	addresses := make([]string, 0, len(list))
+	for _, addr := range list {
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses
+}
+
+func toEmailAddresses(list []*mail.Address) []models.EmailAddress {
+	addresses := make([]models.EmailAddress, 0, len(list))
+	for _, addr := range list {
+		addresses = append(addresses, models.EmailAddress{Name: addr.Name, Address: strings.ToLower(addr.Address)})
+	}
+	return addresses
+}
+
+// splitAddressList splits an address list on commas outside quoted strings,
+// comments and angle brackets
+func splitAddressList(value string) []string {
+	var entries []string
+	var quoted, escaped bool
+	var angle, comment, start int
+
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' && comment == 0:
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			comment++
+		case r == ')' && comment > 0:
+			comment--
+		case r == '<':
+			angle++
+		case r == '>' && angle > 0:
+			angle--
+		case r == ',' && angle == 0 && comment == 0:
+			entries = append(entries, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	entries = append(entries, strings.TrimSpace(value[start:]))
+
+	nonEmpty := entries[:0]
+	for _, entry := range entries {
+		if entry != "" {
+			nonEmpty = append(nonEmpty, entry)
+		}
+	}
+	return nonEmpty
+}
+
+// looseAddress salvages "Name <addr>" or a bare addr from an entry that
+// net/mail rejects, e.g. because of unquoted special characters in the name
+func looseAddress(entry string) models.EmailAddress {
+	if start := strings.LastIndexByte(entry, '<'); start >= 0 {
+		if end := strings.IndexByte(entry[start:], '>'); end > 0 {
+			address := strings.TrimSpace(entry[start+1 : start+end])
+			if strings.Contains(address, "@") {
+				name := strings.Trim(strings.TrimSpace(entry[:start]), `"`)
+				return models.EmailAddress{Name: DecodeHeader(name), Address: strings.ToLower(address)}
+			}
+		}
+	}
+	if strings.Contains(entry, "@") && !strings.ContainsAny(entry, " <>") {
+		return models.EmailAddress{Address: strings.ToLower(entry)}
+	}
+	return models.EmailAddress{}
+}
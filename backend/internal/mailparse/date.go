@@ -0,0 +1,58 @@
+package mailparse
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dateLayouts are tried in order after net/mail has given up. They cover the
+// non-conforming Date headers commonly produced by older or broken mailers.
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC850,
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04 -0700",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"Mon, 2-Jan-2006 15:04:05 -0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// dateComment matches a trailing comment such as "(PST)" or "(Coordinated Universal Time)"
+var dateComment = regexp.MustCompile(`\s*\([^)]*\)\s*$`)
+
+// ParseDate parses a Date header leniently and returns fallback when the value
+// is missing or cannot be parsed
+func ParseDate(value string, fallback time.Time) time.Time {
+	value = strings.Join(strings.Fields(value), " ")
+	if value == "" {
+		return fallback
+	}
+
+	if t, err := mail.ParseDate(value); err == nil {
+		return t
+	}
+
+	value = dateComment.ReplaceAllString(value, "")
+	value = strings.TrimSuffix(value, " GMT+0000")
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,123 @@
+// Package mailparse turns raw message headers into the structured fields of
+// models.Email. Every provider goes through it so addresses, subjects, dates
+// and threading headers are parsed the same way regardless of their source.
+package mailparse
+
+import (
+	"strings"
+	"time"
+
+	"email-harvester/internal/models"
+)
+
+// Header is satisfied by mail.Header, textproto.MIMEHeader and HeaderMap
+type Header interface {
+	Get(key string) string
+}
+
+// HeaderMap adapts a list of name/value pairs, such as the headers Gmail and
+// Graph return, to the Header interface. Keys are case-insensitive and the
+// first occurrence of a header wins.
+type HeaderMap map[string]string
+
+// Add records a header value unless the header is already present
+func (h HeaderMap) Add(name, value string) {
+	key := strings.ToLower(name)
+	if _, ok := h[key]; !ok {
+		h[key] = value
+	}
+}
+
+// Get returns the value of the named header
+func (h HeaderMap) Get(name string) string {
+	return h[strings.ToLower(name)]
+}
+
+// Headers holds the parsed envelope headers of a message
+type Headers struct {
+	Subject    string
+	From       models.EmailAddress
+	To         []models.EmailAddress
+	Cc         []models.EmailAddress
+	Bcc        []models.EmailAddress
+	Date       time.Time
+	MessageID  string
+	InReplyTo  string
+	References []string
+}
+
+// ParseHeaders parses the envelope headers of a message. fallbackDate is used
+// when the Date header is missing or unparseable; providers pass their own
+// received timestamp here.
+func ParseHeaders(h Header, fallbackDate time.Time) *Headers {
+	headers := &Headers{
+		Subject:    DecodeHeader(h.Get("Subject")),
+		To:         ParseAddressList(h.Get("To")),
+		Cc:         ParseAddressList(h.Get("Cc")),
+		Bcc:        ParseAddressList(h.Get("Bcc")),
+		Date:       ParseDate(h.Get("Date"), fallbackDate),
+		References: ParseMessageIDs(h.Get("References")),
+	}
+
+	if from := ParseAddressList(h.Get("From")); len(from) > 0 {
+		headers.From = from[0]
+	}
+	if ids := ParseMessageIDs(h.Get("Message-Id")); len(ids) > 0 {
+		headers.MessageID = ids[0]
+	}
+	if ids := ParseMessageIDs(h.Get("In-Reply-To")); len(ids) > 0 {
+		headers.InReplyTo = ids[0]
+	}
+
+	return headers
+}
+
+// Apply copies the parsed headers onto email, including the flat From/To/Cc/Bcc
+// address fields used for filtering
+func (h *Headers) Apply(email *models.Email) {
+	email.Subject = h.Subject
+	email.FromAddress = h.From
+	email.ToAddresses = h.To
+	email.CcAddresses = h.Cc
+	email.BccAddresses = h.Bcc
+	email.InternetMessageID = h.MessageID
+	email.InReplyTo = h.InReplyTo
+	email.References = h.References
+	email.ReceivedAt = h.Date
+
+	email.From = h.From.Address
+	email.To = Addresses(h.To)
+	email.Cc = Addresses(h.Cc)
+	email.Bcc = Addresses(h.Bcc)
+}
+
+// ParseMessageIDs extracts the message IDs from a Message-ID, In-Reply-To or
+// References header, without their angle brackets. IDs that are not enclosed
+// in brackets, which some clients produce, are split on whitespace.
+func ParseMessageIDs(value string) []string {
+	var ids []string
+	rest := value
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(rest[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		rest = rest[start+end+1:]
+	}
+
+	if len(ids) == 0 {
+		for _, field := range strings.Fields(value) {
+			if strings.Contains(field, "@") {
+				ids = append(ids, strings.Trim(field, "<>,"))
+			}
+		}
+	}
+	return ids
+}
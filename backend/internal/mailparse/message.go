@@ -0,0 +1,38 @@
+package mailparse
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"time"
+
+	"email-harvester/internal/models"
+)
+
+// ParseMessage parses a raw RFC 822 message into our email model and returns
+// its attachments separately. It is used for sources that hand us the full
+// message, such as IMAP servers and archive imports. A missing or unparseable
+// Date header leaves ReceivedAt zero so callers can substitute their own.
+func ParseMessage(r io.Reader) (*models.Email, []Attachment, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read message: %v", err)
+	}
+
+	email := &models.Email{
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	ParseHeaders(msg.Header, time.Time{}).Apply(email)
+
+	root, err := ReadPart(msg.Header, msg.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := Extract(root)
+	email.Body = body.Text
+	email.HTMLBody = body.HTML
+
+	return email, body.Attachments, nil
+}
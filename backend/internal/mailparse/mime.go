@@ -0,0 +1,257 @@
+package mailparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// maxPartDepth bounds multipart nesting so a hostile message cannot recurse forever
+const maxPartDepth = 32
+
+// Part is a node of a MIME message tree. Leaf parts hold their content with
+// the transfer encoding already removed but still in the part's charset.
+type Part struct {
+	Header  Header
+	Content []byte
+	Parts   []*Part
+}
+
+// Body is the readable content extracted from a MIME tree, normalized to UTF-8
+type Body struct {
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment is a non-body part of a message along with its content
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Inline      bool
+	Data        []byte
+}
+
+// ReadPart reads a MIME entity from r into a Part tree, undoing each leaf's
+// Content-Transfer-Encoding
+func ReadPart(header Header, r io.Reader) (*Part, error) {
+	return readPart(header, r, 0)
+}
+
+func readPart(header Header, r io.Reader, depth int) (*Part, error) {
+	part := &Part{Header: header}
+
+	mediaType, params := contentType(header)
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxPartDepth {
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			child, err := reader.NextRawPart()
+			if err == io.EOF {
+				return part, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read MIME part: %w", err)
+			}
+			p, err := readPart(child.Header, child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, p)
+		}
+	}
+
+	data, err := io.ReadAll(DecodeTransferEncoding(header.Get("Content-Transfer-Encoding"), r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s part: %w", mediaType, err)
+	}
+	part.Content = data
+	return part, nil
+}
+
+// DecodeTransferEncoding wraps body with a decoder for the Content-Transfer-Encoding
+func DecodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// Extract walks a MIME tree and returns its text and HTML bodies and its
+// attachments. Within multipart/alternative only the richest representation
+// of each kind is kept; within multipart/mixed every inline text part is
+// kept, in order.
+func Extract(part *Part) *Body {
+	body := &Body{}
+	extract(part, body)
+	return body
+}
+
+func extract(part *Part, body *Body) {
+	mediaType, params := contentType(part.Header)
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && len(part.Parts) == 0:
+		// A multipart without a usable boundary: keep its content as a file
+		// rather than drop it
+		if len(part.Content) > 0 {
+			body.Attachments = append(body.Attachments, attachment(part, mediaType, params))
+		}
+
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if mediaType == "multipart/alternative" {
+			extractAlternative(part, body)
+			return
+		}
+		for _, child := range part.Parts {
+			extract(child, body)
+		}
+
+	case isBodyPart(part, mediaType):
+		text := DecodeCharset(part.Content, params["charset"])
+		if mediaType == "text/html" {
+			body.HTML = joinBody(body.HTML, text, "\n")
+		} else {
+			body.Text = joinBody(body.Text, text, "\n\n")
+		}
+
+	default:
+		body.Attachments = append(body.Attachments, attachment(part, mediaType, params))
+	}
+}
+
+// extractAlternative keeps the last text and the last HTML representation,
+// since alternatives are ordered from plainest to richest. Attachments of any
+// alternative, such as the inline images of a multipart/related, are kept.
+func extractAlternative(part *Part, body *Body) {
+	var text, html string
+	for _, child := range part.Parts {
+		alt := &Body{}
+		extract(child, alt)
+		if alt.Text != "" {
+			text = alt.Text
+		}
+		if alt.HTML != "" {
+			html = alt.HTML
+		}
+		body.Attachments = append(body.Attachments, alt.Attachments...)
+	}
+	body.Text = joinBody(body.Text, text, "\n\n")
+	body.HTML = joinBody(body.HTML, html, "\n")
+}
+
+// isBodyPart reports whether a leaf part is readable message text rather than
+// an attached file
+func isBodyPart(part *Part, mediaType string) bool {
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return false
+	}
+	disposition, params := disposition(part.Header)
+	return disposition != "attachment" && params["filename"] == ""
+}
+
+func attachment(part *Part, mediaType string, params map[string]string) Attachment {
+	disposition, dispositionParams := disposition(part.Header)
+
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename == "" && mediaType == "message/rfc822" {
+		filename = "message.eml"
+	}
+
+	// Parts referenced by Content-ID without a disposition are the inline
+	// images of a multipart/related HTML body
+	contentID := strings.Trim(strings.TrimSpace(part.Header.Get("Content-Id")), "<>")
+
+	return Attachment{
+		Filename:    DecodeHeader(filename),
+		ContentType: mediaType,
+		ContentID:   contentID,
+		Inline:      disposition == "inline" || (disposition == "" && contentID != ""),
+		Data:        part.Content,
+	}
+}
+
+// DecodeCharset converts text in the given charset to UTF-8. Text without a
+// declared charset, or in a charset we do not know, is taken as UTF-8 when it
+// is valid and as Windows-1252, the usual culprit, otherwise.
+func DecodeCharset(data []byte, charset string) string {
+	charset = strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"`))
+
+	switch charset {
+	case "", "us-ascii", "ascii", "utf-8", "utf8":
+	default:
+		if r, err := CharsetReader(charset, bytes.NewReader(data)); err == nil {
+			if decoded, err := io.ReadAll(r); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	return string(decoded)
+}
+
+func contentType(header Header) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// Parts without a usable Content-Type are plain text
+		return "text/plain", map[string]string{"charset": charsetParam(header.Get("Content-Type"))}
+	}
+	return mediaType, params
+}
+
+func disposition(header Header) (string, map[string]string) {
+	value := header.Get("Content-Disposition")
+	if value == "" {
+		return "", map[string]string{}
+	}
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		// Keep the disposition even if its parameters are malformed
+		return strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0])), map[string]string{}
+	}
+	return disposition, params
+}
+
+// charsetParam salvages the charset from a Content-Type header that
+// mime.ParseMediaType rejected
+func charsetParam(value string) string {
+	for _, param := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "charset") {
+			return strings.Trim(strings.TrimSpace(val), `"'`)
+		}
+	}
+	return ""
+}
+
+func joinBody(existing, text, sep string) string {
+	if existing == "" {
+		return text
+	}
+	if text == "" {
+		return existing
+	}
+	return existing + sep + text
+}
@@ -2,21 +2,71 @@ package migrations
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 )
 
-// Migration represents a database migration
+var (
+	// ErrLocked is returned by MigrationStore.Lock while another process
+	// holds the migration lock
+	ErrLocked = errors.New("migrations are locked by another process")
+	// ErrChecksumMismatch is returned when a step was changed after it was
+	// applied
+	ErrChecksumMismatch = errors.New("migration changed after it was applied")
+	// ErrUnknownMigration is returned when the database has a migration the
+	// running binary has no step for, usually because a newer version
+	// migrated it
+	ErrUnknownMigration = errors.New("unknown migration")
+)
+
+// Migration represents an applied database migration
 type Migration struct {
-	Version   int
-	Name      string
-	CreatedAt time.Time
+	Version   int       `bson:"version" json:"version"`
+	Name      string    `bson:"name" json:"name"`
+	Checksum  string    `bson:"checksum,omitempty" json:"checksum,omitempty"` // Of the step, when it was applied
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`                 // When it was applied
+}
+
+// Step is a versioned change of the schema along with the change that
+// reverts it
+type Step struct {
+	Version int
+	Name    string
+	// Definition is what Up and Down work from, such as statements or index
+	// specifications. Its checksum is recorded when the step is applied, so
+	// that editing an applied step is noticed.
+	Definition interface{}
+	Up         func(ctx context.Context) error
+	Down       func(ctx context.Context) error // Nil when the step cannot be reverted
+}
+
+// Checksum returns the SHA-256 of the step's name and JSON-encoded
+// definition
+func (s Step) Checksum() (string, error) {
+	data, err := json.Marshal(struct {
+		Name       string      `json:"name"`
+		Definition interface{} `json:"definition"`
+	}{s.Name, s.Definition})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode migration %d: %w", s.Version, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
 }
 
 // MigrationStore defines the interface for migration operations
@@ -25,17 +75,30 @@ type MigrationStore interface {
 	GetMigrations(ctx context.Context) ([]Migration, error)
 	// CreateMigration records a new migration
 	CreateMigration(ctx context.Context, migration Migration) error
+	// DeleteMigration removes the record of a reverted migration
+	DeleteMigration(ctx context.Context, version int) error
+	// Lock takes the migration lock for owner until ttl passes, or extends
+	// it when owner already holds it. It returns ErrLocked while another
+	// owner's lock has not expired.
+	Lock(ctx context.Context, owner string, ttl time.Duration) error
+	// Unlock releases owner's lock
+	Unlock(ctx context.Context, owner string) error
 }
 
+// migrationLockID identifies the lock document or item
+const migrationLockID = "migrations"
+
 // MongoDBMigrationStore implements MigrationStore for MongoDB
 type MongoDBMigrationStore struct {
 	collection *mongo.Collection
+	locks      *mongo.Collection
 }
 
 // NewMongoDBMigrationStore creates a new MongoDB migration store
 func NewMongoDBMigrationStore(db *mongo.Database) *MongoDBMigrationStore {
 	return &MongoDBMigrationStore{
 		collection: db.Collection("migrations"),
+		locks:      db.Collection("migration_locks"),
 	}
 }
 
@@ -63,6 +126,64 @@ func (s *MongoDBMigrationStore) CreateMigration(ctx context.Context, migration M
 	return nil
 }
 
+// DeleteMigration removes a migration from MongoDB
+func (s *MongoDBMigrationStore) DeleteMigration(ctx context.Context, version int) error {
+	if _, err := s.collection.DeleteOne(ctx, bson.M{"version": version}); err != nil {
+		return fmt.Errorf("failed to delete migration: %w", err)
+	}
+	return nil
+}
+
+// Lock upserts the lock document unless another owner's lock is live, in
+// which case the upsert collides with the existing document's _id
+func (s *MongoDBMigrationStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	now := time.Now()
+	filter := bson.M{
+		"_id": migrationLockID,
+		"$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"expires_at": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(ttl)}}
+
+	_, err := s.locks.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	return nil
+}
+
+// Unlock deletes the lock document if owner holds it
+func (s *MongoDBMigrationStore) Unlock(ctx context.Context, owner string) error {
+	if _, err := s.locks.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner}); err != nil {
+		return fmt.Errorf("failed to unlock migrations: %w", err)
+	}
+	return nil
+}
+
+// cosmosMigration is a migration as stored in the migrations container,
+// which is partitioned by version
+type cosmosMigration struct {
+	ID string `json:"id"`
+	Migration
+}
+
+// cosmosMigrationLock is the lock item, kept in a partition of its own
+type cosmosMigrationLock struct {
+	ID        string    `json:"id"`
+	Version   int       `json:"version"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// cosmosLockVersion is the partition of the lock item, which no migration
+// uses
+const cosmosLockVersion = -1
+
 // CosmosDBMigrationStore implements MigrationStore for Cosmos DB
 type CosmosDBMigrationStore struct {
 	container *azcosmos.Container
@@ -77,8 +198,8 @@ func NewCosmosDBMigrationStore(container *azcosmos.Container) *CosmosDBMigration
 
 // GetMigrations returns all applied migrations from Cosmos DB
 func (s *CosmosDBMigrationStore) GetMigrations(ctx context.Context) ([]Migration, error) {
-	query := "SELECT * FROM c ORDER BY c.version ASC"
-	pager := s.container.NewQueryItemsPager(query, nil, nil)
+	query := "SELECT * FROM c WHERE c.version >= 0 ORDER BY c.version ASC"
+	pager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), nil)
 
 	var migrations []Migration
 	for pager.More() {
@@ -97,65 +218,332 @@ func (s *CosmosDBMigrationStore) GetMigrations(ctx context.Context) ([]Migration
 
 // CreateMigration records a new migration in Cosmos DB
 func (s *CosmosDBMigrationStore) CreateMigration(ctx context.Context, migration Migration) error {
-	_, err := s.container.CreateItem(ctx, azcosmos.NewPartitionKeyString(fmt.Sprintf("%d", migration.Version)), migration, nil)
+	item := cosmosMigration{ID: fmt.Sprintf("%d", migration.Version), Migration: migration}
+	_, err := s.container.CreateItem(ctx, azcosmos.NewPartitionKeyNumber(float64(migration.Version)), item, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create migration: %w", err)
 	}
 	return nil
 }
 
-// Migrator handles database migrations
+// DeleteMigration removes a migration from Cosmos DB
+func (s *CosmosDBMigrationStore) DeleteMigration(ctx context.Context, version int) error {
+	_, err := s.container.DeleteItem(ctx, azcosmos.NewPartitionKeyNumber(float64(version)), fmt.Sprintf("%d", version), nil)
+	if err != nil && !isCosmosStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete migration: %w", err)
+	}
+	return nil
+}
+
+// Lock creates the lock item, or takes over an expired or own one by
+// replacing it with a matching ETag, so two processes cannot both win
+func (s *CosmosDBMigrationStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	pk := azcosmos.NewPartitionKeyNumber(cosmosLockVersion)
+	lock := cosmosMigrationLock{ID: migrationLockID, Version: cosmosLockVersion, Owner: owner, ExpiresAt: time.Now().Add(ttl).UTC()}
+
+	response, err := s.container.ReadItem(ctx, pk, migrationLockID, nil)
+	if isCosmosStatus(err, http.StatusNotFound) {
+		_, err = s.container.CreateItem(ctx, pk, lock, nil)
+		if isCosmosStatus(err, http.StatusConflict) {
+			return ErrLocked
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+
+	var held cosmosMigrationLock
+	if err := json.Unmarshal(response.Value, &held); err != nil {
+		return fmt.Errorf("failed to decode migration lock: %w", err)
+	}
+	if held.Owner != owner && held.ExpiresAt.After(time.Now()) {
+		return ErrLocked
+	}
+	etag := response.ETag
+	_, err = s.container.ReplaceItem(ctx, pk, migrationLockID, lock, &azcosmos.ItemOptions{IfMatchEtag: &etag})
+	if isCosmosStatus(err, http.StatusPreconditionFailed) {
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	return nil
+}
+
+// Unlock deletes the lock item if owner holds it
+func (s *CosmosDBMigrationStore) Unlock(ctx context.Context, owner string) error {
+	pk := azcosmos.NewPartitionKeyNumber(cosmosLockVersion)
+	response, err := s.container.ReadItem(ctx, pk, migrationLockID, nil)
+	if isCosmosStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unlock migrations: %w", err)
+	}
+
+	var held cosmosMigrationLock
+	if err := json.Unmarshal(response.Value, &held); err != nil {
+		return fmt.Errorf("failed to decode migration lock: %w", err)
+	}
+	if held.Owner != owner {
+		return nil
+	}
+	etag := response.ETag
+	_, err = s.container.DeleteItem(ctx, pk, migrationLockID, &azcosmos.ItemOptions{IfMatchEtag: &etag})
+	if err != nil && !isCosmosStatus(err, http.StatusNotFound) && !isCosmosStatus(err, http.StatusPreconditionFailed) {
+		return fmt.Errorf("failed to unlock migrations: %w", err)
+	}
+	return nil
+}
+
+// isCosmosStatus reports whether err is a Cosmos DB response with status
+func isCosmosStatus(err error, status int) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == status
+}
+
+// Locking parameters. A lock outlives a crashed migrator by at most
+// lockTTL, and is extended before every step.
+const (
+	lockTTL           = 10 * time.Minute
+	lockRetryInterval = 2 * time.Second
+)
+
+// Migrator applies and reverts the steps of one database, holding the
+// store's lock so that concurrent processes take turns
 type Migrator struct {
-	store     MigrationStore
-	migrations []Migration
+	store MigrationStore
+	steps []Step
+	owner string
 }
 
-// NewMigrator creates a new migrator
-func NewMigrator(store MigrationStore) *Migrator {
+// NewMigrator creates a new migrator for steps
+func NewMigrator(store MigrationStore, steps []Step) *Migrator {
+	sorted := append([]Step(nil), steps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	host, _ := os.Hostname()
 	return &Migrator{
 		store: store,
-		migrations: []Migration{
-			{
-				Version:   1,
-				Name:      "initial_schema",
-				CreatedAt: time.Now(),
-			},
-		},
+		steps: sorted,
+		owner: fmt.Sprintf("%s/%d/%s", host, os.Getpid(), primitive.NewObjectID().Hex()),
 	}
 }
 
-// Run executes all pending migrations
-func (m *Migrator) Run(ctx context.Context) error {
-	// Get applied migrations
-	applied, err := m.store.GetMigrations(ctx)
+// MigrationStatus is a step or an applied migration, and whether it is
+// applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set for applied steps that changed since
+	Modified bool
+	// Unknown is set for applied migrations without a step
+	Unknown bool
+}
+
+// Status lists the steps and applied migrations by version
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.appliedByVersion(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get applied migrations: %w", err)
+		return nil, err
 	}
 
-	// Create a map of applied versions for quick lookup
-	appliedVersions := make(map[int]bool)
+	var statuses []MigrationStatus
+	for _, step := range m.steps {
+		status := MigrationStatus{Version: step.Version, Name: step.Name}
+		if migration, ok := applied[step.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = migration.CreatedAt
+			modified, err := isModified(step, migration)
+			if err != nil {
+				return nil, err
+			}
+			status.Modified = modified
+			delete(applied, step.Version)
+		}
+		statuses = append(statuses, status)
+	}
 	for _, migration := range applied {
-		appliedVersions[migration.Version] = true
+		statuses = append(statuses, MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   true,
+			AppliedAt: migration.CreatedAt,
+			Unknown:   true,
+		})
 	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Up applies every pending step in version order and returns how many it
+// applied. It refuses to run when an applied step was modified or the
+// database has migrations it does not know.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+	err := m.withLock(ctx, func() error {
+		applied, err := m.verify(ctx)
+		if err != nil {
+			return err
+		}
 
-	// Run pending migrations
-	for _, migration := range m.migrations {
-		if !appliedVersions[migration.Version] {
-			if err := m.runMigration(ctx, migration); err != nil {
-				return fmt.Errorf("failed to run migration %d: %w", migration.Version, err)
+		for _, step := range m.steps {
+			if _, ok := applied[step.Version]; ok {
+				continue
 			}
+			if err := m.apply(ctx, step); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down reverts the n most recently applied steps, newest first, and returns
+// how many it reverted
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	count := 0
+	err := m.withLock(ctx, func() error {
+		applied, err := m.verify(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.steps) - 1; i >= 0 && count < n; i-- {
+			step := m.steps[i]
+			if _, ok := applied[step.Version]; !ok {
+				continue
+			}
+			if err := m.revert(ctx, step); err != nil {
+				return err
+			}
+			count++
 		}
+		return nil
+	})
+	return count, err
+}
+
+// apply runs a step and records it
+func (m *Migrator) apply(ctx context.Context, step Step) error {
+	checksum, err := step.Checksum()
+	if err != nil {
+		return err
+	}
+	if err := m.store.Lock(ctx, m.owner, lockTTL); err != nil {
+		return fmt.Errorf("failed to extend migration lock: %w", err)
 	}
 
-	return nil
+	if err := step.Up(ctx); err != nil {
+		return fmt.Errorf("failed to run migration %d (%s): %w", step.Version, step.Name, err)
+	}
+	return m.store.CreateMigration(ctx, Migration{
+		Version:   step.Version,
+		Name:      step.Name,
+		Checksum:  checksum,
+		CreatedAt: time.Now().UTC(),
+	})
 }
 
-// runMigration executes a single migration
-func (m *Migrator) runMigration(ctx context.Context, migration Migration) error {
-	// Record migration before running to ensure idempotency
-	if err := m.store.CreateMigration(ctx, migration); err != nil {
-		return fmt.Errorf("failed to record migration: %w", err)
+// revert undoes a step and forgets it
+func (m *Migrator) revert(ctx context.Context, step Step) error {
+	if step.Down == nil {
+		return fmt.Errorf("migration %d (%s) cannot be reverted", step.Version, step.Name)
+	}
+	if err := m.store.Lock(ctx, m.owner, lockTTL); err != nil {
+		return fmt.Errorf("failed to extend migration lock: %w", err)
 	}
 
-	return nil
-} 
\ No newline at end of file
+	if err := step.Down(ctx); err != nil {
+		return fmt.Errorf("failed to revert migration %d (%s): %w", step.Version, step.Name, err)
+	}
+	return m.store.DeleteMigration(ctx, step.Version)
+}
+
+// verify returns the applied migrations by version after checking that
+// each has an unmodified step
+func (m *Migrator) verify(ctx context.Context) (map[int]Migration, error) {
+	applied, err := m.appliedByVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make(map[int]Step, len(m.steps))
+	for _, step := range m.steps {
+		steps[step.Version] = step
+	}
+	for version, migration := range applied {
+		step, ok := steps[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d (%s): %w", version, migration.Name, ErrUnknownMigration)
+		}
+		modified, err := isModified(step, migration)
+		if err != nil {
+			return nil, err
+		}
+		if modified {
+			return nil, fmt.Errorf("migration %d (%s): %w", version, step.Name, ErrChecksumMismatch)
+		}
+	}
+	return applied, nil
+}
+
+func (m *Migrator) appliedByVersion(ctx context.Context) (map[int]Migration, error) {
+	migrations, err := m.store.GetMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	applied := make(map[int]Migration, len(migrations))
+	for _, migration := range migrations {
+		applied[migration.Version] = migration
+	}
+	return applied, nil
+}
+
+// isModified reports whether step changed since migration recorded it.
+// Migrations recorded before checksums were kept are taken as they are.
+func isModified(step Step, migration Migration) (bool, error) {
+	if migration.Checksum == "" {
+		return false, nil
+	}
+	checksum, err := step.Checksum()
+	if err != nil {
+		return false, err
+	}
+	return checksum != migration.Checksum, nil
+}
+
+// withLock runs fn while holding the migration lock, waiting for other
+// processes to release it until ctx is done
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	for {
+		err := m.store.Lock(ctx, m.owner, lockTTL)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the migration lock: %w", ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	// Release the lock even when ctx was cancelled mid-migration
+	defer m.store.Unlock(context.WithoutCancel(ctx), m.owner)
+
+	return fn()
+}
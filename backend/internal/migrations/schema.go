@@ -2,68 +2,138 @@ package migrations
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+
+	"email-harvester/internal/search"
 )
 
-// SchemaMigrator handles database schema migrations
-type SchemaMigrator struct {
-	store MigrationStore
+// emailSearchIndex is the name of the emails' full-text search index
+const emailSearchIndex = "email_search"
+
+// NewMongoDBMigrator creates a migrator for the MongoDB schema
+func NewMongoDBMigrator(db *mongo.Database) *Migrator {
+	return NewMigrator(NewMongoDBMigrationStore(db), MongoDBSteps(db))
 }
 
-// NewSchemaMigrator creates a new schema migrator
-func NewSchemaMigrator(store MigrationStore) *SchemaMigrator {
-	return &SchemaMigrator{
-		store: store,
+// MongoDBSteps returns the migrations of the MongoDB schema
+func MongoDBSteps(db *mongo.Database) []Step {
+	return []Step{
+		{
+			Version:    1,
+			Name:       "initial_schema",
+			Definition: mongoDBIndexes,
+			Up: func(ctx context.Context) error {
+				// A collection has at most one text index, so drop the
+				// subject-only one the search index replaces
+				if _, err := db.Collection("emails").Indexes().DropOne(ctx, "subject_text"); err != nil && !isIndexNotFoundError(err) {
+					return fmt.Errorf("failed to drop subject text index: %w", err)
+				}
+				for _, collection := range sortedKeys(mongoDBIndexes) {
+					if _, err := db.Collection(collection).Indexes().CreateMany(ctx, mongoDBIndexes[collection]); err != nil {
+						return fmt.Errorf("failed to create %s indexes: %w", collection, err)
+					}
+				}
+				return nil
+			},
+			Down: func(ctx context.Context) error {
+				for _, collection := range sortedKeys(mongoDBIndexes) {
+					for _, index := range mongoDBIndexes[collection] {
+						if err := dropIndex(ctx, db.Collection(collection), indexName(index)); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+		},
+		{
+			// The schema used to index accountId and messageId, which no
+			// document has, rather than account_id and message_id
+			Version: 2,
+			Name:    "snake_case_email_indexes",
+			Definition: map[string]interface{}{
+				"drop":  camelCaseIndexes,
+				"index": emailMessageIndex,
+			},
+			Up: func(ctx context.Context) error {
+				for _, collection := range sortedKeys(camelCaseIndexes) {
+					for _, name := range camelCaseIndexes[collection] {
+						if err := dropIndex(ctx, db.Collection(collection), name); err != nil {
+							return err
+						}
+					}
+				}
+
+				emails := db.Collection("emails")
+				if err := dedupeEmails(ctx, emails); err != nil {
+					return err
+				}
+				if _, err := emails.Indexes().CreateOne(ctx, emailMessageIndex); err != nil {
+					return fmt.Errorf("failed to create emails message index: %w", err)
+				}
+				return nil
+			},
+			// The camelCase indexes are not restored: their unique index
+			// admits a single email per collection
+			Down: func(ctx context.Context) error {
+				return dropIndex(ctx, db.Collection("emails"), indexName(emailMessageIndex))
+			},
+		},
 	}
 }
 
-// RunMongoDBSchema runs MongoDB schema migrations
-func (m *SchemaMigrator) RunMongoDBSchema(ctx context.Context, db *mongo.Database) error {
-	// Create accounts collection with indexes
-	accountsCollection := db.Collection("accounts")
-	indexes := []mongo.IndexModel{
+// mongoDBIndexes are the indexes of the initial schema by collection
+var mongoDBIndexes = map[string][]mongo.IndexModel{
+	"accounts": {
 		{
+			// Each user connects a mailbox at most once
 			Keys: bson.D{
+				{Key: "user_id", Value: 1},
+				{Key: "provider", Value: 1},
 				{Key: "email", Value: 1},
 			},
 			Options: options.Index().SetUnique(true),
 		},
 		{
+			// Listings, which page by creation time and ID
 			Keys: bson.D{
-				{Key: "createdAt", Value: -1},
+				{Key: "created_at", Value: -1},
+				{Key: "_id", Value: -1},
 			},
 		},
+	},
+	"emails": {
 		{
+			// Listings, which page by received time and ID, across
+			// accounts or within one
 			Keys: bson.D{
-				{Key: "updatedAt", Value: -1},
+				{Key: "received_at", Value: -1},
+				{Key: "_id", Value: -1},
 			},
 		},
-	}
-
-	if _, err := accountsCollection.Indexes().CreateMany(ctx, indexes); err != nil {
-		return fmt.Errorf("failed to create accounts indexes: %w", err)
-	}
-
-	// Create emails collection with indexes
-	emailsCollection := db.Collection("emails")
-	indexes = []mongo.IndexModel{
 		{
 			Keys: bson.D{
-				{Key: "accountId", Value: 1},
-				{Key: "messageId", Value: 1},
+				{Key: "account_id", Value: 1},
+				{Key: "received_at", Value: -1},
+				{Key: "_id", Value: -1},
 			},
-			Options: options.Index().SetUnique(true),
 		},
 		{
+			// The emails of a thread
 			Keys: bson.D{
-				{Key: "accountId", Value: 1},
-				{Key: "date", Value: -1},
+				{Key: "account_id", Value: 1},
+				{Key: "thread_ref", Value: 1},
+				{Key: "received_at", Value: 1},
 			},
 		},
 		{
@@ -77,81 +147,270 @@ func (m *SchemaMigrator) RunMongoDBSchema(ctx context.Context, db *mongo.Databas
 			},
 		},
 		{
+			// Full-text search, weighted like the search package ranks matches
 			Keys: bson.D{
 				{Key: "subject", Value: "text"},
+				{Key: "from_address.name", Value: "text"},
+				{Key: "from", Value: "text"},
+				{Key: "body", Value: "text"},
+				{Key: "html_text", Value: "text"},
 			},
+			Options: options.Index().
+				SetName(emailSearchIndex).
+				SetWeights(bson.M{
+					"subject":           search.SubjectWeight,
+					"from_address.name": search.FromWeight,
+					"from":              search.FromWeight,
+					"body":              search.BodyWeight,
+					"html_text":         search.BodyWeight,
+				}),
 		},
+	},
+	// Finding an email's thread and listing threads by last activity
+	"threads": {
 		{
 			Keys: bson.D{
-				{Key: "createdAt", Value: -1},
+				{Key: "account_id", Value: 1},
+				{Key: "keys", Value: 1},
 			},
 		},
 		{
 			Keys: bson.D{
-				{Key: "updatedAt", Value: -1},
+				{Key: "account_id", Value: 1},
+				{Key: "last_activity_at", Value: -1},
+				{Key: "_id", Value: -1},
 			},
 		},
-	}
-
-	if _, err := emailsCollection.Indexes().CreateMany(ctx, indexes); err != nil {
-		return fmt.Errorf("failed to create emails indexes: %w", err)
-	}
-
-	// Create migrations collection with indexes
-	migrationsCollection := db.Collection("migrations")
-	indexes = []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "last_activity_at", Value: -1},
+				{Key: "_id", Value: -1},
+			},
+		},
+	},
+	// Claiming due jobs
+	"jobs": {
+		{
+			Keys: bson.D{
+				{Key: "status", Value: 1},
+				{Key: "run_at", Value: 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{Key: "status", Value: 1},
+				{Key: "locked_until", Value: 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{Key: "created_at", Value: -1},
+			},
+		},
+	},
+	// Pending OAuth states are removed once they expire
+	"oauth_states": {
+		{
+			Keys: bson.D{
+				{Key: "expires_at", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"migrations": {
 		{
 			Keys: bson.D{
 				{Key: "version", Value: 1},
 			},
 			Options: options.Index().SetUnique(true),
 		},
+	},
+}
+
+// camelCaseIndexes are the indexes on fields no document has, by collection
+var camelCaseIndexes = map[string][]string{
+	"accounts": {"createdAt_-1", "updatedAt_-1"},
+	"emails":   {"accountId_1_messageId_1", "accountId_1_date_-1", "createdAt_-1", "updatedAt_-1"},
+}
+
+// emailMessageIndex keeps an account from storing a message twice
+var emailMessageIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "account_id", Value: 1},
+		{Key: "message_id", Value: 1},
+	},
+	Options: options.Index().SetUnique(true),
+}
+
+// dedupeEmails deletes all but the oldest email of every account and message
+// ID, which the unique index would otherwise reject
+func dedupeEmails(ctx context.Context, emails *mongo.Collection) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "account_id", Value: "$account_id"},
+				{Key: "message_id", Value: "$message_id"},
+			}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+	cursor, err := emails.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate emails: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs bson.A `bson:"ids"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return fmt.Errorf("failed to decode duplicate emails: %w", err)
+		}
+		if _, err := emails.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}}); err != nil {
+			return fmt.Errorf("failed to delete duplicate emails: %w", err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to find duplicate emails: %w", err)
 	}
+	return nil
+}
 
-	if _, err := migrationsCollection.Indexes().CreateMany(ctx, indexes); err != nil {
-		return fmt.Errorf("failed to create migrations indexes: %w", err)
+// indexName returns the name MongoDB gives an index unless one is set
+func indexName(index mongo.IndexModel) string {
+	if index.Options != nil && index.Options.Name != nil {
+		return *index.Options.Name
+	}
+	var parts []string
+	for _, key := range index.Keys.(bson.D) {
+		parts = append(parts, fmt.Sprintf("%s_%v", key.Key, key.Value))
 	}
+	return strings.Join(parts, "_")
+}
 
+// dropIndex drops an index unless it or its collection does not exist
+func dropIndex(ctx context.Context, collection *mongo.Collection, name string) error {
+	if _, err := collection.Indexes().DropOne(ctx, name); err != nil && !isIndexNotFoundError(err) {
+		return fmt.Errorf("failed to drop %s index %s: %w", collection.Name(), name, err)
+	}
 	return nil
 }
 
-// RunCosmosDBSchema runs Cosmos DB schema migrations
-func (m *SchemaMigrator) RunCosmosDBSchema(ctx context.Context, database *azcosmos.Database) error {
-	// Create accounts container
-	accountsProperties := azcosmos.ContainerProperties{
+// isIndexNotFoundError checks if the error is due to the index or its
+// collection not existing
+func isIndexNotFoundError(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27) // NamespaceNotFound, IndexNotFound
+}
+
+// NewCosmosDBMigrator creates a migrator for the Cosmos DB schema, creating
+// the container the migrations are recorded in if needed
+func NewCosmosDBMigrator(ctx context.Context, database *azcosmos.Database) (*Migrator, error) {
+	if err := createContainer(ctx, database, migrationsContainer); err != nil {
+		return nil, err
+	}
+	container, err := database.NewContainer(migrationsContainer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migrations container: %w", err)
+	}
+	return NewMigrator(NewCosmosDBMigrationStore(container), CosmosDBSteps(database)), nil
+}
+
+// CosmosDBSteps returns the migrations of the Cosmos DB schema
+func CosmosDBSteps(database *azcosmos.Database) []Step {
+	return []Step{
+		{
+			Version:    1,
+			Name:       "initial_schema",
+			Definition: cosmosDBContainers,
+			Up: func(ctx context.Context) error {
+				for _, properties := range cosmosDBContainers {
+					if err := createContainer(ctx, database, properties); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			// Deletes the containers along with everything in them
+			Down: func(ctx context.Context) error {
+				for i := len(cosmosDBContainers) - 1; i >= 0; i-- {
+					if err := deleteContainer(ctx, database, cosmosDBContainers[i].ID); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			// The indexes named accountId, messageId, createdAt and
+			// updatedAt, which no item has, rather than their snake_case
+			// fields. A unique key cannot be changed, so the emails are
+			// copied into a container created with the right one.
+			Version: 2,
+			Name:    "snake_case_email_indexes",
+			Definition: map[string]interface{}{
+				"accounts": accountsIndexingPolicy,
+				"emails":   emailsContainer,
+			},
+			Up: func(ctx context.Context) error {
+				if err := replaceIndexingPolicy(ctx, database, "accounts", accountsIndexingPolicy); err != nil {
+					return err
+				}
+				return rebuildContainer(ctx, database, emailsContainer, "account_id")
+			},
+			// The emails keep no unique key, as the camelCase one admits a
+			// single email per account
+			Down: func(ctx context.Context) error {
+				if err := replaceIndexingPolicy(ctx, database, "accounts", cosmosDBContainers[0].IndexingPolicy); err != nil {
+					return err
+				}
+				emails := cosmosDBContainers[1]
+				emails.UniqueKeyPolicy = nil
+				return rebuildContainer(ctx, database, emails, "account_id")
+			},
+		},
+	}
+}
+
+// cosmosDBContainers are the containers of the initial schema
+var cosmosDBContainers = []azcosmos.ContainerProperties{
+	{
 		ID: "accounts",
 		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
 			Paths: []string{"/email"},
 		},
 		IndexingPolicy: &azcosmos.IndexingPolicy{
-			Automatic: true,
+			Automatic:    true,
 			IndexingMode: azcosmos.IndexingModeConsistent,
 			IncludedPaths: []azcosmos.IncludedPath{
 				{Path: "/email/?"},
 				{Path: "/createdAt/?"},
 				{Path: "/updatedAt/?"},
+				{Path: "/created_at/?"},
 			},
 			ExcludedPaths: []azcosmos.ExcludedPath{
 				{Path: "/*"},
 			},
+			// Listings page by creation time and ID
+			CompositeIndexes: [][]azcosmos.CompositeIndex{
+				{
+					{Path: "/created_at", Order: azcosmos.CompositeIndexDescending},
+					{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+				},
+			},
 		},
-	}
-
-	if _, err := database.CreateContainer(ctx, accountsProperties, nil); err != nil {
-		// Ignore if container already exists
-		if !isContainerExistsError(err) {
-			return fmt.Errorf("failed to create accounts container: %w", err)
-		}
-	}
-
-	// Create emails container
-	emailsProperties := azcosmos.ContainerProperties{
+	},
+	{
 		ID: "emails",
 		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
-			Paths: []string{"/accountId"},
+			Paths: []string{"/account_id"},
 		},
 		IndexingPolicy: &azcosmos.IndexingPolicy{
-			Automatic: true,
+			Automatic:    true,
 			IndexingMode: azcosmos.IndexingModeConsistent,
 			IncludedPaths: []azcosmos.IncludedPath{
 				{Path: "/accountId/?"},
@@ -162,10 +421,19 @@ func (m *SchemaMigrator) RunCosmosDBSchema(ctx context.Context, database *azcosm
 				{Path: "/subject/?"},
 				{Path: "/createdAt/?"},
 				{Path: "/updatedAt/?"},
+				{Path: "/received_at/?"},
+				{Path: "/thread_ref/?"},
 			},
 			ExcludedPaths: []azcosmos.ExcludedPath{
 				{Path: "/*"},
 			},
+			// Listings page by received time and ID
+			CompositeIndexes: [][]azcosmos.CompositeIndex{
+				{
+					{Path: "/received_at", Order: azcosmos.CompositeIndexDescending},
+					{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+				},
+			},
 		},
 		UniqueKeyPolicy: &azcosmos.UniqueKeyPolicy{
 			UniqueKeys: []azcosmos.UniqueKey{
@@ -174,49 +442,216 @@ func (m *SchemaMigrator) RunCosmosDBSchema(ctx context.Context, database *azcosm
 				},
 			},
 		},
-	}
-
-	if _, err := database.CreateContainer(ctx, emailsProperties, nil); err != nil {
-		// Ignore if container already exists
-		if !isContainerExistsError(err) {
-			return fmt.Errorf("failed to create emails container: %w", err)
-		}
-	}
-
-	// Create migrations container
-	migrationsProperties := azcosmos.ContainerProperties{
-		ID: "migrations",
+	},
+	{
+		// Partitioned like the emails by account
+		ID: "threads",
 		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
-			Paths: []string{"/version"},
+			Paths: []string{"/account_id"},
 		},
 		IndexingPolicy: &azcosmos.IndexingPolicy{
-			Automatic: true,
+			Automatic:    true,
 			IndexingMode: azcosmos.IndexingModeConsistent,
 			IncludedPaths: []azcosmos.IncludedPath{
-				{Path: "/version/?"},
-				{Path: "/createdAt/?"},
+				{Path: "/keys/[]/?"},
+				{Path: "/last_activity_at/?"},
 			},
 			ExcludedPaths: []azcosmos.ExcludedPath{
 				{Path: "/*"},
 			},
+			// Listings page by last activity and ID
+			CompositeIndexes: [][]azcosmos.CompositeIndex{
+				{
+					{Path: "/last_activity_at", Order: azcosmos.CompositeIndexDescending},
+					{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+				},
+			},
+		},
+	},
+	{
+		ID: "jobs",
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/id"},
+		},
+	},
+}
+
+// accountsIndexingPolicy indexes every field of accounts, which are few and
+// small
+var accountsIndexingPolicy = &azcosmos.IndexingPolicy{
+	Automatic:    true,
+	IndexingMode: azcosmos.IndexingModeConsistent,
+	IncludedPaths: []azcosmos.IncludedPath{
+		{Path: "/*"},
+	},
+	// Listings page by creation time and ID
+	CompositeIndexes: [][]azcosmos.CompositeIndex{
+		{
+			{Path: "/created_at", Order: azcosmos.CompositeIndexDescending},
+			{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+		},
+	},
+}
+
+// emailsContainer is the emails container with snake_case indexes and a
+// unique key that keeps an account from storing a message twice
+var emailsContainer = azcosmos.ContainerProperties{
+	ID: "emails",
+	PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+		Paths: []string{"/account_id"},
+	},
+	IndexingPolicy: &azcosmos.IndexingPolicy{
+		Automatic:    true,
+		IndexingMode: azcosmos.IndexingModeConsistent,
+		IncludedPaths: []azcosmos.IncludedPath{
+			{Path: "/*"},
+		},
+		// The bodies are only searched within the few emails other
+		// conditions leave
+		ExcludedPaths: []azcosmos.ExcludedPath{
+			{Path: "/body/?"},
+			{Path: "/html_body/?"},
+			{Path: "/html_text/?"},
+		},
+		// Listings page by received time and ID
+		CompositeIndexes: [][]azcosmos.CompositeIndex{
+			{
+				{Path: "/received_at", Order: azcosmos.CompositeIndexDescending},
+				{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+			},
+		},
+	},
+	UniqueKeyPolicy: &azcosmos.UniqueKeyPolicy{
+		UniqueKeys: []azcosmos.UniqueKey{
+			{
+				Paths: []string{"/account_id", "/message_id"},
+			},
 		},
+	},
+}
+
+// migrationsContainer records the migrations, and holds the migration lock
+var migrationsContainer = azcosmos.ContainerProperties{
+	ID: "migrations",
+	PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+		Paths: []string{"/version"},
+	},
+}
+
+// createContainer creates a container unless it exists
+func createContainer(ctx context.Context, database *azcosmos.Database, properties azcosmos.ContainerProperties) error {
+	if _, err := database.CreateContainer(ctx, properties, nil); err != nil && !isCosmosStatus(err, http.StatusConflict) {
+		return fmt.Errorf("failed to create %s container: %w", properties.ID, err)
+	}
+	return nil
+}
+
+// replaceIndexingPolicy changes the indexing policy of a container, which
+// Cosmos DB then reindexes in the background
+func replaceIndexingPolicy(ctx context.Context, database *azcosmos.Database, id string, policy *azcosmos.IndexingPolicy) error {
+	container, err := database.NewContainer(id)
+	if err != nil {
+		return fmt.Errorf("failed to get %s container: %w", id, err)
+	}
+	response, err := container.Read(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read %s container: %w", id, err)
+	}
+
+	properties := *response.ContainerProperties
+	properties.IndexingPolicy = policy
+	if _, err := container.Replace(ctx, properties, nil); err != nil {
+		return fmt.Errorf("failed to replace %s indexing policy: %w", id, err)
+	}
+	return nil
+}
+
+// rebuildContainer recreates a container with new properties, keeping its
+// items in a temporary container meanwhile. Items the new unique keys reject
+// are dropped. Every stage tolerates an earlier, interrupted run, so a failed
+// rebuild is completed by running it again.
+func rebuildContainer(ctx context.Context, database *azcosmos.Database, properties azcosmos.ContainerProperties, partitionField string) error {
+	temporary := properties
+	temporary.ID = properties.ID + "_migration"
+	if err := createContainer(ctx, database, temporary); err != nil {
+		return err
+	}
+	if err := copyItems(ctx, database, properties.ID, temporary.ID, partitionField); err != nil {
+		return err
+	}
+
+	if err := deleteContainer(ctx, database, properties.ID); err != nil {
+		return err
+	}
+	if err := createContainer(ctx, database, properties); err != nil {
+		return err
+	}
+	if err := copyItems(ctx, database, temporary.ID, properties.ID, partitionField); err != nil {
+		return err
+	}
+	return deleteContainer(ctx, database, temporary.ID)
+}
+
+// copyItems copies the items of one container into another, skipping items
+// that conflict with those already there. A missing source has no items.
+func copyItems(ctx context.Context, database *azcosmos.Database, from, to string, partitionField string) error {
+	source, err := database.NewContainer(from)
+	if err != nil {
+		return fmt.Errorf("failed to get %s container: %w", from, err)
+	}
+	target, err := database.NewContainer(to)
+	if err != nil {
+		return fmt.Errorf("failed to get %s container: %w", to, err)
 	}
 
-	if _, err := database.CreateContainer(ctx, migrationsProperties, nil); err != nil {
-		// Ignore if container already exists
-		if !isContainerExistsError(err) {
-			return fmt.Errorf("failed to create migrations container: %w", err)
+	pager := source.NewQueryItemsPager("SELECT * FROM c", azcosmos.NewPartitionKey(), nil)
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if isCosmosStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", from, err)
+		}
+
+		var items []map[string]interface{}
+		if err := response.Unmarshal(&items); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", from, err)
+		}
+		for _, item := range items {
+			// System properties are assigned by the target container
+			for _, property := range []string{"_rid", "_self", "_etag", "_attachments", "_ts"} {
+				delete(item, property)
+			}
+			partitionKey, _ := item[partitionField].(string)
+			_, err := target.CreateItem(ctx, azcosmos.NewPartitionKeyString(partitionKey), item, nil)
+			if err != nil && !isCosmosStatus(err, http.StatusConflict) {
+				return fmt.Errorf("failed to copy %s into %s: %w", from, to, err)
+			}
 		}
 	}
+	return nil
+}
 
+// deleteContainer deletes a container unless it does not exist
+func deleteContainer(ctx context.Context, database *azcosmos.Database, id string) error {
+	container, err := database.NewContainer(id)
+	if err != nil {
+		return fmt.Errorf("failed to get %s container: %w", id, err)
+	}
+	if _, err := container.Delete(ctx, nil); err != nil && !isCosmosStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete %s container: %w", id, err)
+	}
 	return nil
 }
 
-// isContainerExistsError checks if the error is due to container already existing
-func isContainerExistsError(err error) bool {
-	if err == nil {
-		return false
+// sortedKeys returns the keys of m in order, so that collections are
+// migrated in the same order every time
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
-	// Cosmos DB returns a specific error code when container already exists
-	return err.Error() == "Container already exists"
-} 
\ No newline at end of file
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,416 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQL dialects the relational schema is written for
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// sqlSchema creates the tables both SQL dialects share. Timestamps are Unix
+// milliseconds, like BSON dates, and IDs are hex object IDs. Attachments,
+// entities, labels and recipients are rows of their own, deleted with their
+// email.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS accounts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		email TEXT NOT NULL,
+		access_token TEXT NOT NULL DEFAULT '',
+		refresh_token TEXT NOT NULL DEFAULT '',
+		token_expiry BIGINT,
+		token_type TEXT NOT NULL DEFAULT '',
+		history_id BIGINT NOT NULL DEFAULT 0,
+		gmail_watch BIGINT,
+		graph_subscription_id TEXT,
+		graph_client_state TEXT,
+		graph_expires_at BIGINT,
+		imap_host TEXT,
+		imap_port INTEGER,
+		imap_tls TEXT,
+		imap_username TEXT,
+		imap_password TEXT,
+		imap_auth_method TEXT,
+		imap_mailbox TEXT,
+		imap_uid_validity BIGINT,
+		imap_uid_next BIGINT,
+		imap_highest_modseq BIGINT,
+		name TEXT NOT NULL DEFAULT '',
+		picture TEXT NOT NULL DEFAULT '',
+		is_active BOOLEAN NOT NULL DEFAULT FALSE,
+		disabled_reason TEXT NOT NULL DEFAULT '',
+		last_sync_at BIGINT,
+		sync_last_attempt_at BIGINT,
+		sync_last_success_at BIGINT,
+		sync_last_error_at BIGINT,
+		sync_last_error TEXT,
+		sync_messages_added INTEGER,
+		sync_duration TEXT,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE (user_id, provider, email)
+	)`,
+	`CREATE INDEX IF NOT EXISTS accounts_created_at ON accounts (created_at DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS accounts_email ON accounts (email)`,
+
+	// Outlook delta links, one per mail folder
+	`CREATE TABLE IF NOT EXISTS account_delta_links (
+		account_id TEXT NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+		folder_id TEXT NOT NULL,
+		delta_link TEXT NOT NULL,
+		PRIMARY KEY (account_id, folder_id)
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS oauth_states (
+		state TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+
+	// Emails don't reference their account, so that archives can be
+	// imported before the account exists. The address lists with display
+	// names and the References header are JSON arrays.
+	`CREATE TABLE IF NOT EXISTS emails (
+		id TEXT PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL DEFAULT '',
+		thread_ref TEXT,
+		from_email TEXT NOT NULL DEFAULT '',
+		from_name TEXT NOT NULL DEFAULT '',
+		from_address TEXT NOT NULL DEFAULT '',
+		to_addresses TEXT,
+		cc_addresses TEXT,
+		bcc_addresses TEXT,
+		subject TEXT NOT NULL DEFAULT '',
+		internet_message_id TEXT NOT NULL DEFAULT '',
+		in_reply_to TEXT NOT NULL DEFAULT '',
+		reference_ids TEXT,
+		body TEXT NOT NULL DEFAULT '',
+		html_body TEXT NOT NULL DEFAULT '',
+		html_text TEXT NOT NULL DEFAULT '',
+		summary TEXT NOT NULL DEFAULT '',
+		read BOOLEAN NOT NULL DEFAULT FALSE,
+		starred BOOLEAN NOT NULL DEFAULT FALSE,
+		received_at BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE (account_id, message_id)
+	)`,
+	// Listings, which page by received time and ID, across accounts or
+	// within one
+	`CREATE INDEX IF NOT EXISTS emails_received_at ON emails (received_at DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS emails_account_received_at ON emails (account_id, received_at DESC, id DESC)`,
+	// The emails of a thread
+	`CREATE INDEX IF NOT EXISTS emails_thread ON emails (account_id, thread_ref, received_at)`,
+
+	// The bare To, Cc and Bcc addresses, for filtering
+	`CREATE TABLE IF NOT EXISTS email_recipients (
+		email_id TEXT NOT NULL REFERENCES emails (id) ON DELETE CASCADE,
+		field TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		PRIMARY KEY (email_id, field, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS email_labels (
+		email_id TEXT NOT NULL REFERENCES emails (id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		label TEXT NOT NULL,
+		PRIMARY KEY (email_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_labels_label ON email_labels (label, email_id)`,
+	`CREATE TABLE IF NOT EXISTS email_attachments (
+		email_id TEXT NOT NULL REFERENCES emails (id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		attachment_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		content_id TEXT NOT NULL DEFAULT '',
+		is_inline BOOLEAN NOT NULL DEFAULT FALSE,
+		sha256 TEXT NOT NULL,
+		PRIMARY KEY (email_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_attachments_sha256 ON email_attachments (sha256)`,
+	`CREATE TABLE IF NOT EXISTS email_entities (
+		email_id TEXT NOT NULL REFERENCES emails (id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		type TEXT NOT NULL,
+		start_pos INTEGER NOT NULL,
+		end_pos INTEGER NOT NULL,
+		confidence DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (email_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_entities_text ON email_entities (type, text)`,
+
+	`CREATE TABLE IF NOT EXISTS threads (
+		id TEXT PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		subject TEXT NOT NULL DEFAULT '',
+		participants TEXT,
+		message_count INTEGER NOT NULL DEFAULT 0,
+		last_activity_at BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS threads_account_last_activity ON threads (account_id, last_activity_at DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS threads_last_activity ON threads (last_activity_at DESC, id DESC)`,
+	// Keys the emails of a thread are recognized by
+	`CREATE TABLE IF NOT EXISTS thread_keys (
+		thread_id TEXT NOT NULL REFERENCES threads (id) ON DELETE CASCADE,
+		thread_key TEXT NOT NULL,
+		PRIMARY KEY (thread_id, thread_key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS thread_keys_key ON thread_keys (thread_key)`,
+
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		account_id TEXT,
+		message_ids TEXT,
+		email_id TEXT,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 0,
+		run_at BIGINT NOT NULL,
+		locked_until BIGINT,
+		worker_id TEXT NOT NULL DEFAULT '',
+		last_error TEXT NOT NULL DEFAULT '',
+		version BIGINT NOT NULL,
+		finished_at BIGINT,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	// Claiming due jobs
+	`CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs (status, run_at)`,
+	`CREATE INDEX IF NOT EXISTS jobs_status_locked_until ON jobs (status, locked_until)`,
+	`CREATE INDEX IF NOT EXISTS jobs_created_at ON jobs (created_at DESC, id DESC)`,
+}
+
+// postgresSearchSchema adds a weighted tsvector of the searchable fields to
+// emails. The @ of addresses is replaced, so that their local part is a word
+// of its own rather than part of an email token.
+var postgresSearchSchema = []string{
+	`ALTER TABLE emails ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', subject), 'A') ||
+		setweight(to_tsvector('english', from_name || ' ' || replace(from_email, '@', ' ')), 'B') ||
+		setweight(to_tsvector('english', body || ' ' || html_text), 'C')
+	) STORED`,
+	`CREATE INDEX IF NOT EXISTS emails_search ON emails USING GIN (search)`,
+}
+
+// sqliteSearchSchema indexes the searchable fields in an FTS5 table, kept in
+// step with emails by triggers and joined to it by rowid
+var sqliteSearchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5 (subject, sender, body, tokenize = 'porter unicode61')`,
+	`CREATE TRIGGER IF NOT EXISTS emails_fts_insert AFTER INSERT ON emails BEGIN
+		INSERT INTO emails_fts (rowid, subject, sender, body)
+		VALUES (new.rowid, new.subject, new.from_name || ' ' || new.from_email, new.body || ' ' || new.html_text);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS emails_fts_update AFTER UPDATE OF subject, from_name, from_email, body, html_text ON emails BEGIN
+		UPDATE emails_fts
+		SET subject = new.subject, sender = new.from_name || ' ' || new.from_email, body = new.body || ' ' || new.html_text
+		WHERE rowid = new.rowid;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS emails_fts_delete AFTER DELETE ON emails BEGIN
+		DELETE FROM emails_fts WHERE rowid = old.rowid;
+	END`,
+}
+
+// sqlTables are the tables of the schema, dependents first
+var sqlTables = []string{
+	"emails_fts", "jobs", "thread_keys", "threads", "email_entities", "email_attachments",
+	"email_labels", "email_recipients", "emails", "oauth_states", "account_delta_links", "accounts",
+}
+
+// sqlMigrationSchema creates the tables the migrations are recorded and
+// locked in
+var sqlMigrationSchema = []string{
+	`CREATE TABLE IF NOT EXISTS migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS migration_lock (
+		id TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+}
+
+// NewSQLMigrator creates a migrator for the relational schema in a
+// PostgreSQL or SQLite database, creating the tables the migrations are
+// recorded in if needed
+func NewSQLMigrator(ctx context.Context, db *sql.DB, dialect string) (*Migrator, error) {
+	steps, err := SQLSteps(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range sqlMigrationSchema {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, fmt.Errorf("failed to create migrations tables: %w", err)
+		}
+	}
+	return NewMigrator(NewSQLMigrationStore(db, dialect), steps), nil
+}
+
+// SQLSteps returns the migrations of the relational schema in dialect. Each
+// runs in a transaction.
+func SQLSteps(db *sql.DB, dialect string) ([]Step, error) {
+	var search []string
+	switch dialect {
+	case DialectPostgres:
+		search = postgresSearchSchema
+	case DialectSQLite:
+		search = sqliteSearchSchema
+	default:
+		return nil, fmt.Errorf("unsupported SQL dialect: %s", dialect)
+	}
+
+	initial := append(append([]string{}, sqlSchema...), search...)
+	var drop []string
+	for _, table := range sqlTables {
+		drop = append(drop, "DROP TABLE IF EXISTS "+table)
+	}
+
+	return []Step{
+		{
+			Version:    1,
+			Name:       "initial_schema",
+			Definition: initial,
+			Up: func(ctx context.Context) error {
+				return execSQL(ctx, db, initial)
+			},
+			// Drops the tables along with everything in them
+			Down: func(ctx context.Context) error {
+				return execSQL(ctx, db, drop)
+			},
+		},
+	}, nil
+}
+
+// execSQL runs statements in a transaction
+func execSQL(ctx context.Context, db *sql.DB, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration: %w", err)
+	}
+	return nil
+}
+
+// SQLMigrationStore implements MigrationStore for PostgreSQL and SQLite
+type SQLMigrationStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewSQLMigrationStore creates a new SQL migration store
+func NewSQLMigrationStore(db *sql.DB, dialect string) *SQLMigrationStore {
+	return &SQLMigrationStore{
+		db:      db,
+		dialect: dialect,
+	}
+}
+
+// GetMigrations returns all applied migrations from the migrations table
+func (s *SQLMigrationStore) GetMigrations(ctx context.Context) ([]Migration, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT version, name, checksum, created_at FROM migrations ORDER BY version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migrations: %w", err)
+	}
+	defer rows.Close()
+
+	var migrations []Migration
+	for rows.Next() {
+		var migration Migration
+		var createdAt int64
+		if err := rows.Scan(&migration.Version, &migration.Name, &migration.Checksum, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to decode migrations: %w", err)
+		}
+		migration.CreatedAt = time.UnixMilli(createdAt).UTC()
+		migrations = append(migrations, migration)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get migrations: %w", err)
+	}
+	return migrations, nil
+}
+
+// CreateMigration records a new migration in the migrations table
+func (s *SQLMigrationStore) CreateMigration(ctx context.Context, migration Migration) error {
+	query := s.rebind("INSERT INTO migrations (version, name, checksum, created_at) VALUES ($1, $2, $3, $4)")
+	_, err := s.db.ExecContext(ctx, query, migration.Version, migration.Name, migration.Checksum, migration.CreatedAt.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to create migration: %w", err)
+	}
+	return nil
+}
+
+// DeleteMigration removes a migration from the migrations table
+func (s *SQLMigrationStore) DeleteMigration(ctx context.Context, version int) error {
+	if _, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM migrations WHERE version = $1"), version); err != nil {
+		return fmt.Errorf("failed to delete migration: %w", err)
+	}
+	return nil
+}
+
+// Lock inserts the lock row, or takes it over when it expired or owner
+// holds it. Otherwise the upsert changes no row.
+func (s *SQLMigrationStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	now := time.Now()
+	query := s.rebind(`INSERT INTO migration_lock (id, owner, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE migration_lock.owner = excluded.owner OR migration_lock.expires_at <= $4`)
+	result, err := s.db.ExecContext(ctx, query, migrationLockID, owner, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	locked, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	if locked == 0 {
+		return ErrLocked
+	}
+	return nil
+}
+
+// Unlock deletes the lock row if owner holds it
+func (s *SQLMigrationStore) Unlock(ctx context.Context, owner string) error {
+	query := s.rebind("DELETE FROM migration_lock WHERE id = $1 AND owner = $2")
+	if _, err := s.db.ExecContext(ctx, query, migrationLockID, owner); err != nil {
+		return fmt.Errorf("failed to unlock migrations: %w", err)
+	}
+	return nil
+}
+
+// rebind rewrites the $n parameters of query as SQLite's ?n
+func (s *SQLMigrationStore) rebind(query string) string {
+	if s.dialect == DialectSQLite {
+		return strings.ReplaceAll(query, "$", "?")
+	}
+	return query
+}
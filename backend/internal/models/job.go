@@ -0,0 +1,80 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JobType identifies the work a job performs
+type JobType string
+
+const (
+	JobTypeSync      JobType = "sync"      // Sync an account's mailbox
+	JobTypeSummarize JobType = "summarize" // Summarize an email with the LLM
+	JobTypeNER       JobType = "ner"       // Extract named entities from an email
+
+	// Sync individual Outlook messages reported by Graph change notifications
+	JobTypeOutlookMessages JobType = "outlook_messages"
+)
+
+// JobStatus represents the lifecycle state of a job
+type JobStatus string
+
+const (
+	JobStatusPending   JobStatus = "pending"   // Waiting for RunAt, including between retries
+	JobStatusRunning   JobStatus = "running"   // Claimed by a worker until LockedUntil
+	JobStatusSucceeded JobStatus = "succeeded" // Finished successfully
+	JobStatusDead      JobStatus = "dead"      // Gave up after MaxAttempts or a permanent failure
+	JobStatusCanceled  JobStatus = "canceled"  // Canceled through the API
+)
+
+// IsFinal reports whether a job in this status will never run again
+func (s JobStatus) IsFinal() bool {
+	return s == JobStatusSucceeded || s == JobStatusDead || s == JobStatusCanceled
+}
+
+// Job is a unit of background work persisted in the store so it survives
+// client disconnects and restarts
+type Job struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Type        JobType             `bson:"type" json:"type"`
+	Status      JobStatus           `bson:"status" json:"status"`
+	AccountID   *primitive.ObjectID `bson:"account_id,omitempty" json:"account_id,omitempty"`   // For sync jobs
+	MessageIDs  []string            `bson:"message_ids,omitempty" json:"message_ids,omitempty"` // Provider message IDs, for outlook_messages jobs
+	EmailID     *primitive.ObjectID `bson:"email_id,omitempty" json:"email_id,omitempty"`       // For summarize and NER jobs
+	Attempts    int                 `bson:"attempts" json:"attempts"`
+	MaxAttempts int                 `bson:"max_attempts" json:"max_attempts"`
+	RunAt       time.Time           `bson:"run_at" json:"run_at"`                                 // Not picked up before this time
+	LockedUntil time.Time           `bson:"locked_until,omitempty" json:"locked_until,omitempty"` // Visibility timeout of a running job
+	WorkerID    string              `bson:"worker_id,omitempty" json:"worker_id,omitempty"`
+	LastError   string              `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	Version     int64               `bson:"version" json:"version"`   // Incremented on every write, for optimistic concurrency
+	ETag        string              `bson:"-" json:"_etag,omitempty"` // Cosmos DB concurrency token
+	FinishedAt  time.Time           `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`
+}
+
+// JobFilter represents the filter criteria for listing jobs
+type JobFilter struct {
+	Type   *JobType   `json:"type,omitempty"`
+	Status *JobStatus `json:"status,omitempty"`
+}
+
+// EnqueueJobRequest represents the request to enqueue a job
+type EnqueueJobRequest struct {
+	Type        JobType  `json:"type" validate:"required,oneof=sync summarize ner outlook_messages"`
+	AccountID   string   `json:"account_id,omitempty"`
+	EmailID     string   `json:"email_id,omitempty"`
+	MessageIDs  []string `json:"message_ids,omitempty"`
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+}
+
+// JobListResponse represents the paginated response for listing jobs
+type JobListResponse struct {
+	Jobs  []Job `json:"jobs"`
+	Total int64 `json:"total"`
+	Page  int   `json:"page"`
+	Limit int   `json:"limit"`
+}
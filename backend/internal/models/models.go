@@ -12,18 +12,73 @@ type AccountType string
 const (
 	AccountTypeGmail   AccountType = "gmail"
 	AccountTypeOutlook AccountType = "outlook"
+	AccountTypeIMAP    AccountType = "imap"
+	AccountTypeArchive AccountType = "archive" // Synthetic account for imported mbox/EML/Maildir archives
+)
+
+// IMAP authentication methods
+const (
+	IMAPAuthPassword = "password"
+	IMAPAuthXOAuth2  = "xoauth2"
 )
 
 // Account represents an email account
 type Account struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Provider     string            `bson:"provider" json:"provider"` // "gmail" or "outlook"
-	Email        string            `bson:"email" json:"email"`
-	AccessToken  string            `bson:"access_token" json:"-"`
-	RefreshToken string            `bson:"refresh_token" json:"-"`
-	TokenExpiry  time.Time         `bson:"token_expiry" json:"-"`
-	CreatedAt    time.Time         `bson:"created_at" json:"created_at"`
-	UpdatedAt    time.Time         `bson:"updated_at" json:"updated_at"`
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID            primitive.ObjectID `bson:"user_id" json:"user_id"`   // User who connected the account
+	Provider          string             `bson:"provider" json:"provider"` // "gmail" or "outlook"
+	Email             string             `bson:"email" json:"email"`
+	AccessToken       string             `bson:"access_token" json:"-"`
+	RefreshToken      string             `bson:"refresh_token" json:"-"`
+	TokenExpiry       time.Time          `bson:"token_expiry" json:"-"`
+	HistoryID         uint64             `bson:"history_id,omitempty" json:"-"`         // Gmail sync cursor, 0 until the first full sync
+	GmailWatch        time.Time          `bson:"gmail_watch,omitempty" json:"-"`        // Expiry of the Gmail users.watch push registration
+	DeltaLinks        map[string]string  `bson:"delta_links,omitempty" json:"-"`        // Outlook @odata.deltaLink per mail folder ID
+	GraphSubscription *GraphSubscription `bson:"graph_subscription,omitempty" json:"-"` // Outlook change notifications
+	IMAP              *IMAPSettings      `bson:"imap,omitempty" json:"imap,omitempty"`
+	Name              string             `bson:"name,omitempty" json:"name,omitempty"`
+	Picture           string             `bson:"picture,omitempty" json:"picture,omitempty"`
+	TokenType         string             `bson:"token_type,omitempty" json:"-"`
+	IsActive          bool               `bson:"is_active" json:"is_active"` // Only active accounts are synced in the background
+	DisabledReason    string             `bson:"disabled_reason,omitempty" json:"disabled_reason,omitempty"` // Why the account was deactivated, e.g. revoked access
+	LastSyncAt        time.Time          `bson:"last_sync_at,omitempty" json:"last_sync_at"`
+	SyncStatus        *SyncStatus        `bson:"sync_status,omitempty" json:"sync_status,omitempty"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// SyncStatus records the outcome of the background syncs of an account
+type SyncStatus struct {
+	LastAttemptAt time.Time `bson:"last_attempt_at" json:"last_attempt_at"`
+	LastSuccessAt time.Time `bson:"last_success_at,omitempty" json:"last_success_at,omitempty"`
+	LastErrorAt   time.Time `bson:"last_error_at,omitempty" json:"last_error_at,omitempty"`
+	LastError     string    `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	MessagesAdded int       `bson:"messages_added" json:"messages_added"` // By the last successful sync
+	Duration      string    `bson:"duration,omitempty" json:"duration,omitempty"`
+}
+
+// GraphSubscription is a Microsoft Graph change-notification subscription for
+// an Outlook account's messages
+type GraphSubscription struct {
+	ID          string    `bson:"id" json:"id"`
+	ClientState string    `bson:"client_state" json:"-"` // Secret Graph echoes in every notification
+	ExpiresAt   time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// IMAPSettings holds the connection details and sync state of an IMAP account
+type IMAPSettings struct {
+	Host       string `bson:"host" json:"host"`
+	Port       int    `bson:"port" json:"port"`
+	TLS        string `bson:"tls" json:"tls"` // "tls", "starttls" or "none"
+	Username   string `bson:"username" json:"username"`
+	Password   string `bson:"password,omitempty" json:"-"`
+	AuthMethod string `bson:"auth_method" json:"auth_method"` // "password" or "xoauth2"
+	Mailbox    string `bson:"mailbox" json:"mailbox"`
+
+	// Sync state, reset whenever the server reports a new UIDVALIDITY
+	UIDValidity   uint32 `bson:"uid_validity" json:"-"`
+	UIDNext       uint32 `bson:"uid_next" json:"-"`
+	HighestModSeq uint64 `bson:"highest_modseq,omitempty" json:"-"` // Only set when the server supports CONDSTORE
 }
 
 // Email represents an email message
@@ -31,17 +86,34 @@ type Email struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	AccountID   primitive.ObjectID `bson:"account_id" json:"account_id"`
 	MessageID   string            `bson:"message_id" json:"message_id"`
-	ThreadID    string            `bson:"thread_id" json:"thread_id"`
+	ThreadID    string            `bson:"thread_id" json:"thread_id"` // The provider's, such as a Gmail thread or an Outlook conversation
+	ThreadRef   primitive.ObjectID `bson:"thread_ref,omitempty" json:"thread_ref"` // The Thread the email was grouped into
 	From        string            `bson:"from" json:"from"`
 	To          []string          `bson:"to" json:"to"`
 	Cc          []string          `bson:"cc" json:"cc"`
 	Bcc         []string          `bson:"bcc" json:"bcc"`
 	Subject     string            `bson:"subject" json:"subject"`
+
+	// Structured addresses with display names. From/To/Cc/Bcc above hold the
+	// bare addresses for filtering.
+	FromAddress  EmailAddress   `bson:"from_address" json:"from_address"`
+	ToAddresses  []EmailAddress `bson:"to_addresses,omitempty" json:"to_addresses,omitempty"`
+	CcAddresses  []EmailAddress `bson:"cc_addresses,omitempty" json:"cc_addresses,omitempty"`
+	BccAddresses []EmailAddress `bson:"bcc_addresses,omitempty" json:"bcc_addresses,omitempty"`
+
+	// RFC 5322 threading headers, message IDs without angle brackets
+	InternetMessageID string   `bson:"internet_message_id,omitempty" json:"internet_message_id,omitempty"`
+	InReplyTo         string   `bson:"in_reply_to,omitempty" json:"in_reply_to,omitempty"`
+	References        []string `bson:"references,omitempty" json:"references,omitempty"`
+
 	Body        string            `bson:"body" json:"body"`
 	HTMLBody    string            `bson:"html_body" json:"html_body"`
+	// Text of HTMLBody without the markup, kept for full-text search
+	HTMLText    string            `bson:"html_text,omitempty" json:"html_text,omitempty"`
 	Summary     string            `bson:"summary,omitempty" json:"summary,omitempty"`
 	Entities    []NEREntity       `bson:"entities,omitempty" json:"entities,omitempty"`
 	Labels      []string          `bson:"labels" json:"labels"`
+	Attachments []Attachment      `bson:"attachments,omitempty" json:"attachments,omitempty"`
 	Read        bool              `bson:"read" json:"read"`
 	Starred     bool              `bson:"starred" json:"starred"`
 	ReceivedAt  time.Time         `bson:"received_at" json:"received_at"`
@@ -49,6 +121,24 @@ type Email struct {
 	UpdatedAt   time.Time         `bson:"updated_at" json:"updated_at"`
 }
 
+// EmailAddress is a mailbox with its optional display name
+type EmailAddress struct {
+	Name    string `bson:"name,omitempty" json:"name,omitempty"`
+	Address string `bson:"address" json:"address"`
+}
+
+// Attachment describes a file attached to an email. The content lives in the
+// blob store, keyed by its SHA-256 digest.
+type Attachment struct {
+	ID          string `bson:"id" json:"id"`
+	Filename    string `bson:"filename" json:"filename"`
+	ContentType string `bson:"content_type" json:"content_type"`
+	Size        int64  `bson:"size" json:"size"`
+	ContentID   string `bson:"content_id,omitempty" json:"content_id,omitempty"` // For inline parts referenced as cid: from HTML
+	Inline      bool   `bson:"is_inline" json:"inline"`                          // Not "inline", which BSON reads as the inline flag
+	SHA256      string `bson:"sha256" json:"sha256"`
+}
+
 // NEREntity represents a named entity extracted from an email
 type NEREntity struct {
 	Text      string `bson:"text" json:"text"`
@@ -60,8 +150,11 @@ type NEREntity struct {
 
 // AddAccountRequest represents the request to add a new email account
 type AddAccountRequest struct {
-	Provider string `json:"provider" binding:"required,oneof=gmail outlook"`
-	Email    string `json:"email" binding:"required,email"`
+	Provider string        `json:"provider" binding:"required,oneof=gmail outlook imap"`
+	Email    string        `json:"email" binding:"required,email"`
+	IMAP     *IMAPSettings `json:"imap,omitempty" binding:"required_if=Provider imap"`
+	// IMAP secret: the password, or the access token for XOAUTH2
+	Password string `json:"password,omitempty"`
 }
 
 // EmailFilter represents the filter criteria for listing emails
@@ -75,14 +168,45 @@ type EmailFilter struct {
 	Starred   *bool              `json:"starred,omitempty"`
 	StartDate *time.Time         `json:"start_date,omitempty"`
 	EndDate   *time.Time         `json:"end_date,omitempty"`
+
+	HasAttachment *bool `json:"has_attachment,omitempty"`
+	// Full-text terms and phrases that must all occur in the subject,
+	// sender or body
+	Text []string `json:"text,omitempty"`
+	// Negated conditions: emails matching any of them are left out
+	Not []EmailFilter `json:"not,omitempty"`
 }
 
 // EmailListResponse represents the paginated response for listing emails
 type EmailListResponse struct {
-	Emails []Email `json:"emails"`
-	Total  int64   `json:"total"`
-	Page   int     `json:"page"`
-	Limit  int     `json:"limit"`
+	Emails     []Email `json:"emails"`
+	Total      int64   `json:"total,omitempty"` // Only counted for page listings
+	Page       int     `json:"page,omitempty"`  // Only set for page listings
+	Limit      int     `json:"limit"`
+	NextCursor string  `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// EmailSearchResult is an email matched by a full-text search
+type EmailSearchResult struct {
+	Email    Email           `json:"email"`
+	Score    float64         `json:"score"`
+	Snippets []SearchSnippet `json:"snippets"`
+}
+
+// SearchSnippet is an extract of a matched email field. The text is
+// HTML-escaped and every match is wrapped in <mark> tags.
+type SearchSnippet struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+}
+
+// EmailSearchResponse represents the paginated, ranked response for
+// searching emails
+type EmailSearchResponse struct {
+	Results []EmailSearchResult `json:"results"`
+	Total   int64               `json:"total"`
+	Page    int                 `json:"page"`
+	Limit   int                 `json:"limit"`
 }
 
 // ErrorResponse represents an error response
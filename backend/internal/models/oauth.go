@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // OAuthTokens represents the OAuth tokens received from the provider
 type OAuthTokens struct {
@@ -10,6 +14,17 @@ type OAuthTokens struct {
 	TokenType    string    `json:"token_type"`
 }
 
+// OAuthState records a connect flow between redirecting the user to the
+// provider and the callback. The state value doubles as the ID.
+type OAuthState struct {
+	State        string             `bson:"_id" json:"id"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"user_id"`             // User who started the flow
+	Provider     string             `bson:"provider" json:"provider"`           // Canonical provider ID
+	CodeVerifier string             `bson:"code_verifier" json:"code_verifier"` // PKCE verifier sent with the code exchange
+	ExpiresAt    time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
 // UserInfo represents the user information received from the provider
 type UserInfo struct {
 	ID      string `json:"id"`
@@ -18,33 +33,17 @@ type UserInfo struct {
 	Picture string `json:"picture,omitempty"`
 }
 
-// Account represents a user's email account
-type Account struct {
-	ID           string    `json:"id" bson:"_id,omitempty"`
-	Provider     string    `json:"provider" bson:"provider"` // "google" or "microsoft"
-	Email        string    `json:"email" bson:"email"`
-	Name         string    `json:"name" bson:"name"`
-	Picture      string    `json:"picture,omitempty" bson:"picture,omitempty"`
-	AccessToken  string    `json:"-" bson:"access_token"`  // Not exposed in JSON
-	RefreshToken string    `json:"-" bson:"refresh_token"` // Not exposed in JSON
-	ExpiresAt    time.Time `json:"-" bson:"expires_at"`    // Not exposed in JSON
-	TokenType    string    `json:"-" bson:"token_type"`    // Not exposed in JSON
-	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
-	LastSyncAt   time.Time `json:"last_sync_at" bson:"last_sync_at"`
-	IsActive     bool      `json:"is_active" bson:"is_active"`
-}
-
 // AccountCreate represents the data needed to create a new account
 type AccountCreate struct {
-	Provider     string    `json:"provider" validate:"required,oneof=google microsoft"`
-	Email        string    `json:"email" validate:"required,email"`
-	Name         string    `json:"name" validate:"required"`
-	Picture      string    `json:"picture,omitempty"`
-	AccessToken  string    `json:"access_token" validate:"required"`
-	RefreshToken string    `json:"refresh_token" validate:"required"`
-	ExpiresAt    time.Time `json:"expires_at" validate:"required"`
-	TokenType    string    `json:"token_type" validate:"required"`
+	UserID       primitive.ObjectID `json:"-"` // Owner, taken from the authenticated session
+	Provider     string             `json:"provider" validate:"required,oneof=gmail outlook"`
+	Email        string             `json:"email" validate:"required,email"`
+	Name         string             `json:"name" validate:"required"`
+	Picture      string             `json:"picture,omitempty"`
+	AccessToken  string             `json:"access_token" validate:"required"`
+	RefreshToken string             `json:"refresh_token" validate:"required"`
+	ExpiresAt    time.Time          `json:"expires_at" validate:"required"`
+	TokenType    string             `json:"token_type" validate:"required"`
 }
 
 // AccountUpdate represents the data needed to update an existing account
@@ -61,29 +60,31 @@ type AccountUpdate struct {
 
 // AccountResponse represents the account data returned in API responses
 type AccountResponse struct {
-	ID         string    `json:"id"`
-	Provider   string    `json:"provider"`
-	Email      string    `json:"email"`
-	Name       string    `json:"name"`
-	Picture    string    `json:"picture,omitempty"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
-	LastSyncAt time.Time `json:"last_sync_at"`
-	IsActive   bool      `json:"is_active"`
+	ID             string    `json:"id"`
+	Provider       string    `json:"provider"`
+	Email          string    `json:"email"`
+	Name           string    `json:"name"`
+	Picture        string    `json:"picture,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	LastSyncAt     time.Time `json:"last_sync_at"`
+	IsActive       bool      `json:"is_active"`
+	DisabledReason string    `json:"disabled_reason,omitempty"` // Set when the user has to reconnect the account
 }
 
 // ToResponse converts an Account to an AccountResponse
 func (a *Account) ToResponse() *AccountResponse {
 	return &AccountResponse{
-		ID:         a.ID,
-		Provider:   a.Provider,
-		Email:      a.Email,
-		Name:       a.Name,
-		Picture:    a.Picture,
-		CreatedAt:  a.CreatedAt,
-		UpdatedAt:  a.UpdatedAt,
-		LastSyncAt: a.LastSyncAt,
-		IsActive:   a.IsActive,
+		ID:             a.ID.Hex(),
+		Provider:       a.Provider,
+		Email:          a.Email,
+		Name:           a.Name,
+		Picture:        a.Picture,
+		CreatedAt:      a.CreatedAt,
+		UpdatedAt:      a.UpdatedAt,
+		LastSyncAt:     a.LastSyncAt,
+		IsActive:       a.IsActive,
+		DisabledReason: a.DisabledReason,
 	}
 }
 
@@ -102,7 +103,7 @@ func (a *Account) Update(update *AccountUpdate) {
 		a.RefreshToken = *update.RefreshToken
 	}
 	if update.ExpiresAt != nil {
-		a.ExpiresAt = *update.ExpiresAt
+		a.TokenExpiry = *update.ExpiresAt
 	}
 	if update.TokenType != nil {
 		a.TokenType = *update.TokenType
@@ -120,17 +121,18 @@ func (a *Account) Update(update *AccountUpdate) {
 func FromCreate(create *AccountCreate) *Account {
 	now := time.Now()
 	return &Account{
+		UserID:       create.UserID,
 		Provider:     create.Provider,
 		Email:        create.Email,
 		Name:         create.Name,
 		Picture:      create.Picture,
 		AccessToken:  create.AccessToken,
 		RefreshToken: create.RefreshToken,
-		ExpiresAt:    create.ExpiresAt,
+		TokenExpiry:  create.ExpiresAt,
 		TokenType:    create.TokenType,
 		CreatedAt:    now,
 		UpdatedAt:    now,
 		LastSyncAt:   now,
 		IsActive:     true,
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Thread is a conversation: the emails of one account that reply to each
+// other, or that the provider grouped together
+type Thread struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID    primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Subject      string             `bson:"subject" json:"subject"` // Without reply and forward prefixes
+	Participants []EmailAddress     `bson:"participants" json:"participants"`
+	MessageCount int                `bson:"message_count" json:"message_count"`
+	// Keys the emails of the thread are recognized by: provider thread IDs,
+	// message IDs and the normalized subject
+	Keys           []string  `bson:"keys" json:"-"`
+	LastActivityAt time.Time `bson:"last_activity_at" json:"last_activity_at"` // When the newest email was received
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// ThreadListResponse represents the paginated response for listing threads
+type ThreadListResponse struct {
+	Threads []Thread `json:"threads"`
+	Total   int64    `json:"total"`
+	Page    int      `json:"page"`
+	Limit   int      `json:"limit"`
+}
+
+// ThreadResponse is a thread with its emails, oldest first
+type ThreadResponse struct {
+	Thread
+	Emails []Email `json:"emails"`
+}
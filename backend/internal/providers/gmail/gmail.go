@@ -0,0 +1,231 @@
+// Package gmail implements the Gmail provider on top of Google OAuth and the
+// Gmail API
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// ID is the canonical provider ID of Gmail accounts
+const ID = string(models.AccountTypeGmail)
+
+// Default Google endpoints, used when Config leaves them empty
+const (
+	DefaultAuthURL     = "https://accounts.google.com/o/oauth2/v2/auth"
+	DefaultTokenURL    = "https://oauth2.googleapis.com/token"
+	DefaultUserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+	DefaultAPIURL      = "https://gmail.googleapis.com/"
+)
+
+// Config holds the Google OAuth client settings and the endpoints to use
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	APIURL      string // Gmail API base URL, with a trailing slash
+
+	// HTTPClient is used for every request to Google; nil means
+	// http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Provider is the Gmail provider
+type Provider struct {
+	config Config
+}
+
+var (
+	_ providers.Provider = (*Provider)(nil)
+	_ providers.Watcher  = (*Provider)(nil)
+)
+
+// New creates a Gmail provider
+func New(config Config) *Provider {
+	if config.AuthURL == "" {
+		config.AuthURL = DefaultAuthURL
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = DefaultTokenURL
+	}
+	if config.UserInfoURL == "" {
+		config.UserInfoURL = DefaultUserInfoURL
+	}
+	if config.APIURL == "" {
+		config.APIURL = DefaultAPIURL
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &Provider{config: config}
+}
+
+// ID returns the canonical provider ID
+func (p *Provider) ID() string {
+	return ID
+}
+
+// AuthCodeURL generates a Google OAuth authorization URL
+func (p *Provider) AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error) {
+	params := url.Values{}
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("response_type", "code")
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("access_type", "offline")
+	params.Set("prompt", "consent")
+	params.Set("state", state)
+	params.Set("code_challenge", oauth2.S256ChallengeFromVerifier(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	return fmt.Sprintf("%s?%s", p.config.AuthURL, params.Encode()), nil
+}
+
+// Exchange processes the Google OAuth callback
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (*models.OAuthTokens, error) {
+	params := url.Values{}
+	params.Set("client_id", p.config.ClientID)
+	params.Set("client_secret", p.config.ClientSecret)
+	params.Set("code", code)
+	params.Set("code_verifier", codeVerifier)
+	params.Set("grant_type", "authorization_code")
+	params.Set("redirect_uri", p.config.RedirectURL)
+
+	tokens, err := p.requestToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code for token: %w", err)
+	}
+	return tokens, nil
+}
+
+// Refresh refreshes a Google OAuth token
+func (p *Provider) Refresh(ctx context.Context, refreshToken string) (*models.OAuthTokens, error) {
+	params := url.Values{}
+	params.Set("client_id", p.config.ClientID)
+	params.Set("client_secret", p.config.ClientSecret)
+	params.Set("refresh_token", refreshToken)
+	params.Set("grant_type", "refresh_token")
+
+	tokens, err := p.requestToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	// Google usually keeps the refresh token and omits it from the response
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshToken
+	}
+	return tokens, nil
+}
+
+// requestToken posts a token request and parses the tokens from the
+// response. A rejected grant is reported as providers.ErrInvalidGrant.
+func (p *Provider) requestToken(ctx context.Context, params url.Values) (*models.OAuthTokens, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.config.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		if errResp.Error == "invalid_grant" {
+			return nil, fmt.Errorf("%w: %s", providers.ErrInvalidGrant, errResp.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token request failed with status: %d %s", resp.StatusCode, errResp.Error)
+	}
+
+	var tokenResp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	return &models.OAuthTokens{
+		AccessToken:  tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		TokenType:    tokenResp.TokenType,
+	}, nil
+}
+
+// UserInfo retrieves user information from Google
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (*models.UserInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.config.UserInfoURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get user info with status: %d", resp.StatusCode)
+	}
+
+	var userInfo struct {
+		ID            string `json:"id"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode user info: %w", err)
+	}
+
+	return &models.UserInfo{
+		ID:      userInfo.ID,
+		Email:   userInfo.Email,
+		Name:    userInfo.Name,
+		Picture: userInfo.Picture,
+	}, nil
+}
+
+// service creates a Gmail API client authorized with the account's access token
+func (p *Provider) service(ctx context.Context, account *models.Account) (*gmailapi.Service, error) {
+	client := oauth2.NewClient(context.WithValue(ctx, oauth2.HTTPClient, p.config.HTTPClient), oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: account.AccessToken,
+		TokenType:   "Bearer",
+	}))
+	gmailService, err := gmailapi.NewService(ctx, option.WithHTTPClient(client), option.WithEndpoint(p.config.APIURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gmail service: %v", err)
+	}
+	return gmailService, nil
+}
@@ -0,0 +1,362 @@
+package gmailtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	gmailapi "google.golang.org/api/gmail/v1"
+)
+
+// listMessages implements messages.list. Of the search syntax only "in:"
+// terms are understood; they filter by label.
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var labels []string
+	for _, term := range strings.Fields(query.Get("q")) {
+		if label, ok := strings.CutPrefix(strings.ToLower(term), "in:"); ok {
+			labels = append(labels, strings.ToUpper(label))
+		}
+	}
+	labels = append(labels, query["labelIds"]...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Gmail lists the newest messages first
+	var ids []string
+	for n := len(s.order) - 1; n >= 0; n-- {
+		msg := s.messages[s.order[n]]
+		if hasLabels(msg.LabelIDs, labels) {
+			ids = append(ids, msg.ID)
+		}
+	}
+
+	start, end, next, ok := s.page(query, len(ids))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalidArgument")
+		return
+	}
+
+	resp := &gmailapi.ListMessagesResponse{
+		Messages:           []*gmailapi.Message{},
+		NextPageToken:      next,
+		ResultSizeEstimate: int64(len(ids)),
+	}
+	for _, id := range ids[start:end] {
+		resp.Messages = append(resp.Messages, &gmailapi.Message{Id: id, ThreadId: s.messages[id].ThreadID})
+	}
+	writeJSON(w, resp)
+}
+
+// getMessage implements messages.get in the "full" and "minimal" formats
+func (s *Server) getMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	if r.URL.Query().Get("format") == "minimal" {
+		writeJSON(w, summary(msg))
+		return
+	}
+	writeJSON(w, s.full(msg))
+}
+
+// getAttachment implements messages.attachments.get
+func (s *Server) getAttachment(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(chi.URLParam(r, "attachmentID"), "att"))
+	if err != nil || n < 0 || n >= len(msg.Attachments) {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	data := msg.Attachments[n].Data
+	writeJSON(w, &gmailapi.MessagePartBody{
+		AttachmentId: chi.URLParam(r, "attachmentID"),
+		Data:         base64.URLEncoding.EncodeToString(data),
+		Size:         int64(len(data)),
+	})
+}
+
+// modifyMessage implements messages.modify
+func (s *Server) modifyMessage(w http.ResponseWriter, r *http.Request) {
+	var req gmailapi.ModifyMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	s.modify(msg, req.AddLabelIds, req.RemoveLabelIds)
+	writeJSON(w, summary(msg))
+}
+
+// trashMessage implements messages.trash
+func (s *Server) trashMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	s.modify(msg, []string{"TRASH"}, []string{"INBOX"})
+	writeJSON(w, summary(msg))
+}
+
+// listHistory implements history.list, including the 404 Gmail answers for
+// a startHistoryId that is too old
+func (s *Server) listHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start, err := strconv.ParseUint(query.Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if start < s.oldestHistory {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	var records []*gmailapi.History
+	for _, h := range s.history {
+		if h.Id > start && hasHistoryType(h, query["historyTypes"]) {
+			records = append(records, h)
+		}
+	}
+
+	from, to, next, ok := s.page(query, len(records))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalidArgument")
+		return
+	}
+	writeJSON(w, &gmailapi.ListHistoryResponse{
+		History:       records[from:to],
+		HistoryId:     s.historyID,
+		NextPageToken: next,
+	})
+}
+
+// watch implements users.watch; notifications are never actually sent
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	var req gmailapi.WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TopicName == "" {
+		writeError(w, http.StatusBadRequest, "invalidArgument")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, &gmailapi.WatchResponse{
+		HistoryId:  s.historyID,
+		Expiration: time.Now().Add(7 * 24 * time.Hour).UnixMilli(),
+	})
+}
+
+// page resolves the pageToken and maxResults parameters to a slice of
+// total items and the token of the following page
+func (s *Server) page(query url.Values, total int) (start, end int, next string, ok bool) {
+	size := s.PageSize
+	if limit := query.Get("maxResults"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return 0, 0, "", false
+		}
+		if n < size {
+			size = n
+		}
+	}
+
+	if token := query.Get("pageToken"); token != "" {
+		n, err := strconv.Atoi(token)
+		if err != nil || n < 0 || n > total {
+			return 0, 0, "", false
+		}
+		start = n
+	}
+
+	end = start + size
+	if end >= total {
+		return start, total, "", true
+	}
+	return start, end, strconv.Itoa(end), true
+}
+
+// full renders a message in the "full" format: headers plus a MIME tree
+// whose attachments are referenced by ID
+func (s *Server) full(msg *Message) *gmailapi.Message {
+	var body []*gmailapi.MessagePart
+	if msg.Text != "" || msg.HTML == "" {
+		body = append(body, textPart("text/plain", msg.Text))
+	}
+	if msg.HTML != "" {
+		body = append(body, textPart("text/html", msg.HTML))
+	}
+
+	payload := body[0]
+	if len(body) > 1 {
+		payload = multipart("alternative", body)
+	}
+	if len(msg.Attachments) > 0 {
+		parts := []*gmailapi.MessagePart{payload}
+		for n, a := range msg.Attachments {
+			parts = append(parts, &gmailapi.MessagePart{
+				Filename: a.Filename,
+				MimeType: a.ContentType,
+				Headers: []*gmailapi.MessagePartHeader{
+					{Name: "Content-Type", Value: fmt.Sprintf("%s; name=%q", a.ContentType, a.Filename)},
+					{Name: "Content-Disposition", Value: fmt.Sprintf("attachment; filename=%q", a.Filename)},
+				},
+				Body: &gmailapi.MessagePartBody{
+					AttachmentId: fmt.Sprintf("att%d", n),
+					Size:         int64(len(a.Data)),
+				},
+			})
+		}
+		payload = multipart("mixed", parts)
+	}
+
+	// The top-level part carries the message headers
+	payload.Headers = append([]*gmailapi.MessagePartHeader{
+		{Name: "From", Value: msg.From},
+		{Name: "To", Value: msg.To},
+		{Name: "Subject", Value: msg.Subject},
+		{Name: "Date", Value: msg.Date.Format(time.RFC1123Z)},
+		{Name: "Message-ID", Value: fmt.Sprintf("<%s@gmailtest>", msg.ID)},
+	}, payload.Headers...)
+
+	full := summary(msg)
+	full.Snippet = snippet(msg.Text)
+	full.InternalDate = msg.Date.UnixMilli()
+	full.HistoryId = s.historyID
+	full.Payload = payload
+	return full
+}
+
+// summary returns the ID, thread and labels of a message, which is what
+// history records and the "minimal" format carry
+func summary(msg *Message) *gmailapi.Message {
+	return &gmailapi.Message{
+		Id:       msg.ID,
+		ThreadId: msg.ThreadID,
+		LabelIds: append([]string(nil), msg.LabelIDs...),
+	}
+}
+
+// textPart returns a UTF-8 text part
+func textPart(mimeType, content string) *gmailapi.MessagePart {
+	return &gmailapi.MessagePart{
+		MimeType: mimeType,
+		Headers: []*gmailapi.MessagePartHeader{
+			{Name: "Content-Type", Value: mimeType + "; charset=UTF-8"},
+		},
+		Body: &gmailapi.MessagePartBody{
+			Data: base64.URLEncoding.EncodeToString([]byte(content)),
+			Size: int64(len(content)),
+		},
+	}
+}
+
+// multipart returns a multipart container of parts
+func multipart(subtype string, parts []*gmailapi.MessagePart) *gmailapi.MessagePart {
+	mimeType := "multipart/" + subtype
+	return &gmailapi.MessagePart{
+		MimeType: mimeType,
+		Headers: []*gmailapi.MessagePartHeader{
+			{Name: "Content-Type", Value: fmt.Sprintf("%s; boundary=%q", mimeType, subtype+"-boundary")},
+		},
+		Body:  &gmailapi.MessagePartBody{},
+		Parts: parts,
+	}
+}
+
+// snippet returns the start of a text body, like Gmail's message snippets
+func snippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > 100 {
+		return string(r[:100])
+	}
+	return text
+}
+
+// hasHistoryType reports whether a history record is of one of the types,
+// or of any type when types is empty
+func hasHistoryType(h *gmailapi.History, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		switch t {
+		case "messageAdded":
+			if len(h.MessagesAdded) > 0 {
+				return true
+			}
+		case "messageDeleted":
+			if len(h.MessagesDeleted) > 0 {
+				return true
+			}
+		case "labelAdded":
+			if len(h.LabelsAdded) > 0 {
+				return true
+			}
+		case "labelRemoved":
+			if len(h.LabelsRemoved) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasLabels reports whether labelIDs contains every label in want
+func hasLabels(labelIDs, want []string) bool {
+	for _, label := range want {
+		if !hasLabel(labelIDs, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLabel reports whether labelIDs contains label
+func hasLabel(labelIDs []string, label string) bool {
+	for _, id := range labelIDs {
+		if id == label {
+			return true
+		}
+	}
+	return false
+}
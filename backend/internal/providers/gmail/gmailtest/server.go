@@ -0,0 +1,437 @@
+// Package gmailtest runs an in-process fake of the Google OAuth endpoints and
+// the parts of the Gmail API the gmail provider uses. The fake keeps a mailbox
+// with a history log, so full and incremental syncs both work against it, and
+// errors can be injected into any endpoint.
+package gmailtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	gmailapi "google.golang.org/api/gmail/v1"
+
+	"email-harvester/internal/providers/gmail"
+	"email-harvester/internal/providers/providertest"
+)
+
+// Message is a message in the fake mailbox
+type Message struct {
+	ID          string
+	ThreadID    string
+	From        string
+	To          string
+	Subject     string
+	Date        time.Time
+	Text        string
+	HTML        string
+	LabelIDs    []string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a Message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// User is the Google account that owns the fake mailbox
+type User struct {
+	ID      string
+	Email   string
+	Name    string
+	Picture string
+}
+
+// Server is a fake Google OAuth and Gmail API server
+type Server struct {
+	*httptest.Server
+	*providertest.Injector
+
+	// User is returned by the userinfo endpoint and the Gmail profile
+	User User
+	// PageSize is the most items a messages.list or history.list page holds
+	PageSize int
+
+	mu            sync.Mutex
+	historyID     uint64
+	oldestHistory uint64 // history.list rejects older start IDs with a 404
+	messages      map[string]*Message
+	order         []string // message IDs, oldest first
+	history       []*gmailapi.History
+	codes         map[string]string // Authorization code to its PKCE challenge
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+	nextID        int
+}
+
+// NewServer starts a fake server with an empty mailbox. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Injector: providertest.NewInjector(writeError),
+		User: User{
+			ID:    "100000000000000000001",
+			Email: "user@gmail.test",
+			Name:  "Test User",
+		},
+		PageSize:      100,
+		historyID:     1000,
+		oldestHistory: 1,
+		messages:      make(map[string]*Message),
+		codes:         make(map[string]string),
+		accessTokens:  make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+	}
+
+	r := chi.NewRouter()
+	r.Use(s.Injector.Middleware)
+	r.Get("/o/oauth2/v2/auth", s.authorize)
+	r.Post("/token", s.token)
+	r.With(s.authenticate).Get("/oauth2/v2/userinfo", s.userInfo)
+	r.Route("/gmail/v1/users/{userID}", func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/profile", s.getProfile)
+		r.Get("/messages", s.listMessages)
+		r.Get("/messages/{id}", s.getMessage)
+		r.Get("/messages/{id}/attachments/{attachmentID}", s.getAttachment)
+		r.Post("/messages/{id}/modify", s.modifyMessage)
+		r.Post("/messages/{id}/trash", s.trashMessage)
+		r.Get("/history", s.listHistory)
+		r.Post("/watch", s.watch)
+	})
+
+	s.Server = httptest.NewServer(r)
+	return s
+}
+
+// ProviderConfig returns a provider config that talks to the fake server
+func (s *Server) ProviderConfig() gmail.Config {
+	return gmail.Config{
+		ClientID:     "gmailtest-client",
+		ClientSecret: "gmailtest-secret",
+		RedirectURL:  "http://localhost/oauth/callback/google",
+		Scopes:       []string{"https://www.googleapis.com/auth/gmail.modify"},
+		AuthURL:      s.URL + "/o/oauth2/v2/auth",
+		TokenURL:     s.URL + "/token",
+		UserInfoURL:  s.URL + "/oauth2/v2/userinfo",
+		APIURL:       s.URL + "/",
+		HTTPClient:   s.Client(),
+	}
+}
+
+// AddAuthCode registers an authorization code the token endpoint accepts once,
+// issued without a PKCE challenge
+func (s *Server) AddAuthCode(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = ""
+}
+
+// NewTokens issues an access and refresh token pair, as if the user had
+// completed the consent screen
+func (s *Server) NewTokens() (accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueAccessToken(), s.issueRefreshToken()
+}
+
+// RevokeTokens invalidates every issued token, so API calls answer 401 and
+// refreshes fail with invalid_grant
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTokens = make(map[string]bool)
+	s.refreshTokens = make(map[string]bool)
+}
+
+// HistoryID returns the mailbox's current historyId
+func (s *Server) HistoryID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.historyID
+}
+
+// ExpireHistory drops the history log, so history.list rejects every
+// historyId handed out so far like Gmail does for stale cursors
+func (s *Server) ExpireHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.historyID++
+	s.oldestHistory = s.historyID
+	s.history = nil
+}
+
+// AddMessage delivers a message to the mailbox and returns its ID. Missing
+// IDs are generated, and messages without labels land unread in the inbox.
+func (s *Server) AddMessage(msg Message) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.ID == "" {
+		msg.ID = s.newID("msg")
+	}
+	if msg.ThreadID == "" {
+		msg.ThreadID = msg.ID
+	}
+	if msg.Date.IsZero() {
+		msg.Date = time.Now().Truncate(time.Second)
+	}
+	if msg.LabelIDs == nil {
+		msg.LabelIDs = []string{"INBOX", "UNREAD"}
+	}
+	msg.LabelIDs = append([]string(nil), msg.LabelIDs...)
+
+	s.messages[msg.ID] = &msg
+	s.order = append(s.order, msg.ID)
+	s.record(&gmailapi.History{
+		MessagesAdded: []*gmailapi.HistoryMessageAdded{{Message: summary(&msg)}},
+	})
+	return msg.ID
+}
+
+// DeleteMessage permanently deletes a message, bypassing the trash
+func (s *Server) DeleteMessage(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return
+	}
+	delete(s.messages, id)
+	for n, other := range s.order {
+		if other == id {
+			s.order = append(s.order[:n], s.order[n+1:]...)
+			break
+		}
+	}
+	s.record(&gmailapi.History{
+		MessagesDeleted: []*gmailapi.HistoryMessageDeleted{{Message: summary(msg)}},
+	})
+}
+
+// ModifyLabels adds and removes labels of a message, as a user would in
+// another client
+func (s *Server) ModifyLabels(id string, add, remove []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg, ok := s.messages[id]; ok {
+		s.modify(msg, add, remove)
+	}
+}
+
+// Message returns the current state of a message in the mailbox
+func (s *Server) Message(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	snapshot := *msg
+	snapshot.LabelIDs = append([]string(nil), msg.LabelIDs...)
+	return snapshot, true
+}
+
+// modify changes the labels of a message and records the changes
+func (s *Server) modify(msg *Message, add, remove []string) {
+	var added, removed []string
+	for _, label := range add {
+		if !hasLabel(msg.LabelIDs, label) {
+			msg.LabelIDs = append(msg.LabelIDs, label)
+			added = append(added, label)
+		}
+	}
+	for _, label := range remove {
+		for n, other := range msg.LabelIDs {
+			if other == label {
+				msg.LabelIDs = append(msg.LabelIDs[:n], msg.LabelIDs[n+1:]...)
+				removed = append(removed, label)
+				break
+			}
+		}
+	}
+
+	if len(added) > 0 {
+		s.record(&gmailapi.History{
+			LabelsAdded: []*gmailapi.HistoryLabelAdded{{LabelIds: added, Message: summary(msg)}},
+		})
+	}
+	if len(removed) > 0 {
+		s.record(&gmailapi.History{
+			LabelsRemoved: []*gmailapi.HistoryLabelRemoved{{LabelIds: removed, Message: summary(msg)}},
+		})
+	}
+}
+
+// record appends a history record under a new historyId
+func (s *Server) record(h *gmailapi.History) {
+	s.historyID++
+	h.Id = s.historyID
+	s.history = append(s.history, h)
+}
+
+// newID returns a new unique ID with the given prefix
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%012x", prefix, s.nextID)
+}
+
+func (s *Server) issueAccessToken() string {
+	token := s.newID("ya29.")
+	s.accessTokens[token] = true
+	return token
+}
+
+func (s *Server) issueRefreshToken() string {
+	token := s.newID("1//")
+	s.refreshTokens[token] = true
+	return token
+}
+
+// authenticate rejects requests without a valid bearer token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+
+		s.mu.Lock()
+		ok := s.accessTokens[token]
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "authError")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize stands in for the consent screen: it approves right away and
+// redirects back with a fresh authorization code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	redirectURI, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	challenge, ok := providertest.PKCEChallenge(r.URL.Query())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	code := s.newID("4/")
+	s.codes[code] = challenge
+	s.mu.Unlock()
+
+	q := redirectURI.Query()
+	q.Set("code", code)
+	q.Set("state", r.URL.Query().Get("state"))
+	redirectURI.RawQuery = q.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token implements the authorization_code and refresh_token grants
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, "invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"expires_in": 3599,
+		"token_type": "Bearer",
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		challenge, ok := s.codes[code]
+		if !ok || !providertest.VerifyPKCE(challenge, r.PostForm.Get("code_verifier")) {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+		delete(s.codes, code)
+		resp["access_token"] = s.issueAccessToken()
+		resp["refresh_token"] = s.issueRefreshToken()
+	case "refresh_token":
+		if !s.refreshTokens[r.PostForm.Get("refresh_token")] {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+		resp["access_token"] = s.issueAccessToken()
+	default:
+		writeTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	writeJSON(w, resp)
+}
+
+func (s *Server) userInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"id":             s.User.ID,
+		"email":          s.User.Email,
+		"verified_email": true,
+		"name":           s.User.Name,
+		"picture":        s.User.Picture,
+	})
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, &gmailapi.Profile{
+		EmailAddress:  s.User.Email,
+		HistoryId:     s.historyID,
+		MessagesTotal: int64(len(s.messages)),
+	})
+}
+
+// writeJSON writes v as a 200 JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the Gmail API format, which the client
+// library turns into a *googleapi.Error
+func writeError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": http.StatusText(status),
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": http.StatusText(status)},
+			},
+		},
+	})
+}
+
+// writeTokenError writes an OAuth token endpoint error
+func writeTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// bearerToken returns the token of a Bearer Authorization header
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
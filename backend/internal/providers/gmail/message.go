@@ -0,0 +1,177 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+)
+
+// parseMessage parses a full Gmail message into our email model
+func parseMessage(msg *gmailapi.Message) (*models.Email, error) {
+	email := &models.Email{
+		MessageID: msg.Id,
+		ThreadID:  msg.ThreadId,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// Parse headers, falling back to Gmail's internal date (ms since epoch)
+	// when the Date header is missing or unparseable
+	headers := make(mailparse.HeaderMap)
+	for _, header := range msg.Payload.Headers {
+		headers.Add(header.Name, header.Value)
+	}
+	mailparse.ParseHeaders(headers, time.UnixMilli(msg.InternalDate)).Apply(email)
+
+	// Parse body
+	if err := parseBody(msg.Payload, email); err != nil {
+		return nil, err
+	}
+
+	setLabels(email, msg.LabelIds)
+	return email, nil
+}
+
+// parseBody decodes the text and HTML bodies of a Gmail message
+func parseBody(payload *gmailapi.MessagePart, email *models.Email) error {
+	root, err := mimePart(payload)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return nil
+	}
+
+	body := mailparse.Extract(root)
+	email.Body = body.Text
+	email.HTMLBody = body.HTML
+	return nil
+}
+
+// mimePart converts a Gmail payload to a MIME tree. Gmail has already
+// removed the transfer encoding, leaving the data in the part's charset.
+// Attachment parts are left out; fetchAttachments handles them.
+func mimePart(part *gmailapi.MessagePart) (*mailparse.Part, error) {
+	if part == nil || part.Filename != "" || part.Body != nil && part.Body.AttachmentId != "" {
+		return nil, nil
+	}
+
+	headers := make(mailparse.HeaderMap)
+	for _, header := range part.Headers {
+		headers.Add(header.Name, header.Value)
+	}
+	if headers.Get("Content-Type") == "" {
+		headers.Add("Content-Type", part.MimeType)
+	}
+	p := &mailparse.Part{Header: headers}
+
+	if part.Body != nil && part.Body.Data != "" {
+		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s part: %v", part.MimeType, err)
+		}
+		p.Content = data
+	}
+
+	for _, sub := range part.Parts {
+		child, err := mimePart(sub)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			p.Parts = append(p.Parts, child)
+		}
+	}
+
+	return p, nil
+}
+
+// fetchAttachments downloads the attachments of a message. Small parts
+// carry their data inline; larger ones have to be fetched by attachment ID.
+func fetchAttachments(ctx context.Context, gmailService *gmailapi.Service, message *gmailapi.Message) ([]mailparse.Attachment, error) {
+	var attachments []mailparse.Attachment
+	for _, part := range attachmentParts(message.Payload) {
+		encoded := part.Body.Data
+		if part.Body.AttachmentId != "" {
+			body, err := gmailService.Users.Messages.Attachments.Get("me", message.Id, part.Body.AttachmentId).Context(ctx).Do()
+			if err != nil {
+				return nil, err
+			}
+			encoded = body.Data
+		}
+
+		data, err := base64.URLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode attachment %s: %v", part.Filename, err)
+		}
+
+		headers := make(map[string]string)
+		for _, header := range part.Headers {
+			headers[strings.ToLower(header.Name)] = header.Value
+		}
+
+		attachments = append(attachments, mailparse.Attachment{
+			Filename:    part.Filename,
+			ContentType: part.MimeType,
+			ContentID:   strings.Trim(headers["content-id"], "<>"),
+			Inline:      strings.HasPrefix(strings.ToLower(headers["content-disposition"]), "inline"),
+			Data:        data,
+		})
+	}
+	return attachments, nil
+}
+
+// attachmentParts returns the parts of a message payload that are attachments
+func attachmentParts(part *gmailapi.MessagePart) []*gmailapi.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.Filename != "" || part.Body != nil && part.Body.AttachmentId != "" {
+		return []*gmailapi.MessagePart{part}
+	}
+
+	var parts []*gmailapi.MessagePart
+	for _, p := range part.Parts {
+		parts = append(parts, attachmentParts(p)...)
+	}
+	return parts
+}
+
+// setLabels sets the labels and the read/starred flags from Gmail label IDs
+func setLabels(email *models.Email, labelIDs []string) {
+	email.Labels = labelIDs
+	email.Read = !hasLabel(labelIDs, "UNREAD")
+	email.Starred = hasLabel(labelIDs, "STARRED")
+}
+
+// hasLabel reports whether labelIDs contains label
+func hasLabel(labelIDs []string, label string) bool {
+	for _, id := range labelIDs {
+		if id == label {
+			return true
+		}
+	}
+	return false
+}
+
+// isHistoryExpired reports whether history.list rejected the start
+// historyId, which Gmail signals with a 404
+func isHistoryExpired(err error) bool {
+	return isNotFound(err)
+}
+
+// isNotFound reports whether err is a Gmail API 404
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
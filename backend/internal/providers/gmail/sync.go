@@ -0,0 +1,290 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// Sync syncs a Gmail mailbox. The first sync lists the whole inbox; later
+// syncs only apply history deltas since the account's saved historyId.
+func (p *Provider) Sync(ctx context.Context, account *models.Account, mailbox providers.Mailbox) error {
+	gmailService, err := p.service(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	if account.HistoryID == 0 {
+		return fullSync(ctx, gmailService, account, mailbox)
+	}
+
+	err = incrementalSync(ctx, gmailService, account, mailbox)
+	if isHistoryExpired(err) {
+		// The saved historyId is too old for history.list; start over
+		account.HistoryID = 0
+		return fullSync(ctx, gmailService, account, mailbox)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply Gmail history: %v", err)
+	}
+	return nil
+}
+
+// fullSync ingests every inbox message that is not stored yet and saves the
+// mailbox historyId as the cursor for subsequent incremental syncs
+func fullSync(ctx context.Context, gmailService *gmailapi.Service, account *models.Account, mailbox providers.Mailbox) error {
+	// Read the cursor before listing so changes made during the listing are
+	// replayed by the next incremental sync
+	profile, err := gmailService.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get Gmail profile: %v", err)
+	}
+
+	err = gmailService.Users.Messages.List("me").Q("in:inbox").Pages(ctx, func(page *gmailapi.ListMessagesResponse) error {
+		for _, msg := range page.Messages {
+			if err := ingestMessage(ctx, gmailService, mailbox, msg.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %v", err)
+	}
+
+	account.HistoryID = profile.HistoryId
+	if err := mailbox.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save sync cursor: %v", err)
+	}
+	return nil
+}
+
+// incrementalSync applies added messages, deleted messages and label
+// changes recorded since account.HistoryID
+func incrementalSync(ctx context.Context, gmailService *gmailapi.Service, account *models.Account, mailbox providers.Mailbox) error {
+	latest := account.HistoryID
+
+	call := gmailService.Users.History.List("me").
+		StartHistoryId(account.HistoryID).
+		HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved")
+	err := call.Pages(ctx, func(page *gmailapi.ListHistoryResponse) error {
+		for _, h := range page.History {
+			if err := applyHistory(ctx, gmailService, mailbox, h); err != nil {
+				return err
+			}
+		}
+		if page.HistoryId > latest {
+			latest = page.HistoryId
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if latest == account.HistoryID {
+		return nil
+	}
+	account.HistoryID = latest
+	if err := mailbox.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save sync cursor: %v", err)
+	}
+	return nil
+}
+
+// applyHistory applies a single history record to the mailbox
+func applyHistory(ctx context.Context, gmailService *gmailapi.Service, mailbox providers.Mailbox, h *gmailapi.History) error {
+	for _, added := range h.MessagesAdded {
+		if !hasLabel(added.Message.LabelIds, "INBOX") {
+			continue
+		}
+		if err := ingestMessage(ctx, gmailService, mailbox, added.Message.Id); err != nil {
+			return err
+		}
+	}
+
+	for _, deleted := range h.MessagesDeleted {
+		if err := mailbox.Remove(ctx, deleted.Message.Id); err != nil {
+			return fmt.Errorf("failed to delete message %s: %v", deleted.Message.Id, err)
+		}
+	}
+
+	for _, changed := range h.LabelsAdded {
+		if err := applyLabels(ctx, gmailService, mailbox, changed.Message); err != nil {
+			return err
+		}
+	}
+	for _, changed := range h.LabelsRemoved {
+		if err := applyLabels(ctx, gmailService, mailbox, changed.Message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyLabels copies the current labels of a message onto the stored email.
+// A message that gains the INBOX label and is not stored yet is ingested.
+func applyLabels(ctx context.Context, gmailService *gmailapi.Service, mailbox providers.Mailbox, msg *gmailapi.Message) error {
+	email, err := mailbox.Get(ctx, msg.Id)
+	if err != nil {
+		return err
+	}
+	if email == nil {
+		if hasLabel(msg.LabelIds, "INBOX") {
+			return ingestMessage(ctx, gmailService, mailbox, msg.Id)
+		}
+		return nil
+	}
+
+	setLabels(email, msg.LabelIds)
+	if err := mailbox.Update(ctx, email); err != nil {
+		return fmt.Errorf("failed to update labels for message %s: %v", msg.Id, err)
+	}
+	return nil
+}
+
+// ingestMessage fetches and stores a message unless it already exists
+func ingestMessage(ctx context.Context, gmailService *gmailapi.Service, mailbox providers.Mailbox, messageID string) error {
+	// Check if email already exists
+	if existing, err := mailbox.Get(ctx, messageID); err != nil || existing != nil {
+		return err
+	}
+
+	// Get full message
+	message, err := gmailService.Users.Messages.Get("me", messageID).Format("full").Context(ctx).Do()
+	if err != nil {
+		if isNotFound(err) {
+			return nil // Deleted before we got to it
+		}
+		return fmt.Errorf("failed to get message %s: %v", messageID, err)
+	}
+
+	return addMessage(ctx, gmailService, mailbox, message)
+}
+
+// addMessage converts a full Gmail message and stores it with its attachments
+func addMessage(ctx context.Context, gmailService *gmailapi.Service, mailbox providers.Mailbox, message *gmailapi.Message) error {
+	email, err := parseMessage(message)
+	if err != nil {
+		return fmt.Errorf("failed to parse message %s: %v", message.Id, err)
+	}
+
+	attachments, err := fetchAttachments(ctx, gmailService, message)
+	if err != nil {
+		return fmt.Errorf("failed to fetch attachments of message %s: %v", message.Id, err)
+	}
+
+	if err := mailbox.Add(ctx, email, attachments); err != nil {
+		return fmt.Errorf("failed to store message %s: %v", message.Id, err)
+	}
+	return nil
+}
+
+// FetchMessages syncs the given messages: new ones are stored, known ones
+// get their labels updated and deleted ones are removed
+func (p *Provider) FetchMessages(ctx context.Context, account *models.Account, messageIDs []string, mailbox providers.Mailbox) error {
+	gmailService, err := p.service(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range messageIDs {
+		message, err := gmailService.Users.Messages.Get("me", id).Format("full").Context(ctx).Do()
+		if isNotFound(err) {
+			if err := mailbox.Remove(ctx, id); err != nil {
+				return fmt.Errorf("failed to delete message %s: %v", id, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get message %s: %v", id, err)
+		}
+
+		existing, err := mailbox.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			if err := addMessage(ctx, gmailService, mailbox, message); err != nil {
+				return err
+			}
+			continue
+		}
+
+		setLabels(existing, message.LabelIds)
+		if err := mailbox.Update(ctx, existing); err != nil {
+			return fmt.Errorf("failed to update message %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// UpdateMessage changes the read and starred state of a message through its
+// UNREAD and STARRED labels
+func (p *Provider) UpdateMessage(ctx context.Context, account *models.Account, messageID string, update providers.MessageUpdate) error {
+	req := &gmailapi.ModifyMessageRequest{}
+	if update.Read != nil {
+		if *update.Read {
+			req.RemoveLabelIds = append(req.RemoveLabelIds, "UNREAD")
+		} else {
+			req.AddLabelIds = append(req.AddLabelIds, "UNREAD")
+		}
+	}
+	if update.Starred != nil {
+		if *update.Starred {
+			req.AddLabelIds = append(req.AddLabelIds, "STARRED")
+		} else {
+			req.RemoveLabelIds = append(req.RemoveLabelIds, "STARRED")
+		}
+	}
+	if len(req.AddLabelIds) == 0 && len(req.RemoveLabelIds) == 0 {
+		return nil
+	}
+
+	gmailService, err := p.service(ctx, account)
+	if err != nil {
+		return err
+	}
+	if _, err := gmailService.Users.Messages.Modify("me", messageID, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to modify message %s: %v", messageID, err)
+	}
+	return nil
+}
+
+// DeleteMessage moves a message to the trash
+func (p *Provider) DeleteMessage(ctx context.Context, account *models.Account, messageID string) error {
+	gmailService, err := p.service(ctx, account)
+	if err != nil {
+		return err
+	}
+	if _, err := gmailService.Users.Messages.Trash("me", messageID).Context(ctx).Do(); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to trash message %s: %v", messageID, err)
+	}
+	return nil
+}
+
+// Watch registers (or renews) Gmail push notifications for the account's
+// inbox on the given Pub/Sub topic and returns the registration's expiry
+func (p *Provider) Watch(ctx context.Context, account *models.Account, topic string) (time.Time, error) {
+	gmailService, err := p.service(ctx, account)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := gmailService.Users.Watch("me", &gmailapi.WatchRequest{
+		TopicName:         topic,
+		LabelIds:          []string{"INBOX"},
+		LabelFilterAction: "include",
+	}).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to watch Gmail inbox: %v", err)
+	}
+	return time.UnixMilli(resp.Expiration), nil
+}
@@ -0,0 +1,310 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// Sync syncs the account's mailbox. New messages are found through UIDNEXT,
+// and flag changes through CHANGEDSINCE when the server supports CONDSTORE.
+// A UIDVALIDITY change discards the local copy and starts over.
+func (p *Provider) Sync(ctx context.Context, account *models.Account, mailbox providers.Mailbox) error {
+	client, err := p.open(ctx, account)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	settings := account.IMAP
+	condStore := client.Caps().Has(imap.CapCondStore)
+
+	selected, err := client.Select(settings.Mailbox, &imap.SelectOptions{ReadOnly: true, CondStore: condStore}).Wait()
+	if err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", settings.Mailbox, err)
+	}
+
+	if selected.UIDValidity != settings.UIDValidity {
+		// UIDs from the previous validity period mean nothing anymore
+		if settings.UIDValidity != 0 {
+			if err := mailbox.Reset(ctx); err != nil {
+				return fmt.Errorf("failed to reset mailbox: %v", err)
+			}
+		}
+		settings.UIDValidity = selected.UIDValidity
+		settings.UIDNext = 1
+		settings.HighestModSeq = 0
+	}
+
+	if condStore && settings.HighestModSeq > 0 && settings.UIDNext > 1 {
+		if err := syncFlags(ctx, client, account, mailbox); err != nil {
+			return err
+		}
+	}
+
+	if uint32(selected.UIDNext) > settings.UIDNext {
+		var uids imap.UIDSet
+		uids.AddRange(imap.UID(settings.UIDNext), 0) // 0 means "*"
+		if err := fetchMessages(ctx, client, account, uids, imap.UID(settings.UIDNext), mailbox); err != nil {
+			return err
+		}
+	}
+
+	settings.UIDNext = uint32(selected.UIDNext)
+	if condStore {
+		settings.HighestModSeq = selected.HighestModSeq
+	}
+	if err := mailbox.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save sync state: %v", err)
+	}
+
+	client.Logout().Wait()
+	return nil
+}
+
+// fetchMessages stores the messages in uids, or updates the flags of the ones
+// already stored. Messages below minUID are skipped.
+func fetchMessages(ctx context.Context, client *imapclient.Client, account *models.Account, uids imap.UIDSet, minUID imap.UID, mailbox providers.Mailbox) error {
+	settings := account.IMAP
+
+	bodySection := &imap.FetchItemBodySection{Peek: true}
+	messages, err := client.Fetch(uids, &imap.FetchOptions{
+		UID:          true,
+		Flags:        true,
+		InternalDate: true,
+		BodySection:  []*imap.FetchItemBodySection{bodySection},
+	}).Collect()
+	if err != nil {
+		return fmt.Errorf("failed to fetch messages: %v", err)
+	}
+
+	for _, msg := range messages {
+		// "UID n:*" always returns the last message, even when it is older than n
+		if msg.UID < minUID {
+			continue
+		}
+
+		messageID := strconv.FormatUint(uint64(msg.UID), 10)
+		existing, err := mailbox.Get(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			setFlags(existing, msg.Flags)
+			if err := mailbox.Update(ctx, existing); err != nil {
+				return fmt.Errorf("failed to update message %s: %v", messageID, err)
+			}
+			continue
+		}
+
+		email, attachments, err := mailparse.ParseMessage(bytes.NewReader(msg.FindBodySection(bodySection)))
+		if err != nil {
+			return fmt.Errorf("failed to parse message %s: %v", messageID, err)
+		}
+
+		email.MessageID = messageID
+		email.Labels = []string{settings.Mailbox}
+		if email.ReceivedAt.IsZero() {
+			email.ReceivedAt = msg.InternalDate
+		}
+		setFlags(email, msg.Flags)
+
+		if err := mailbox.Add(ctx, email, attachments); err != nil {
+			return fmt.Errorf("failed to store message %s: %v", messageID, err)
+		}
+	}
+
+	return nil
+}
+
+// syncFlags updates read/starred state for known messages whose MODSEQ
+// moved past the saved HIGHESTMODSEQ
+func syncFlags(ctx context.Context, client *imapclient.Client, account *models.Account, mailbox providers.Mailbox) error {
+	settings := account.IMAP
+
+	var uids imap.UIDSet
+	uids.AddRange(1, imap.UID(settings.UIDNext-1))
+
+	messages, err := client.Fetch(uids, &imap.FetchOptions{
+		UID:          true,
+		Flags:        true,
+		ChangedSince: settings.HighestModSeq,
+	}).Collect()
+	if err != nil {
+		return fmt.Errorf("failed to fetch changed flags: %v", err)
+	}
+
+	for _, msg := range messages {
+		messageID := strconv.FormatUint(uint64(msg.UID), 10)
+		email, err := mailbox.Get(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		if email == nil {
+			continue
+		}
+
+		setFlags(email, msg.Flags)
+		if err := mailbox.Update(ctx, email); err != nil {
+			return fmt.Errorf("failed to update message %s: %v", messageID, err)
+		}
+	}
+
+	return nil
+}
+
+// setFlags sets the read/starred flags from IMAP system flags
+func setFlags(email *models.Email, flags []imap.Flag) {
+	email.Read = false
+	email.Starred = false
+	for _, flag := range flags {
+		switch flag {
+		case imap.FlagSeen:
+			email.Read = true
+		case imap.FlagFlagged:
+			email.Starred = true
+		}
+	}
+	email.UpdatedAt = time.Now()
+}
+
+// FetchMessages syncs individual messages by UID. Messages the server no
+// longer has are removed from the mailbox.
+func (p *Provider) FetchMessages(ctx context.Context, account *models.Account, messageIDs []string, mailbox providers.Mailbox) error {
+	uids, err := parseUIDs(messageIDs)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.open(ctx, account)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := client.Select(account.IMAP.Mailbox, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", account.IMAP.Mailbox, err)
+	}
+
+	if err := fetchMessages(ctx, client, account, imap.UIDSetNum(uids...), 0, mailbox); err != nil {
+		return err
+	}
+
+	// Anything the search does not find anymore was expunged
+	found, err := client.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{imap.UIDSetNum(uids...)}}, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("failed to search messages: %v", err)
+	}
+	present := make(map[imap.UID]bool)
+	for _, uid := range found.AllUIDs() {
+		present[uid] = true
+	}
+	for _, uid := range uids {
+		if present[uid] {
+			continue
+		}
+		if err := mailbox.Remove(ctx, strconv.FormatUint(uint64(uid), 10)); err != nil {
+			return fmt.Errorf("failed to delete message %d: %v", uid, err)
+		}
+	}
+
+	client.Logout().Wait()
+	return nil
+}
+
+// UpdateMessage sets or clears the \Seen and \Flagged flags of a message
+func (p *Provider) UpdateMessage(ctx context.Context, account *models.Account, messageID string, update providers.MessageUpdate) error {
+	var add, remove []imap.Flag
+	if update.Read != nil {
+		if *update.Read {
+			add = append(add, imap.FlagSeen)
+		} else {
+			remove = append(remove, imap.FlagSeen)
+		}
+	}
+	if update.Starred != nil {
+		if *update.Starred {
+			add = append(add, imap.FlagFlagged)
+		} else {
+			remove = append(remove, imap.FlagFlagged)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	return p.modify(ctx, account, messageID, func(client *imapclient.Client, uids imap.UIDSet) error {
+		if len(add) > 0 {
+			if err := client.Store(uids, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Silent: true, Flags: add}, nil).Close(); err != nil {
+				return err
+			}
+		}
+		if len(remove) > 0 {
+			if err := client.Store(uids, &imap.StoreFlags{Op: imap.StoreFlagsDel, Silent: true, Flags: remove}, nil).Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteMessage marks a message \Deleted and expunges it when the server
+// can expunge single messages (UIDPLUS)
+func (p *Provider) DeleteMessage(ctx context.Context, account *models.Account, messageID string) error {
+	return p.modify(ctx, account, messageID, func(client *imapclient.Client, uids imap.UIDSet) error {
+		flags := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Silent: true, Flags: []imap.Flag{imap.FlagDeleted}}
+		if err := client.Store(uids, flags, nil).Close(); err != nil {
+			return err
+		}
+		if client.Caps().Has(imap.CapUIDPlus) {
+			return client.UIDExpunge(uids).Close()
+		}
+		return nil
+	})
+}
+
+// modify selects the account's mailbox for writing and runs fn on a message
+func (p *Provider) modify(ctx context.Context, account *models.Account, messageID string, fn func(*imapclient.Client, imap.UIDSet) error) error {
+	uids, err := parseUIDs([]string{messageID})
+	if err != nil {
+		return err
+	}
+
+	client, err := p.open(ctx, account)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := client.Select(account.IMAP.Mailbox, nil).Wait(); err != nil {
+		return fmt.Errorf("failed to select mailbox %s: %v", account.IMAP.Mailbox, err)
+	}
+	if err := fn(client, imap.UIDSetNum(uids...)); err != nil {
+		return fmt.Errorf("failed to modify message %s: %v", messageID, err)
+	}
+
+	client.Logout().Wait()
+	return nil
+}
+
+// parseUIDs converts message IDs back to the UIDs they were made from
+func parseUIDs(messageIDs []string) ([]imap.UID, error) {
+	uids := make([]imap.UID, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		uid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil || uid == 0 {
+			return nil, fmt.Errorf("invalid IMAP message ID %q", id)
+		}
+		uids = append(uids, imap.UID(uid))
+	}
+	return uids, nil
+}
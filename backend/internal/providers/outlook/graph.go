@@ -0,0 +1,141 @@
+package outlook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// messageSelect lists the message properties requested from Graph
+const messageSelect = "id,subject,from,toRecipients,ccRecipients,bccRecipients,receivedDateTime,body,isRead,flag,categories,hasAttachments,internetMessageId,internetMessageHeaders,conversationId,parentFolderId"
+
+// recipient is a Graph recipient
+type recipient struct {
+	EmailAddress struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+// message is a Graph message as returned by messages/delta. Deleted or
+// moved messages only carry their ID and an @removed annotation.
+type message struct {
+	ID               string      `json:"id"`
+	Subject          string      `json:"subject"`
+	From             recipient   `json:"from"`
+	ToRecipients     []recipient `json:"toRecipients"`
+	CcRecipients     []recipient `json:"ccRecipients"`
+	BccRecipients    []recipient `json:"bccRecipients"`
+	ReceivedDateTime time.Time   `json:"receivedDateTime"`
+	Body             struct {
+		Content     string `json:"content"`
+		ContentType string `json:"contentType"`
+	} `json:"body"`
+	IsRead bool `json:"isRead"`
+	Flag   struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+	Categories        []string `json:"categories"`
+	HasAttachments    bool     `json:"hasAttachments"`
+	InternetMessageID string   `json:"internetMessageId"`
+	ConversationID    string   `json:"conversationId"`
+	InternetHeaders   []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"internetMessageHeaders"`
+	ParentFolderID string `json:"parentFolderId"`
+	Removed        *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed,omitempty"`
+}
+
+// folder is a Graph mail folder
+type folder struct {
+	ID               string `json:"id"`
+	DisplayName      string `json:"displayName"`
+	ChildFolderCount int    `json:"childFolderCount"`
+}
+
+// graphError is a non-2xx response from Microsoft Graph
+type graphError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("graph API returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// getJSON issues a GET against Microsoft Graph and decodes the JSON body into out
+func getJSON(ctx context.Context, client *http.Client, rawURL string, out interface{}) error {
+	return sendJSON(ctx, client, http.MethodGet, rawURL, nil, out)
+}
+
+// sendJSON sends a request with an optional JSON body to Microsoft Graph
+// and decodes the JSON response into out
+func sendJSON(ctx context.Context, client *http.Client, method, rawURL string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Prefer", "odata.maxpagesize=50")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return &graphError{StatusCode: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// isNotFound reports whether Graph answered 404 Not Found
+func isNotFound(err error) bool {
+	var gerr *graphError
+	return errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound
+}
+
+// isSyncStateExpired reports whether Graph rejected a delta token, which
+// it signals with 410 Gone or a SyncStateNotFound error
+func isSyncStateExpired(err error) bool {
+	var gerr *graphError
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	return gerr.StatusCode == http.StatusGone || gerr.Code == "SyncStateNotFound" || gerr.Code == "SyncStateInvalid"
+}
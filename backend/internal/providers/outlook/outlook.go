@@ -0,0 +1,171 @@
+// Package outlook implements the Outlook provider on top of the Microsoft
+// identity platform and Microsoft Graph
+package outlook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// ID is the canonical provider ID of Outlook accounts
+const ID = string(models.AccountTypeOutlook)
+
+// DefaultGraphURL is the Microsoft Graph endpoint used when Config leaves
+// GraphURL empty
+const DefaultGraphURL = "https://graph.microsoft.com/v1.0"
+
+// Config holds the Microsoft OAuth client settings and the endpoints to use
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Authority    string
+	GraphURL     string
+
+	// HTTPClient is used for every request to Microsoft, including the
+	// identity platform; nil means http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Provider is the Outlook provider
+type Provider struct {
+	config Config
+	oauth  *oauth2.Config
+}
+
+var (
+	_ providers.Provider   = (*Provider)(nil)
+	_ providers.Subscriber = (*Provider)(nil)
+)
+
+// New creates an Outlook provider
+func New(config Config) *Provider {
+	if config.GraphURL == "" {
+		config.GraphURL = DefaultGraphURL
+	}
+	config.GraphURL = strings.TrimSuffix(config.GraphURL, "/")
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	authority := strings.TrimSuffix(config.Authority, "/")
+	return &Provider{
+		config: config,
+		oauth: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       config.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   authority + "/oauth2/v2.0/authorize",
+				TokenURL:  authority + "/oauth2/v2.0/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+// ID returns the canonical provider ID
+func (p *Provider) ID() string {
+	return ID
+}
+
+// AuthCodeURL generates a Microsoft OAuth authorization URL
+func (p *Provider) AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error) {
+	return p.oauth.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("response_mode", "query"),
+		oauth2.S256ChallengeOption(codeVerifier)), nil
+}
+
+// Exchange processes the Microsoft OAuth callback
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (*models.OAuthTokens, error) {
+	token, err := p.oauth.Exchange(p.httpContext(ctx), code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire token: %w", err)
+	}
+	return toTokens(token), nil
+}
+
+// Refresh refreshes a Microsoft OAuth token. Microsoft rotates refresh
+// tokens, so the returned one replaces the old one.
+func (p *Provider) Refresh(ctx context.Context, refreshToken string) (*models.OAuthTokens, error) {
+	token, err := p.oauth.TokenSource(p.httpContext(ctx), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return nil, fmt.Errorf("%w: %s", providers.ErrInvalidGrant, retrieveErr.ErrorDescription)
+		}
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	return toTokens(token), nil
+}
+
+// toTokens converts an oauth2 token to our token model
+func toTokens(token *oauth2.Token) *models.OAuthTokens {
+	return &models.OAuthTokens{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresAt:    token.Expiry,
+		TokenType:    token.Type(),
+	}
+}
+
+// UserInfo retrieves user information from Microsoft Graph
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (*models.UserInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.config.GraphURL+"/me", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get user info with status: %d", resp.StatusCode)
+	}
+
+	var userInfo struct {
+		ID                string `json:"id"`
+		UserPrincipalName string `json:"userPrincipalName"`
+		DisplayName       string `json:"displayName"`
+		Mail              string `json:"mail"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode user info: %w", err)
+	}
+
+	return &models.UserInfo{
+		ID:      userInfo.ID,
+		Email:   userInfo.Mail,
+		Name:    userInfo.DisplayName,
+		Picture: "", // Microsoft Graph API doesn't provide profile picture by default
+	}, nil
+}
+
+// client returns an HTTP client authorized with the account's access token
+func (p *Provider) client(ctx context.Context, account *models.Account) *http.Client {
+	return oauth2.NewClient(p.httpContext(ctx), oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: account.AccessToken,
+		TokenType:   "Bearer",
+	}))
+}
+
+// httpContext makes the oauth2 package use the configured HTTP client
+func (p *Provider) httpContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, p.config.HTTPClient)
+}
@@ -0,0 +1,465 @@
+package outlooktest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// listFolders lists the top-level folders, or the child folders of the
+// folder in the path
+func (s *Server) listFolders(w http.ResponseWriter, r *http.Request) {
+	parentID := chi.URLParam(r, "id")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if parentID != "" && s.folder(parentID) == nil {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+
+	var items []interface{}
+	for _, f := range s.folders {
+		if f.parentID == parentID {
+			items = append(items, s.renderFolder(f))
+		}
+	}
+
+	skip, _ := strconv.Atoi(r.URL.Query().Get("$skip"))
+	s.writePage(w, r, items, skip, func(next int) string {
+		q := r.URL.Query()
+		q.Set("$skip", strconv.Itoa(next))
+		return s.URL + r.URL.Path + "?" + q.Encode()
+	}, "")
+}
+
+// getFolder returns a single folder
+func (s *Server) getFolder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.folder(chi.URLParam(r, "id"))
+	if f == nil {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.renderFolder(f))
+}
+
+// delta implements messages/delta on a folder. Delta and skip tokens are
+// change sequence numbers: a round returns every change after its token,
+// and its last page carries a deltaLink for the next round.
+func (s *Server) delta(w http.ResponseWriter, r *http.Request) {
+	folderID := chi.URLParam(r, "id")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.folder(folderID) == nil {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+
+	// A skip token is "<delta token>.<offset>" within the same round
+	var since uint64
+	var skip int
+	var err error
+	switch {
+	case query.Get("$skiptoken") != "":
+		token, offset, _ := strings.Cut(query.Get("$skiptoken"), ".")
+		since, err = strconv.ParseUint(token, 10, 64)
+		if err == nil {
+			skip, err = strconv.Atoi(offset)
+		}
+	case query.Get("$deltatoken") != "":
+		since, err = strconv.ParseUint(query.Get("$deltatoken"), 10, 64)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+	if since > 0 && since < s.oldestDelta {
+		writeError(w, http.StatusGone, "SyncStateNotFound")
+		return
+	}
+
+	type change struct {
+		seq  uint64
+		item interface{}
+	}
+	var changes []change
+	for _, msg := range s.messages {
+		if msg.FolderID == folderID && msg.seq > since {
+			changes = append(changes, change{msg.seq, s.renderMessage(msg)})
+		}
+	}
+	if since > 0 {
+		for _, t := range s.tombstones {
+			if t.folderID == folderID && t.seq > since {
+				changes = append(changes, change{t.seq, map[string]interface{}{
+					"id":       t.id,
+					"@removed": map[string]string{"reason": "deleted"},
+				}})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].seq < changes[j].seq })
+
+	items := make([]interface{}, len(changes))
+	for n, c := range changes {
+		items[n] = c.item
+	}
+
+	base := fmt.Sprintf("%s/v1.0/me/mailFolders/%s/messages/delta", s.URL, url.PathEscape(folderID))
+	s.writePage(w, r, items, skip, func(next int) string {
+		return base + "?$skiptoken=" + fmt.Sprintf("%d.%d", since, next)
+	}, base+"?$deltatoken="+strconv.FormatUint(s.seq, 10))
+}
+
+// getMessage returns a single message
+func (s *Server) getMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.renderMessage(msg))
+}
+
+// updateMessage implements PATCH on isRead, flag and categories
+func (s *Server) updateMessage(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		IsRead *bool `json:"isRead"`
+		Flag   *struct {
+			FlagStatus string `json:"flagStatus"`
+		} `json:"flag"`
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+	if patch.IsRead != nil {
+		msg.IsRead = *patch.IsRead
+	}
+	if patch.Flag != nil {
+		msg.Flagged = patch.Flag.FlagStatus == "flagged"
+	}
+	if patch.Categories != nil {
+		msg.Categories = patch.Categories
+	}
+	s.seq++
+	msg.seq = s.seq
+
+	writeJSON(w, http.StatusOK, s.renderMessage(msg))
+}
+
+// deleteMessage moves a message to Deleted Items, or deletes it for good
+// when it already is there
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+	if msg.FolderID == "deleteditems" {
+		s.remove(msg)
+	} else {
+		s.move(msg.ID, "deleteditems")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listAttachments returns the file attachments of a message with their
+// content
+func (s *Server) listAttachments(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ErrorItemNotFound")
+		return
+	}
+
+	items := []interface{}{}
+	for n, a := range msg.Attachments {
+		contentID := ""
+		if a.ContentID != "" {
+			contentID = "<" + a.ContentID + ">"
+		}
+		items = append(items, map[string]interface{}{
+			"@odata.type":  "#microsoft.graph.fileAttachment",
+			"id":           fmt.Sprintf("%s-att%d", msg.ID, n),
+			"name":         a.Name,
+			"contentType":  a.ContentType,
+			"contentId":    contentID,
+			"isInline":     a.Inline,
+			"size":         len(a.Data),
+			"contentBytes": base64.StdEncoding.EncodeToString(a.Data),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": items})
+}
+
+// createSubscription creates a subscription after the validation handshake
+// Graph performs against the notification URL
+func (s *Server) createSubscription(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChangeType         string    `json:"changeType"`
+		Resource           string    `json:"resource"`
+		NotificationURL    string    `json:"notificationUrl"`
+		ExpirationDateTime time.Time `json:"expirationDateTime"`
+		ClientState        string    `json:"clientState"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NotificationURL == "" || req.Resource == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	if err := validateNotificationURL(r, req.NotificationURL); err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationError")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := &Subscription{
+		ID:              s.newID("sub-"),
+		NotificationURL: req.NotificationURL,
+		ClientState:     req.ClientState,
+		ExpiresAt:       req.ExpirationDateTime.UTC(),
+	}
+	s.subscriptions[sub.ID] = sub
+	writeJSON(w, http.StatusCreated, renderSubscription(sub))
+}
+
+// renewSubscription moves the expiry of a subscription
+func (s *Server) renewSubscription(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ExpirationDateTime time.Time `json:"expirationDateTime"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[chi.URLParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound")
+		return
+	}
+	sub.ExpiresAt = req.ExpirationDateTime.UTC()
+	writeJSON(w, http.StatusOK, renderSubscription(sub))
+}
+
+// deleteSubscription removes a subscription
+func (s *Server) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := chi.URLParam(r, "id")
+	if _, ok := s.subscriptions[id]; !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound")
+		return
+	}
+	delete(s.subscriptions, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateNotificationURL posts a validationToken to the notification URL
+// and checks that it is echoed back as text/plain within 10 seconds
+func validateNotificationURL(r *http.Request, notificationURL string) error {
+	const token = "outlooktest-validation-token"
+
+	target, err := url.Parse(notificationURL)
+	if err != nil {
+		return err
+	}
+	q := target.Query()
+	q.Set("validationToken", token)
+	target.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte(token)) {
+		return fmt.Errorf("notification URL answered %d %q", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// writePage writes the page of items starting at skip. nextLink builds
+// the link to the following page; deltaLink, if any, ends the last page.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []interface{}, skip int, nextLink func(int) string, deltaLink string) {
+	size := s.PageSize
+	if top, err := strconv.Atoi(r.URL.Query().Get("$top")); err == nil && top > 0 && top < size {
+		size = top
+	}
+	if skip < 0 || skip > len(items) {
+		skip = len(items)
+	}
+
+	end := skip + size
+	resp := map[string]interface{}{}
+	if end < len(items) {
+		resp["@odata.nextLink"] = nextLink(end)
+	} else {
+		end = len(items)
+		if deltaLink != "" {
+			resp["@odata.deltaLink"] = deltaLink
+		}
+	}
+
+	page := items[skip:end]
+	if page == nil {
+		page = []interface{}{}
+	}
+	resp["value"] = page
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// folder returns the folder with the given ID, or nil
+func (s *Server) folder(id string) *folder {
+	for _, f := range s.folders {
+		if f.id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// renderFolder renders a folder as Graph returns it
+func (s *Server) renderFolder(f *folder) map[string]interface{} {
+	var children, total, unread int
+	for _, other := range s.folders {
+		if other.parentID == f.id {
+			children++
+		}
+	}
+	for _, msg := range s.messages {
+		if msg.FolderID == f.id {
+			total++
+			if !msg.IsRead {
+				unread++
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"id":               f.id,
+		"displayName":      f.name,
+		"parentFolderId":   f.parentID,
+		"childFolderCount": children,
+		"totalItemCount":   total,
+		"unreadItemCount":  unread,
+	}
+}
+
+// renderMessage renders a message with the properties the provider selects
+func (s *Server) renderMessage(msg *stored) map[string]interface{} {
+	contentType := "text"
+	if msg.HTML {
+		contentType = "html"
+	}
+	flagStatus := "notFlagged"
+	if msg.Flagged {
+		flagStatus = "flagged"
+	}
+	categories := msg.Categories
+	if categories == nil {
+		categories = []string{}
+	}
+	internetID := fmt.Sprintf("<%s@outlooktest>", msg.ID)
+	conversation := msg.ThreadID
+	if conversation == "" {
+		conversation = msg.ID
+	}
+
+	return map[string]interface{}{
+		"id":                msg.ID,
+		"subject":           msg.Subject,
+		"from":              renderRecipient(msg.From),
+		"toRecipients":      renderRecipients(msg.To),
+		"ccRecipients":      renderRecipients(msg.Cc),
+		"bccRecipients":     []interface{}{},
+		"receivedDateTime":  msg.Received.UTC().Format(time.RFC3339),
+		"body":              map[string]string{"contentType": contentType, "content": msg.Body},
+		"isRead":            msg.IsRead,
+		"flag":              map[string]string{"flagStatus": flagStatus},
+		"categories":        categories,
+		"hasAttachments":    len(msg.Attachments) > 0,
+		"internetMessageId": internetID,
+		"conversationId":    conversation,
+		"internetMessageHeaders": []map[string]string{
+			{"name": "Message-ID", "value": internetID},
+			{"name": "Subject", "value": msg.Subject},
+		},
+		"parentFolderId": msg.FolderID,
+	}
+}
+
+// renderSubscription renders a subscription as Graph returns it
+func renderSubscription(sub *Subscription) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                 sub.ID,
+		"notificationUrl":    sub.NotificationURL,
+		"expirationDateTime": sub.ExpiresAt.Format(time.RFC3339),
+	}
+}
+
+func renderRecipient(r Recipient) map[string]interface{} {
+	return map[string]interface{}{
+		"emailAddress": map[string]string{"name": r.Name, "address": r.Address},
+	}
+}
+
+func renderRecipients(recipients []Recipient) []interface{} {
+	items := []interface{}{}
+	for _, r := range recipients {
+		items = append(items, renderRecipient(r))
+	}
+	return items
+}
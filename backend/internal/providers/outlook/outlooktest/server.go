@@ -0,0 +1,513 @@
+// Package outlooktest runs an in-process fake of the Microsoft identity
+// platform and the parts of Microsoft Graph the outlook provider uses: mail
+// folders, message delta queries, attachments and change-notification
+// subscriptions. Errors can be injected into any endpoint.
+package outlooktest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"email-harvester/internal/providers/outlook"
+	"email-harvester/internal/providers/providertest"
+)
+
+// Message is a message in the fake mailbox
+type Message struct {
+	ID          string
+	FolderID    string
+	ThreadID    string // Rendered as the conversationId, defaults to ID
+	Subject     string
+	From        Recipient
+	To          []Recipient
+	Cc          []Recipient
+	Received    time.Time
+	Body        string
+	HTML        bool // Body is HTML rather than text
+	IsRead      bool
+	Flagged     bool
+	Categories  []string
+	Attachments []Attachment
+}
+
+// Recipient is a mail address with an optional display name
+type Recipient struct {
+	Name    string
+	Address string
+}
+
+// Attachment is a file attached to a Message
+type Attachment struct {
+	Name        string
+	ContentType string
+	ContentID   string
+	Inline      bool
+	Data        []byte
+}
+
+// User is the Microsoft account that owns the fake mailbox
+type User struct {
+	ID   string
+	Mail string
+	Name string
+}
+
+// Subscription is a change-notification subscription created through Graph
+type Subscription struct {
+	ID              string
+	NotificationURL string
+	ClientState     string
+	ExpiresAt       time.Time
+}
+
+// folder is a mail folder of the fake mailbox
+type folder struct {
+	id       string
+	name     string
+	parentID string
+}
+
+// tombstone remembers that a message left a folder, for delta queries
+type tombstone struct {
+	id       string
+	folderID string
+	seq      uint64
+}
+
+// stored is a message plus the change sequence number delta queries use
+type stored struct {
+	Message
+	seq uint64
+}
+
+// Server is a fake Microsoft identity platform and Graph server
+type Server struct {
+	*httptest.Server
+	*providertest.Injector
+
+	// User is returned by /me and in ID tokens
+	User User
+	// PageSize is the most items a folder list or delta page holds
+	PageSize int
+
+	mu            sync.Mutex
+	seq           uint64
+	oldestDelta   uint64 // delta tokens below this answer 410 Gone
+	folders       []*folder
+	messages      map[string]*stored
+	tombstones    []tombstone
+	subscriptions map[string]*Subscription
+	codes         map[string]string // Authorization code to its PKCE challenge
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+	nextID        int
+}
+
+// NewServer starts a fake server whose mailbox has an empty Inbox, Archive
+// and Deleted Items folder. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Injector: providertest.NewInjector(writeError),
+		User: User{
+			ID:   "00000000-0000-0000-0000-000000000001",
+			Mail: "user@outlook.test",
+			Name: "Test User",
+		},
+		PageSize: 100,
+		seq:      1, // Delta tokens start at 1; 0 means no token
+		folders: []*folder{
+			{id: "inbox", name: "Inbox"},
+			{id: "archive", name: "Archive"},
+			{id: "deleteditems", name: "Deleted Items"},
+		},
+		messages:      make(map[string]*stored),
+		subscriptions: make(map[string]*Subscription),
+		codes:         make(map[string]string),
+		accessTokens:  make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+	}
+
+	r := chi.NewRouter()
+	r.Use(s.Injector.Middleware)
+	r.Route("/{tenant}/oauth2/v2.0", func(r chi.Router) {
+		r.Get("/authorize", s.authorize)
+		r.Post("/token", s.token)
+	})
+	r.Route("/v1.0", func(r chi.Router) {
+		r.Use(s.authenticate)
+		r.Get("/me", s.getMe)
+		r.Get("/me/mailFolders", s.listFolders)
+		r.Get("/me/mailFolders/{id}", s.getFolder)
+		r.Get("/me/mailFolders/{id}/childFolders", s.listFolders)
+		r.Get("/me/mailFolders/{id}/messages/delta", s.delta)
+		r.Get("/me/messages/{id}", s.getMessage)
+		r.Patch("/me/messages/{id}", s.updateMessage)
+		r.Delete("/me/messages/{id}", s.deleteMessage)
+		r.Get("/me/messages/{id}/attachments", s.listAttachments)
+		r.Post("/subscriptions", s.createSubscription)
+		r.Patch("/subscriptions/{id}", s.renewSubscription)
+		r.Delete("/subscriptions/{id}", s.deleteSubscription)
+	})
+
+	s.Server = httptest.NewServer(r)
+	return s
+}
+
+// ProviderConfig returns a provider config that talks to the fake server
+func (s *Server) ProviderConfig() outlook.Config {
+	return outlook.Config{
+		ClientID:     "outlooktest-client",
+		ClientSecret: "outlooktest-secret",
+		RedirectURL:  "http://localhost/oauth/callback/microsoft",
+		Scopes:       []string{"https://graph.microsoft.com/Mail.ReadWrite"},
+		Authority:    s.URL + "/common",
+		GraphURL:     s.URL + "/v1.0",
+		HTTPClient:   s.Client(),
+	}
+}
+
+// AddAuthCode registers an authorization code the token endpoint accepts once,
+// issued without a PKCE challenge
+func (s *Server) AddAuthCode(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = ""
+}
+
+// NewTokens issues an access and refresh token pair, as if the user had
+// completed the consent screen
+func (s *Server) NewTokens() (accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueAccessToken(), s.issueRefreshToken()
+}
+
+// RevokeTokens invalidates every issued token, so Graph answers 401 and
+// refreshes fail with invalid_grant
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTokens = make(map[string]bool)
+	s.refreshTokens = make(map[string]bool)
+}
+
+// AddFolder creates a mail folder, nested under parentID unless it is
+// empty, and returns its ID
+func (s *Server) AddFolder(name, parentID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := &folder{id: s.newID("folder"), name: name, parentID: parentID}
+	s.folders = append(s.folders, f)
+	return f.id
+}
+
+// AddMessage delivers a message and returns its ID. Missing IDs are
+// generated, and messages without a folder land in the Inbox.
+func (s *Server) AddMessage(msg Message) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.ID == "" {
+		msg.ID = s.newID("AAMk")
+	}
+	if msg.FolderID == "" {
+		msg.FolderID = "inbox"
+	}
+	if msg.Received.IsZero() {
+		msg.Received = time.Now().UTC().Truncate(time.Second)
+	}
+
+	s.seq++
+	s.messages[msg.ID] = &stored{Message: msg, seq: s.seq}
+	return msg.ID
+}
+
+// UpdateMessage changes a message in place, as a user would in another
+// client
+func (s *Server) UpdateMessage(id string, update func(*Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg, ok := s.messages[id]; ok {
+		update(&msg.Message)
+		msg.ID = id
+		s.seq++
+		msg.seq = s.seq
+	}
+}
+
+// MoveMessage moves a message to another folder. Like Graph, the moved
+// message gets a new ID, which is returned.
+func (s *Server) MoveMessage(id, folderID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.move(id, folderID)
+}
+
+// DeleteMessage permanently deletes a message
+func (s *Server) DeleteMessage(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg, ok := s.messages[id]; ok {
+		s.remove(msg)
+	}
+}
+
+// Message returns the current state of a message in the mailbox
+func (s *Server) Message(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return msg.Message, true
+}
+
+// ExpireDeltaTokens invalidates every delta token handed out so far, so
+// the next delta query of each folder answers 410 Gone
+func (s *Server) ExpireDeltaTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.oldestDelta = s.seq
+	s.tombstones = nil
+}
+
+// Subscriptions returns the active change-notification subscriptions
+func (s *Server) Subscriptions() []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subs []Subscription
+	for _, sub := range s.subscriptions {
+		subs = append(subs, *sub)
+	}
+	return subs
+}
+
+// Notify sends a change notification for a message to every subscription,
+// the way Graph posts them to the notification URL
+func (s *Server) Notify(ctx context.Context, changeType, messageID string) error {
+	return s.notify(ctx, func(sub *Subscription) map[string]interface{} {
+		return map[string]interface{}{
+			"subscriptionId": sub.ID,
+			"clientState":    sub.ClientState,
+			"changeType":     changeType,
+			"resource":       fmt.Sprintf("Users/%s/Messages/%s", s.User.ID, messageID),
+			"resourceData":   map[string]string{"id": messageID},
+		}
+	})
+}
+
+// NotifyLifecycle sends a lifecycle notification, such as "missed" or
+// "subscriptionRemoved", to every subscription
+func (s *Server) NotifyLifecycle(ctx context.Context, event string) error {
+	return s.notify(ctx, func(sub *Subscription) map[string]interface{} {
+		return map[string]interface{}{
+			"subscriptionId": sub.ID,
+			"clientState":    sub.ClientState,
+			"lifecycleEvent": event,
+		}
+	})
+}
+
+// notify posts a notification built by build to every subscription
+func (s *Server) notify(ctx context.Context, build func(*Subscription) map[string]interface{}) error {
+	for _, sub := range s.Subscriptions() {
+		body, err := json.Marshal(map[string]interface{}{
+			"value": []interface{}{build(&sub)},
+		})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.NotificationURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to notify subscription %s: %v", sub.ID, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("notification URL of subscription %s answered %d", sub.ID, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// move moves a message to another folder under a new ID
+func (s *Server) move(id, folderID string) string {
+	msg, ok := s.messages[id]
+	if !ok {
+		return ""
+	}
+	s.remove(msg)
+
+	moved := msg.Message
+	moved.ID = s.newID("AAMk")
+	moved.FolderID = folderID
+	s.seq++
+	s.messages[moved.ID] = &stored{Message: moved, seq: s.seq}
+	return moved.ID
+}
+
+// remove deletes a message and leaves a tombstone in its folder
+func (s *Server) remove(msg *stored) {
+	delete(s.messages, msg.ID)
+	s.seq++
+	s.tombstones = append(s.tombstones, tombstone{id: msg.ID, folderID: msg.FolderID, seq: s.seq})
+}
+
+// newID returns a new unique ID with the given prefix
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%012x", prefix, s.nextID)
+}
+
+func (s *Server) issueAccessToken() string {
+	token := s.newID("eyJ0eXAi.")
+	s.accessTokens[token] = true
+	return token
+}
+
+func (s *Server) issueRefreshToken() string {
+	token := s.newID("M.R3_BAY.")
+	s.refreshTokens[token] = true
+	return token
+}
+
+// authenticate rejects requests without a valid bearer token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.mu.Lock()
+		ok := s.accessTokens[token]
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "InvalidAuthenticationToken")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize stands in for the consent screen: it approves right away and
+// redirects back with a fresh authorization code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	redirectURI, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		writeTokenError(w, "invalid_request")
+		return
+	}
+	challenge, ok := providertest.PKCEChallenge(r.URL.Query())
+	if !ok {
+		writeTokenError(w, "invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	code := s.newID("M.C5_BAY.")
+	s.codes[code] = challenge
+	s.mu.Unlock()
+
+	q := redirectURI.Query()
+	q.Set("code", code)
+	q.Set("state", r.URL.Query().Get("state"))
+	redirectURI.RawQuery = q.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token implements the authorization_code and refresh_token grants
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, "invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		challenge, ok := s.codes[code]
+		if !ok || !providertest.VerifyPKCE(challenge, r.PostForm.Get("code_verifier")) {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+		delete(s.codes, code)
+	case "refresh_token":
+		refreshToken := r.PostForm.Get("refresh_token")
+		if !s.refreshTokens[refreshToken] {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+		// Microsoft rotates refresh tokens
+		delete(s.refreshTokens, refreshToken)
+	default:
+		writeTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":   s.issueAccessToken(),
+		"refresh_token":  s.issueRefreshToken(),
+		"expires_in":     3599,
+		"ext_expires_in": 3599,
+		"token_type":     "Bearer",
+		"scope":          r.PostForm.Get("scope"),
+	})
+}
+
+func (s *Server) getMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":                s.User.ID,
+		"displayName":       s.User.Name,
+		"mail":              s.User.Mail,
+		"userPrincipalName": s.User.Mail,
+	})
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the Graph format
+func writeError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]string{
+			"code":    code,
+			"message": http.StatusText(status),
+		},
+	})
+}
+
+// writeTokenError writes an OAuth token endpoint error
+func writeTokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": "AADSTS70000: " + code,
+	})
+}
@@ -0,0 +1,83 @@
+package outlook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"email-harvester/internal/models"
+)
+
+// subscriptionLifetime is how long Graph message subscriptions are requested
+// for; Graph caps them at a little under seven days
+const subscriptionLifetime = 72 * time.Hour
+
+// Subscribe creates (or renews) a Graph change-notification subscription for
+// the account's messages. Graph delivers the notifications to
+// notificationURL/{accountID}.
+func (p *Provider) Subscribe(ctx context.Context, account *models.Account, notificationURL string) (*models.GraphSubscription, error) {
+	client := p.client(ctx, account)
+	expiry := time.Now().Add(subscriptionLifetime).UTC()
+
+	if current := account.GraphSubscription; current != nil {
+		var resp struct {
+			ExpirationDateTime time.Time `json:"expirationDateTime"`
+		}
+		err := sendJSON(ctx, client, http.MethodPatch, p.config.GraphURL+"/subscriptions/"+url.PathEscape(current.ID),
+			map[string]interface{}{"expirationDateTime": expiry}, &resp)
+		if err == nil {
+			return &models.GraphSubscription{
+				ID:          current.ID,
+				ClientState: current.ClientState,
+				ExpiresAt:   resp.ExpirationDateTime,
+			}, nil
+		}
+		if !isNotFound(err) {
+			return nil, fmt.Errorf("failed to renew subscription: %v", err)
+		}
+		// Graph already dropped the subscription; create a new one
+	}
+
+	clientState, err := newClientState()
+	if err != nil {
+		return nil, err
+	}
+	target := strings.TrimSuffix(notificationURL, "/") + "/" + account.ID.Hex()
+
+	var resp struct {
+		ID                 string    `json:"id"`
+		ExpirationDateTime time.Time `json:"expirationDateTime"`
+	}
+	err = sendJSON(ctx, client, http.MethodPost, p.config.GraphURL+"/subscriptions", map[string]interface{}{
+		"changeType":               "created,updated,deleted",
+		"resource":                 "me/messages",
+		"notificationUrl":          target,
+		"lifecycleNotificationUrl": target,
+		"expirationDateTime":       expiry,
+		"clientState":              clientState,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subscription: %v", err)
+	}
+
+	return &models.GraphSubscription{
+		ID:          resp.ID,
+		ClientState: clientState,
+		ExpiresAt:   resp.ExpirationDateTime,
+	}, nil
+}
+
+// newClientState returns a random secret Graph echoes back in every
+// notification of a subscription
+func newClientState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate client state: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
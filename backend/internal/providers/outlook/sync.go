@@ -0,0 +1,331 @@
+package outlook
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// Sync syncs every mail folder of an Outlook mailbox using Graph delta
+// queries. The deltaLink of each folder is saved on the account so the next
+// sync only receives creates, updates and removals.
+func (p *Provider) Sync(ctx context.Context, account *models.Account, mailbox providers.Mailbox) error {
+	client := p.client(ctx, account)
+
+	folders, err := p.listFolders(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to list mail folders: %v", err)
+	}
+
+	deltaLinks := make(map[string]string, len(folders))
+	for _, f := range folders {
+		deltaLinks[f.ID] = account.DeltaLinks[f.ID]
+	}
+	// Folders that no longer exist are dropped here
+	account.DeltaLinks = deltaLinks
+
+	for _, f := range folders {
+		deltaLink, err := p.syncFolder(ctx, client, mailbox, f, account.DeltaLinks[f.ID])
+		if err != nil {
+			return fmt.Errorf("failed to sync folder %s: %v", f.DisplayName, err)
+		}
+
+		// Persist after each folder so an interrupted sync keeps its progress
+		account.DeltaLinks[f.ID] = deltaLink
+		if err := mailbox.SaveAccount(ctx, account); err != nil {
+			return fmt.Errorf("failed to save sync cursor: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// syncFolder follows a folder's delta query to the end and returns the
+// new deltaLink. An empty deltaLink starts a full sync of the folder.
+func (p *Provider) syncFolder(ctx context.Context, client *http.Client, mailbox providers.Mailbox, f folder, deltaLink string) (string, error) {
+	initial := fmt.Sprintf("%s/me/mailFolders/%s/messages/delta?$select=%s", p.config.GraphURL, url.PathEscape(f.ID), messageSelect)
+
+	next := deltaLink
+	if next == "" {
+		next = initial
+	}
+
+	for {
+		var page struct {
+			Value     []message `json:"value"`
+			NextLink  string    `json:"@odata.nextLink"`
+			DeltaLink string    `json:"@odata.deltaLink"`
+		}
+		err := getJSON(ctx, client, next, &page)
+		if isSyncStateExpired(err) && next != initial {
+			// The delta token is no longer valid; resync the folder from scratch
+			next = initial
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		for _, msg := range page.Value {
+			if err := p.applyMessage(ctx, client, mailbox, f, msg); err != nil {
+				return "", err
+			}
+		}
+
+		if page.NextLink != "" {
+			next = page.NextLink
+			continue
+		}
+		return page.DeltaLink, nil
+	}
+}
+
+// applyMessage applies a single delta item to the mailbox
+func (p *Provider) applyMessage(ctx context.Context, client *http.Client, mailbox providers.Mailbox, f folder, msg message) error {
+	if msg.Removed != nil {
+		if err := mailbox.Remove(ctx, msg.ID); err != nil {
+			return fmt.Errorf("failed to delete message %s: %v", msg.ID, err)
+		}
+		return nil
+	}
+
+	existing, err := mailbox.Get(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		setFlags(existing, f, msg)
+		if err := mailbox.Update(ctx, existing); err != nil {
+			return fmt.Errorf("failed to update message %s: %v", msg.ID, err)
+		}
+		return nil
+	}
+
+	// Convert to our email model. Graph has already parsed the addresses;
+	// the raw headers are only needed for threading.
+	headers := make(mailparse.HeaderMap)
+	for _, header := range msg.InternetHeaders {
+		headers.Add(header.Name, header.Value)
+	}
+	parsed := mailparse.ParseHeaders(headers, msg.ReceivedDateTime)
+	parsed.Subject = msg.Subject
+	parsed.From = toAddress(msg.From)
+	parsed.To = toAddresses(msg.ToRecipients)
+	parsed.Cc = toAddresses(msg.CcRecipients)
+	parsed.Bcc = toAddresses(msg.BccRecipients)
+	parsed.Date = msg.ReceivedDateTime
+	if ids := mailparse.ParseMessageIDs(msg.InternetMessageID); len(ids) > 0 {
+		parsed.MessageID = ids[0]
+	}
+
+	email := &models.Email{
+		MessageID: msg.ID,
+		ThreadID:  msg.ConversationID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	parsed.Apply(email)
+
+	// Set body based on content type
+	if msg.Body.ContentType == "html" {
+		email.HTMLBody = msg.Body.Content
+	} else {
+		email.Body = msg.Body.Content
+	}
+	setFlags(email, f, msg)
+
+	var attachments []mailparse.Attachment
+	if msg.HasAttachments {
+		attachments, err = p.fetchAttachments(ctx, client, msg.ID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch attachments of message %s: %v", msg.ID, err)
+		}
+	}
+
+	if err := mailbox.Add(ctx, email, attachments); err != nil {
+		return fmt.Errorf("failed to store message %s: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// toAddress converts a Graph recipient to our address model
+func toAddress(r recipient) models.EmailAddress {
+	return models.EmailAddress{
+		Name:    strings.TrimSpace(r.EmailAddress.Name),
+		Address: strings.ToLower(strings.TrimSpace(r.EmailAddress.Address)),
+	}
+}
+
+// toAddresses converts a list of Graph recipients, dropping empty ones
+func toAddresses(recipients []recipient) []models.EmailAddress {
+	var addresses []models.EmailAddress
+	for _, r := range recipients {
+		if addr := toAddress(r); addr.Address != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// setFlags copies the mutable message state reported by delta queries
+func setFlags(email *models.Email, f folder, msg message) {
+	email.Read = msg.IsRead
+	email.Starred = msg.Flag.FlagStatus == "flagged"
+	email.Labels = append([]string{f.DisplayName}, msg.Categories...)
+}
+
+// fetchAttachments downloads the file attachments of a message. Item and
+// reference attachments (attached emails, cloud links) carry no file content
+// and are skipped.
+func (p *Provider) fetchAttachments(ctx context.Context, client *http.Client, messageID string) ([]mailparse.Attachment, error) {
+	var attachments []mailparse.Attachment
+	next := fmt.Sprintf("%s/me/messages/%s/attachments", p.config.GraphURL, url.PathEscape(messageID))
+
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ODataType    string `json:"@odata.type"`
+				Name         string `json:"name"`
+				ContentType  string `json:"contentType"`
+				ContentID    string `json:"contentId"`
+				IsInline     bool   `json:"isInline"`
+				ContentBytes string `json:"contentBytes"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := getJSON(ctx, client, next, &page); err != nil {
+			return nil, err
+		}
+
+		for _, a := range page.Value {
+			if a.ODataType != "#microsoft.graph.fileAttachment" {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(a.ContentBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode attachment %s: %v", a.Name, err)
+			}
+			attachments = append(attachments, mailparse.Attachment{
+				Filename:    a.Name,
+				ContentType: a.ContentType,
+				ContentID:   strings.Trim(a.ContentID, "<>"),
+				Inline:      a.IsInline,
+				Data:        data,
+			})
+		}
+		next = page.NextLink
+	}
+
+	return attachments, nil
+}
+
+// listFolders returns every mail folder of the mailbox, including nested ones
+func (p *Provider) listFolders(ctx context.Context, client *http.Client) ([]folder, error) {
+	var folders []folder
+	pending := []string{p.config.GraphURL + "/me/mailFolders?$top=100"}
+
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+
+		for next != "" {
+			var page struct {
+				Value    []folder `json:"value"`
+				NextLink string   `json:"@odata.nextLink"`
+			}
+			if err := getJSON(ctx, client, next, &page); err != nil {
+				return nil, err
+			}
+
+			for _, f := range page.Value {
+				folders = append(folders, f)
+				if f.ChildFolderCount > 0 {
+					pending = append(pending, fmt.Sprintf("%s/me/mailFolders/%s/childFolders?$top=100", p.config.GraphURL, url.PathEscape(f.ID)))
+				}
+			}
+			next = page.NextLink
+		}
+	}
+
+	return folders, nil
+}
+
+// FetchMessages fetches the given messages and applies them to the mailbox,
+// removing the ones Graph no longer has. It is used for change
+// notifications, which only name the messages that changed.
+func (p *Provider) FetchMessages(ctx context.Context, account *models.Account, messageIDs []string, mailbox providers.Mailbox) error {
+	client := p.client(ctx, account)
+
+	folders := make(map[string]folder)
+	for _, id := range messageIDs {
+		var msg message
+		err := getJSON(ctx, client, fmt.Sprintf("%s/me/messages/%s?$select=%s", p.config.GraphURL, url.PathEscape(id), messageSelect), &msg)
+		if isNotFound(err) {
+			// Deleted, or moved to another folder under a new ID
+			if err := mailbox.Remove(ctx, id); err != nil {
+				return fmt.Errorf("failed to delete message %s: %v", id, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get message %s: %v", id, err)
+		}
+
+		f, ok := folders[msg.ParentFolderID]
+		if !ok {
+			if err := getJSON(ctx, client, fmt.Sprintf("%s/me/mailFolders/%s", p.config.GraphURL, url.PathEscape(msg.ParentFolderID)), &f); err != nil {
+				return fmt.Errorf("failed to get folder of message %s: %v", id, err)
+			}
+			folders[msg.ParentFolderID] = f
+		}
+
+		if err := p.applyMessage(ctx, client, mailbox, f, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateMessage changes the read and flagged state of a message
+func (p *Provider) UpdateMessage(ctx context.Context, account *models.Account, messageID string, update providers.MessageUpdate) error {
+	patch := make(map[string]interface{})
+	if update.Read != nil {
+		patch["isRead"] = *update.Read
+	}
+	if update.Starred != nil {
+		status := "notFlagged"
+		if *update.Starred {
+			status = "flagged"
+		}
+		patch["flag"] = map[string]string{"flagStatus": status}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+
+	err := sendJSON(ctx, p.client(ctx, account), http.MethodPatch,
+		fmt.Sprintf("%s/me/messages/%s", p.config.GraphURL, url.PathEscape(messageID)), patch, nil)
+	if err != nil {
+		return fmt.Errorf("failed to update message %s: %v", messageID, err)
+	}
+	return nil
+}
+
+// DeleteMessage deletes a message, which Outlook moves to Deleted Items
+func (p *Provider) DeleteMessage(ctx context.Context, account *models.Account, messageID string) error {
+	err := sendJSON(ctx, p.client(ctx, account), http.MethodDelete,
+		fmt.Sprintf("%s/me/messages/%s", p.config.GraphURL, url.PathEscape(messageID)), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete message %s: %v", messageID, err)
+	}
+	return nil
+}
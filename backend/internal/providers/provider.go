@@ -0,0 +1,98 @@
+// Package providers defines the interface every mail provider implements and
+// a registry to look them up by their canonical ID. Each provider lives in its
+// own subpackage.
+package providers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown provider")
+	ErrNotSupported    = errors.New("operation not supported by provider")
+	// ErrInvalidGrant is returned by Refresh when the provider rejects the
+	// refresh token because it was revoked or expired
+	ErrInvalidGrant = errors.New("refresh token rejected by provider")
+)
+
+// Provider connects accounts of one mail provider: it authorizes them, reads
+// their mailboxes into a local Mailbox and changes messages on the server
+type Provider interface {
+	// ID returns the canonical provider ID stored in Account.Provider
+	ID() string
+
+	// AuthCodeURL returns the URL the user visits to grant access. The
+	// request carries the S256 PKCE challenge of codeVerifier.
+	AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error)
+	// Exchange trades an authorization code for tokens, proving possession
+	// of the PKCE verifier the authorization was requested with
+	Exchange(ctx context.Context, code, codeVerifier string) (*models.OAuthTokens, error)
+	// Refresh obtains a new access token. Providers that do not rotate
+	// refresh tokens return the one they were given.
+	Refresh(ctx context.Context, refreshToken string) (*models.OAuthTokens, error)
+	// UserInfo returns the profile of the user an access token belongs to
+	UserInfo(ctx context.Context, accessToken string) (*models.UserInfo, error)
+
+	// Sync brings the mailbox up to date with the server, continuing from the
+	// sync cursors saved on the account
+	Sync(ctx context.Context, account *models.Account, mailbox Mailbox) error
+	// FetchMessages syncs individual messages by their provider message ID,
+	// removing the ones that no longer exist
+	FetchMessages(ctx context.Context, account *models.Account, messageIDs []string, mailbox Mailbox) error
+	// UpdateMessage changes the state of a message on the server
+	UpdateMessage(ctx context.Context, account *models.Account, messageID string, update MessageUpdate) error
+	// DeleteMessage deletes a message on the server, or moves it to the trash
+	// where the provider has one
+	DeleteMessage(ctx context.Context, account *models.Account, messageID string) error
+}
+
+// MessageUpdate describes a change to a message; nil fields are left alone
+type MessageUpdate struct {
+	Read    *bool `json:"read,omitempty"`
+	Starred *bool `json:"starred,omitempty"`
+}
+
+// Mailbox is the local copy of an account's mailbox that providers sync into.
+// Messages are identified by their provider message ID.
+type Mailbox interface {
+	// Get returns a stored message, or nil if it is not stored
+	Get(ctx context.Context, messageID string) (*models.Email, error)
+	// Add stores a new message along with its attachments
+	Add(ctx context.Context, email *models.Email, attachments []mailparse.Attachment) error
+	// Update saves changes to a stored message
+	Update(ctx context.Context, email *models.Email) error
+	// Remove deletes a stored message; unknown messages are ignored
+	Remove(ctx context.Context, messageID string) error
+	// Reset deletes every stored message of the account
+	Reset(ctx context.Context) error
+	// SaveAccount persists the sync cursors kept on the account
+	SaveAccount(ctx context.Context, account *models.Account) error
+}
+
+// Verifier is implemented by providers whose accounts are set up with
+// credentials entered by the user rather than through OAuth
+type Verifier interface {
+	// Verify checks that the account's credentials work
+	Verify(ctx context.Context, account *models.Account) error
+}
+
+// Watcher is implemented by providers that publish mailbox changes to a
+// Pub/Sub topic
+type Watcher interface {
+	// Watch registers or renews the account's watch on topic and returns
+	// when it expires
+	Watch(ctx context.Context, account *models.Account, topic string) (time.Time, error)
+}
+
+// Subscriber is implemented by providers that POST change notifications to
+// a webhook
+type Subscriber interface {
+	// Subscribe creates or renews the account's subscription delivering to
+	// notificationURL
+	Subscribe(ctx context.Context, account *models.Account, notificationURL string) (*models.GraphSubscription, error)
+}
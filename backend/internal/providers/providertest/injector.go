@@ -0,0 +1,128 @@
+// Package providertest holds the pieces shared by the in-process fakes of
+// the mail provider APIs, such as gmailtest and outlooktest
+package providertest
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrorWriter writes an error response in the format of the faked API
+type ErrorWriter func(w http.ResponseWriter, status int, code string)
+
+// fault is an injected error response
+type fault struct {
+	method    string
+	pattern   string
+	status    int
+	code      string
+	remaining int // < 0 means forever
+}
+
+// Injector counts the requests a fake server receives and answers some of
+// them with injected errors instead of passing them on
+type Injector struct {
+	writeError ErrorWriter
+
+	mu       sync.Mutex
+	faults   []*fault
+	requests map[string]int // "METHOD /path" -> count
+}
+
+// NewInjector creates an injector that writes errors with writeError
+func NewInjector(writeError ErrorWriter) *Injector {
+	return &Injector{
+		writeError: writeError,
+		requests:   make(map[string]int),
+	}
+}
+
+// Fail makes the next times requests matching method and pattern fail with
+// status and the API error code. Patterns use path.Match syntax, so
+// "/v1.0/me/messages/*" matches any single message. An empty method matches
+// every method and times <= 0 fails every matching request until Reset.
+func (i *Injector) Fail(method, pattern string, status int, code string, times int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if times <= 0 {
+		times = -1
+	}
+	i.faults = append(i.faults, &fault{
+		method:    method,
+		pattern:   pattern,
+		status:    status,
+		code:      code,
+		remaining: times,
+	})
+}
+
+// Reset removes all injected faults and forgets the counted requests
+func (i *Injector) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.faults = nil
+	i.requests = make(map[string]int)
+}
+
+// Requests returns how many requests matching method and pattern were
+// received, including the ones that failed
+func (i *Injector) Requests(method, pattern string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var n int
+	for key, count := range i.requests {
+		m, p, _ := strings.Cut(key, " ")
+		if matches(method, pattern, m, p) {
+			n += count
+		}
+	}
+	return n
+}
+
+// Middleware counts each request and answers it with the first matching
+// fault, if any
+func (i *Injector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f := i.take(r.Method, r.URL.Path); f != nil {
+			i.writeError(w, f.status, f.code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take counts a request and consumes the fault it triggers
+func (i *Injector) take(method, urlPath string) *fault {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.requests[method+" "+urlPath]++
+
+	for n, f := range i.faults {
+		if !matches(f.method, f.pattern, method, urlPath) {
+			continue
+		}
+		if f.remaining > 0 {
+			f.remaining--
+			if f.remaining == 0 {
+				i.faults = append(i.faults[:n], i.faults[n+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// matches reports whether a request matches a method and path pattern
+func matches(method, pattern, reqMethod, reqPath string) bool {
+	if method != "" && method != reqMethod {
+		return false
+	}
+	ok, err := path.Match(pattern, reqPath)
+	return err == nil && ok
+}
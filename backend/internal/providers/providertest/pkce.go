@@ -0,0 +1,29 @@
+package providertest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+)
+
+// PKCEChallenge returns the S256 code challenge of an authorization request,
+// or "" when it carries none. ok is false for other challenge methods, which
+// the fakes reject.
+func PKCEChallenge(query url.Values) (challenge string, ok bool) {
+	challenge = query.Get("code_challenge")
+	if challenge == "" {
+		return "", true
+	}
+	return challenge, query.Get("code_challenge_method") == "S256"
+}
+
+// VerifyPKCE reports whether a token request's code_verifier matches the
+// challenge its authorization code was issued for. Codes issued without a
+// challenge need no verifier.
+func VerifyPKCE(challenge, verifier string) bool {
+	if challenge == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry maps canonical provider IDs, and aliases of them, to providers
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]Provider
+	aliases   map[string]string
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		providers: make(map[string]Provider),
+		aliases:   make(map[string]string),
+	}
+}
+
+// Register adds a provider under its ID. Aliases are alternative names that
+// resolve to the same provider, such as "google" for "gmail".
+func (r *Registry) Register(p Provider, aliases ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := p.ID()
+	r.providers[id] = p
+	for _, alias := range aliases {
+		r.aliases[strings.ToLower(alias)] = id
+	}
+}
+
+// Canonical resolves a provider ID or alias to the canonical ID
+func (r *Registry) Canonical(name string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name = strings.ToLower(name)
+	if _, ok := r.providers[name]; ok {
+		return name, nil
+	}
+	if id, ok := r.aliases[name]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+}
+
+// Get returns the provider registered under a provider ID or alias
+func (r *Registry) Get(name string) (Provider, error) {
+	id, err := r.Canonical(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.providers[id], nil
+}
+
+// IDs returns the canonical IDs of all registered providers, sorted
+func (r *Registry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.providers))
+	for id := range r.providers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,49 @@
+package search
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PlainText returns the text of an HTML document with the markup, scripts and
+// styles removed and entities decoded. Block elements start a new line, so
+// words in adjacent paragraphs or cells do not run together.
+func PlainText(document string) string {
+	if document == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	skip := 0 // Depth inside script and style elements
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// The end of the document; the tokenizer does not fail otherwise
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(tokenizer.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip++
+			case "br", "p", "div", "li", "tr", "td", "th", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote":
+				b.WriteByte('\n')
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				if skip > 0 {
+					skip--
+				}
+			case "p", "div", "li", "tr", "td", "th", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote":
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
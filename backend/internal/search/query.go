@@ -0,0 +1,312 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"email-harvester/internal/models"
+)
+
+// ErrInvalidQuery is wrapped by every QueryError
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// QueryError describes a malformed search query
+type QueryError struct {
+	Offset  int // Position of the offending token, in characters
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%v: %s at position %d", ErrInvalidQuery, e.Message, e.Offset+1)
+}
+
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+// operators are the operator names ParseQuery understands
+var operators = map[string]bool{
+	"from": true, "to": true, "subject": true, "label": true, "is": true, "has": true,
+	"after": true, "before": true, "newer_than": true, "older_than": true,
+}
+
+// dateLayouts are the accepted formats of after: and before: dates
+var dateLayouts = []string{"2006/01/02", "2006-01-02", "2006/1/2", "2006-1-2"}
+
+// ParseQuery compiles a Gmail-style search query into an email filter. It
+// understands
+//
+//	from:alice to:bob subject:invoice label:invoices
+//	is:read is:unread is:starred is:unstarred has:attachment
+//	after:2026/01/01 before:2026/02/01 newer_than:7d older_than:1y
+//	words "quoted phrases"
+//
+// Values containing spaces can be quoted, as in subject:"quarterly report".
+// A leading - negates a term or operator. Words and phrases become the full-
+// text part of the filter; everything has to match.
+func ParseQuery(query string) (models.EmailFilter, error) {
+	var filter models.EmailFilter
+	p := &queryParser{input: []rune(query), now: time.Now().UTC()}
+
+	for {
+		p.skipSpace()
+		if p.done() {
+			return filter, nil
+		}
+
+		start := p.pos
+		negate := p.peek() == '-'
+		if negate {
+			p.pos++
+		}
+
+		target := &filter
+		if negate {
+			target = &models.EmailFilter{}
+		}
+
+		switch {
+		case p.peek() == '"':
+			phrase, err := p.quoted()
+			if err != nil {
+				return models.EmailFilter{}, err
+			}
+			if phrase = normalizePhrase(phrase); phrase != "" {
+				target.Text = append(target.Text, phrase)
+			}
+		case p.done() || unicode.IsSpace(p.peek()):
+			return models.EmailFilter{}, &QueryError{Offset: start, Message: `"-" must be followed by a term`}
+		default:
+			name := p.name()
+			if p.peek() != ':' {
+				target.Text = append(target.Text, Terms(name)...)
+				break
+			}
+			p.pos++ // The colon
+
+			if !operators[strings.ToLower(name)] {
+				return models.EmailFilter{}, &QueryError{Offset: start, Message: fmt.Sprintf("unknown operator %q (quote it to search for the text)", name+":")}
+			}
+			valueStart := p.pos
+			value, err := p.value()
+			if err != nil {
+				return models.EmailFilter{}, err
+			}
+			if value == "" {
+				return models.EmailFilter{}, &QueryError{Offset: valueStart, Message: fmt.Sprintf("missing value for %q", name+":")}
+			}
+			if err := p.apply(target, strings.ToLower(name), value); err != nil {
+				return models.EmailFilter{}, &QueryError{Offset: start, Message: err.Error()}
+			}
+		}
+
+		if negate && !isEmptyFilter(target) {
+			filter.Not = append(filter.Not, *target)
+		}
+	}
+}
+
+// Terms splits free text into lowercase search terms
+func Terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isSeparator)
+}
+
+// isSeparator reports whether r separates words in a query
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !strings.ContainsRune("@.-_'", r)
+}
+
+// normalizePhrase lowercases a phrase and collapses its whitespace
+func normalizePhrase(phrase string) string {
+	return strings.Join(strings.Fields(strings.ToLower(phrase)), " ")
+}
+
+// queryParser scans a query
+type queryParser struct {
+	input []rune
+	pos   int
+	now   time.Time
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) peek() rune {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *queryParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+// name reads a bare word or operator name, up to whitespace, a colon or a
+// quote
+func (p *queryParser) name() string {
+	start := p.pos
+	for !p.done() && !unicode.IsSpace(p.peek()) && p.peek() != ':' && p.peek() != '"' {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// value reads an operator value, either quoted or up to whitespace
+func (p *queryParser) value() (string, error) {
+	if p.peek() == '"' {
+		return p.quoted()
+	}
+	start := p.pos
+	for !p.done() && !unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos]), nil
+}
+
+// quoted reads a double-quoted string
+func (p *queryParser) quoted() (string, error) {
+	start := p.pos
+	p.pos++ // The opening quote
+	for !p.done() && p.peek() != '"' {
+		p.pos++
+	}
+	if p.done() {
+		return "", &QueryError{Offset: start, Message: "unterminated quote"}
+	}
+	p.pos++ // The closing quote
+	return string(p.input[start+1 : p.pos-1]), nil
+}
+
+// apply adds the condition of an operator to filter
+func (p *queryParser) apply(filter *models.EmailFilter, operator, value string) error {
+	switch operator {
+	case "from":
+		return setString(&filter.From, operator, value)
+	case "to":
+		return setString(&filter.To, operator, value)
+	case "subject":
+		return setString(&filter.Subject, operator, value)
+	case "label":
+		return setString(&filter.Label, operator, value)
+
+	case "is":
+		switch strings.ToLower(value) {
+		case "read":
+			return setBool(&filter.Read, operator, true)
+		case "unread":
+			return setBool(&filter.Read, operator, false)
+		case "starred":
+			return setBool(&filter.Starred, operator, true)
+		case "unstarred":
+			return setBool(&filter.Starred, operator, false)
+		}
+		return fmt.Errorf(`unknown value %q for "is:" (use read, unread, starred or unstarred)`, value)
+
+	case "has":
+		if strings.ToLower(value) != "attachment" {
+			return fmt.Errorf(`unknown value %q for "has:" (use attachment)`, value)
+		}
+		return setBool(&filter.HasAttachment, operator, true)
+
+	case "after", "before":
+		date, err := parseDate(value)
+		if err != nil {
+			return fmt.Errorf("invalid date %q for %q (use YYYY/MM/DD)", value, operator+":")
+		}
+		if operator == "after" {
+			setStart(filter, date)
+		} else {
+			setEnd(filter, date.Add(-time.Nanosecond))
+		}
+		return nil
+
+	case "newer_than", "older_than":
+		date, err := p.ago(value)
+		if err != nil {
+			return fmt.Errorf("invalid age %q for %q (use a number followed by d, m or y)", value, operator+":")
+		}
+		if operator == "newer_than" {
+			setStart(filter, date)
+		} else {
+			setEnd(filter, date)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operator %q", operator+":")
+}
+
+// ago returns the time an age such as 7d, 3m or 1y ago
+func (p *queryParser) ago(age string) (time.Time, error) {
+	if len(age) < 2 {
+		return time.Time{}, errors.New("age too short")
+	}
+	n, err := strconv.Atoi(age[:len(age)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, errors.New("invalid number")
+	}
+	switch unicode.ToLower(rune(age[len(age)-1])) {
+	case 'd':
+		return p.now.AddDate(0, 0, -n), nil
+	case 'm':
+		return p.now.AddDate(0, -n, 0), nil
+	case 'y':
+		return p.now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, errors.New("unknown unit")
+}
+
+func parseDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var date time.Time
+		if date, err = time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func setString(field **string, operator, value string) error {
+	if *field != nil {
+		return fmt.Errorf("%q can only be given once", operator+":")
+	}
+	*field = &value
+	return nil
+}
+
+func setBool(field **bool, operator string, value bool) error {
+	if *field != nil && **field != value {
+		return fmt.Errorf("conflicting values for %q", operator+":")
+	}
+	*field = &value
+	return nil
+}
+
+// setStart narrows the filter to emails received at or after date
+func setStart(filter *models.EmailFilter, date time.Time) {
+	if filter.StartDate == nil || date.After(*filter.StartDate) {
+		filter.StartDate = &date
+	}
+}
+
+// setEnd narrows the filter to emails received at or before date
+func setEnd(filter *models.EmailFilter, date time.Time) {
+	if filter.EndDate == nil || date.Before(*filter.EndDate) {
+		filter.EndDate = &date
+	}
+}
+
+// isEmptyFilter reports whether a filter has no conditions
+func isEmptyFilter(filter *models.EmailFilter) bool {
+	return filter.From == nil && filter.To == nil && filter.Subject == nil && filter.Label == nil &&
+		filter.Read == nil && filter.Starred == nil && filter.HasAttachment == nil &&
+		filter.StartDate == nil && filter.EndDate == nil && len(filter.Text) == 0 && len(filter.Not) == 0
+}
@@ -0,0 +1,229 @@
+// Package search holds the store-independent parts of full-text search over
+// emails: the searchable text of an email, splitting queries into terms,
+// ranking matches and cutting highlighted snippets out of the matched fields.
+package search
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+
+	"email-harvester/internal/models"
+)
+
+// Field names, as reported in snippets
+const (
+	FieldSubject = "subject"
+	FieldFrom    = "from"
+	FieldBody    = "body"
+)
+
+// Relative weights of the fields when ranking matches. The MongoDB text index
+// uses the same weights.
+const (
+	SubjectWeight = 10
+	FromWeight    = 5
+	BodyWeight    = 1
+)
+
+const (
+	// snippetRadius is how many characters of context a body snippet shows
+	// on either side of a match
+	snippetRadius = 80
+
+	// maxBodySnippets caps the snippets cut out of the body
+	maxBodySnippets = 3
+)
+
+// Field is a searchable part of an email
+type Field struct {
+	Name   string
+	Text   string
+	Weight int
+}
+
+// Fields returns the searchable text of an email: its subject, the sender's
+// name and address, and its body, which for HTML-only messages is the text
+// of the HTML part
+func Fields(email *models.Email) []Field {
+	from := email.From
+	if email.FromAddress.Name != "" {
+		from = email.FromAddress.Name + " <" + email.From + ">"
+	}
+
+	// HTML-only messages are searched by the text of their HTML part
+	body := email.Body
+	if strings.TrimSpace(body) == "" {
+		body = email.HTMLText
+	}
+
+	return []Field{
+		{Name: FieldSubject, Text: email.Subject, Weight: SubjectWeight},
+		{Name: FieldFrom, Text: from, Weight: FromWeight},
+		{Name: FieldBody, Text: body, Weight: BodyWeight},
+	}
+}
+
+// Matches reports whether every term occurs in at least one field of email
+func Matches(email *models.Email, terms []string) bool {
+	fields := Fields(email)
+	for _, term := range terms {
+		found := false
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field.Text), term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Score ranks how well email matches terms. Every occurrence counts with the
+// weight of its field, so matches in the subject outrank matches in the body.
+func Score(email *models.Email, terms []string) float64 {
+	var score float64
+	for _, field := range Fields(email) {
+		text := strings.ToLower(field.Text)
+		for _, term := range terms {
+			score += float64(field.Weight * strings.Count(text, term))
+		}
+	}
+	return score
+}
+
+// Snippets cuts the matches of terms out of the fields of email. Subjects and
+// senders are returned whole, bodies as up to a few extracts around the
+// matches. Snippet text is HTML-escaped with every match wrapped in <mark>.
+func Snippets(email *models.Email, terms []string) []models.SearchSnippet {
+	var snippets []models.SearchSnippet
+	for _, field := range Fields(email) {
+		text := []rune(strings.Join(strings.Fields(field.Text), " "))
+		matches := find(text, terms)
+		if len(matches) == 0 {
+			continue
+		}
+
+		if field.Name != FieldBody {
+			snippets = append(snippets, models.SearchSnippet{
+				Field: field.Name,
+				Text:  highlight(text, matches, 0, len(text)),
+			})
+			continue
+		}
+
+		count, end := 0, 0
+		for _, m := range matches {
+			if m.start < end {
+				continue // Shown by the previous snippet
+			}
+			if count == maxBodySnippets {
+				break
+			}
+			count++
+
+			start := wordStart(text, max(end, m.start-snippetRadius), m.start)
+			end = wordEnd(text, min(len(text), m.end+snippetRadius), m.end)
+			snippet := highlight(text, matches, start, end)
+			if start > 0 {
+				snippet = "…" + snippet
+			}
+			if end < len(text) {
+				snippet += "…"
+			}
+			snippets = append(snippets, models.SearchSnippet{Field: field.Name, Text: snippet})
+		}
+	}
+	return snippets
+}
+
+// match is a range of runes that matched a term
+type match struct {
+	start, end int
+}
+
+// find returns the non-overlapping matches of terms in text, in order
+func find(text []rune, terms []string) []match {
+	// Lowercasing rune by rune keeps the offsets of text
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	var matches []match
+	for _, term := range terms {
+		needle := []rune(term)
+		if len(needle) == 0 {
+			continue
+		}
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) == term {
+				matches = append(matches, match{start: i, end: i + len(needle)})
+				i += len(needle) - 1
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+
+	// Merge overlapping matches of different terms
+	merged := matches[:0]
+	for _, m := range matches {
+		if n := len(merged); n > 0 && m.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, m.end)
+			continue
+		}
+		merged = append(merged, m)
+	}
+	return merged
+}
+
+// highlight escapes text[start:end] and marks the matches within it
+func highlight(text []rune, matches []match, start, end int) string {
+	var b strings.Builder
+	pos := start
+	for _, m := range matches {
+		if m.end <= start || m.start >= end {
+			continue
+		}
+		from, to := max(m.start, start), min(m.end, end)
+		b.WriteString(html.EscapeString(string(text[pos:from])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(text[from:to])))
+		b.WriteString("</mark>")
+		pos = to
+	}
+	b.WriteString(html.EscapeString(string(text[pos:end])))
+	return b.String()
+}
+
+// wordStart moves i forward to the start of a word, but not past limit, so
+// snippets do not begin in the middle of one
+func wordStart(text []rune, i, limit int) int {
+	if i == 0 {
+		return 0
+	}
+	for j := i; j < limit; j++ {
+		if text[j] == ' ' {
+			return j + 1
+		}
+	}
+	return i
+}
+
+// wordEnd moves i back to the end of a word, but not before limit
+func wordEnd(text []rune, i, limit int) int {
+	if i == len(text) {
+		return i
+	}
+	for j := i; j > limit; j-- {
+		if text[j] == ' ' {
+			return j
+		}
+	}
+	return i
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"email-harvester/internal/blob"
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+)
+
+var (
+	ErrEmailNotFound      = errors.New("email not found")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// attachmentData is an attachment extracted from a message along with its content
+type attachmentData = mailparse.Attachment
+
+// saveAttachments writes attachment contents to the blob store, keyed by their
+// SHA-256 digest so identical files are stored once, and records their metadata
+// on email. Without a blob store only the metadata is kept.
+func saveAttachments(ctx context.Context, blobs blob.Store, email *models.Email, files []attachmentData) error {
+	for _, file := range files {
+		sum := sha256.Sum256(file.Data)
+		digest := hex.EncodeToString(sum[:])
+
+		if blobs != nil {
+			exists, err := blobs.Exists(ctx, digest)
+			if err != nil {
+				return fmt.Errorf("failed to check attachment %s: %v", file.Filename, err)
+			}
+			if !exists {
+				if err := blobs.Put(ctx, digest, bytes.NewReader(file.Data)); err != nil {
+					return fmt.Errorf("failed to store attachment %s: %v", file.Filename, err)
+				}
+			}
+		}
+
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		email.Attachments = append(email.Attachments, models.Attachment{
+			ID:          primitive.NewObjectID().Hex(),
+			Filename:    file.Filename,
+			ContentType: contentType,
+			Size:        int64(len(file.Data)),
+			ContentID:   file.ContentID,
+			Inline:      file.Inline,
+			SHA256:      digest,
+		})
+	}
+	return nil
+}
+
+// SetBlobStore sets the blob store attachments are saved to
+func (s *EmailService) SetBlobStore(blobs blob.Store) {
+	s.blobs = blobs
+}
+
+// ListAttachments returns the attachment metadata of an email
+func (s *EmailService) ListAttachments(ctx context.Context, emailID primitive.ObjectID) ([]models.Attachment, error) {
+	email, err := s.store.GetEmail(ctx, emailID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email: %v", err)
+	}
+	if email == nil {
+		return nil, ErrEmailNotFound
+	}
+	return email.Attachments, nil
+}
+
+// OpenAttachment returns an attachment's metadata and a reader over its content.
+// The caller must close the reader.
+func (s *EmailService) OpenAttachment(ctx context.Context, emailID primitive.ObjectID, attachmentID string) (*models.Attachment, io.ReadCloser, error) {
+	attachments, err := s.ListAttachments(ctx, emailID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range attachments {
+		attachment := &attachments[i]
+		if attachment.ID != attachmentID {
+			continue
+		}
+		if s.blobs == nil {
+			return nil, nil, ErrAttachmentNotFound
+		}
+
+		content, err := s.blobs.Get(ctx, attachment.SHA256)
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, nil, ErrAttachmentNotFound
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open attachment: %v", err)
+		}
+		return attachment, content, nil
+	}
+
+	return nil, nil, ErrAttachmentNotFound
+}
@@ -2,259 +2,212 @@ package services
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"strings"
 	"time"
 
-	"github.com/email-harvester/internal/models"
-	"github.com/email-harvester/internal/store"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/microsoft"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
-	"email-harvester/internal/config"
+	"email-harvester/internal/blob"
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
+	"email-harvester/internal/store"
 )
 
-// EmailService handles email operations for different providers
+var ErrAccountNotFound = errors.New("account not found")
+
+// EmailService syncs and changes mailboxes through their providers
 type EmailService struct {
-	store        *store.MongoDBStore
-	oauthService *OAuthService
-	config       *config.OAuthConfig
+	store     store.Store
+	providers *providers.Registry
+	monitor   *monitoring.Monitor
+	tokens    *TokenManager
+	threads   *ThreadService
+	blobs     blob.Store
 }
 
 // NewEmailService creates a new email service instance
-func NewEmailService(store *store.MongoDBStore, oauthService *OAuthService) *EmailService {
+func NewEmailService(store store.Store, registry *providers.Registry, monitor *monitoring.Monitor) *EmailService {
 	return &EmailService{
-		store:        store,
-		oauthService: oauthService,
-		config:       oauthService.config,
+		store:     store,
+		providers: registry,
+		monitor:   monitor,
+		tokens:    NewTokenManager(store, registry, monitor),
+		threads:   NewThreadService(store, monitor),
 	}
 }
 
-// FetchEmails fetches emails from the specified account and stores them in MongoDB
-func (s *EmailService) FetchEmails(ctx context.Context, accountID string) error {
-	// Get account from store
+// FetchEmails syncs the specified account through its provider and stores
+// new and changed emails
+func (s *EmailService) FetchEmails(ctx context.Context, accountID string) (*SyncResult, error) {
 	objID, err := primitive.ObjectIDFromHex(accountID)
 	if err != nil {
-		return fmt.Errorf("invalid account ID: %v", err)
+		return nil, fmt.Errorf("invalid account ID: %v", err)
 	}
 
-	account, err := s.store.GetAccount(ctx, objID)
+	account, provider, err := s.connect(ctx, objID)
 	if err != nil {
-		return fmt.Errorf("failed to get account: %v", err)
+		return nil, err
 	}
 
-	// Get fresh token
-	token := &oauth2.Token{
-		AccessToken:  account.AccessToken,
-		RefreshToken: account.RefreshToken,
-		Expiry:       account.TokenExpiry,
+	// Count the emails added by the provider
+	result := &SyncResult{AccountID: accountID}
+	ctx = context.WithValue(ctx, syncResultKey{}, result)
+
+	// Emails synced before a failure are kept
+	mailbox := s.mailbox(account)
+	err = provider.Sync(ctx, account, mailbox)
+	if flushErr := mailbox.Flush(ctx); err == nil {
+		err = flushErr
 	}
+	return result, err
+}
 
-	token, err = s.oauthService.RefreshToken(ctx, account.Type, token)
+// SyncMessages syncs individual messages of an account by their provider
+// message IDs, as reported by change notifications
+func (s *EmailService) SyncMessages(ctx context.Context, accountID primitive.ObjectID, messageIDs []string) error {
+	account, provider, err := s.connect(ctx, accountID)
 	if err != nil {
-		return fmt.Errorf("failed to refresh token: %v", err)
+		return err
 	}
-
-	// Update account tokens
-	if err := s.store.UpdateAccountTokens(ctx, account.ID, token.AccessToken, token.RefreshToken, token.Expiry); err != nil {
-		return fmt.Errorf("failed to update account tokens: %v", err)
-	}
-
-	// Fetch emails based on account type
-	switch account.Type {
-	case models.AccountTypeGmail:
-		return s.fetchGmailEmails(ctx, account, token)
-	case models.AccountTypeOutlook:
-		return s.fetchOutlookEmails(ctx, account, token)
-	default:
-		return fmt.Errorf("unsupported account type: %s", account.Type)
+	mailbox := s.mailbox(account)
+	err = provider.FetchMessages(ctx, account, messageIDs, mailbox)
+	if flushErr := mailbox.Flush(ctx); err == nil {
+		err = flushErr
 	}
+	return err
 }
 
-// fetchGmailEmails fetches emails from Gmail
-func (s *EmailService) fetchGmailEmails(ctx context.Context, account *models.Account, token *oauth2.Token) error {
-	client := s.oauthService.getClient(ctx, account.Type, token)
-	gmailService, err := gmail.New(client)
-	if err != nil {
-		return fmt.Errorf("failed to create Gmail service: %v", err)
+// UpdateEmail changes the read or starred state of an email on the
+// provider and then in the store
+func (s *EmailService) UpdateEmail(ctx context.Context, emailID primitive.ObjectID, update providers.MessageUpdate) (*models.Email, error) {
+	email, err := s.store.GetEmail(ctx, emailID)
+	if err != nil || email == nil {
+		return nil, ErrEmailNotFound
 	}
 
-	// Get list of messages
-	messages, err := gmailService.Users.Messages.List("me").Q("in:inbox").Do()
+	account, provider, err := s.connect(ctx, email.AccountID)
 	if err != nil {
-		return fmt.Errorf("failed to list messages: %v", err)
+		return nil, err
 	}
-
-	for _, msg := range messages.Messages {
-		// Check if email already exists
-		if _, err := s.store.GetEmailByMessageID(ctx, account.ID, msg.Id); err == nil {
-			continue // Email already exists
-		}
-
-		// Get full message
-		message, err := gmailService.Users.Messages.Get("me", msg.Id).Format("full").Do()
-		if err != nil {
-			return fmt.Errorf("failed to get message %s: %v", msg.Id, err)
-		}
-
-		// Parse message
-		email, err := s.parseGmailMessage(message)
-		if err != nil {
-			return fmt.Errorf("failed to parse message %s: %v", msg.Id, err)
-		}
-
-		email.AccountID = account.ID
-		email.MessageID = msg.Id
-
-		// Store in MongoDB
-		if err := s.store.CreateEmail(ctx, email); err != nil {
-			return fmt.Errorf("failed to store message %s: %v", msg.Id, err)
-		}
+	if err := provider.UpdateMessage(ctx, account, email.MessageID, update); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if update.Read != nil {
+		email.Read = *update.Read
+	}
+	if update.Starred != nil {
+		email.Starred = *update.Starred
+	}
+	email.UpdatedAt = time.Now()
+	if err := s.store.UpdateEmail(ctx, email); err != nil {
+		return nil, fmt.Errorf("failed to update email: %v", err)
+	}
+	return email, nil
 }
 
-// fetchOutlookEmails fetches emails from Outlook
-func (s *EmailService) fetchOutlookEmails(ctx context.Context, account *models.Account, token *oauth2.Token) error {
-	client := s.oauthService.getClient(ctx, account.Type, token)
+// DeleteEmail deletes an email on the provider and then from the store
+func (s *EmailService) DeleteEmail(ctx context.Context, emailID primitive.ObjectID) error {
+	email, err := s.store.GetEmail(ctx, emailID)
+	if err != nil || email == nil {
+		return ErrEmailNotFound
+	}
 
-	// Get messages from Outlook Graph API
-	resp, err := client.Get("https://graph.microsoft.com/v1.0/me/messages?$top=50&$select=id,subject,from,toRecipients,ccRecipients,bccRecipients,receivedDateTime,body")
+	account, provider, err := s.connect(ctx, email.AccountID)
 	if err != nil {
-		return fmt.Errorf("failed to get messages: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	var result struct {
-		Value []struct {
-			ID               string    `json:"id"`
-			Subject          string    `json:"subject"`
-			From             struct{ EmailAddress struct{ Address string } } `json:"from"`
-			ToRecipients     []struct{ EmailAddress struct{ Address string } } `json:"toRecipients"`
-			CcRecipients     []struct{ EmailAddress struct{ Address string } } `json:"ccRecipients"`
-			BccRecipients    []struct{ EmailAddress struct{ Address string } } `json:"bccRecipients"`
-			ReceivedDateTime time.Time `json:"receivedDateTime"`
-			Body             struct {
-				Content     string `json:"content"`
-				ContentType string `json:"contentType"`
-			} `json:"body"`
-		} `json:"value"`
+	if err := provider.DeleteMessage(ctx, account, email.MessageID); err != nil {
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return fmt.Errorf("failed to decode response: %v", err)
+	if err := s.store.DeleteEmail(ctx, email.ID); err != nil {
+		return fmt.Errorf("failed to delete email: %v", err)
 	}
+	return s.threads.Remove(ctx, email)
+}
 
-	for _, msg := range result.Value {
-		// Check if email already exists
-		if _, err := s.store.GetEmailByMessageID(ctx, account.ID, msg.ID); err == nil {
-			continue // Email already exists
-		}
-
-		// Convert to our email model
-		email := &models.Email{
-			AccountID:  account.ID,
-			MessageID:  msg.ID,
-			From:       msg.From.EmailAddress.Address,
-			Subject:    msg.Subject,
-			ReceivedAt: msg.ReceivedDateTime,
-			CreatedAt:  time.Now(),
-			UpdatedAt:  time.Now(),
-		}
-
-		// Add recipients
-		for _, to := range msg.ToRecipients {
-			email.To = append(email.To, to.EmailAddress.Address)
-		}
-		for _, cc := range msg.CcRecipients {
-			email.Cc = append(email.Cc, cc.EmailAddress.Address)
-		}
-		for _, bcc := range msg.BccRecipients {
-			email.Bcc = append(email.Bcc, bcc.EmailAddress.Address)
-		}
-
-		// Set body based on content type
-		if msg.Body.ContentType == "html" {
-			email.HTMLBody = msg.Body.Content
-		} else {
-			email.Body = msg.Body.Content
-		}
+// WatchGmail registers (or renews) Gmail push notifications for the account's
+// inbox on the given Pub/Sub topic and saves the registration's expiry
+func (s *EmailService) WatchGmail(ctx context.Context, account *models.Account, topic string) error {
+	provider, err := s.authorize(ctx, account)
+	if err != nil {
+		return err
+	}
+	watcher, ok := provider.(providers.Watcher)
+	if !ok {
+		return fmt.Errorf("%w: watch on %s", providers.ErrNotSupported, account.Provider)
+	}
 
-		// Store in MongoDB
-		if err := s.store.CreateEmail(ctx, email); err != nil {
-			return fmt.Errorf("failed to store message %s: %v", msg.ID, err)
-		}
+	expiry, err := watcher.Watch(ctx, account, topic)
+	if err != nil {
+		return err
 	}
 
+	// Re-read the account so a sync that ran meanwhile keeps its cursor
+	latest, err := s.store.GetAccount(ctx, account.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get account: %v", err)
+	}
+	latest.GmailWatch = expiry
+	if err := s.store.UpdateAccount(ctx, latest); err != nil {
+		return fmt.Errorf("failed to save watch expiry: %v", err)
+	}
+	account.GmailWatch = expiry
 	return nil
 }
 
-// parseGmailMessage parses a Gmail message into our email model
-func (s *EmailService) parseGmailMessage(msg *gmail.Message) (*models.Email, error) {
-	email := &models.Email{
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+// SubscribeOutlook creates (or renews) a Graph change-notification subscription
+// for the account's messages and saves it on the account
+func (s *EmailService) SubscribeOutlook(ctx context.Context, account *models.Account, notificationURL string) error {
+	provider, err := s.authorize(ctx, account)
+	if err != nil {
+		return err
 	}
-
-	// Parse headers
-	headers := make(map[string]string)
-	for _, header := range msg.Payload.Headers {
-		headers[strings.ToLower(header.Name)] = header.Value
+	subscriber, ok := provider.(providers.Subscriber)
+	if !ok {
+		return fmt.Errorf("%w: subscribe on %s", providers.ErrNotSupported, account.Provider)
 	}
 
-	email.Subject = headers["subject"]
-	email.From = headers["from"]
-	email.To = strings.Split(headers["to"], ",")
-	if cc := headers["cc"]; cc != "" {
-		email.Cc = strings.Split(cc, ",")
-	}
-	if bcc := headers["bcc"]; bcc != "" {
-		email.Bcc = strings.Split(bcc, ",")
+	subscription, err := subscriber.Subscribe(ctx, account, notificationURL)
+	if err != nil {
+		return err
 	}
 
-	// Parse received date
-	if date := headers["date"]; date != "" {
-		if t, err := time.Parse(time.RFC1123Z, date); err == nil {
-			email.ReceivedAt = t
-		}
+	// Re-read the account so a sync that ran meanwhile keeps its cursors
+	latest, err := s.store.GetAccount(ctx, account.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get account: %v", err)
 	}
-
-	// Parse body
-	if err := s.parseGmailBody(msg.Payload, email); err != nil {
-		return nil, err
+	latest.GraphSubscription = subscription
+	if err := s.store.UpdateAccount(ctx, latest); err != nil {
+		return fmt.Errorf("failed to save subscription: %v", err)
 	}
-
-	return email, nil
+	account.GraphSubscription = subscription
+	return nil
 }
 
-// parseGmailBody parses the body of a Gmail message
-func (s *EmailService) parseGmailBody(part *gmail.MessagePart, email *models.Email) error {
-	if part.MimeType == "text/plain" {
-		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
-		if err != nil {
-			return err
-		}
-		email.Body = string(data)
-	} else if part.MimeType == "text/html" {
-		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
-		if err != nil {
-			return err
-		}
-		email.HTMLBody = string(data)
+// connect loads an account and authorizes it with its provider
+func (s *EmailService) connect(ctx context.Context, accountID primitive.ObjectID) (*models.Account, providers.Provider, error) {
+	account, err := s.store.GetAccount(ctx, accountID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get account: %v", err)
+	}
+	if account == nil {
+		return nil, nil, ErrAccountNotFound
 	}
 
-	// Process nested parts
-	for _, p := range part.Parts {
-		if err := s.parseGmailBody(p, email); err != nil {
-			return err
-		}
+	provider, err := s.authorize(ctx, account)
+	if err != nil {
+		return nil, nil, err
 	}
+	return account, provider, nil
+}
 
-	return nil
-} 
\ No newline at end of file
+// authorize looks up the account's provider and makes sure the account's
+// access token is valid
+func (s *EmailService) authorize(ctx context.Context, account *models.Account) (providers.Provider, error) {
+	return s.tokens.Authorize(ctx, account)
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/idtoken"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/store"
+)
+
+var (
+	ErrPushUnauthorized = errors.New("push request not authorized")
+	ErrInvalidPush      = errors.New("invalid push message")
+)
+
+// PubSubPushRequest is the body Pub/Sub POSTs to a push subscription endpoint
+type PubSubPushRequest struct {
+	Message struct {
+		Data        string    `json:"data"` // Base64-encoded GmailNotification
+		MessageID   string    `json:"messageId"`
+		PublishTime time.Time `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// GmailNotification is the payload Gmail publishes when a watched mailbox changes
+type GmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// PushTokenValidator validates the OIDC token Pub/Sub attaches to push
+// requests. Tests replace it to accept tokens from a fake push sender.
+type PushTokenValidator func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+
+// GmailPushConfig configures Gmail push notifications
+type GmailPushConfig struct {
+	Topic             string        // Pub/Sub topic Gmail publishes to, projects/{project}/topics/{topic}
+	Audience          string        // Expected audience of the push token, usually the endpoint URL
+	ServiceAccount    string        // Expected service account email of the push subscription
+	VerificationToken string        // Shared secret accepted as ?token= instead of a push token, for local senders
+	RenewInterval     time.Duration // How often watches are checked for renewal
+	RenewBefore       time.Duration // Renew watches expiring within this window
+}
+
+// GmailPushService receives Gmail push notifications and keeps the
+// users.watch registrations of Gmail accounts alive
+type GmailPushService struct {
+	store         store.Store
+	emailService  *EmailService
+	jobService    *JobService
+	monitor       *monitoring.Monitor
+	config        GmailPushConfig
+	validateToken PushTokenValidator
+}
+
+// NewGmailPushService creates a new Gmail push service
+func NewGmailPushService(store store.Store, emailService *EmailService, jobService *JobService, monitor *monitoring.Monitor, config GmailPushConfig) *GmailPushService {
+	return &GmailPushService{
+		store:         store,
+		emailService:  emailService,
+		jobService:    jobService,
+		monitor:       monitor,
+		config:        config,
+		validateToken: idtoken.Validate,
+	}
+}
+
+// SetTokenValidator replaces the validator used for push tokens
+func (s *GmailPushService) SetTokenValidator(validator PushTokenValidator) {
+	s.validateToken = validator
+}
+
+// VerifyPush checks that a push request comes from our Pub/Sub subscription,
+// either through its bearer token or through the configured verification token
+func (s *GmailPushService) VerifyPush(ctx context.Context, authorization, verificationToken string) error {
+	if s.config.VerificationToken != "" && verificationToken != "" {
+		if subtle.ConstantTimeCompare([]byte(verificationToken), []byte(s.config.VerificationToken)) == 1 {
+			return nil
+		}
+		return ErrPushUnauthorized
+	}
+
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return ErrPushUnauthorized
+	}
+
+	payload, err := s.validateToken(ctx, token, s.config.Audience)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPushUnauthorized, err)
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || (s.config.ServiceAccount != "" && email != s.config.ServiceAccount) {
+		return fmt.Errorf("%w: unexpected push identity %q", ErrPushUnauthorized, email)
+	}
+	return nil
+}
+
+// HandlePush queues an incremental sync for the account a notification is
+// about. Notifications for unknown or inactive accounts, or for history the
+// account has already synced past, are ignored.
+func (s *GmailPushService) HandlePush(ctx context.Context, push *PubSubPushRequest) error {
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPush, err)
+	}
+
+	var notification GmailNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPush, err)
+	}
+	if notification.EmailAddress == "" {
+		return fmt.Errorf("%w: missing emailAddress", ErrInvalidPush)
+	}
+
+	logFields := []zap.Field{
+		zap.String("email", notification.EmailAddress),
+		zap.Uint64("history_id", notification.HistoryID),
+		zap.String("message_id", push.Message.MessageID),
+	}
+
+	account, err := s.store.GetAccountByEmail(ctx, notification.EmailAddress)
+	if err != nil || account == nil || account.Provider != string(models.AccountTypeGmail) || !account.IsActive {
+		s.monitor.LogDebug("Ignoring Gmail push for unknown account", logFields...)
+		return nil
+	}
+	if account.HistoryID != 0 && notification.HistoryID <= account.HistoryID {
+		s.monitor.LogDebug("Ignoring Gmail push for already synced history", logFields...)
+		return nil
+	}
+
+	// The sync job continues from the account's saved historyId, which
+	// covers everything up to the notified one
+	job, err := s.jobService.Enqueue(ctx, &models.EnqueueJobRequest{
+		Type:      models.JobTypeSync,
+		AccountID: account.ID.Hex(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue sync: %w", err)
+	}
+
+	s.monitor.LogDebug("Queued sync for Gmail push", append(logFields, zap.String("job_id", job.ID.Hex()))...)
+	return nil
+}
+
+// RunWatchRenewer renews watches every RenewInterval until ctx is canceled
+func (s *GmailPushService) RunWatchRenewer(ctx context.Context) {
+	for {
+		if err := s.RenewWatches(ctx); err != nil && ctx.Err() == nil {
+			s.monitor.LogError("Failed to renew Gmail watches", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.config.RenewInterval):
+		}
+	}
+}
+
+// RenewWatches calls users.watch for every active Gmail account whose watch
+// is missing or expires within RenewBefore. Gmail lets watches lapse after
+// seven days, and renewing early is harmless.
+func (s *GmailPushService) RenewWatches(ctx context.Context) error {
+	accounts, err := s.store.ListActiveAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	deadline := time.Now().Add(s.config.RenewBefore)
+	for i := range accounts {
+		account := &accounts[i]
+		if account.Provider != string(models.AccountTypeGmail) || account.GmailWatch.After(deadline) {
+			continue
+		}
+
+		if err := s.emailService.WatchGmail(ctx, account, s.config.Topic); err != nil {
+			s.monitor.LogError("Failed to renew Gmail watch", err,
+				zap.String("account_id", account.ID.Hex()))
+			continue
+		}
+		s.monitor.LogInfo("Renewed Gmail watch",
+			zap.String("account_id", account.ID.Hex()),
+			zap.Time("expires_at", account.GmailWatch),
+		)
+	}
+	return nil
+}
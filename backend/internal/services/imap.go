@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// AddIMAPAccount verifies that the IMAP credentials work and stores the account
+func (s *EmailService) AddIMAPAccount(ctx context.Context, email string, settings *models.IMAPSettings, secret string) (*models.Account, error) {
+	if settings.Mailbox == "" {
+		settings.Mailbox = "INBOX"
+	}
+	if settings.AuthMethod == "" {
+		settings.AuthMethod = models.IMAPAuthPassword
+	}
+
+	account := &models.Account{
+		Provider: string(models.AccountTypeIMAP),
+		Email:    email,
+		IMAP:     settings,
+		IsActive: true,
+	}
+	if settings.AuthMethod == models.IMAPAuthXOAuth2 {
+		account.AccessToken = secret
+	} else {
+		settings.Password = secret
+	}
+
+	provider, err := s.providers.Get(account.Provider)
+	if err != nil {
+		return nil, err
+	}
+	verifier, ok := provider.(providers.Verifier)
+	if !ok {
+		return nil, fmt.Errorf("%w: verify on %s", providers.ErrNotSupported, account.Provider)
+	}
+	if err := verifier.Verify(ctx, account); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.CreateAccount(ctx, account); err != nil {
+		return nil, fmt.Errorf("failed to create account: %v", err)
+	}
+	return account, nil
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"email-harvester/internal/blob"
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/search"
+	"email-harvester/internal/store"
+)
+
+// Supported archive formats
+const (
+	ImportFormatMbox    = "mbox"
+	ImportFormatEML     = "eml"
+	ImportFormatMaildir = "maildir"
+)
+
+// importProgressInterval is the number of messages between progress reports
+const importProgressInterval = 100
+
+// importBatchSize is the number of messages stored at once
+const importBatchSize = 100
+
+// ImportProgress reports how far an archive import has come
+type ImportProgress struct {
+	Processed int  `json:"processed"`
+	Imported  int  `json:"imported"`
+	Skipped   int  `json:"skipped"` // Already stored under the same Message-ID
+	Failed    int  `json:"failed"`
+	Done      bool `json:"done"`
+}
+
+// ImportService imports offline mail archives into a synthetic "archive" account
+type ImportService struct {
+	store   store.Store
+	blobs   blob.Store
+	threads *ThreadService
+	monitor *monitoring.Monitor
+}
+
+// NewImportService creates a new import service
+func NewImportService(store store.Store, monitor *monitoring.Monitor) *ImportService {
+	return &ImportService{
+		store:   store,
+		threads: NewThreadService(store, monitor),
+		monitor: monitor,
+	}
+}
+
+// SetBlobStore sets the blob store attachments are saved to
+func (s *ImportService) SetBlobStore(blobs blob.Store) {
+	s.blobs = blobs
+}
+
+// Import reads an archive stream and stores its messages under the archive
+// account named archiveName. An mbox stream holds many messages, an EML stream
+// exactly one, and a Maildir is uploaded as a tar stream of the directory.
+// progress, if not nil, is called periodically and once more when done.
+func (s *ImportService) Import(ctx context.Context, archiveName, format string, r io.Reader, progress func(ImportProgress)) (*ImportProgress, error) {
+	account, err := s.archiveAccount(ctx, archiveName)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &importRun{service: s, account: account, progress: progress}
+	switch format {
+	case ImportFormatMbox:
+		err = run.readMbox(ctx, r)
+	case ImportFormatEML:
+		err = run.add(ctx, r, "")
+	case ImportFormatMaildir:
+		err = run.readMaildirTar(ctx, r)
+	default:
+		return nil, fmt.Errorf("unsupported import format: %s", format)
+	}
+
+	return run.finish(ctx, err)
+}
+
+// ImportMaildir imports a Maildir directory from the local filesystem
+func (s *ImportService) ImportMaildir(ctx context.Context, archiveName, dir string, progress func(ImportProgress)) (*ImportProgress, error) {
+	account, err := s.archiveAccount(ctx, archiveName)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &importRun{service: s, account: account, progress: progress}
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isMaildirMessage(path) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return run.add(ctx, f, maildirFlags(path))
+	})
+
+	return run.finish(ctx, err)
+}
+
+// archiveAccount returns the synthetic account for an archive, creating it on
+// first use
+func (s *ImportService) archiveAccount(ctx context.Context, archiveName string) (*models.Account, error) {
+	if archiveName == "" {
+		archiveName = "default"
+	}
+	address := archiveName + "@archive.invalid"
+
+	account, err := s.store.GetAccountByEmail(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archive account: %w", err)
+	}
+	if account != nil {
+		return account, nil
+	}
+
+	account = &models.Account{
+		Provider: string(models.AccountTypeArchive),
+		Email:    address,
+	}
+	if err := s.store.CreateAccount(ctx, account); err != nil {
+		return nil, fmt.Errorf("failed to create archive account: %w", err)
+	}
+	return account, nil
+}
+
+// importRun tracks a single import
+type importRun struct {
+	service  *ImportService
+	account  *models.Account
+	progress func(ImportProgress)
+	stats    ImportProgress
+	pending  []*models.Email // Read but not stored yet
+}
+
+// add parses and stores one message. Maildir flags, if any, set read/starred.
+// Parse failures are counted rather than aborting the import.
+func (r *importRun) add(ctx context.Context, msg io.Reader, flags string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	raw, err := io.ReadAll(msg)
+	if err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+
+	r.stats.Processed++
+	defer r.report()
+
+	email, attachments, err := mailparse.ParseMessage(bytes.NewReader(raw))
+	if err != nil {
+		r.stats.Failed++
+		r.service.monitor.LogDebug("Skipping unparseable archived message",
+			zap.String("account_id", r.account.ID.Hex()),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	email.AccountID = r.account.ID
+	email.MessageID = archiveMessageID(raw)
+	if strings.Contains(flags, "S") {
+		email.Read = true
+	}
+	if strings.Contains(flags, "F") {
+		email.Starred = true
+	}
+
+	if err := saveAttachments(ctx, r.service.blobs, email, attachments); err != nil {
+		return err
+	}
+	email.HTMLText = search.PlainText(email.HTMLBody)
+
+	r.pending = append(r.pending, email)
+	if len(r.pending) >= importBatchSize {
+		return r.flush(ctx)
+	}
+	return nil
+}
+
+// flush stores the pending messages. Messages already stored under the same
+// Message-ID are skipped and ones that fail are counted, rather than
+// aborting the import.
+func (r *importRun) flush(ctx context.Context) error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	emails := r.pending
+	r.pending = nil
+
+	results, err := r.service.threads.AddAll(ctx, emails, func() ([]store.BulkEmailResult, error) {
+		return r.service.store.BulkUpsertEmails(ctx, emails)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store messages: %w", err)
+	}
+	for i, result := range results {
+		switch {
+		case result.Created:
+			r.stats.Imported++
+		case result.Err != nil:
+			r.stats.Failed++
+			r.service.monitor.LogError("Failed to store archived message", result.Err,
+				zap.String("account_id", r.account.ID.Hex()),
+				zap.String("message_id", emails[i].MessageID),
+			)
+		default:
+			r.stats.Skipped++
+		}
+	}
+	return nil
+}
+
+// report sends a progress update every importProgressInterval messages
+func (r *importRun) report() {
+	if r.progress != nil && r.stats.Processed%importProgressInterval == 0 {
+		r.progress(r.stats)
+	}
+}
+
+// finish stores the last messages and sends the final progress update
+func (r *importRun) finish(ctx context.Context, err error) (*ImportProgress, error) {
+	// Messages read before a failure are kept
+	if flushErr := r.flush(ctx); err == nil {
+		err = flushErr
+	}
+	r.stats.Done = err == nil
+	if r.progress != nil {
+		r.progress(r.stats)
+	}
+	if err != nil {
+		return &r.stats, err
+	}
+
+	r.service.monitor.LogInfo("Archive import finished",
+		zap.String("account_id", r.account.ID.Hex()),
+		zap.Int("imported", r.stats.Imported),
+		zap.Int("skipped", r.stats.Skipped),
+		zap.Int("failed", r.stats.Failed),
+	)
+	return &r.stats, nil
+}
+
+// readMbox splits an mbox stream on its "From " separator lines. Lines quoted
+// as ">From " (mboxrd) are unquoted.
+func (r *importRun) readMbox(ctx context.Context, in io.Reader) error {
+	reader := bufio.NewReader(in)
+	var msg bytes.Buffer
+	started := false
+
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		err := r.add(ctx, bytes.NewReader(msg.Bytes()), "")
+		msg.Reset()
+		return err
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+			case started:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read mbox: %w", err)
+		}
+	}
+}
+
+// readMaildirTar imports the messages of a Maildir packed as a tar stream
+func (r *importRun) readMaildirTar(ctx context.Context, in io.Reader) error {
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar stream: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !isMaildirMessage(hdr.Name) {
+			continue
+		}
+		if err := r.add(ctx, tr, maildirFlags(hdr.Name)); err != nil {
+			return err
+		}
+	}
+}
+
+// isMaildirMessage reports whether path is a message file in a cur or new directory
+func isMaildirMessage(path string) bool {
+	dir := filepath.Base(filepath.Dir(path))
+	return (dir == "cur" || dir == "new") && !strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// maildirFlags returns the flag letters from a Maildir file name ("...:2,FS")
+func maildirFlags(path string) string {
+	if i := strings.LastIndex(filepath.Base(path), ":2,"); i >= 0 {
+		return filepath.Base(path)[i+3:]
+	}
+	return ""
+}
+
+// archiveMessageID returns the message's Message-ID, or a content hash for
+// messages that lack one so re-imports still dedupe
+func archiveMessageID(raw []byte) string {
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if ids := mailparse.ParseMessageIDs(msg.Header.Get("Message-Id")); len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/store"
+)
+
+var (
+	ErrJobNotFound       = errors.New("job not found")
+	ErrJobFinished       = errors.New("job already finished")
+	ErrUnknownJobType    = errors.New("unknown job type")
+	ErrInvalidJobPayload = errors.New("invalid job payload")
+)
+
+// JobHandler performs the work of a job. Returning an error schedules a retry
+// unless the error is wrapped with PermanentError.
+type JobHandler func(ctx context.Context, job *models.Job) error
+
+// permanentError marks a job failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// PermanentError wraps err so the job is dead-lettered without further retries
+func PermanentError(err error) error {
+	return &permanentError{err: err}
+}
+
+// JobConfig controls the job workers
+type JobConfig struct {
+	Workers           int           // Jobs processed in parallel
+	PollInterval      time.Duration // Wait between polls when the queue is empty
+	VisibilityTimeout time.Duration // How long a claimed job stays hidden from other workers
+	MaxAttempts       int           // Default attempts before a job is dead-lettered
+	BackoffBase       time.Duration // Delay before the first retry, doubled on each further retry
+	BackoffMax        time.Duration // Upper bound for the retry delay
+}
+
+// JobService enqueues jobs in the store and runs them on background workers
+type JobService struct {
+	store    store.Store
+	monitor  *monitoring.Monitor
+	config   JobConfig
+	workerID string
+
+	mu       sync.RWMutex
+	handlers map[models.JobType]JobHandler
+}
+
+// NewJobService creates a new job service
+func NewJobService(store store.Store, monitor *monitoring.Monitor, config JobConfig) *JobService {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+
+	hostname, _ := os.Hostname()
+	return &JobService{
+		store:    store,
+		monitor:  monitor,
+		config:   config,
+		workerID: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		handlers: make(map[models.JobType]JobHandler),
+	}
+}
+
+// RegisterHandler sets the handler for a job type
+func (s *JobService) RegisterHandler(jobType models.JobType, handler JobHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[jobType] = handler
+}
+
+// RegisterEmailHandlers registers the handlers for mailbox syncs, Outlook
+// message updates and LLM analysis
+func (s *JobService) RegisterEmailHandlers(emailService *EmailService, llmService *LLMService) {
+	s.RegisterHandler(models.JobTypeSync, func(ctx context.Context, job *models.Job) error {
+		_, err := emailService.FetchEmails(ctx, job.AccountID.Hex())
+		return permanentIfRevoked(err)
+	})
+	s.RegisterHandler(models.JobTypeOutlookMessages, func(ctx context.Context, job *models.Job) error {
+		return permanentIfRevoked(emailService.SyncMessages(ctx, *job.AccountID, job.MessageIDs))
+	})
+	s.RegisterHandler(models.JobTypeSummarize, func(ctx context.Context, job *models.Job) error {
+		_, err := llmService.SummarizeEmail(ctx, *job.EmailID)
+		return err
+	})
+	s.RegisterHandler(models.JobTypeNER, func(ctx context.Context, job *models.Job) error {
+		_, err := llmService.PerformNER(ctx, *job.EmailID)
+		return err
+	})
+}
+
+// permanentIfRevoked keeps jobs of accounts that must be reconnected from
+// being retried
+func permanentIfRevoked(err error) error {
+	if errors.Is(err, ErrAccountRevoked) {
+		return PermanentError(err)
+	}
+	return err
+}
+
+func (s *JobService) handler(jobType models.JobType) (JobHandler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	handler, ok := s.handlers[jobType]
+	return handler, ok
+}
+
+// Enqueue validates a request and stores a new pending job
+func (s *JobService) Enqueue(ctx context.Context, req *models.EnqueueJobRequest) (*models.Job, error) {
+	if _, ok := s.handler(req.Type); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJobType, req.Type)
+	}
+
+	job := &models.Job{
+		Type:        req.Type,
+		Status:      models.JobStatusPending,
+		MaxAttempts: req.MaxAttempts,
+		RunAt:       time.Now(),
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = s.config.MaxAttempts
+	}
+
+	switch req.Type {
+	case models.JobTypeSync:
+		id, err := primitive.ObjectIDFromHex(req.AccountID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: sync jobs need an account_id", ErrInvalidJobPayload)
+		}
+		job.AccountID = &id
+	case models.JobTypeOutlookMessages:
+		id, err := primitive.ObjectIDFromHex(req.AccountID)
+		if err != nil || len(req.MessageIDs) == 0 {
+			return nil, fmt.Errorf("%w: outlook_messages jobs need an account_id and message_ids", ErrInvalidJobPayload)
+		}
+		job.AccountID = &id
+		job.MessageIDs = req.MessageIDs
+	case models.JobTypeSummarize, models.JobTypeNER:
+		id, err := primitive.ObjectIDFromHex(req.EmailID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s jobs need an email_id", ErrInvalidJobPayload, req.Type)
+		}
+		job.EmailID = &id
+	}
+
+	if err := s.store.CreateJob(ctx, job); err != nil {
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+	return job, nil
+}
+
+// GetJob returns a job by ID
+func (s *JobService) GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// ListJobs lists jobs with filtering and pagination
+func (s *JobService) ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error) {
+	return s.store.ListJobs(ctx, filter, page, limit)
+}
+
+// CancelJob cancels a job that has not finished. A running job is not
+// interrupted, but its outcome is discarded.
+func (s *JobService) CancelJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	for {
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status.IsFinal() {
+			return job, ErrJobFinished
+		}
+
+		job.Status = models.JobStatusCanceled
+		job.FinishedAt = time.Now()
+		err = s.store.UpdateJob(ctx, job)
+		if errors.Is(err, store.ErrConflict) {
+			continue // A worker claimed or finished it meanwhile; look again
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to cancel job: %w", err)
+		}
+		return job, nil
+	}
+}
+
+// Run starts the workers and blocks until ctx is canceled and they have stopped
+func (s *JobService) Run(ctx context.Context) {
+	s.monitor.LogInfo("Starting job workers",
+		zap.Int("workers", s.config.Workers),
+		zap.String("worker_id", s.workerID),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	s.monitor.LogInfo("Job workers stopped")
+}
+
+// work claims and runs jobs until ctx is canceled, polling while the queue is empty
+func (s *JobService) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := s.store.ClaimJob(ctx, s.workerID, s.config.VisibilityTimeout)
+		if err != nil && ctx.Err() == nil {
+			s.monitor.LogError("Failed to claim job", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.config.PollInterval):
+			}
+			continue
+		}
+
+		s.runJob(ctx, job)
+	}
+}
+
+// runJob runs a claimed job and records the outcome
+func (s *JobService) runJob(ctx context.Context, job *models.Job) {
+	logFields := []zap.Field{
+		zap.String("job_id", job.ID.Hex()),
+		zap.String("type", string(job.Type)),
+		zap.Int("attempt", job.Attempts),
+	}
+
+	var err error
+	handler, ok := s.handler(job.Type)
+	switch {
+	case !ok:
+		err = PermanentError(fmt.Errorf("%w: %s", ErrUnknownJobType, job.Type))
+	case job.Attempts > job.MaxAttempts:
+		// The previous attempt outlived its visibility timeout
+		err = PermanentError(errors.New("visibility timeout expired on the last attempt"))
+	default:
+		jobCtx, cancel := context.WithTimeout(ctx, s.config.VisibilityTimeout)
+		err = handler(jobCtx, job)
+		cancel()
+	}
+
+	now := time.Now()
+	var permanent *permanentError
+	switch {
+	case err == nil:
+		job.Status = models.JobStatusSucceeded
+		job.LastError = ""
+		job.FinishedAt = now
+		s.monitor.LogInfo("Job succeeded", logFields...)
+	case ctx.Err() != nil:
+		// Interrupted by shutdown: hand the job back without using up an attempt
+		job.Status = models.JobStatusPending
+		job.Attempts--
+		job.RunAt = now
+		s.monitor.LogInfo("Job interrupted by shutdown", logFields...)
+	case errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts:
+		job.Status = models.JobStatusDead
+		job.LastError = err.Error()
+		job.FinishedAt = now
+		s.monitor.LogError("Job dead-lettered", err, logFields...)
+	default:
+		delay := s.backoff(job.Attempts)
+		job.Status = models.JobStatusPending
+		job.LastError = err.Error()
+		job.RunAt = now.Add(delay)
+		s.monitor.LogError("Job failed, retrying", err, append(logFields, zap.Duration("retry_in", delay))...)
+	}
+	job.LockedUntil = time.Time{}
+	job.WorkerID = ""
+
+	// Record the outcome even when shutting down, so the job is not rerun
+	// after its visibility timeout
+	if err := s.store.UpdateJob(context.WithoutCancel(ctx), job); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			s.monitor.LogInfo("Discarding outcome of job changed while running", logFields...)
+			return
+		}
+		s.monitor.LogError("Failed to record job outcome", err, logFields...)
+	}
+}
+
+// backoff returns the delay before retrying after the given attempt
+func (s *JobService) backoff(attempt int) time.Duration {
+	delay := s.config.BackoffBase
+	for i := 1; i < attempt && delay < s.config.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > s.config.BackoffMax {
+		delay = s.config.BackoffMax
+	}
+	return delay
+}
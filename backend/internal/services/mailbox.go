@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-harvester/internal/mailparse"
+	"email-harvester/internal/models"
+	"email-harvester/internal/providers"
+)
+
+// mailboxBatchSize is the number of new emails a mailbox writes at once
+const mailboxBatchSize = 100
+
+// accountMailbox is the stored copy of one account's mailbox that providers
+// sync into. New emails are held back and written in batches, at the latest
+// before the sync cursors are saved and by Flush.
+type accountMailbox struct {
+	service *EmailService
+	account *models.Account
+	pending []*models.Email // Added but not written yet, in order
+}
+
+var _ providers.Mailbox = (*accountMailbox)(nil)
+
+// mailbox returns the stored mailbox of an account
+func (s *EmailService) mailbox(account *models.Account) *accountMailbox {
+	return &accountMailbox{service: s, account: account}
+}
+
+// Get returns a stored or pending email by provider message ID, or nil when
+// it is neither
+func (m *accountMailbox) Get(ctx context.Context, messageID string) (*models.Email, error) {
+	if i := m.pendingIndex(messageID); i >= 0 {
+		return m.pending[i], nil
+	}
+	return m.service.store.GetEmailByMessageID(ctx, m.account.ID, messageID)
+}
+
+// Add saves the attachments to the blob store and queues the email to be
+// stored
+func (m *accountMailbox) Add(ctx context.Context, email *models.Email, attachments []mailparse.Attachment) error {
+	email.AccountID = m.account.ID
+	if email.CreatedAt.IsZero() {
+		email.CreatedAt = time.Now()
+	}
+	email.UpdatedAt = time.Now()
+
+	if err := saveAttachments(ctx, m.service.blobs, email, attachments); err != nil {
+		return err
+	}
+	m.pending = append(m.pending, email)
+	if len(m.pending) >= mailboxBatchSize {
+		return m.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the pending emails. Emails that fail are logged and skipped
+// rather than failing the sync; it only fails when none could be written.
+func (m *accountMailbox) Flush(ctx context.Context) error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	emails := m.pending
+	m.pending = nil
+
+	results, err := m.service.createEmails(ctx, emails)
+	if err != nil {
+		return fmt.Errorf("failed to store emails: %w", err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			m.service.monitor.LogError("Failed to store email", result.Err,
+				zap.String("account_id", m.account.ID.Hex()),
+				zap.String("message_id", emails[i].MessageID),
+			)
+		}
+	}
+	return nil
+}
+
+// Update saves a changed email. Pending emails are written as they are
+// when flushed.
+func (m *accountMailbox) Update(ctx context.Context, email *models.Email) error {
+	email.UpdatedAt = time.Now()
+	if m.pendingIndex(email.MessageID) >= 0 {
+		return nil
+	}
+	return m.service.store.UpdateEmail(ctx, email)
+}
+
+// Remove deletes a stored or pending email if there is one
+func (m *accountMailbox) Remove(ctx context.Context, messageID string) error {
+	if i := m.pendingIndex(messageID); i >= 0 {
+		m.pending = append(m.pending[:i], m.pending[i+1:]...)
+		return nil
+	}
+
+	email, _ := m.Get(ctx, messageID)
+	if email == nil {
+		return nil // Never ingested
+	}
+	if err := m.service.store.DeleteEmail(ctx, email.ID); err != nil {
+		return err
+	}
+	return m.service.threads.Remove(ctx, email)
+}
+
+// Reset deletes every stored and pending email and thread of the account
+func (m *accountMailbox) Reset(ctx context.Context) error {
+	m.pending = nil
+	if err := m.service.store.DeleteAccountEmails(ctx, m.account.ID); err != nil {
+		return err
+	}
+	return m.service.store.DeleteAccountThreads(ctx, m.account.ID)
+}
+
+// SaveAccount writes the pending emails, then persists the account's sync
+// cursors, so that a cursor never skips emails that were not written
+func (m *accountMailbox) SaveAccount(ctx context.Context, account *models.Account) error {
+	if err := m.Flush(ctx); err != nil {
+		return err
+	}
+	return m.service.store.UpdateAccount(ctx, account)
+}
+
+// pendingIndex returns the index of the pending email with messageID, or -1
+func (m *accountMailbox) pendingIndex(messageID string) int {
+	for i, email := range m.pending {
+		if email.MessageID == messageID {
+			return i
+		}
+	}
+	return -1
+}
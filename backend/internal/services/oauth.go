@@ -4,188 +4,159 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
-	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
-	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 
-	"email-harvester/internal/config"
-	"email-harvester/internal/monitoring"
 	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
 	"email-harvester/internal/store"
 )
 
+// oauthStateTTL is how long a user has to complete a connect flow
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	// ErrInvalidOAuthState is returned for a callback whose state is unknown,
+	// expired, already used or was issued to another user or provider
+	ErrInvalidOAuthState = errors.New("invalid OAuth state")
+
+	errNoOAuthStore = errors.New("OAuth service has no store")
+)
+
 // OAuthService handles OAuth authentication for email providers
 type OAuthService struct {
-	config  *config.Config
-	monitor *monitoring.Monitor
-	// Microsoft MSAL clients
-	msalPublicClient     public.Client
-	msalConfidentialApp  confidential.Client
-	store  *store.MongoStore
-	states map[string]string // In-memory state store for OAuth flow
+	providers *providers.Registry
+	monitor   *monitoring.Monitor
+	store     store.Store
 }
 
 // NewOAuthService creates a new OAuth service
-func NewOAuthService(cfg *config.Config, monitor *monitoring.Monitor) (*OAuthService, error) {
-	// Initialize Microsoft MSAL clients
-	msalPublicClient, err := public.New(cfg.OAuth.Microsoft.ClientID,
-		public.WithAuthority(cfg.OAuth.Microsoft.Authority))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create MSAL public client: %w", err)
-	}
-
-	cred, err := confidential.NewCredFromSecret(cfg.OAuth.Microsoft.ClientSecret)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create MSAL credential: %w", err)
-	}
-
-	msalConfidentialApp, err := confidential.New(cfg.OAuth.Microsoft.ClientID, cred,
-		confidential.WithAuthority(cfg.OAuth.Microsoft.Authority))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create MSAL confidential client: %w", err)
-	}
-
+func NewOAuthService(registry *providers.Registry, monitor *monitoring.Monitor) *OAuthService {
 	return &OAuthService{
-		config:              cfg,
-		monitor:             monitor,
-		msalPublicClient:    msalPublicClient,
-		msalConfidentialApp: msalConfidentialApp,
-		states:              make(map[string]string),
-	}, nil
+		providers: registry,
+		monitor:   monitor,
+	}
 }
 
-// SetStore sets the store for the OAuth service
-func (s *OAuthService) SetStore(store *store.MongoStore) {
+// SetStore sets the store that pending OAuth states and connected accounts
+// are saved to
+func (s *OAuthService) SetStore(store store.Store) {
 	s.store = store
 }
 
-// GetAuthURL generates an authorization URL for the specified provider
-func (s *OAuthService) GetAuthURL(ctx context.Context, provider string, state string) (string, error) {
+// ProviderID resolves a provider name, such as "google", to the canonical
+// provider ID stored on accounts
+func (s *OAuthService) ProviderID(provider string) (string, error) {
+	return s.providers.Canonical(provider)
+}
+
+// GetAuthURL starts a connect flow for the user: it records a fresh state and
+// PKCE verifier and returns the provider's authorization URL
+func (s *OAuthService) GetAuthURL(ctx context.Context, userID primitive.ObjectID, provider string) (string, error) {
 	ctx, span := s.monitor.WithSpan(ctx, "oauth.get_auth_url")
 	defer span.End()
 
 	s.monitor.LogDebug("Generating auth URL",
 		zap.String("provider", provider),
-		zap.String("state", state),
+		zap.String("user_id", userID.Hex()),
 	)
 
-	switch provider {
-	case "google":
-		return s.getGoogleAuthURL(state)
-	case "microsoft":
-		return s.getMicrosoftAuthURL(ctx, state)
-	default:
-		err := fmt.Errorf("unsupported provider: %s", provider)
+	p, err := s.providers.Get(provider)
+	if err != nil {
 		s.monitor.RecordError(span, err)
 		return "", err
 	}
-}
-
-// getGoogleAuthURL generates a Google OAuth authorization URL
-func (s *OAuthService) getGoogleAuthURL(state string) (string, error) {
-	params := url.Values{}
-	params.Set("client_id", s.config.OAuth.Google.ClientID)
-	params.Set("redirect_uri", s.config.OAuth.Google.RedirectURL)
-	params.Set("response_type", "code")
-	params.Set("scope", strings.Join(s.config.OAuth.Google.Scopes, " "))
-	params.Set("access_type", "offline")
-	params.Set("prompt", "consent")
-	params.Set("state", state)
-
-	return fmt.Sprintf("https://accounts.google.com/o/oauth2/v2/auth?%s", params.Encode()), nil
-}
+	if s.store == nil {
+		s.monitor.RecordError(span, errNoOAuthStore)
+		return "", errNoOAuthStore
+	}
 
-// getMicrosoftAuthURL generates a Microsoft OAuth authorization URL
-func (s *OAuthService) getMicrosoftAuthURL(ctx context.Context, state string) (string, error) {
-	authURL, err := s.msalPublicClient.CreateAuthCodeURL(ctx, s.config.OAuth.Microsoft.ClientID,
-		s.config.OAuth.Microsoft.RedirectURL, s.config.OAuth.Microsoft.Scopes,
-		public.WithState(state))
+	state, err := newOAuthState()
 	if err != nil {
-		return "", fmt.Errorf("failed to create Microsoft auth URL: %w", err)
+		s.monitor.RecordError(span, err)
+		return "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	pending := &models.OAuthState{
+		State:        state,
+		UserID:       userID,
+		Provider:     p.ID(),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		ExpiresAt:    time.Now().Add(oauthStateTTL),
+	}
+	if err := s.store.CreateOAuthState(ctx, pending); err != nil {
+		s.monitor.RecordError(span, err)
+		return "", fmt.Errorf("failed to save state: %w", err)
 	}
-	return authURL, nil
+
+	return p.AuthCodeURL(ctx, pending.State, pending.CodeVerifier)
 }
 
-// HandleCallback processes the OAuth callback and returns the tokens
-func (s *OAuthService) HandleCallback(ctx context.Context, provider string, code string) (*models.OAuthTokens, error) {
+// HandleCallback verifies and consumes the state of a connect flow started by
+// the user and exchanges the code for tokens. It returns ErrInvalidOAuthState
+// when the state does not check out.
+func (s *OAuthService) HandleCallback(ctx context.Context, userID primitive.ObjectID, provider, code, state string) (*models.OAuthTokens, error) {
 	ctx, span := s.monitor.WithSpan(ctx, "oauth.handle_callback")
 	defer span.End()
 
 	s.monitor.LogDebug("Handling OAuth callback",
 		zap.String("provider", provider),
+		zap.String("user_id", userID.Hex()),
 	)
 
-	switch provider {
-	case "google":
-		return s.handleGoogleCallback(ctx, code)
-	case "microsoft":
-		return s.handleMicrosoftCallback(ctx, code)
-	default:
-		err := fmt.Errorf("unsupported provider: %s", provider)
+	p, err := s.providers.Get(provider)
+	if err != nil {
 		s.monitor.RecordError(span, err)
 		return nil, err
 	}
-}
-
-// handleGoogleCallback processes the Google OAuth callback
-func (s *OAuthService) handleGoogleCallback(ctx context.Context, code string) (*models.OAuthTokens, error) {
-	params := url.Values{}
-	params.Set("client_id", s.config.OAuth.Google.ClientID)
-	params.Set("client_secret", s.config.OAuth.Google.ClientSecret)
-	params.Set("code", code)
-	params.Set("grant_type", "authorization_code")
-	params.Set("redirect_uri", s.config.OAuth.Google.RedirectURL)
+	if s.store == nil {
+		s.monitor.RecordError(span, errNoOAuthStore)
+		return nil, errNoOAuthStore
+	}
 
-	resp, err := http.PostForm("https://oauth2.googleapis.com/token", params)
+	pending, err := s.store.ConsumeOAuthState(ctx, state)
 	if err != nil {
-		return nil, fmt.Errorf("failed to exchange code for token: %w", err)
+		s.monitor.RecordError(span, err)
+		return nil, fmt.Errorf("failed to load state: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("token exchange failed with status: %d", resp.StatusCode)
+	if pending == nil || time.Now().After(pending.ExpiresAt) ||
+		pending.UserID != userID || pending.Provider != p.ID() {
+		s.monitor.RecordError(span, ErrInvalidOAuthState)
+		return nil, ErrInvalidOAuthState
 	}
 
-	var tokenResp struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		TokenType    string `json:"token_type"`
-	}
+	return p.Exchange(ctx, code, pending.CodeVerifier)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return nil, fmt.Errorf("failed to decode token response: %w", err)
-	}
+// SaveAccount stores the account connected by an OAuth callback. When the user
+// already connected the same mailbox, its tokens and profile are updated
+// instead of creating a second account.
+func (s *OAuthService) SaveAccount(ctx context.Context, create *models.AccountCreate) (*models.Account, error) {
+	ctx, span := s.monitor.WithSpan(ctx, "oauth.save_account")
+	defer span.End()
 
-	return &models.OAuthTokens{
-		AccessToken:  tokenResp.AccessToken,
-		RefreshToken: tokenResp.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
-		TokenType:    tokenResp.TokenType,
-	}, nil
-}
+	if s.store == nil {
+		s.monitor.RecordError(span, errNoOAuthStore)
+		return nil, errNoOAuthStore
+	}
 
-// handleMicrosoftCallback processes the Microsoft OAuth callback
-func (s *OAuthService) handleMicrosoftCallback(ctx context.Context, code string) (*models.OAuthTokens, error) {
-	result, err := s.msalPublicClient.AcquireTokenByAuthCode(ctx, code,
-		s.config.OAuth.Microsoft.RedirectURL, s.config.OAuth.Microsoft.Scopes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to acquire token: %w", err)
+	account := models.FromCreate(create)
+	if err := s.store.UpsertAccount(ctx, account); err != nil {
+		s.monitor.RecordError(span, err)
+		return nil, fmt.Errorf("failed to save account: %w", err)
 	}
 
-	return &models.OAuthTokens{
-		AccessToken:  result.AccessToken,
-		RefreshToken: result.RefreshToken,
-		ExpiresAt:    result.ExpiresOn,
-		TokenType:    "Bearer",
-	}, nil
+	s.monitor.LogInfo("Connected account",
+		zap.String("account_id", account.ID.Hex()),
+		zap.String("user_id", account.UserID.Hex()),
+		zap.String("provider", account.Provider),
+	)
+	return account, nil
 }
 
 // RefreshToken refreshes the OAuth tokens for the specified provider
@@ -197,68 +168,12 @@ func (s *OAuthService) RefreshToken(ctx context.Context, provider string, refres
 		zap.String("provider", provider),
 	)
 
-	switch provider {
-	case "google":
-		return s.refreshGoogleToken(ctx, refreshToken)
-	case "microsoft":
-		return s.refreshMicrosoftToken(ctx, refreshToken)
-	default:
-		err := fmt.Errorf("unsupported provider: %s", provider)
+	p, err := s.providers.Get(provider)
+	if err != nil {
 		s.monitor.RecordError(span, err)
 		return nil, err
 	}
-}
-
-// refreshGoogleToken refreshes a Google OAuth token
-func (s *OAuthService) refreshGoogleToken(ctx context.Context, refreshToken string) (*models.OAuthTokens, error) {
-	params := url.Values{}
-	params.Set("client_id", s.config.OAuth.Google.ClientID)
-	params.Set("client_secret", s.config.OAuth.Google.ClientSecret)
-	params.Set("refresh_token", refreshToken)
-	params.Set("grant_type", "refresh_token")
-
-	resp, err := http.PostForm("https://oauth2.googleapis.com/token", params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to refresh token: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("token refresh failed with status: %d", resp.StatusCode)
-	}
-
-	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		TokenType   string `json:"token_type"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return nil, fmt.Errorf("failed to decode token response: %w", err)
-	}
-
-	return &models.OAuthTokens{
-		AccessToken:  tokenResp.AccessToken,
-		RefreshToken: refreshToken, // Google returns the same refresh token
-		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
-		TokenType:    tokenResp.TokenType,
-	}, nil
-}
-
-// refreshMicrosoftToken refreshes a Microsoft OAuth token
-func (s *OAuthService) refreshMicrosoftToken(ctx context.Context, refreshToken string) (*models.OAuthTokens, error) {
-	result, err := s.msalConfidentialApp.AcquireTokenByRefreshToken(ctx, refreshToken,
-		s.config.OAuth.Microsoft.Scopes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to refresh token: %w", err)
-	}
-
-	return &models.OAuthTokens{
-		AccessToken:  result.AccessToken,
-		RefreshToken: result.RefreshToken,
-		ExpiresAt:    result.ExpiresOn,
-		TokenType:    "Bearer",
-	}, nil
+	return p.Refresh(ctx, refreshToken)
 }
 
 // GetUserInfo retrieves user information from the provider
@@ -270,89 +185,19 @@ func (s *OAuthService) GetUserInfo(ctx context.Context, provider string, accessT
 		zap.String("provider", provider),
 	)
 
-	switch provider {
-	case "google":
-		return s.getGoogleUserInfo(ctx, accessToken)
-	case "microsoft":
-		return s.getMicrosoftUserInfo(ctx, accessToken)
-	default:
-		err := fmt.Errorf("unsupported provider: %s", provider)
+	p, err := s.providers.Get(provider)
+	if err != nil {
 		s.monitor.RecordError(span, err)
 		return nil, err
 	}
+	return p.UserInfo(ctx, accessToken)
 }
 
-// getGoogleUserInfo retrieves user information from Google
-func (s *OAuthService) getGoogleUserInfo(ctx context.Context, accessToken string) (*models.UserInfo, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/oauth2/v2/userinfo", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user info: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get user info with status: %d", resp.StatusCode)
-	}
-
-	var userInfo struct {
-		ID            string `json:"id"`
-		Email         string `json:"email"`
-		VerifiedEmail bool   `json:"verified_email"`
-		Name          string `json:"name"`
-		Picture       string `json:"picture"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode user info: %w", err)
+// newOAuthState returns an unguessable state value
+func newOAuthState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-
-	return &models.UserInfo{
-		ID:      userInfo.ID,
-		Email:   userInfo.Email,
-		Name:    userInfo.Name,
-		Picture: userInfo.Picture,
-	}, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
-
-// getMicrosoftUserInfo retrieves user information from Microsoft
-func (s *OAuthService) getMicrosoftUserInfo(ctx context.Context, accessToken string) (*models.UserInfo, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://graph.microsoft.com/v1.0/me", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user info: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get user info with status: %d", resp.StatusCode)
-	}
-
-	var userInfo struct {
-		ID                string `json:"id"`
-		UserPrincipalName string `json:"userPrincipalName"`
-		DisplayName       string `json:"displayName"`
-		Mail              string `json:"mail"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode user info: %w", err)
-	}
-
-	return &models.UserInfo{
-		ID:      userInfo.ID,
-		Email:   userInfo.Mail,
-		Name:    userInfo.DisplayName,
-		Picture: "", // Microsoft Graph API doesn't provide profile picture by default
-	}, nil
-} 
\ No newline at end of file
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/store"
+)
+
+// GraphNotificationRequest is the body Microsoft Graph POSTs to a
+// subscription's notification URL
+type GraphNotificationRequest struct {
+	Value []GraphNotification `json:"value"`
+}
+
+// GraphNotification is a single change or lifecycle notification
+type GraphNotification struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ClientState    string `json:"clientState"`
+	ChangeType     string `json:"changeType"`     // created, updated or deleted
+	LifecycleEvent string `json:"lifecycleEvent"` // Set instead of ChangeType on lifecycle notifications
+	Resource       string `json:"resource"`
+	ResourceData   struct {
+		ID string `json:"id"`
+	} `json:"resourceData"`
+}
+
+// Graph lifecycle events
+const (
+	graphLifecycleReauthorize = "reauthorizationRequired"
+	graphLifecycleRemoved     = "subscriptionRemoved"
+	graphLifecycleMissed      = "missed"
+)
+
+// OutlookPushConfig configures Graph change notifications for Outlook accounts
+type OutlookPushConfig struct {
+	NotificationURL string        // Public base URL of the notification endpoint, the account ID is appended
+	RenewInterval   time.Duration // How often subscriptions are checked for renewal
+	RenewBefore     time.Duration // Renew subscriptions expiring within this window
+}
+
+// OutlookPushService receives Graph change notifications and keeps the
+// message subscriptions of Outlook accounts alive
+type OutlookPushService struct {
+	store        store.Store
+	emailService *EmailService
+	jobService   *JobService
+	monitor      *monitoring.Monitor
+	config       OutlookPushConfig
+}
+
+// NewOutlookPushService creates a new Outlook push service
+func NewOutlookPushService(store store.Store, emailService *EmailService, jobService *JobService, monitor *monitoring.Monitor, config OutlookPushConfig) *OutlookPushService {
+	return &OutlookPushService{
+		store:        store,
+		emailService: emailService,
+		jobService:   jobService,
+		monitor:      monitor,
+		config:       config,
+	}
+}
+
+// HandleNotifications verifies a batch of notifications for an account
+// against its subscription and queues a sync of the changed messages.
+// Lifecycle notifications renew or recreate the subscription and queue a full
+// sync when Graph may have dropped notifications.
+func (s *OutlookPushService) HandleNotifications(ctx context.Context, accountID primitive.ObjectID, req *GraphNotificationRequest) error {
+	account, err := s.store.GetAccount(ctx, accountID)
+	if err != nil || account == nil || account.Provider != string(models.AccountTypeOutlook) || account.GraphSubscription == nil {
+		return fmt.Errorf("%w: no subscription for account %s", ErrPushUnauthorized, accountID.Hex())
+	}
+	subscription := account.GraphSubscription
+
+	for _, n := range req.Value {
+		if n.SubscriptionID != subscription.ID ||
+			subtle.ConstantTimeCompare([]byte(n.ClientState), []byte(subscription.ClientState)) != 1 {
+			return fmt.Errorf("%w: clientState mismatch for subscription %q", ErrPushUnauthorized, n.SubscriptionID)
+		}
+	}
+
+	logFields := []zap.Field{
+		zap.String("account_id", accountID.Hex()),
+		zap.String("subscription_id", subscription.ID),
+	}
+	if !account.IsActive {
+		s.monitor.LogDebug("Ignoring Graph notifications for inactive account", logFields...)
+		return nil
+	}
+
+	var messageIDs []string
+	seen := make(map[string]bool)
+	fullSync := false
+	for _, n := range req.Value {
+		switch n.LifecycleEvent {
+		case "":
+			if id := n.ResourceData.ID; id != "" && !seen[id] {
+				seen[id] = true
+				messageIDs = append(messageIDs, id)
+			}
+		case graphLifecycleReauthorize:
+			if err := s.emailService.SubscribeOutlook(ctx, account, s.config.NotificationURL); err != nil {
+				return fmt.Errorf("failed to reauthorize subscription: %w", err)
+			}
+		case graphLifecycleRemoved:
+			if err := s.emailService.SubscribeOutlook(ctx, account, s.config.NotificationURL); err != nil {
+				return fmt.Errorf("failed to recreate subscription: %w", err)
+			}
+			fullSync = true
+		case graphLifecycleMissed:
+			fullSync = true
+		}
+	}
+
+	var enqueue *models.EnqueueJobRequest
+	switch {
+	case fullSync:
+		// A full sync catches up on everything, including the notified messages
+		enqueue = &models.EnqueueJobRequest{Type: models.JobTypeSync, AccountID: accountID.Hex()}
+	case len(messageIDs) > 0:
+		enqueue = &models.EnqueueJobRequest{
+			Type:       models.JobTypeOutlookMessages,
+			AccountID:  accountID.Hex(),
+			MessageIDs: messageIDs,
+		}
+	default:
+		return nil
+	}
+
+	job, err := s.jobService.Enqueue(ctx, enqueue)
+	if err != nil {
+		return fmt.Errorf("failed to queue sync: %w", err)
+	}
+
+	s.monitor.LogDebug("Queued sync for Graph notifications", append(logFields,
+		zap.String("job_id", job.ID.Hex()),
+		zap.Int("messages", len(messageIDs)),
+	)...)
+	return nil
+}
+
+// RunSubscriptionRenewer renews subscriptions every RenewInterval until ctx
+// is canceled
+func (s *OutlookPushService) RunSubscriptionRenewer(ctx context.Context) {
+	for {
+		if err := s.RenewSubscriptions(ctx); err != nil && ctx.Err() == nil {
+			s.monitor.LogError("Failed to renew Graph subscriptions", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.config.RenewInterval):
+		}
+	}
+}
+
+// RenewSubscriptions creates a subscription for every active Outlook account
+// that has none and extends the ones expiring within RenewBefore
+func (s *OutlookPushService) RenewSubscriptions(ctx context.Context) error {
+	accounts, err := s.store.ListActiveAccounts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	deadline := time.Now().Add(s.config.RenewBefore)
+	for i := range accounts {
+		account := &accounts[i]
+		if account.Provider != string(models.AccountTypeOutlook) {
+			continue
+		}
+		if account.GraphSubscription != nil && account.GraphSubscription.ExpiresAt.After(deadline) {
+			continue
+		}
+
+		if err := s.emailService.SubscribeOutlook(ctx, account, s.config.NotificationURL); err != nil {
+			s.monitor.LogError("Failed to renew Graph subscription", err,
+				zap.String("account_id", account.ID.Hex()))
+			continue
+		}
+		s.monitor.LogInfo("Renewed Graph subscription",
+			zap.String("account_id", account.ID.Hex()),
+			zap.String("subscription_id", account.GraphSubscription.ID),
+			zap.Time("expires_at", account.GraphSubscription.ExpiresAt),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/search"
+	"email-harvester/internal/store"
+)
+
+// ErrEmptySearch is returned for search queries without any words or phrases
+var ErrEmptySearch = errors.New("search query has no terms")
+
+// ListEmails lists a page of the emails matching a search query, newest
+// first, optionally within one account. Malformed queries are reported with
+// search.ErrInvalidQuery. Unless it is the last page, the response also holds
+// the cursor to continue from with ListEmailsAfter.
+func (s *EmailService) ListEmails(ctx context.Context, query string, accountID *primitive.ObjectID, page, limit int) (*models.EmailListResponse, error) {
+	filter, err := search.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	filter.AccountID = accountID
+
+	emails, total, err := s.store.ListEmails(ctx, filter, page, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list emails: %w", err)
+	}
+	if emails == nil {
+		emails = []models.Email{}
+	}
+
+	response := &models.EmailListResponse{
+		Emails: emails,
+		Total:  total,
+		Page:   page,
+		Limit:  limit,
+	}
+	if n := len(emails); n > 0 && int64((page-1)*limit+n) < total {
+		last := emails[n-1]
+		response.NextCursor = store.EncodeCursor(last.ReceivedAt, last.ID)
+	}
+	return response, nil
+}
+
+// ListEmailsAfter lists the emails matching a search query after a cursor,
+// optionally within one account. Cursors from other listings are rejected
+// with store.ErrInvalidCursor.
+func (s *EmailService) ListEmailsAfter(ctx context.Context, query string, accountID *primitive.ObjectID, cursor string, limit int) (*models.EmailListResponse, error) {
+	filter, err := search.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	filter.AccountID = accountID
+
+	emails, next, err := s.store.ListEmailsAfter(ctx, filter, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list emails: %w", err)
+	}
+	if emails == nil {
+		emails = []models.Email{}
+	}
+
+	return &models.EmailListResponse{
+		Emails:     emails,
+		Limit:      limit,
+		NextCursor: next,
+	}, nil
+}
+
+// SearchEmails runs a ranked full-text search with a search query, optionally
+// within one account, and highlights the matches of every result in snippets.
+// The query needs at least one word or phrase to rank by.
+func (s *EmailService) SearchEmails(ctx context.Context, query string, accountID *primitive.ObjectID, page, limit int) (*models.EmailSearchResponse, error) {
+	filter, err := search.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter.Text) == 0 {
+		return nil, ErrEmptySearch
+	}
+	filter.AccountID = accountID
+
+	results, total, err := s.store.SearchEmails(ctx, filter, page, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search emails: %w", err)
+	}
+	if results == nil {
+		results = []models.EmailSearchResult{}
+	}
+	for i := range results {
+		results[i].Snippets = search.Snippets(&results[i].Email, filter.Text)
+	}
+
+	return &models.EmailSearchResponse{
+		Results: results,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, nil
+}
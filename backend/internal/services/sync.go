@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/search"
+	"email-harvester/internal/store"
+)
+
+// SyncResult summarizes one sync of an account
+type SyncResult struct {
+	AccountID      string `json:"account_id"`
+	MessagesAdded  int    `json:"messages_added"`
+	MessagesFailed int    `json:"messages_failed,omitempty"` // Could not be stored, and were skipped
+}
+
+// syncResultKey is the context key under which FetchEmails tracks its SyncResult
+type syncResultKey struct{}
+
+// createEmails stores newly synced emails of one account in their threads
+// and counts them towards the running sync's result. Emails the account
+// already has are skipped. It returns the result of every email.
+func (s *EmailService) createEmails(ctx context.Context, emails []*models.Email) ([]store.BulkEmailResult, error) {
+	for _, email := range emails {
+		email.HTMLText = search.PlainText(email.HTMLBody)
+	}
+	results, err := s.threads.AddAll(ctx, emails, func() ([]store.BulkEmailResult, error) {
+		return s.store.BulkUpsertEmails(ctx, emails)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result, ok := ctx.Value(syncResultKey{}).(*SyncResult); ok {
+		for _, r := range results {
+			switch {
+			case r.Created:
+				result.MessagesAdded++
+			case r.Err != nil:
+				result.MessagesFailed++
+			}
+		}
+	}
+	return results, nil
+}
+
+// SyncSchedulerConfig controls how often accounts are synced in the background
+type SyncSchedulerConfig struct {
+	Interval    time.Duration // Time between two sync rounds
+	Jitter      time.Duration // Random spread added to or removed from Interval
+	Timeout     time.Duration // Upper bound for syncing a single account
+	Concurrency int           // Accounts synced in parallel
+}
+
+// SyncScheduler periodically syncs every active account and records the
+// outcome on the account
+type SyncScheduler struct {
+	store        store.Store
+	emailService *EmailService
+	monitor      *monitoring.Monitor
+	config       SyncSchedulerConfig
+
+	mu      sync.Mutex
+	running map[primitive.ObjectID]bool
+}
+
+// NewSyncScheduler creates a new sync scheduler
+func NewSyncScheduler(store store.Store, emailService *EmailService, monitor *monitoring.Monitor, config SyncSchedulerConfig) *SyncScheduler {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	return &SyncScheduler{
+		store:        store,
+		emailService: emailService,
+		monitor:      monitor,
+		config:       config,
+		running:      make(map[primitive.ObjectID]bool),
+	}
+}
+
+// Run syncs all active accounts, then keeps doing so every interval until ctx
+// is canceled
+func (s *SyncScheduler) Run(ctx context.Context) {
+	s.monitor.LogInfo("Starting sync scheduler",
+		zap.Duration("interval", s.config.Interval),
+		zap.Duration("jitter", s.config.Jitter),
+	)
+
+	for {
+		s.syncAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.monitor.LogInfo("Sync scheduler stopped")
+			return
+		case <-time.After(s.nextDelay()):
+		}
+	}
+}
+
+// nextDelay returns the interval randomly shifted by up to the jitter, so
+// several server instances do not hit the providers in lockstep
+func (s *SyncScheduler) nextDelay() time.Duration {
+	delay := s.config.Interval
+	if s.config.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*s.config.Jitter))) - s.config.Jitter
+	}
+	if delay < time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// syncAll syncs the active accounts, at most Concurrency at a time
+func (s *SyncScheduler) syncAll(ctx context.Context) {
+	accounts, err := s.store.ListActiveAccounts(ctx)
+	if err != nil {
+		s.monitor.LogError("Failed to list active accounts", err)
+		return
+	}
+
+	sem := make(chan struct{}, s.config.Concurrency)
+	var wg sync.WaitGroup
+
+	for i := range accounts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+
+		wg.Add(1)
+		go func(account *models.Account) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.SyncAccount(ctx, account)
+		}(&accounts[i])
+	}
+
+	wg.Wait()
+}
+
+// SyncAccount syncs one account and records the outcome. An account that is
+// still being synced from a previous round is skipped.
+func (s *SyncScheduler) SyncAccount(ctx context.Context, account *models.Account) {
+	if !s.acquire(account.ID) {
+		s.monitor.LogDebug("Skipping account still being synced",
+			zap.String("account_id", account.ID.Hex()))
+		return
+	}
+	defer s.release(account.ID)
+
+	syncCtx := ctx
+	if s.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		syncCtx, cancel = context.WithTimeout(ctx, s.config.Timeout)
+		defer cancel()
+	}
+
+	status := &models.SyncStatus{}
+	if account.SyncStatus != nil {
+		*status = *account.SyncStatus
+	}
+
+	start := time.Now()
+	status.LastAttemptAt = start
+	result, err := s.emailService.FetchEmails(syncCtx, account.ID.Hex())
+	status.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	var lastSyncAt time.Time
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+		s.monitor.LogError("Failed to sync account", err,
+			zap.String("account_id", account.ID.Hex()),
+			zap.String("provider", account.Provider),
+		)
+	} else {
+		lastSyncAt = time.Now()
+		status.LastSuccessAt = lastSyncAt
+		status.LastError = ""
+		status.MessagesAdded = result.MessagesAdded
+		s.monitor.LogInfo("Synced account",
+			zap.String("account_id", account.ID.Hex()),
+			zap.String("provider", account.Provider),
+			zap.Int("messages_added", result.MessagesAdded),
+			zap.Int("messages_failed", result.MessagesFailed),
+		)
+	}
+
+	// Record the outcome even if the sync was cut short by shutdown
+	if err := s.store.UpdateSyncStatus(context.WithoutCancel(ctx), account.ID, lastSyncAt, status); err != nil {
+		s.monitor.LogError("Failed to record sync status", err,
+			zap.String("account_id", account.ID.Hex()))
+	}
+}
+
+func (s *SyncScheduler) acquire(id primitive.ObjectID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[id] {
+		return false
+	}
+	s.running[id] = true
+	return true
+}
+
+func (s *SyncScheduler) release(id primitive.ObjectID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
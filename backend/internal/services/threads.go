@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/store"
+	"email-harvester/internal/threading"
+)
+
+// ErrThreadNotFound is returned for unknown threads
+var ErrThreadNotFound = errors.New("thread not found")
+
+// ThreadService files stored emails into threads and keeps the threads'
+// participants, message counts and last activity up to date
+type ThreadService struct {
+	store   store.Store
+	monitor *monitoring.Monitor
+
+	mu    sync.Mutex
+	locks map[primitive.ObjectID]*sync.Mutex
+}
+
+// NewThreadService creates a new thread service
+func NewThreadService(store store.Store, monitor *monitoring.Monitor) *ThreadService {
+	return &ThreadService{
+		store:   store,
+		monitor: monitor,
+		locks:   make(map[primitive.ObjectID]*sync.Mutex),
+	}
+}
+
+// AddAll stores new emails of one account with save and files the ones it
+// created into their threads, starting threads for emails that belong to
+// none. The emails are matched to threads in order before they are saved,
+// so replies saved together end up in one thread, and the emails of an
+// account are threaded one batch at a time.
+func (t *ThreadService) AddAll(ctx context.Context, emails []*models.Email, save func() ([]store.BulkEmailResult, error)) ([]store.BulkEmailResult, error) {
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	ctx, span := t.monitor.WithSpan(ctx, "threads.add_all")
+	defer span.End()
+
+	unlock := t.lock(emails[0].AccountID)
+	defer unlock()
+
+	batch := &threadBatch{store: t.store, stored: make(map[primitive.ObjectID]*models.Thread)}
+	for _, email := range emails {
+		thread, err := t.find(ctx, email, batch.find)
+		if err != nil {
+			t.monitor.RecordError(span, err)
+			return nil, fmt.Errorf("failed to find thread: %v", err)
+		}
+		if thread == nil {
+			thread = &models.Thread{ID: primitive.NewObjectID(), AccountID: email.AccountID}
+			batch.threads = append(batch.threads, thread)
+		}
+		email.ThreadRef = thread.ID
+		threading.Add(thread, email)
+	}
+
+	results, err := save()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the emails save created, and not the ones stored before, which
+	// are already counted in their threads
+	var changed []*models.Thread
+	threads := make(map[primitive.ObjectID]*models.Thread)
+	for i, email := range emails {
+		if !results[i].Created {
+			continue
+		}
+		thread, ok := threads[email.ThreadRef]
+		if !ok {
+			thread = batch.base(email)
+			threads[thread.ID] = thread
+			changed = append(changed, thread)
+		}
+		threading.Add(thread, email)
+	}
+
+	for _, thread := range changed {
+		if batch.stored[thread.ID] == nil {
+			err = t.store.CreateThread(ctx, thread)
+		} else {
+			err = t.store.UpdateThread(ctx, thread)
+		}
+		// The emails are stored either way, so failing here would only
+		// abort the rest of the sync
+		if err != nil {
+			t.monitor.RecordError(span, err)
+			t.monitor.LogError("Failed to save thread", err,
+				zap.String("thread_id", thread.ID.Hex()),
+			)
+		}
+	}
+	return results, nil
+}
+
+// threadBatch holds the threads a batch of emails is being filed into, which
+// take precedence over the stored threads while matching
+type threadBatch struct {
+	store   store.Store
+	threads []*models.Thread
+	// The stored state of the threads that were stored before the batch
+	stored map[primitive.ObjectID]*models.Thread
+}
+
+// find returns the batch's latest thread that has any of keys, or else the
+// stored thread, which joins the batch
+func (b *threadBatch) find(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error) {
+	for i := len(b.threads) - 1; i >= 0; i-- {
+		if hasAnyKey(b.threads[i], keys) {
+			return b.threads[i], nil
+		}
+	}
+
+	thread, err := b.store.FindThread(ctx, accountID, keys)
+	if err != nil || thread == nil {
+		return nil, err
+	}
+	for _, joined := range b.threads {
+		if joined.ID == thread.ID {
+			return joined, nil
+		}
+	}
+	b.stored[thread.ID] = cloneThread(thread)
+	b.threads = append(b.threads, thread)
+	return thread, nil
+}
+
+// base returns the thread email was filed into as it was before the batch
+func (b *threadBatch) base(email *models.Email) *models.Thread {
+	if stored := b.stored[email.ThreadRef]; stored != nil {
+		return cloneThread(stored)
+	}
+	return &models.Thread{ID: email.ThreadRef, AccountID: email.AccountID}
+}
+
+func hasAnyKey(thread *models.Thread, keys []string) bool {
+	for _, have := range thread.Keys {
+		for _, key := range keys {
+			if have == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cloneThread copies a thread, so that adding emails to the copy leaves the
+// original as it is
+func cloneThread(thread *models.Thread) *models.Thread {
+	copied := *thread
+	copied.Participants = append([]models.EmailAddress(nil), thread.Participants...)
+	copied.Keys = append([]string(nil), thread.Keys...)
+	return &copied
+}
+
+// Remove stops counting a deleted email towards its thread, and deletes the
+// thread along with its last email
+func (t *ThreadService) Remove(ctx context.Context, email *models.Email) error {
+	if email.ThreadRef.IsZero() {
+		return nil // Stored before threading
+	}
+
+	unlock := t.lock(email.AccountID)
+	defer unlock()
+
+	thread, err := t.store.GetThread(ctx, email.ThreadRef)
+	if err != nil {
+		return fmt.Errorf("failed to get thread: %v", err)
+	}
+	if thread == nil {
+		return nil
+	}
+
+	thread.MessageCount--
+	if thread.MessageCount <= 0 {
+		err = t.store.DeleteThread(ctx, thread.ID)
+	} else {
+		err = t.store.UpdateThread(ctx, thread)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update thread: %v", err)
+	}
+	return nil
+}
+
+// find returns the thread an email belongs to as lookup finds it by keys,
+// or nil when it starts a new one. The provider's thread ID wins over the
+// threading headers, which win over the subject.
+func (t *ThreadService) find(ctx context.Context, email *models.Email, lookup func(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error)) (*models.Thread, error) {
+	if key := threading.ProviderKey(email); key != "" {
+		thread, err := lookup(ctx, email.AccountID, []string{key})
+		if err != nil || thread != nil {
+			return thread, err
+		}
+	}
+
+	if keys := threading.MessageKeys(email); len(keys) > 0 {
+		thread, err := lookup(ctx, email.AccountID, keys)
+		if err != nil {
+			return nil, err
+		}
+		if thread != nil && !threading.Conflicts(thread, email) {
+			return thread, nil
+		}
+	}
+
+	if key := threading.SubjectKey(email); key != "" {
+		thread, err := lookup(ctx, email.AccountID, []string{key})
+		if err != nil {
+			return nil, err
+		}
+		if thread != nil && !threading.Conflicts(thread, email) && threading.MatchesSubject(thread, email) {
+			return thread, nil
+		}
+	}
+	return nil, nil
+}
+
+// lock serializes threading within an account and returns the unlock
+// function
+func (t *ThreadService) lock(accountID primitive.ObjectID) func() {
+	t.mu.Lock()
+	l, ok := t.locks[accountID]
+	if !ok {
+		l = &sync.Mutex{}
+		t.locks[accountID] = l
+	}
+	t.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// ListThreads lists threads, optionally of one account, by last activity,
+// newest first
+func (s *EmailService) ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) (*models.ThreadListResponse, error) {
+	threads, total, err := s.store.ListThreads(ctx, accountID, page, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list threads: %w", err)
+	}
+	if threads == nil {
+		threads = []models.Thread{}
+	}
+
+	return &models.ThreadListResponse{
+		Threads: threads,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, nil
+}
+
+// GetThread returns a thread with its emails, oldest first
+func (s *EmailService) GetThread(ctx context.Context, id primitive.ObjectID) (*models.ThreadResponse, error) {
+	thread, err := s.store.GetThread(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %w", err)
+	}
+	if thread == nil {
+		return nil, ErrThreadNotFound
+	}
+
+	emails, err := s.store.ListThreadEmails(ctx, thread.AccountID, thread.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list thread emails: %w", err)
+	}
+	if emails == nil {
+		emails = []models.Email{}
+	}
+	return &models.ThreadResponse{Thread: *thread, Emails: emails}, nil
+}
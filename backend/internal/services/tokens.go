@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/providers"
+	"email-harvester/internal/store"
+)
+
+const (
+	// tokenRefreshMargin is how long before expiry an access token is
+	// refreshed, so it stays valid for the request that uses it
+	tokenRefreshMargin = 5 * time.Minute
+
+	// tokenRefreshTimeout bounds a refresh, which runs detached from the
+	// request that started it
+	tokenRefreshTimeout = 30 * time.Second
+
+	// accountRevokedReason is shown to users whose account was deactivated
+	// because the provider rejected its refresh token
+	accountRevokedReason = "Access was revoked or has expired. Reconnect the account to resume syncing."
+)
+
+// ErrAccountRevoked is returned for accounts whose refresh token the provider
+// rejected. They stay inactive until the user reconnects them.
+var ErrAccountRevoked = errors.New("account access revoked")
+
+// TokenManager hands out valid access tokens for accounts. Tokens are only
+// refreshed when they are about to expire, and concurrent refreshes of the
+// same account are collapsed into one.
+type TokenManager struct {
+	store     store.Store
+	providers *providers.Registry
+	monitor   *monitoring.Monitor
+
+	mu       sync.Mutex
+	inflight map[primitive.ObjectID]*tokenRefresh
+}
+
+// tokenRefresh is a refresh in progress that callers can wait on
+type tokenRefresh struct {
+	done   chan struct{}
+	tokens *models.OAuthTokens
+	err    error
+}
+
+// NewTokenManager creates a new token manager
+func NewTokenManager(store store.Store, registry *providers.Registry, monitor *monitoring.Monitor) *TokenManager {
+	return &TokenManager{
+		store:     store,
+		providers: registry,
+		monitor:   monitor,
+		inflight:  make(map[primitive.ObjectID]*tokenRefresh),
+	}
+}
+
+// Authorize looks up the account's provider and makes sure the account holds
+// a valid access token, refreshing it if it is about to expire. Accounts
+// without a refresh token, such as IMAP accounts, are used as is.
+func (m *TokenManager) Authorize(ctx context.Context, account *models.Account) (providers.Provider, error) {
+	provider, err := m.providers.Get(account.Provider)
+	if err != nil {
+		return nil, err
+	}
+	if account.RefreshToken == "" {
+		return provider, nil
+	}
+	if revoked(account) {
+		return nil, ErrAccountRevoked
+	}
+	if fresh(account) {
+		return provider, nil
+	}
+
+	tokens, err := m.refresh(ctx, provider, account.ID)
+	if err != nil {
+		return nil, err
+	}
+	applyTokens(account, tokens)
+	return provider, nil
+}
+
+// refresh refreshes the account's tokens, or waits for the refresh another
+// caller already started
+func (m *TokenManager) refresh(ctx context.Context, provider providers.Provider, accountID primitive.ObjectID) (*models.OAuthTokens, error) {
+	m.mu.Lock()
+	call, ok := m.inflight[accountID]
+	if !ok {
+		call = &tokenRefresh{done: make(chan struct{})}
+		m.inflight[accountID] = call
+
+		// Other callers share the result, so the caller that started the
+		// refresh going away must not cancel it
+		refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenRefreshTimeout)
+		go func() {
+			defer cancel()
+			call.tokens, call.err = m.doRefresh(refreshCtx, provider, accountID)
+
+			m.mu.Lock()
+			delete(m.inflight, accountID)
+			m.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.tokens, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// doRefresh refreshes the stored account's tokens with its provider and saves
+// them, deactivating the account if the provider rejects its refresh token
+func (m *TokenManager) doRefresh(ctx context.Context, provider providers.Provider, accountID primitive.ObjectID) (*models.OAuthTokens, error) {
+	ctx, span := m.monitor.WithSpan(ctx, "tokens.refresh")
+	defer span.End()
+
+	// Work on a fresh copy so a concurrent sync keeps its cursors
+	latest, err := m.store.GetAccount(ctx, accountID)
+	if err != nil {
+		m.monitor.RecordError(span, err)
+		return nil, fmt.Errorf("failed to get account: %v", err)
+	}
+	if latest == nil {
+		return nil, ErrAccountNotFound
+	}
+	if revoked(latest) {
+		return nil, ErrAccountRevoked
+	}
+	// Another instance may have refreshed the tokens since they were read
+	if fresh(latest) {
+		return tokensOf(latest), nil
+	}
+
+	m.monitor.LogDebug("Refreshing access token",
+		zap.String("account_id", accountID.Hex()),
+		zap.String("provider", latest.Provider),
+	)
+
+	tokens, err := provider.Refresh(ctx, latest.RefreshToken)
+	if errors.Is(err, providers.ErrInvalidGrant) {
+		m.monitor.RecordError(span, err)
+		return nil, m.deactivate(ctx, latest, err)
+	}
+	if err != nil {
+		m.monitor.RecordError(span, err)
+		return nil, fmt.Errorf("failed to refresh token: %v", err)
+	}
+
+	// Providers that rotate refresh tokens invalidate the old one, so the
+	// new one has to be saved before it is used
+	applyTokens(latest, tokens)
+	if err := m.store.UpdateAccount(ctx, latest); err != nil {
+		m.monitor.RecordError(span, err)
+		return nil, fmt.Errorf("failed to update account tokens: %v", err)
+	}
+	return tokensOf(latest), nil
+}
+
+// deactivate marks an account whose refresh token was rejected as inactive,
+// so it is no longer synced and the user is asked to reconnect it
+func (m *TokenManager) deactivate(ctx context.Context, account *models.Account, cause error) error {
+	account.IsActive = false
+	account.DisabledReason = accountRevokedReason
+	if err := m.store.UpdateAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to deactivate account: %v", err)
+	}
+
+	m.monitor.LogInfo("Deactivated account with revoked access",
+		zap.String("account_id", account.ID.Hex()),
+		zap.String("provider", account.Provider),
+		zap.Error(cause),
+	)
+	return ErrAccountRevoked
+}
+
+// fresh reports whether the account's access token is valid for longer than
+// the refresh margin
+func fresh(account *models.Account) bool {
+	return account.AccessToken != "" && time.Until(account.TokenExpiry) > tokenRefreshMargin
+}
+
+// revoked reports whether the account was deactivated because its access was
+// revoked
+func revoked(account *models.Account) bool {
+	return !account.IsActive && account.DisabledReason != ""
+}
+
+// applyTokens sets the tokens on an account, keeping its refresh token when
+// the provider did not issue a new one
+func applyTokens(account *models.Account, tokens *models.OAuthTokens) {
+	account.AccessToken = tokens.AccessToken
+	if tokens.RefreshToken != "" {
+		account.RefreshToken = tokens.RefreshToken
+	}
+	account.TokenExpiry = tokens.ExpiresAt
+	account.TokenType = tokens.TokenType
+}
+
+// tokensOf returns the tokens of an account
+func tokensOf(account *models.Account) *models.OAuthTokens {
+	return &models.OAuthTokens{
+		AccessToken:  account.AccessToken,
+		RefreshToken: account.RefreshToken,
+		ExpiresAt:    account.TokenExpiry,
+		TokenType:    account.TokenType,
+	}
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,8 +13,9 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 
-	"email-harvester/backend/internal/models"
-	"email-harvester/backend/internal/monitoring"
+	"email-harvester/internal/models"
+	"email-harvester/internal/monitoring"
+	"email-harvester/internal/secrets"
 )
 
 var (
@@ -30,6 +32,7 @@ type UserService struct {
 	db        *mongo.Database
 	monitor   *monitoring.Monitor
 	usersColl *mongo.Collection
+	keyring   *secrets.Keyring // Encrypts 2FA secrets at rest when set
 }
 
 // NewUserService creates a new user service
@@ -41,6 +44,11 @@ func NewUserService(db *mongo.Database, monitor *monitoring.Monitor) *UserServic
 	}
 }
 
+// SetKeyring sets the keyring 2FA secrets are encrypted with
+func (s *UserService) SetKeyring(keyring *secrets.Keyring) {
+	s.keyring = keyring
+}
+
 // GetByID retrieves a user by their ID
 func (s *UserService) GetByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
 	var user models.User
@@ -51,6 +59,9 @@ func (s *UserService) GetByID(ctx context.Context, id primitive.ObjectID) (*mode
 		}
 		return nil, err
 	}
+	if err := s.openSecret(&user); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -64,6 +75,9 @@ func (s *UserService) GetByEmail(ctx context.Context, email string) (*models.Use
 		}
 		return nil, err
 	}
+	if err := s.openSecret(&user); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -118,6 +132,9 @@ func (s *UserService) UpdateProfile(ctx context.Context, id primitive.ObjectID,
 		}
 		return nil, err
 	}
+	if err := s.openSecret(&user); err != nil {
+		return nil, err
+	}
 
 	s.monitor.RecordMetric("profile_updated", 1, nil)
 	return &user, nil
@@ -173,10 +190,14 @@ func (s *UserService) Enable2FA(ctx context.Context, id primitive.ObjectID) (str
 	if err != nil {
 		return "", err
 	}
+	sealed, err := s.sealSecret(secret.Secret())
+	if err != nil {
+		return "", err
+	}
 
 	update := bson.M{
 		"$set": bson.M{
-			"twoFactorSecret":   secret.Secret(),
+			"twoFactorSecret":   sealed,
 			"twoFactorEnabled": true,
 			"updatedAt":        time.Now(),
 		},
@@ -297,4 +318,69 @@ func (s *UserService) UpdateLastLogin(ctx context.Context, id primitive.ObjectID
 
 	s.monitor.RecordMetric("user_login", 1, nil)
 	return nil
-} 
\ No newline at end of file
+}
+
+// RekeyTwoFactorSecrets re-encrypts every 2FA secret that is still in
+// plaintext or under a key other than the primary one, and returns the number
+// of users it updated
+func (s *UserService) RekeyTwoFactorSecrets(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, errors.New("no keyring configured")
+	}
+
+	cursor, err := s.usersColl.Find(ctx, bson.M{"twoFactorSecret": bson.M{"$nin": bson.A{"", nil}}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	rekeyed := 0
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return rekeyed, err
+		}
+		if !s.keyring.NeedsRekey(user.TwoFactorSecret) {
+			continue
+		}
+
+		// Only replace the secret that was read, in case 2FA changed meanwhile
+		stored := user.TwoFactorSecret
+		if err := s.openSecret(&user); err != nil {
+			return rekeyed, err
+		}
+		sealed, err := s.sealSecret(user.TwoFactorSecret)
+		if err != nil {
+			return rekeyed, err
+		}
+		_, err = s.usersColl.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "twoFactorSecret": stored},
+			bson.M{"$set": bson.M{"twoFactorSecret": sealed}})
+		if err != nil {
+			return rekeyed, err
+		}
+		rekeyed++
+	}
+	return rekeyed, cursor.Err()
+}
+
+// sealSecret encrypts a 2FA secret for storage when a keyring is set
+func (s *UserService) sealSecret(secret string) (string, error) {
+	if s.keyring == nil {
+		return secret, nil
+	}
+	return s.keyring.Encrypt(secret)
+}
+
+// openSecret decrypts the 2FA secret of a stored user in place
+func (s *UserService) openSecret(user *models.User) error {
+	if s.keyring == nil {
+		return nil
+	}
+	secret, err := s.keyring.Decrypt(user.TwoFactorSecret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt 2FA secret: %w", err)
+	}
+	user.TwoFactorSecret = secret
+	return nil
+}
@@ -2,13 +2,20 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"email-harvester/internal/models"
+	"email-harvester/internal/search"
 )
 
 // CosmosStore implements the Store interface using Azure Cosmos DB
@@ -17,6 +24,9 @@ type CosmosStore struct {
 	database   *azcosmos.Database
 	accounts   *azcosmos.Container
 	emails     *azcosmos.Container
+	jobs       *azcosmos.Container
+	states     *azcosmos.Container
+	threads    *azcosmos.Container
 }
 
 // NewCosmosStore creates a new Cosmos DB store instance
@@ -37,25 +47,55 @@ func NewCosmosStore(endpoint, key, databaseName string) (*CosmosStore, error) {
 	}
 
 	// Create containers if they don't exist
-	accounts, err := createContainerIfNotExists(database, "accounts", "/email")
+	accounts, err := createContainerIfNotExists(database, "accounts", "/email", newestFirstIndex("/created_at"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create accounts container: %w", err)
 	}
 
-	emails, err := createContainerIfNotExists(database, "emails", "/accountId")
+	// An account stores each message once
+	emails, err := createContainerIfNotExists(database, "emails", "/account_id", newestFirstIndex("/received_at"), "/account_id", "/message_id")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create emails container: %w", err)
 	}
 
+	jobs, err := createContainerIfNotExists(database, "jobs", "/id", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jobs container: %w", err)
+	}
+
+	states, err := createContainerIfNotExists(database, "oauth_states", "/id", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create oauth_states container: %w", err)
+	}
+
+	threads, err := createContainerIfNotExists(database, "threads", "/account_id", newestFirstIndex("/last_activity_at"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create threads container: %w", err)
+	}
+
 	return &CosmosStore{
 		client:   client,
 		database: database,
 		accounts: accounts,
 		emails:   emails,
+		jobs:     jobs,
+		states:   states,
+		threads:  threads,
 	}, nil
 }
 
-func createContainerIfNotExists(db *azcosmos.Database, id string, partitionKey string) (*azcosmos.Container, error) {
+// newestFirstIndex is the composite index that listings sorted by the
+// timestamp at path and then by ID, newest first, need
+func newestFirstIndex(path string) []azcosmos.CompositeIndex {
+	return []azcosmos.CompositeIndex{
+		{Path: path, Order: azcosmos.CompositeIndexDescending},
+		{Path: "/id", Order: azcosmos.CompositeIndexDescending},
+	}
+}
+
+// createContainerIfNotExists returns a container, creating it with the given
+// composite index and unique key, if any, when it does not exist yet
+func createContainerIfNotExists(db *azcosmos.Database, id string, partitionKey string, compositeIndex []azcosmos.CompositeIndex, uniqueKey ...string) (*azcosmos.Container, error) {
 	container, err := db.NewContainer(id)
 	if err != nil {
 		return nil, err
@@ -81,6 +121,14 @@ func createContainerIfNotExists(db *azcosmos.Database, id string, partitionKey s
 			},
 		},
 	}
+	if compositeIndex != nil {
+		properties.IndexingPolicy.CompositeIndexes = [][]azcosmos.CompositeIndex{compositeIndex}
+	}
+	if len(uniqueKey) > 0 {
+		properties.UniqueKeyPolicy = &azcosmos.UniqueKeyPolicy{
+			UniqueKeys: []azcosmos.UniqueKey{{Paths: uniqueKey}},
+		}
+	}
 
 	_, err = db.CreateContainer(context.Background(), properties, nil)
 	if err != nil {
@@ -90,6 +138,98 @@ func createContainerIfNotExists(db *azcosmos.Database, id string, partitionKey s
 	return container, nil
 }
 
+// accountDocument is an account as stored in Cosmos DB. Items are encoded as
+// JSON, which would drop the credentials and sync state the account model
+// keeps out of API responses.
+type accountDocument struct {
+	*models.Account
+	AccessToken       string                     `json:"access_token"`
+	RefreshToken      string                     `json:"refresh_token"`
+	TokenExpiry       time.Time                  `json:"token_expiry"`
+	HistoryID         uint64                     `json:"history_id,omitempty"`
+	GmailWatch        time.Time                  `json:"gmail_watch,omitempty"`
+	DeltaLinks        map[string]string          `json:"delta_links,omitempty"`
+	GraphSubscription *graphSubscriptionDocument `json:"graph_subscription,omitempty"`
+	IMAP              *imapDocument              `json:"imap,omitempty"`
+	TokenType         string                     `json:"token_type,omitempty"`
+}
+
+type graphSubscriptionDocument struct {
+	*models.GraphSubscription
+	ClientState string `json:"client_state"`
+}
+
+type imapDocument struct {
+	*models.IMAPSettings
+	Password      string `json:"password,omitempty"`
+	UIDValidity   uint32 `json:"uid_validity"`
+	UIDNext       uint32 `json:"uid_next"`
+	HighestModSeq uint64 `json:"highest_modseq,omitempty"`
+}
+
+// newAccountDocument returns the document an account is stored as, with
+// its timestamps in UTC so they compare as strings
+func newAccountDocument(account *models.Account) accountDocument {
+	account.CreatedAt = account.CreatedAt.UTC()
+	account.UpdatedAt = account.UpdatedAt.UTC()
+
+	doc := accountDocument{
+		Account:      account,
+		AccessToken:  account.AccessToken,
+		RefreshToken: account.RefreshToken,
+		TokenExpiry:  account.TokenExpiry,
+		HistoryID:    account.HistoryID,
+		GmailWatch:   account.GmailWatch,
+		DeltaLinks:   account.DeltaLinks,
+		TokenType:    account.TokenType,
+	}
+	if account.GraphSubscription != nil {
+		doc.GraphSubscription = &graphSubscriptionDocument{
+			GraphSubscription: account.GraphSubscription,
+			ClientState:       account.GraphSubscription.ClientState,
+		}
+	}
+	if account.IMAP != nil {
+		doc.IMAP = &imapDocument{
+			IMAPSettings:  account.IMAP,
+			Password:      account.IMAP.Password,
+			UIDValidity:   account.IMAP.UIDValidity,
+			UIDNext:       account.IMAP.UIDNext,
+			HighestModSeq: account.IMAP.HighestModSeq,
+		}
+	}
+	return doc
+}
+
+// account returns the account a document holds
+func (d accountDocument) account() models.Account {
+	var account models.Account
+	if d.Account != nil {
+		account = *d.Account
+	}
+	account.AccessToken = d.AccessToken
+	account.RefreshToken = d.RefreshToken
+	account.TokenExpiry = d.TokenExpiry
+	account.HistoryID = d.HistoryID
+	account.GmailWatch = d.GmailWatch
+	account.DeltaLinks = d.DeltaLinks
+	account.TokenType = d.TokenType
+	if d.GraphSubscription != nil && d.GraphSubscription.GraphSubscription != nil {
+		subscription := *d.GraphSubscription.GraphSubscription
+		subscription.ClientState = d.GraphSubscription.ClientState
+		account.GraphSubscription = &subscription
+	}
+	if d.IMAP != nil && d.IMAP.IMAPSettings != nil {
+		settings := *d.IMAP.IMAPSettings
+		settings.Password = d.IMAP.Password
+		settings.UIDValidity = d.IMAP.UIDValidity
+		settings.UIDNext = d.IMAP.UIDNext
+		settings.HighestModSeq = d.IMAP.HighestModSeq
+		account.IMAP = &settings
+	}
+	return account
+}
+
 // Account operations
 func (s *CosmosStore) CreateAccount(ctx context.Context, account *models.Account) error {
 	if account.ID.IsZero() {
@@ -98,67 +238,105 @@ func (s *CosmosStore) CreateAccount(ctx context.Context, account *models.Account
 	account.CreatedAt = time.Now()
 	account.UpdatedAt = account.CreatedAt
 
-	_, err := s.accounts.CreateItem(ctx, azcosmos.NewPartitionKeyString(account.Email), account, nil)
+	_, err := s.accounts.CreateItem(ctx, azcosmos.NewPartitionKeyString(account.Email), newAccountDocument(account), nil)
 	return err
 }
 
+// GetAccount looks an account up across partitions, as only its ID is known
 func (s *CosmosStore) GetAccount(ctx context.Context, id primitive.ObjectID) (*models.Account, error) {
-	var account models.Account
-	_, err := s.accounts.ReadItem(ctx, azcosmos.NewPartitionKeyString(id.Hex()), id.Hex(), &account)
-	if err != nil {
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: id.Hex()}},
+	}
+	accounts, err := s.queryAccounts(ctx, "SELECT * FROM c WHERE c.id = @id", azcosmos.NewPartitionKey(), &options)
+	if err != nil || len(accounts) == 0 {
 		return nil, err
 	}
-	return &account, nil
+	return &accounts[0], nil
 }
 
 func (s *CosmosStore) GetAccountByEmail(ctx context.Context, email string) (*models.Account, error) {
-	query := fmt.Sprintf("SELECT * FROM c WHERE c.email = @email")
-	parameters := []azcosmos.QueryParameter{
-		{Name: "@email", Value: email},
-	}
-
+	query := "SELECT * FROM c WHERE c.email = @email ORDER BY c.created_at"
 	options := azcosmos.QueryOptions{
-		QueryParameters: parameters,
-	}
-
-	pager := s.accounts.NewQueryItemsPager(query, azcosmos.NewPartitionKeyString(email), &options)
-	var accounts []models.Account
-	for pager.More() {
-		response, err := pager.NextPage(ctx)
-		if err != nil {
-			return nil, err
-		}
-		var batch []models.Account
-		err = response.Unmarshal(&batch)
-		if err != nil {
-			return nil, err
-		}
-		accounts = append(accounts, batch...)
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@email", Value: email}},
 	}
-
-	if len(accounts) == 0 {
-		return nil, fmt.Errorf("account not found")
+	accounts, err := s.queryAccounts(ctx, query, azcosmos.NewPartitionKeyString(email), &options)
+	if err != nil || len(accounts) == 0 {
+		return nil, err
 	}
 	return &accounts[0], nil
 }
 
 func (s *CosmosStore) UpdateAccount(ctx context.Context, account *models.Account) error {
 	account.UpdatedAt = time.Now()
-	_, err := s.accounts.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(account.Email), account.ID.Hex(), account, nil)
+	_, err := s.accounts.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(account.Email), account.ID.Hex(), newAccountDocument(account), nil)
+	if isCosmosNotFound(err) {
+		return nil
+	}
 	return err
 }
 
+func (s *CosmosStore) UpsertAccount(ctx context.Context, account *models.Account) error {
+	query := "SELECT * FROM c WHERE c.email = @email AND c.user_id = @user_id AND c.provider = @provider"
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@email", Value: account.Email},
+			{Name: "@user_id", Value: account.UserID.Hex()},
+			{Name: "@provider", Value: account.Provider},
+		},
+	}
+
+	existing, err := s.queryAccounts(ctx, query, azcosmos.NewPartitionKeyString(account.Email), &options)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		account.IsActive = true
+		account.DisabledReason = ""
+		return s.CreateAccount(ctx, account)
+	}
+
+	stored := existing[0]
+	stored.AccessToken = account.AccessToken
+	stored.TokenExpiry = account.TokenExpiry
+	stored.TokenType = account.TokenType
+	stored.Name = account.Name
+	stored.Picture = account.Picture
+	stored.IsActive = true
+	stored.DisabledReason = ""
+	// Providers only issue a refresh token on the first consent
+	if account.RefreshToken != "" {
+		stored.RefreshToken = account.RefreshToken
+	}
+	if err := s.UpdateAccount(ctx, &stored); err != nil {
+		return err
+	}
+	*account = stored
+	return nil
+}
+
+// DeleteAccount deletes an account along with its emails and threads. The
+// account goes last, so a failed delete can be retried.
 func (s *CosmosStore) DeleteAccount(ctx context.Context, id primitive.ObjectID) error {
 	account, err := s.GetAccount(ctx, id)
-	if err != nil {
+	if err != nil || account == nil {
+		return err
+	}
+	if err := s.DeleteAccountEmails(ctx, id); err != nil {
+		return err
+	}
+	if err := s.DeleteAccountThreads(ctx, id); err != nil {
 		return err
 	}
 	_, err = s.accounts.DeleteItem(ctx, azcosmos.NewPartitionKeyString(account.Email), id.Hex(), nil)
+	if isCosmosNotFound(err) {
+		return nil
+	}
 	return err
 }
 
 func (s *CosmosStore) ListAccounts(ctx context.Context, page, limit int) ([]models.Account, int64, error) {
-	query := "SELECT * FROM c ORDER BY c.createdAt DESC OFFSET @offset LIMIT @limit"
+	query := "SELECT * FROM c ORDER BY c.created_at DESC, c.id DESC OFFSET @offset LIMIT @limit"
 	parameters := []azcosmos.QueryParameter{
 		{Name: "@offset", Value: (page - 1) * limit},
 		{Name: "@limit", Value: limit},
@@ -168,149 +346,280 @@ func (s *CosmosStore) ListAccounts(ctx context.Context, page, limit int) ([]mode
 		QueryParameters: parameters,
 	}
 
-	pager := s.accounts.NewQueryItemsPager(query, nil, &options)
-	var accounts []models.Account
-	for pager.More() {
-		response, err := pager.NextPage(ctx)
-		if err != nil {
-			return nil, 0, err
-		}
-		var batch []models.Account
-		err = response.Unmarshal(&batch)
-		if err != nil {
-			return nil, 0, err
-		}
-		accounts = append(accounts, batch...)
+	accounts, err := s.queryAccounts(ctx, query, azcosmos.NewPartitionKey(), &options)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Get total count
 	countQuery := "SELECT VALUE COUNT(1) FROM c"
-	countPager := s.accounts.NewQueryItemsPager(countQuery, nil, nil)
+	countPager := s.accounts.NewQueryItemsPager(countQuery, azcosmos.NewPartitionKey(), nil)
 	var total int64
 	if countPager.More() {
 		response, err := countPager.NextPage(ctx)
 		if err != nil {
 			return nil, 0, err
 		}
-		err = response.Unmarshal(&total)
+		var counts []int64
+		err = response.Unmarshal(&counts)
 		if err != nil {
 			return nil, 0, err
 		}
+		if len(counts) > 0 {
+			total = counts[0]
+		}
 	}
 
 	return accounts, total, nil
 }
 
+func (s *CosmosStore) ListAccountsAfter(ctx context.Context, after string, limit int) ([]models.Account, string, error) {
+	var q cosmosQuery
+	var where string
+	if after != "" {
+		position, err := q.afterCursor("created_at", after)
+		if err != nil {
+			return nil, "", err
+		}
+		where = " WHERE " + position
+	}
+
+	// One extra account tells whether there is a next page
+	query := "SELECT TOP " + q.param(limit+1) + " * FROM c" + where + " ORDER BY c.created_at DESC, c.id DESC"
+	accounts, err := s.queryAccounts(ctx, query, azcosmos.NewPartitionKey(), &azcosmos.QueryOptions{QueryParameters: q.parameters})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(accounts) <= limit {
+		return accounts, "", nil
+	}
+	last := accounts[limit-1]
+	return accounts[:limit], EncodeCursor(last.CreatedAt, last.ID), nil
+}
+
+func (s *CosmosStore) ListActiveAccounts(ctx context.Context) ([]models.Account, error) {
+	query := "SELECT * FROM c WHERE c.is_active = true"
+	return s.queryAccounts(ctx, query, azcosmos.NewPartitionKey(), nil)
+}
+
+func (s *CosmosStore) UpdateSyncStatus(ctx context.Context, id primitive.ObjectID, lastSyncAt time.Time, status *models.SyncStatus) error {
+	account, err := s.GetAccount(ctx, id)
+	if err != nil || account == nil {
+		return err
+	}
+
+	account.SyncStatus = status
+	if !lastSyncAt.IsZero() {
+		account.LastSyncAt = lastSyncAt
+	}
+	_, err = s.accounts.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(account.Email), account.ID.Hex(), newAccountDocument(account), nil)
+	return err
+}
+
+func (s *CosmosStore) queryAccounts(ctx context.Context, query string, partitionKey azcosmos.PartitionKey, options *azcosmos.QueryOptions) ([]models.Account, error) {
+	pager := s.accounts.NewQueryItemsPager(query, partitionKey, options)
+	var accounts []models.Account
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []accountDocument
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, err
+		}
+		for _, doc := range batch {
+			accounts = append(accounts, doc.account())
+		}
+	}
+	return accounts, nil
+}
+
 // Email operations
 func (s *CosmosStore) CreateEmail(ctx context.Context, email *models.Email) error {
 	if email.ID.IsZero() {
 		email.ID = primitive.NewObjectID()
 	}
-	email.CreatedAt = time.Now()
+	email.CreatedAt = time.Now().UTC()
 	email.UpdatedAt = email.CreatedAt
+	email.ReceivedAt = email.ReceivedAt.UTC()
 
 	_, err := s.emails.CreateItem(ctx, azcosmos.NewPartitionKeyString(email.AccountID.Hex()), email, nil)
 	return err
 }
 
-func (s *CosmosStore) GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error) {
-	var email models.Email
-	_, err := s.emails.ReadItem(ctx, azcosmos.NewPartitionKeyString(id.Hex()), id.Hex(), &email)
-	if err != nil {
-		return nil, err
-	}
-	return &email, nil
-}
+// cosmosBatchSize is the most operations a transactional batch takes
+const cosmosBatchSize = 100
 
-func (s *CosmosStore) GetEmailByMessageID(ctx context.Context, accountID primitive.ObjectID, messageID string) (*models.Email, error) {
-	query := "SELECT * FROM c WHERE c.accountId = @accountId AND c.messageId = @messageId"
-	parameters := []azcosmos.QueryParameter{
-		{Name: "@accountId", Value: accountID.Hex()},
-		{Name: "@messageId", Value: messageID},
+// BulkUpsertEmails creates the emails with a transactional batch per account
+// partition and hundred emails. The emails container's unique key rejects
+// those the account already has.
+func (s *CosmosStore) BulkUpsertEmails(ctx context.Context, emails []*models.Email) ([]BulkEmailResult, error) {
+	results := make([]BulkEmailResult, len(emails))
+
+	// The indexes of the emails by partition, in order
+	var partitions []string
+	byPartition := make(map[string][]int)
+	for i, email := range emails {
+		if email.ID.IsZero() {
+			email.ID = primitive.NewObjectID()
+		}
+		email.CreatedAt = time.Now().UTC()
+		email.UpdatedAt = email.CreatedAt
+		email.ReceivedAt = email.ReceivedAt.UTC()
+
+		key := email.AccountID.Hex()
+		if _, ok := byPartition[key]; !ok {
+			partitions = append(partitions, key)
+		}
+		byPartition[key] = append(byPartition[key], i)
 	}
 
-	options := azcosmos.QueryOptions{
-		QueryParameters: parameters,
+	for _, key := range partitions {
+		indexes := byPartition[key]
+		for start := 0; start < len(indexes); start += cosmosBatchSize {
+			end := min(start+cosmosBatchSize, len(indexes))
+			s.createEmailBatch(ctx, key, emails, indexes[start:end], results)
+		}
 	}
+	return results, nil
+}
 
-	pager := s.emails.NewQueryItemsPager(query, azcosmos.NewPartitionKeyString(accountID.Hex()), &options)
-	var emails []models.Email
-	for pager.More() {
-		response, err := pager.NextPage(ctx)
+// createEmailBatch creates the emails at pending, which share a partition,
+// and records their results. A batch fails as a whole when any of its
+// operations does, so the emails that failed or were stored already are
+// taken out and the rest retried.
+func (s *CosmosStore) createEmailBatch(ctx context.Context, partition string, emails []*models.Email, pending []int, results []BulkEmailResult) {
+	items := make(map[int][]byte, len(pending))
+	var encoded []int
+	for _, i := range pending {
+		item, err := json.Marshal(emails[i])
 		if err != nil {
-			return nil, err
+			results[i].Err = err
+			continue
 		}
-		var batch []models.Email
-		err = response.Unmarshal(&batch)
+		items[i] = item
+		encoded = append(encoded, i)
+	}
+	pending = encoded
+
+	for len(pending) > 0 {
+		batch := s.emails.NewTransactionalBatch(azcosmos.NewPartitionKeyString(partition))
+		for _, i := range pending {
+			batch.CreateItem(items[i], nil)
+		}
+
+		response, err := s.emails.ExecuteTransactionalBatch(ctx, batch, nil)
 		if err != nil {
-			return nil, err
+			for _, i := range pending {
+				results[i].Err = err
+			}
+			return
 		}
-		emails = append(emails, batch...)
+		if response.Success {
+			for _, i := range pending {
+				results[i].Created = true
+			}
+			return
+		}
+
+		// Operations that did not fail themselves report a failed dependency
+		var retry []int
+		for j, operation := range response.OperationResults {
+			i := pending[j]
+			switch operation.StatusCode {
+			case http.StatusFailedDependency:
+				retry = append(retry, i)
+			case http.StatusConflict:
+				// Stored already
+			default:
+				results[i].Err = fmt.Errorf("failed to create email: status %d", operation.StatusCode)
+			}
+		}
+		if len(retry) == len(pending) {
+			for _, i := range pending {
+				results[i].Err = errors.New("failed to create emails: transactional batch failed")
+			}
+			return
+		}
+		pending = retry
+	}
+}
+
+// GetEmail looks an email up across partitions, as only its ID is known
+func (s *CosmosStore) GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error) {
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: id.Hex()}},
+	}
+	emails, err := s.queryEmails(ctx, "SELECT * FROM c WHERE c.id = @id", azcosmos.NewPartitionKey(), &options)
+	if err != nil || len(emails) == 0 {
+		return nil, err
 	}
+	return &emails[0], nil
+}
 
-	if len(emails) == 0 {
-		return nil, fmt.Errorf("email not found")
+func (s *CosmosStore) GetEmailByMessageID(ctx context.Context, accountID primitive.ObjectID, messageID string) (*models.Email, error) {
+	query := "SELECT * FROM c WHERE c.account_id = @accountId AND c.message_id = @messageId"
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@accountId", Value: accountID.Hex()},
+			{Name: "@messageId", Value: messageID},
+		},
+	}
+	emails, err := s.queryEmails(ctx, query, azcosmos.NewPartitionKeyString(accountID.Hex()), &options)
+	if err != nil || len(emails) == 0 {
+		return nil, err
 	}
 	return &emails[0], nil
 }
 
+// UpdateEmail saves the enrichment and flags of an email over the stored
+// one, leaving the rest of the stored email as it is, like MongoStore
 func (s *CosmosStore) UpdateEmail(ctx context.Context, email *models.Email) error {
-	email.UpdatedAt = time.Now()
-	_, err := s.emails.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(email.AccountID.Hex()), email.ID.Hex(), email, nil)
+	partitionKey := azcosmos.NewPartitionKeyString(email.AccountID.Hex())
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: email.ID.Hex()}},
+	}
+	emails, err := s.queryEmails(ctx, "SELECT * FROM c WHERE c.id = @id", partitionKey, &options)
+	if err != nil || len(emails) == 0 {
+		return err
+	}
+
+	email.UpdatedAt = time.Now().UTC()
+	stored := emails[0]
+	stored.Summary = email.Summary
+	stored.Entities = email.Entities
+	stored.Labels = email.Labels
+	stored.Read = email.Read
+	stored.Starred = email.Starred
+	stored.UpdatedAt = email.UpdatedAt
+	_, err = s.emails.ReplaceItem(ctx, partitionKey, email.ID.Hex(), stored, nil)
 	return err
 }
 
 func (s *CosmosStore) DeleteEmail(ctx context.Context, id primitive.ObjectID) error {
 	email, err := s.GetEmail(ctx, id)
-	if err != nil {
+	if err != nil || email == nil {
 		return err
 	}
 	_, err = s.emails.DeleteItem(ctx, azcosmos.NewPartitionKeyString(email.AccountID.Hex()), id.Hex(), nil)
+	if isCosmosNotFound(err) {
+		return nil
+	}
 	return err
 }
 
 func (s *CosmosStore) ListEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.Email, int64, error) {
-	query := "SELECT * FROM c WHERE 1=1"
-	parameters := []azcosmos.QueryParameter{}
-
-	if !filter.AccountID.IsZero() {
-		query += " AND c.accountId = @accountId"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@accountId", Value: filter.AccountID.Hex()})
-	}
-	if filter.From != "" {
-		query += " AND c.from = @from"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@from", Value: filter.From})
-	}
-	if filter.To != "" {
-		query += " AND c.to = @to"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@to", Value: filter.To})
-	}
-	if filter.Subject != "" {
-		query += " AND CONTAINS(c.subject, @subject)"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@subject", Value: filter.Subject})
-	}
-	if filter.StartDate != nil {
-		query += " AND c.date >= @startDate"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@startDate", Value: filter.StartDate})
-	}
-	if filter.EndDate != nil {
-		query += " AND c.date <= @endDate"
-		parameters = append(parameters, azcosmos.QueryParameter{Name: "@endDate", Value: filter.EndDate})
-	}
-
-	query += " ORDER BY c.date DESC OFFSET @offset LIMIT @limit"
-	parameters = append(parameters,
-		azcosmos.QueryParameter{Name: "@offset", Value: (page - 1) * limit},
-		azcosmos.QueryParameter{Name: "@limit", Value: limit},
-	)
+	where, parameters := cosmosEmailFilter(filter)
+	partitionKey := emailPartition(filter)
 
+	query := "SELECT * FROM c WHERE 1=1" + where + " ORDER BY c.received_at DESC, c.id DESC OFFSET @offset LIMIT @limit"
 	options := azcosmos.QueryOptions{
-		QueryParameters: parameters,
-	}
-
-	partitionKey := azcosmos.NewPartitionKeyString(filter.AccountID.Hex())
-	if filter.AccountID.IsZero() {
-		partitionKey = nil
+		QueryParameters: append([]azcosmos.QueryParameter{
+			{Name: "@offset", Value: (page - 1) * limit},
+			{Name: "@limit", Value: limit},
+		}, parameters...),
 	}
 
 	pager := s.emails.NewQueryItemsPager(query, partitionKey, &options)
@@ -329,28 +638,210 @@ func (s *CosmosStore) ListEmails(ctx context.Context, filter models.EmailFilter,
 	}
 
 	// Get total count
-	countQuery := "SELECT VALUE COUNT(1) FROM c WHERE 1=1"
-	if !filter.AccountID.IsZero() {
-		countQuery += " AND c.accountId = @accountId"
-	}
-	countPager := s.emails.NewQueryItemsPager(countQuery, partitionKey, &options)
+	countQuery := "SELECT VALUE COUNT(1) FROM c WHERE 1=1" + where
+	countPager := s.emails.NewQueryItemsPager(countQuery, partitionKey, &azcosmos.QueryOptions{QueryParameters: parameters})
 	var total int64
 	if countPager.More() {
 		response, err := countPager.NextPage(ctx)
 		if err != nil {
 			return nil, 0, err
 		}
-		err = response.Unmarshal(&total)
+		var counts []int64
+		err = response.Unmarshal(&counts)
 		if err != nil {
 			return nil, 0, err
 		}
+		if len(counts) > 0 {
+			total = counts[0]
+		}
 	}
 
 	return emails, total, nil
 }
 
+// ListEmailsAfter lists the emails matching filter after a cursor. Paging
+// with a cursor avoids OFFSET, which reads every skipped email again.
+func (s *CosmosStore) ListEmailsAfter(ctx context.Context, filter models.EmailFilter, after string, limit int) ([]models.Email, string, error) {
+	var q cosmosQuery
+	conditions := q.emailConditions(filter)
+	if after != "" {
+		position, err := q.afterCursor("received_at", after)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions = append(conditions, position)
+	}
+
+	// One extra email tells whether there is a next page
+	query := "SELECT TOP " + q.param(limit+1) + " * FROM c WHERE 1=1"
+	for _, condition := range conditions {
+		query += " AND " + condition
+	}
+	query += " ORDER BY c.received_at DESC, c.id DESC"
+
+	pager := s.emails.NewQueryItemsPager(query, emailPartition(filter), &azcosmos.QueryOptions{QueryParameters: q.parameters})
+	var emails []models.Email
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		var batch []models.Email
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, "", err
+		}
+		emails = append(emails, batch...)
+	}
+
+	if len(emails) <= limit {
+		return emails, "", nil
+	}
+	last := emails[limit-1]
+	return emails[:limit], EncodeCursor(last.ReceivedAt, last.ID), nil
+}
+
+// searchCandidateLimit caps the emails a search ranks in memory
+const searchCandidateLimit = 1000
+
+// SearchEmails runs a ranked full-text search over the emails matching
+// filter. Cosmos DB has no text index here, so the query only finds emails
+// that contain every term, and up to searchCandidateLimit of them are ranked
+// in memory.
+func (s *CosmosStore) SearchEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.EmailSearchResult, int64, error) {
+	where, parameters := cosmosEmailFilter(filter)
+
+	// Without ORDER BY the query can run across partitions
+	options := azcosmos.QueryOptions{
+		QueryParameters: parameters,
+	}
+	pager := s.emails.NewQueryItemsPager("SELECT * FROM c WHERE 1=1"+where, emailPartition(filter), &options)
+
+	var results []models.EmailSearchResult
+	for pager.More() && len(results) < searchCandidateLimit {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		var batch []models.Email
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, 0, err
+		}
+		for _, email := range batch {
+			results = append(results, models.EmailSearchResult{Email: email, Score: search.Score(&email, filter.Text)})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Email.ReceivedAt.After(results[j].Email.ReceivedAt)
+	})
+
+	total := int64(len(results))
+	start := (page - 1) * limit
+	if start >= len(results) {
+		return []models.EmailSearchResult{}, total, nil
+	}
+	return results[start:min(start+limit, len(results))], total, nil
+}
+
+// cosmosEmailFilter translates an EmailFilter into conditions to append to a
+// WHERE clause, along with their parameters
+func cosmosEmailFilter(filter models.EmailFilter) (string, []azcosmos.QueryParameter) {
+	var q cosmosQuery
+	var where string
+	for _, condition := range q.emailConditions(filter) {
+		where += " AND " + condition
+	}
+	return where, q.parameters
+}
+
+// cosmosQuery collects the parameters of a query as its conditions are built
+type cosmosQuery struct {
+	parameters []azcosmos.QueryParameter
+}
+
+// param adds a parameter and returns its name
+func (q *cosmosQuery) param(value interface{}) string {
+	name := fmt.Sprintf("@p%d", len(q.parameters))
+	q.parameters = append(q.parameters, azcosmos.QueryParameter{Name: name, Value: value})
+	return name
+}
+
+// emailConditions translates an EmailFilter into query conditions
+func (q *cosmosQuery) emailConditions(filter models.EmailFilter) []string {
+	var conditions []string
+	if filter.AccountID != nil {
+		conditions = append(conditions, "c.account_id = "+q.param(filter.AccountID.Hex()))
+	}
+	if filter.From != nil {
+		from := q.param(*filter.From)
+		conditions = append(conditions, fmt.Sprintf(`(CONTAINS(c["from"], %[1]s, true) OR CONTAINS(c.from_address.name, %[1]s, true))`, from))
+	}
+	if filter.To != nil {
+		conditions = append(conditions, fmt.Sprintf(`EXISTS(SELECT VALUE t FROM t IN c["to"] WHERE CONTAINS(t, %s, true))`, q.param(*filter.To)))
+	}
+	if filter.Subject != nil {
+		conditions = append(conditions, fmt.Sprintf("CONTAINS(c.subject, %s, true)", q.param(*filter.Subject)))
+	}
+	if filter.Label != nil {
+		conditions = append(conditions, fmt.Sprintf("ARRAY_CONTAINS(c.labels, %s)", q.param(*filter.Label)))
+	}
+	if filter.Read != nil {
+		conditions = append(conditions, "c.read = "+q.param(*filter.Read))
+	}
+	if filter.Starred != nil {
+		conditions = append(conditions, "c.starred = "+q.param(*filter.Starred))
+	}
+	if filter.HasAttachment != nil {
+		conditions = append(conditions, fmt.Sprintf("(IS_DEFINED(c.attachments) AND ARRAY_LENGTH(c.attachments) > 0) = %s", q.param(*filter.HasAttachment)))
+	}
+	if filter.StartDate != nil {
+		conditions = append(conditions, "c.received_at >= "+q.param(filter.StartDate.UTC().Format(time.RFC3339Nano)))
+	}
+	if filter.EndDate != nil {
+		conditions = append(conditions, "c.received_at <= "+q.param(filter.EndDate.UTC().Format(time.RFC3339Nano)))
+	}
+	for _, term := range filter.Text {
+		conditions = append(conditions, fmt.Sprintf(`(CONTAINS(c.subject, %[1]s, true) OR CONTAINS(c["from"], %[1]s, true)`+
+			` OR CONTAINS(c.from_address.name, %[1]s, true) OR CONTAINS(c.body, %[1]s, true)`+
+			` OR CONTAINS(c.html_text, %[1]s, true))`, q.param(term)))
+	}
+
+	// IIF treats undefined like false, which NOT alone would not
+	for _, not := range filter.Not {
+		if negated := q.emailConditions(not); len(negated) > 0 {
+			conditions = append(conditions, fmt.Sprintf("NOT IIF(%s, true, false)", strings.Join(negated, " AND ")))
+		}
+	}
+	return conditions
+}
+
+// afterCursor returns the condition matching the items that come after
+// cursor when sorted by the timestamp field and then by ID, newest first.
+// Timestamps compare as the UTC strings they are stored as.
+func (q *cosmosQuery) afterCursor(field, cursor string) (string, error) {
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	t := q.param(c.Time.UTC().Format(time.RFC3339Nano))
+	id := q.param(c.ID.Hex())
+	return fmt.Sprintf("(c.%[1]s < %[2]s OR (c.%[1]s = %[2]s AND c.id < %[3]s))", field, t, id), nil
+}
+
+// emailPartition returns the partition holding the emails of the filter's
+// account, or every partition when it has none
+func emailPartition(filter models.EmailFilter) azcosmos.PartitionKey {
+	if filter.AccountID == nil {
+		return azcosmos.NewPartitionKey()
+	}
+	return azcosmos.NewPartitionKeyString(filter.AccountID.Hex())
+}
+
 func (s *CosmosStore) DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error {
-	query := "SELECT c.id FROM c WHERE c.accountId = @accountId"
+	query := "SELECT c.id FROM c WHERE c.account_id = @accountId"
 	parameters := []azcosmos.QueryParameter{
 		{Name: "@accountId", Value: accountID.Hex()},
 	}
@@ -372,10 +863,404 @@ func (s *CosmosStore) DeleteAccountEmails(ctx context.Context, accountID primiti
 		}
 		for _, email := range emails {
 			_, err = s.emails.DeleteItem(ctx, azcosmos.NewPartitionKeyString(accountID.Hex()), email.ID, nil)
-			if err != nil {
+			if err != nil && !isCosmosNotFound(err) {
 				return err
 			}
 		}
 	}
 	return nil
-} 
\ No newline at end of file
+}
+
+func (s *CosmosStore) queryEmails(ctx context.Context, query string, partitionKey azcosmos.PartitionKey, options *azcosmos.QueryOptions) ([]models.Email, error) {
+	pager := s.emails.NewQueryItemsPager(query, partitionKey, options)
+	var emails []models.Email
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []models.Email
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, err
+		}
+		emails = append(emails, batch...)
+	}
+	return emails, nil
+}
+
+// Thread operations
+
+// threadDocument is a thread as stored in Cosmos DB, with the keys the
+// thread model keeps out of API responses
+type threadDocument struct {
+	*models.Thread
+	Keys []string `json:"keys"`
+}
+
+func (s *CosmosStore) CreateThread(ctx context.Context, thread *models.Thread) error {
+	if thread.ID.IsZero() {
+		thread.ID = primitive.NewObjectID()
+	}
+	thread.CreatedAt = time.Now().UTC()
+	thread.UpdatedAt = thread.CreatedAt
+	thread.LastActivityAt = thread.LastActivityAt.UTC()
+
+	_, err := s.threads.CreateItem(ctx, azcosmos.NewPartitionKeyString(thread.AccountID.Hex()), threadDocument{thread, thread.Keys}, nil)
+	return err
+}
+
+// GetThread looks a thread up across partitions, as only its ID is known
+func (s *CosmosStore) GetThread(ctx context.Context, id primitive.ObjectID) (*models.Thread, error) {
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@id", Value: id.Hex()}},
+	}
+	threads, err := s.queryThreads(ctx, "SELECT * FROM c WHERE c.id = @id", azcosmos.NewPartitionKey(), &options)
+	if err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	return &threads[0], nil
+}
+
+func (s *CosmosStore) UpdateThread(ctx context.Context, thread *models.Thread) error {
+	thread.UpdatedAt = time.Now().UTC()
+	thread.LastActivityAt = thread.LastActivityAt.UTC()
+	_, err := s.threads.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(thread.AccountID.Hex()), thread.ID.Hex(), threadDocument{thread, thread.Keys}, nil)
+	if isCosmosNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *CosmosStore) DeleteThread(ctx context.Context, id primitive.ObjectID) error {
+	thread, err := s.GetThread(ctx, id)
+	if err != nil || thread == nil {
+		return err
+	}
+	_, err = s.threads.DeleteItem(ctx, azcosmos.NewPartitionKeyString(thread.AccountID.Hex()), id.Hex(), nil)
+	if isCosmosNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *CosmosStore) FindThread(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	query := "SELECT TOP 1 * FROM c WHERE EXISTS(SELECT VALUE k FROM k IN c.keys WHERE ARRAY_CONTAINS(@keys, k)) ORDER BY c.last_activity_at DESC"
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@keys", Value: keys}},
+	}
+	threads, err := s.queryThreads(ctx, query, azcosmos.NewPartitionKeyString(accountID.Hex()), &options)
+	if err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	return &threads[0], nil
+}
+
+func (s *CosmosStore) ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) ([]models.Thread, int64, error) {
+	partitionKey := azcosmos.NewPartitionKey()
+	if accountID != nil {
+		partitionKey = azcosmos.NewPartitionKeyString(accountID.Hex())
+	}
+
+	query := "SELECT * FROM c ORDER BY c.last_activity_at DESC, c.id DESC OFFSET @offset LIMIT @limit"
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@offset", Value: (page - 1) * limit},
+			{Name: "@limit", Value: limit},
+		},
+	}
+	threads, err := s.queryThreads(ctx, query, partitionKey, &options)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Get total count
+	countPager := s.threads.NewQueryItemsPager("SELECT VALUE COUNT(1) FROM c", partitionKey, nil)
+	var total int64
+	if countPager.More() {
+		response, err := countPager.NextPage(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		var counts []int64
+		if err := response.Unmarshal(&counts); err != nil {
+			return nil, 0, err
+		}
+		if len(counts) > 0 {
+			total = counts[0]
+		}
+	}
+
+	return threads, total, nil
+}
+
+func (s *CosmosStore) ListThreadEmails(ctx context.Context, accountID, threadID primitive.ObjectID) ([]models.Email, error) {
+	query := "SELECT * FROM c WHERE c.account_id = @accountId AND c.thread_ref = @threadId ORDER BY c.received_at ASC, c.id ASC"
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@accountId", Value: accountID.Hex()},
+			{Name: "@threadId", Value: threadID.Hex()},
+		},
+	}
+
+	pager := s.emails.NewQueryItemsPager(query, azcosmos.NewPartitionKeyString(accountID.Hex()), &options)
+	var emails []models.Email
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []models.Email
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, err
+		}
+		emails = append(emails, batch...)
+	}
+	return emails, nil
+}
+
+func (s *CosmosStore) DeleteAccountThreads(ctx context.Context, accountID primitive.ObjectID) error {
+	partitionKey := azcosmos.NewPartitionKeyString(accountID.Hex())
+	threads, err := s.queryThreads(ctx, "SELECT * FROM c", partitionKey, nil)
+	if err != nil {
+		return err
+	}
+	for _, thread := range threads {
+		if _, err := s.threads.DeleteItem(ctx, partitionKey, thread.ID.Hex(), nil); err != nil && !isCosmosNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CosmosStore) queryThreads(ctx context.Context, query string, partitionKey azcosmos.PartitionKey, options *azcosmos.QueryOptions) ([]models.Thread, error) {
+	pager := s.threads.NewQueryItemsPager(query, partitionKey, options)
+	var threads []models.Thread
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []threadDocument
+		if err := response.Unmarshal(&batch); err != nil {
+			return nil, err
+		}
+		for _, doc := range batch {
+			if doc.Thread == nil {
+				doc.Thread = &models.Thread{}
+			}
+			thread := *doc.Thread
+			thread.Keys = doc.Keys
+			threads = append(threads, thread)
+		}
+	}
+	return threads, nil
+}
+
+// OAuth state operations
+
+func (s *CosmosStore) CreateOAuthState(ctx context.Context, state *models.OAuthState) error {
+	state.CreatedAt = time.Now().UTC()
+	_, err := s.states.CreateItem(ctx, azcosmos.NewPartitionKeyString(state.State), state, nil)
+	return err
+}
+
+func (s *CosmosStore) ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error) {
+	partitionKey := azcosmos.NewPartitionKeyString(state)
+	response, err := s.states.ReadItem(ctx, partitionKey, state, nil)
+	if err != nil {
+		if isCosmosNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Only the request whose delete succeeds gets to use the state
+	if _, err := s.states.DeleteItem(ctx, partitionKey, state, nil); err != nil {
+		if isCosmosNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var pending models.OAuthState
+	if err := json.Unmarshal(response.Value, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// isCosmosNotFound reports whether err is a 404 from Cosmos DB
+func isCosmosNotFound(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
+}
+
+// Job operations
+
+// cosmosJobCandidates is the number of due jobs fetched per claim attempt
+const cosmosJobCandidates = 10
+
+func (s *CosmosStore) CreateJob(ctx context.Context, job *models.Job) error {
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	job.CreatedAt = time.Now().UTC()
+	job.UpdatedAt = job.CreatedAt
+	job.RunAt = job.RunAt.UTC()
+	job.Version = 1
+
+	response, err := s.jobs.CreateItem(ctx, azcosmos.NewPartitionKeyString(job.ID.Hex()), job, nil)
+	if err != nil {
+		return err
+	}
+	job.ETag = string(response.ETag)
+	return nil
+}
+
+func (s *CosmosStore) GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	response, err := s.jobs.ReadItem(ctx, azcosmos.NewPartitionKeyString(id.Hex()), id.Hex(), nil)
+	if err != nil {
+		if isCosmosNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var job models.Job
+	if err := json.Unmarshal(response.Value, &job); err != nil {
+		return nil, err
+	}
+	job.ETag = string(response.ETag)
+	return &job, nil
+}
+
+func (s *CosmosStore) ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error) {
+	where := " WHERE 1=1"
+	var parameters []azcosmos.QueryParameter
+	if filter.Type != nil {
+		where += " AND c.type = @type"
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@type", Value: string(*filter.Type)})
+	}
+	if filter.Status != nil {
+		where += " AND c.status = @status"
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@status", Value: string(*filter.Status)})
+	}
+
+	query := "SELECT * FROM c" + where + " ORDER BY c.created_at DESC OFFSET @offset LIMIT @limit"
+	options := azcosmos.QueryOptions{
+		QueryParameters: append(parameters,
+			azcosmos.QueryParameter{Name: "@offset", Value: (page - 1) * limit},
+			azcosmos.QueryParameter{Name: "@limit", Value: limit},
+		),
+	}
+
+	jobs, err := s.queryJobs(ctx, query, &options)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Get total count
+	countQuery := "SELECT VALUE COUNT(1) FROM c" + where
+	countPager := s.jobs.NewQueryItemsPager(countQuery, azcosmos.NewPartitionKey(), &azcosmos.QueryOptions{QueryParameters: parameters})
+	var total int64
+	if countPager.More() {
+		response, err := countPager.NextPage(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		var counts []int64
+		err = response.Unmarshal(&counts)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(counts) > 0 {
+			total = counts[0]
+		}
+	}
+
+	return jobs, total, nil
+}
+
+// ClaimJob reads a handful of due jobs and leases the first one it can
+// replace with a matching ETag; losing a race for a job just moves on to the next
+func (s *CosmosStore) ClaimJob(ctx context.Context, workerID string, lease time.Duration) (*models.Job, error) {
+	now := time.Now().UTC()
+
+	query := fmt.Sprintf(`SELECT TOP %d * FROM c
+		WHERE (c.status = @pending AND c.run_at <= @now)
+		   OR (c.status = @running AND c.locked_until <= @now)
+		ORDER BY c.run_at`, cosmosJobCandidates)
+	options := azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@pending", Value: string(models.JobStatusPending)},
+			{Name: "@running", Value: string(models.JobStatusRunning)},
+			{Name: "@now", Value: now.Format(time.RFC3339Nano)},
+		},
+	}
+
+	candidates, err := s.queryJobs(ctx, query, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range candidates {
+		job := &candidates[i]
+		job.Status = models.JobStatusRunning
+		job.WorkerID = workerID
+		job.LockedUntil = now.Add(lease)
+		job.Attempts++
+
+		err := s.UpdateJob(ctx, job)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	return nil, nil
+}
+
+func (s *CosmosStore) UpdateJob(ctx context.Context, job *models.Job) error {
+	job.UpdatedAt = time.Now().UTC()
+	job.RunAt = job.RunAt.UTC()
+	job.LockedUntil = job.LockedUntil.UTC()
+	job.Version++
+
+	etag := azcore.ETag(job.ETag)
+	response, err := s.jobs.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(job.ID.Hex()), job.ID.Hex(), job,
+		&azcosmos.ItemOptions{IfMatchEtag: &etag})
+	if err != nil {
+		job.Version--
+		var responseErr *azcore.ResponseError
+		if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusPreconditionFailed {
+			return ErrConflict
+		}
+		return err
+	}
+	job.ETag = string(response.ETag)
+	return nil
+}
+
+func (s *CosmosStore) queryJobs(ctx context.Context, query string, options *azcosmos.QueryOptions) ([]models.Job, error) {
+	pager := s.jobs.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), options)
+	var jobs []models.Job
+	for pager.More() {
+		response, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []models.Job
+		err = response.Unmarshal(&batch)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, batch...)
+	}
+	return jobs, nil
+}
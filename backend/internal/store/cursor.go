@@ -0,0 +1,47 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidCursor is returned for cursors that were not issued by a listing
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a listing ordered newest first: the timestamp and
+// ID of the last item a page returned. Items with equal timestamps are
+// ordered by descending ID, so every item has a unique position even while
+// new ones are added.
+type Cursor struct {
+	Time time.Time
+	ID   primitive.ObjectID
+}
+
+// cursorSize is the length of an encoded cursor before base64: the timestamp
+// in Unix nanoseconds followed by the ID
+const cursorSize = 8 + len(primitive.ObjectID{})
+
+// EncodeCursor returns the opaque form of the position after an item, as
+// handed to clients
+func EncodeCursor(t time.Time, id primitive.ObjectID) string {
+	buf := make([]byte, cursorSize)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	copy(buf[8:], id[:])
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeCursor parses a cursor returned by EncodeCursor
+func DecodeCursor(cursor string) (Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != cursorSize {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var c Cursor
+	c.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf))).UTC()
+	copy(c.ID[:], buf[8:])
+	return c, nil
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/secrets"
+)
+
+// EncryptedStore wraps a Store and encrypts account credentials (OAuth tokens
+// and IMAP passwords) before they are written, decrypting them again when
+// accounts are read. Callers only ever see plaintext.
+type EncryptedStore struct {
+	Store
+	keyring *secrets.Keyring
+}
+
+var _ Store = (*EncryptedStore)(nil)
+
+// NewEncryptedStore wraps store with encryption under keyring
+func NewEncryptedStore(store Store, keyring *secrets.Keyring) *EncryptedStore {
+	return &EncryptedStore{Store: store, keyring: keyring}
+}
+
+// CreateAccount stores an account with its credentials encrypted
+func (s *EncryptedStore) CreateAccount(ctx context.Context, account *models.Account) error {
+	return s.write(account, func(sealed *models.Account) error {
+		return s.Store.CreateAccount(ctx, sealed)
+	})
+}
+
+// UpdateAccount saves an account with its credentials encrypted
+func (s *EncryptedStore) UpdateAccount(ctx context.Context, account *models.Account) error {
+	return s.write(account, func(sealed *models.Account) error {
+		return s.Store.UpdateAccount(ctx, sealed)
+	})
+}
+
+// UpsertAccount creates or updates an account with its credentials encrypted
+func (s *EncryptedStore) UpsertAccount(ctx context.Context, account *models.Account) error {
+	return s.write(account, func(sealed *models.Account) error {
+		return s.Store.UpsertAccount(ctx, sealed)
+	})
+}
+
+// GetAccount retrieves an account with its credentials decrypted
+func (s *EncryptedStore) GetAccount(ctx context.Context, id primitive.ObjectID) (*models.Account, error) {
+	account, err := s.Store.GetAccount(ctx, id)
+	if err != nil || account == nil {
+		return account, err
+	}
+	return account, s.open(account)
+}
+
+// GetAccountByEmail retrieves an account with its credentials decrypted
+func (s *EncryptedStore) GetAccountByEmail(ctx context.Context, email string) (*models.Account, error) {
+	account, err := s.Store.GetAccountByEmail(ctx, email)
+	if err != nil || account == nil {
+		return account, err
+	}
+	return account, s.open(account)
+}
+
+// ListAccounts lists accounts with their credentials decrypted
+func (s *EncryptedStore) ListAccounts(ctx context.Context, page, limit int) ([]models.Account, int64, error) {
+	accounts, total, err := s.Store.ListAccounts(ctx, page, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range accounts {
+		if err := s.open(&accounts[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return accounts, total, nil
+}
+
+// ListAccountsAfter lists the accounts after a cursor with their credentials
+// decrypted
+func (s *EncryptedStore) ListAccountsAfter(ctx context.Context, cursor string, limit int) ([]models.Account, string, error) {
+	accounts, next, err := s.Store.ListAccountsAfter(ctx, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range accounts {
+		if err := s.open(&accounts[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	return accounts, next, nil
+}
+
+// ListActiveAccounts lists active accounts with their credentials decrypted
+func (s *EncryptedStore) ListActiveAccounts(ctx context.Context) ([]models.Account, error) {
+	accounts, err := s.Store.ListActiveAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range accounts {
+		if err := s.open(&accounts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+// RekeyAccounts re-encrypts the credentials of every account that is still
+// in plaintext or under a key other than the primary one, and returns the
+// number of accounts it rewrote. Accounts are rewritten in full, so it should
+// not run while the sync workers are updating the same accounts.
+func (s *EncryptedStore) RekeyAccounts(ctx context.Context) (int, error) {
+	const pageSize = 100
+
+	rekeyed := 0
+	cursor := ""
+	for {
+		// Read the stored values to see which key they are under
+		accounts, next, err := s.Store.ListAccountsAfter(ctx, cursor, pageSize)
+		if err != nil {
+			return rekeyed, err
+		}
+		for i := range accounts {
+			account := &accounts[i]
+			if !s.needsRekey(account) {
+				continue
+			}
+			if err := s.open(account); err != nil {
+				return rekeyed, fmt.Errorf("account %s: %w", account.ID.Hex(), err)
+			}
+			if err := s.UpdateAccount(ctx, account); err != nil {
+				return rekeyed, fmt.Errorf("account %s: %w", account.ID.Hex(), err)
+			}
+			rekeyed++
+		}
+		if next == "" {
+			return rekeyed, nil
+		}
+		cursor = next
+	}
+}
+
+// write passes an encrypted copy of account to save, then updates account
+// from what was stored, such as its ID and timestamps
+func (s *EncryptedStore) write(account *models.Account, save func(*models.Account) error) error {
+	sealed, err := s.seal(account)
+	if err != nil {
+		return err
+	}
+	if err := save(sealed); err != nil {
+		return err
+	}
+	if err := s.open(sealed); err != nil {
+		return err
+	}
+	*account = *sealed
+	return nil
+}
+
+// seal returns a copy of account with its credentials encrypted
+func (s *EncryptedStore) seal(account *models.Account) (*models.Account, error) {
+	sealed := *account
+	if account.IMAP != nil {
+		imap := *account.IMAP
+		sealed.IMAP = &imap
+	}
+
+	for _, field := range credentials(&sealed) {
+		value, err := s.keyring.Encrypt(*field)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt credentials: %w", err)
+		}
+		*field = value
+	}
+	return &sealed, nil
+}
+
+// open decrypts the credentials of account in place
+func (s *EncryptedStore) open(account *models.Account) error {
+	for _, field := range credentials(account) {
+		value, err := s.keyring.Decrypt(*field)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt credentials of account %s: %w", account.ID.Hex(), err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// needsRekey reports whether any stored credential of account is not under
+// the primary key
+func (s *EncryptedStore) needsRekey(account *models.Account) bool {
+	for _, field := range credentials(account) {
+		if s.keyring.NeedsRekey(*field) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns the fields of account that are encrypted at rest
+func credentials(account *models.Account) []*string {
+	fields := []*string{&account.AccessToken, &account.RefreshToken}
+	if account.IMAP != nil {
+		fields = append(fields, &account.IMAP.Password)
+	}
+	return fields
+}
@@ -0,0 +1,929 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/search"
+)
+
+// MemoryStore implements the Store interface in memory. It is meant for tests
+// and single-process development setups. Documents are copied through BSON on
+// the way in and out, so they come back the way MongoDB would return them,
+// with timestamps in UTC and truncated to milliseconds.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	accounts map[primitive.ObjectID]*models.Account
+	states   map[string]*models.OAuthState
+	emails   map[primitive.ObjectID]*models.Email
+	threads  map[primitive.ObjectID]*models.Thread
+	jobs     map[primitive.ObjectID]*models.Job
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts: make(map[primitive.ObjectID]*models.Account),
+		states:   make(map[string]*models.OAuthState),
+		emails:   make(map[primitive.ObjectID]*models.Email),
+		threads:  make(map[primitive.ObjectID]*models.Thread),
+		jobs:     make(map[primitive.ObjectID]*models.Job),
+	}
+}
+
+// clone deep-copies a document through BSON
+func clone[T any](doc *T) (*T, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var copied T
+	if err := bson.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+// cloneAll deep-copies the documents into a slice
+func cloneAll[T any](docs []*T) ([]T, error) {
+	var copies []T
+	for _, doc := range docs {
+		copied, err := clone(doc)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, *copied)
+	}
+	return copies, nil
+}
+
+// paginate returns the items on a page, counting pages from 1
+func paginate[T any](items []T, page, limit int) []T {
+	start := (page - 1) * limit
+	if start < 0 || start >= len(items) {
+		return nil
+	}
+	return items[start:min(start+limit, len(items))]
+}
+
+// sortNewestFirst sorts items by a timestamp and then by ID, newest first,
+// like the other stores' listings
+func sortNewestFirst[T any](items []*T, key func(*T) (time.Time, primitive.ObjectID)) {
+	sort.Slice(items, func(i, j int) bool {
+		ti, idi := key(items[i])
+		tj, idj := key(items[j])
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return bytes.Compare(idi[:], idj[:]) > 0
+	})
+}
+
+// isAfter reports whether an item at t and id comes after cursor in a
+// listing sorted newest first
+func isAfter(cursor Cursor, t time.Time, id primitive.ObjectID) bool {
+	if !t.Equal(cursor.Time) {
+		return t.Before(cursor.Time)
+	}
+	return bytes.Compare(id[:], cursor.ID[:]) < 0
+}
+
+// CreateAccount creates a new email account
+func (s *MemoryStore) CreateAccount(ctx context.Context, account *models.Account) error {
+	if account.ID.IsZero() {
+		account.ID = primitive.NewObjectID()
+	}
+	account.CreatedAt = time.Now()
+	account.UpdatedAt = account.CreatedAt
+
+	stored, err := clone(account)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[account.ID] = stored
+	return nil
+}
+
+// GetAccount retrieves an account by ID
+func (s *MemoryStore) GetAccount(ctx context.Context, id primitive.ObjectID) (*models.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, nil
+	}
+	return clone(account)
+}
+
+// GetAccountByEmail retrieves the oldest account of an email address
+func (s *MemoryStore) GetAccountByEmail(ctx context.Context, email string) (*models.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *models.Account
+	for _, account := range s.accounts {
+		if account.Email == email && (found == nil || account.CreatedAt.Before(found.CreatedAt)) {
+			found = account
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return clone(found)
+}
+
+// UpdateAccount updates the credentials, sync cursors and profile of an
+// existing account, the fields MongoStore updates
+func (s *MemoryStore) UpdateAccount(ctx context.Context, account *models.Account) error {
+	account.UpdatedAt = time.Now()
+
+	update, err := clone(account)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[account.ID]
+	if !ok {
+		return nil
+	}
+	stored.AccessToken = update.AccessToken
+	stored.RefreshToken = update.RefreshToken
+	stored.TokenExpiry = update.TokenExpiry
+	stored.HistoryID = update.HistoryID
+	stored.GmailWatch = update.GmailWatch
+	stored.DeltaLinks = update.DeltaLinks
+	stored.GraphSubscription = update.GraphSubscription
+	stored.IMAP = update.IMAP
+	stored.Name = update.Name
+	stored.Picture = update.Picture
+	stored.TokenType = update.TokenType
+	stored.IsActive = update.IsActive
+	stored.DisabledReason = update.DisabledReason
+	stored.UpdatedAt = update.UpdatedAt
+	return nil
+}
+
+// UpsertAccount creates an account or updates the user's existing account
+// for the same mailbox
+func (s *MemoryStore) UpsertAccount(ctx context.Context, account *models.Account) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored *models.Account
+	for _, existing := range s.accounts {
+		if existing.UserID == account.UserID && existing.Provider == account.Provider && existing.Email == account.Email {
+			stored = existing
+			break
+		}
+	}
+	if stored == nil {
+		stored = &models.Account{
+			ID:        primitive.NewObjectID(),
+			UserID:    account.UserID,
+			Provider:  account.Provider,
+			Email:     account.Email,
+			CreatedAt: now,
+		}
+	}
+
+	stored.AccessToken = account.AccessToken
+	stored.TokenExpiry = account.TokenExpiry
+	stored.TokenType = account.TokenType
+	stored.Name = account.Name
+	stored.Picture = account.Picture
+	stored.IsActive = true
+	stored.DisabledReason = ""
+	stored.UpdatedAt = now
+	// Providers only issue a refresh token on the first consent
+	if account.RefreshToken != "" {
+		stored.RefreshToken = account.RefreshToken
+	}
+
+	stored, err := clone(stored)
+	if err != nil {
+		return err
+	}
+	s.accounts[stored.ID] = stored
+
+	result, err := clone(stored)
+	if err != nil {
+		return err
+	}
+	*account = *result
+	return nil
+}
+
+// DeleteAccount deletes an account along with its emails and threads
+func (s *MemoryStore) DeleteAccount(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteAccountEmails(id)
+	s.deleteAccountThreads(id)
+	delete(s.accounts, id)
+	return nil
+}
+
+// ListAccounts lists all accounts with pagination
+func (s *MemoryStore) ListAccounts(ctx context.Context, page, limit int) ([]models.Account, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := s.sortedAccounts()
+	result, err := cloneAll(paginate(accounts, page, limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, int64(len(accounts)), nil
+}
+
+// ListAccountsAfter lists the accounts after a cursor
+func (s *MemoryStore) ListAccountsAfter(ctx context.Context, after string, limit int) ([]models.Account, string, error) {
+	var position *Cursor
+	if after != "" {
+		c, err := DecodeCursor(after)
+		if err != nil {
+			return nil, "", err
+		}
+		position = &c
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accounts []*models.Account
+	for _, account := range s.sortedAccounts() {
+		if position == nil || isAfter(*position, account.CreatedAt, account.ID) {
+			accounts = append(accounts, account)
+		}
+	}
+
+	var next string
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+		last := accounts[limit-1]
+		next = EncodeCursor(last.CreatedAt, last.ID)
+	}
+	result, err := cloneAll(accounts)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+
+// ListActiveAccounts lists every account that should be synced
+func (s *MemoryStore) ListActiveAccounts(ctx context.Context) ([]models.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var active []*models.Account
+	for _, account := range s.sortedAccounts() {
+		if account.IsActive {
+			active = append(active, account)
+		}
+	}
+	return cloneAll(active)
+}
+
+// UpdateSyncStatus records the outcome of an account sync
+func (s *MemoryStore) UpdateSyncStatus(ctx context.Context, id primitive.ObjectID, lastSyncAt time.Time, status *models.SyncStatus) error {
+	update, err := clone(&models.Account{LastSyncAt: lastSyncAt, SyncStatus: status})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[id]
+	if !ok {
+		return nil
+	}
+	stored.SyncStatus = update.SyncStatus
+	if !lastSyncAt.IsZero() {
+		stored.LastSyncAt = update.LastSyncAt
+	}
+	return nil
+}
+
+// sortedAccounts returns the accounts newest first
+func (s *MemoryStore) sortedAccounts() []*models.Account {
+	accounts := make([]*models.Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	sortNewestFirst(accounts, func(a *models.Account) (time.Time, primitive.ObjectID) {
+		return a.CreatedAt, a.ID
+	})
+	return accounts
+}
+
+// CreateOAuthState records a pending OAuth connect flow
+func (s *MemoryStore) CreateOAuthState(ctx context.Context, state *models.OAuthState) error {
+	state.CreatedAt = time.Now()
+
+	stored, err := clone(state)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[state.State] = stored
+	return nil
+}
+
+// ConsumeOAuthState deletes and returns a pending OAuth state
+func (s *MemoryStore) ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.states[state]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.states, state)
+	return pending, nil
+}
+
+// CreateEmail creates a new email
+func (s *MemoryStore) CreateEmail(ctx context.Context, email *models.Email) error {
+	if email.ID.IsZero() {
+		email.ID = primitive.NewObjectID()
+	}
+	email.CreatedAt = time.Now()
+	email.UpdatedAt = email.CreatedAt
+
+	stored, err := clone(email)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emails[email.ID] = stored
+	return nil
+}
+
+// BulkUpsertEmails creates the emails whose account and message ID are not
+// stored yet, including earlier emails of the same batch
+func (s *MemoryStore) BulkUpsertEmails(ctx context.Context, emails []*models.Email) ([]BulkEmailResult, error) {
+	type messageKey struct {
+		accountID primitive.ObjectID
+		messageID string
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := make(map[messageKey]bool, len(s.emails))
+	for _, email := range s.emails {
+		stored[messageKey{email.AccountID, email.MessageID}] = true
+	}
+
+	results := make([]BulkEmailResult, len(emails))
+	for i, email := range emails {
+		key := messageKey{email.AccountID, email.MessageID}
+		if stored[key] {
+			continue
+		}
+
+		if email.ID.IsZero() {
+			email.ID = primitive.NewObjectID()
+		}
+		email.CreatedAt = time.Now()
+		email.UpdatedAt = email.CreatedAt
+
+		copied, err := clone(email)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		s.emails[email.ID] = copied
+		stored[key] = true
+		results[i].Created = true
+	}
+	return results, nil
+}
+
+// GetEmail retrieves an email by ID
+func (s *MemoryStore) GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	email, ok := s.emails[id]
+	if !ok {
+		return nil, nil
+	}
+	return clone(email)
+}
+
+// GetEmailByMessageID retrieves an email by message ID
+func (s *MemoryStore) GetEmailByMessageID(ctx context.Context, accountID primitive.ObjectID, messageID string) (*models.Email, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, email := range s.emails {
+		if email.AccountID == accountID && email.MessageID == messageID {
+			return clone(email)
+		}
+	}
+	return nil, nil
+}
+
+// UpdateEmail updates the enrichment and flags of an existing email, the
+// fields MongoStore updates
+func (s *MemoryStore) UpdateEmail(ctx context.Context, email *models.Email) error {
+	email.UpdatedAt = time.Now()
+
+	update, err := clone(email)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.emails[email.ID]
+	if !ok {
+		return nil
+	}
+	stored.Summary = update.Summary
+	stored.Entities = update.Entities
+	stored.Labels = update.Labels
+	stored.Read = update.Read
+	stored.Starred = update.Starred
+	stored.UpdatedAt = update.UpdatedAt
+	return nil
+}
+
+// DeleteEmail deletes an email by ID
+func (s *MemoryStore) DeleteEmail(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.emails, id)
+	return nil
+}
+
+// ListEmails lists emails with filtering and pagination
+func (s *MemoryStore) ListEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.Email, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	emails := s.filterEmails(filter)
+	result, err := cloneAll(paginate(emails, page, limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, int64(len(emails)), nil
+}
+
+// ListEmailsAfter lists the emails matching filter after a cursor
+func (s *MemoryStore) ListEmailsAfter(ctx context.Context, filter models.EmailFilter, after string, limit int) ([]models.Email, string, error) {
+	var position *Cursor
+	if after != "" {
+		c, err := DecodeCursor(after)
+		if err != nil {
+			return nil, "", err
+		}
+		position = &c
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var emails []*models.Email
+	for _, email := range s.filterEmails(filter) {
+		if position == nil || isAfter(*position, email.ReceivedAt, email.ID) {
+			emails = append(emails, email)
+		}
+	}
+
+	var next string
+	if len(emails) > limit {
+		emails = emails[:limit]
+		last := emails[limit-1]
+		next = EncodeCursor(last.ReceivedAt, last.ID)
+	}
+	result, err := cloneAll(emails)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+
+// SearchEmails ranks the emails matching filter with the search package's
+// scoring, the way CosmosStore does
+func (s *MemoryStore) SearchEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.EmailSearchResult, int64, error) {
+	terms := make([]string, len(filter.Text))
+	for i, term := range filter.Text {
+		terms[i] = strings.ToLower(term)
+	}
+
+	s.mu.RLock()
+	emails, err := cloneAll(s.filterEmails(filter))
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Emails are already newest first, which breaks ties in score
+	results := make([]models.EmailSearchResult, len(emails))
+	for i := range emails {
+		results[i] = models.EmailSearchResult{Email: emails[i], Score: search.Score(&emails[i], terms)}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return paginate(results, page, limit), int64(len(results)), nil
+}
+
+// DeleteAccountEmails deletes all emails for an account
+func (s *MemoryStore) DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteAccountEmails(accountID)
+	return nil
+}
+
+func (s *MemoryStore) deleteAccountEmails(accountID primitive.ObjectID) {
+	for id, email := range s.emails {
+		if email.AccountID == accountID {
+			delete(s.emails, id)
+		}
+	}
+}
+
+// filterEmails returns the emails matching filter, newest first
+func (s *MemoryStore) filterEmails(filter models.EmailFilter) []*models.Email {
+	var emails []*models.Email
+	for _, email := range s.emails {
+		if matchesEmail(email, filter) {
+			emails = append(emails, email)
+		}
+	}
+	sortNewestFirst(emails, func(e *models.Email) (time.Time, primitive.ObjectID) {
+		return e.ReceivedAt, e.ID
+	})
+	return emails
+}
+
+// matchesEmail evaluates an EmailFilter like the MongoDB query emailFilter
+// builds. Full-text terms match anywhere in the searchable fields, as they
+// do in Cosmos DB, rather than as whole words.
+func matchesEmail(email *models.Email, filter models.EmailFilter) bool {
+	if filter.AccountID != nil && email.AccountID != *filter.AccountID {
+		return false
+	}
+	if filter.From != nil && !containsFold(email.From, *filter.From) && !containsFold(email.FromAddress.Name, *filter.From) {
+		return false
+	}
+	if filter.To != nil && !anyContainsFold(email.To, *filter.To) {
+		return false
+	}
+	if filter.Subject != nil && !containsFold(email.Subject, *filter.Subject) {
+		return false
+	}
+	if filter.Label != nil && !hasLabel(email.Labels, *filter.Label) {
+		return false
+	}
+	if filter.Read != nil && email.Read != *filter.Read {
+		return false
+	}
+	if filter.Starred != nil && email.Starred != *filter.Starred {
+		return false
+	}
+	if filter.HasAttachment != nil && (len(email.Attachments) > 0) != *filter.HasAttachment {
+		return false
+	}
+	if filter.StartDate != nil && email.ReceivedAt.Before(*filter.StartDate) {
+		return false
+	}
+	if filter.EndDate != nil && email.ReceivedAt.After(*filter.EndDate) {
+		return false
+	}
+	for _, term := range filter.Text {
+		if !containsText(email, term) {
+			return false
+		}
+	}
+
+	for _, not := range filter.Not {
+		if matchesEmail(email, not) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsText reports whether term occurs in a searchable field of email
+func containsText(email *models.Email, term string) bool {
+	for _, field := range []string{email.Subject, email.From, email.FromAddress.Name, email.Body, email.HTMLText} {
+		if containsFold(field, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether s contains substr, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// anyContainsFold reports whether any of values contains substr, ignoring case
+func anyContainsFold(values []string, substr string) bool {
+	for _, v := range values {
+		if containsFold(v, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateThread creates a new thread
+func (s *MemoryStore) CreateThread(ctx context.Context, thread *models.Thread) error {
+	if thread.ID.IsZero() {
+		thread.ID = primitive.NewObjectID()
+	}
+	thread.CreatedAt = time.Now()
+	thread.UpdatedAt = thread.CreatedAt
+
+	stored, err := clone(thread)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.threads[thread.ID] = stored
+	return nil
+}
+
+// GetThread retrieves a thread by ID
+func (s *MemoryStore) GetThread(ctx context.Context, id primitive.ObjectID) (*models.Thread, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	thread, ok := s.threads[id]
+	if !ok {
+		return nil, nil
+	}
+	return clone(thread)
+}
+
+// UpdateThread saves an existing thread
+func (s *MemoryStore) UpdateThread(ctx context.Context, thread *models.Thread) error {
+	thread.UpdatedAt = time.Now()
+
+	stored, err := clone(thread)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.threads[thread.ID]; ok {
+		s.threads[thread.ID] = stored
+	}
+	return nil
+}
+
+// DeleteThread deletes a thread by ID
+func (s *MemoryStore) DeleteThread(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.threads, id)
+	return nil
+}
+
+// FindThread finds the account's most recently active thread with any of
+// the keys
+func (s *MemoryStore) FindThread(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error) {
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *models.Thread
+	for _, thread := range s.threads {
+		if thread.AccountID != accountID || (found != nil && !thread.LastActivityAt.After(found.LastActivityAt)) {
+			continue
+		}
+		for _, key := range thread.Keys {
+			if wanted[key] {
+				found = thread
+				break
+			}
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return clone(found)
+}
+
+// ListThreads lists threads by last activity with pagination
+func (s *MemoryStore) ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) ([]models.Thread, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var threads []*models.Thread
+	for _, thread := range s.threads {
+		if accountID == nil || thread.AccountID == *accountID {
+			threads = append(threads, thread)
+		}
+	}
+	sortNewestFirst(threads, func(t *models.Thread) (time.Time, primitive.ObjectID) {
+		return t.LastActivityAt, t.ID
+	})
+
+	result, err := cloneAll(paginate(threads, page, limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, int64(len(threads)), nil
+}
+
+// ListThreadEmails lists the emails of a thread, oldest first
+func (s *MemoryStore) ListThreadEmails(ctx context.Context, accountID, threadID primitive.ObjectID) ([]models.Email, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var emails []*models.Email
+	for _, email := range s.emails {
+		if email.AccountID == accountID && email.ThreadRef == threadID {
+			emails = append(emails, email)
+		}
+	}
+	sortNewestFirst(emails, func(e *models.Email) (time.Time, primitive.ObjectID) {
+		return e.ReceivedAt, e.ID
+	})
+	for i, j := 0, len(emails)-1; i < j; i, j = i+1, j-1 {
+		emails[i], emails[j] = emails[j], emails[i]
+	}
+	return cloneAll(emails)
+}
+
+// DeleteAccountThreads deletes every thread of an account
+func (s *MemoryStore) DeleteAccountThreads(ctx context.Context, accountID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteAccountThreads(accountID)
+	return nil
+}
+
+func (s *MemoryStore) deleteAccountThreads(accountID primitive.ObjectID) {
+	for id, thread := range s.threads {
+		if thread.AccountID == accountID {
+			delete(s.threads, id)
+		}
+	}
+}
+
+// CreateJob enqueues a new job
+func (s *MemoryStore) CreateJob(ctx context.Context, job *models.Job) error {
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	job.Version = 1
+
+	stored, err := clone(job)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = stored
+	return nil
+}
+
+// GetJob retrieves a job by ID
+func (s *MemoryStore) GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	return clone(job)
+}
+
+// ListJobs lists jobs with filtering and pagination, newest first
+func (s *MemoryStore) ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var jobs []*models.Job
+	for _, job := range s.jobs {
+		if filter.Type != nil && job.Type != *filter.Type {
+			continue
+		}
+		if filter.Status != nil && job.Status != *filter.Status {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sortNewestFirst(jobs, func(j *models.Job) (time.Time, primitive.ObjectID) {
+		return j.CreatedAt, j.ID
+	})
+
+	result, err := cloneAll(paginate(jobs, page, limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, int64(len(jobs)), nil
+}
+
+// ClaimJob leases the job that has been due the longest
+func (s *MemoryStore) ClaimJob(ctx context.Context, workerID string, lease time.Duration) (*models.Job, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due *models.Job
+	for _, job := range s.jobs {
+		isDue := (job.Status == models.JobStatusPending && !job.RunAt.After(now)) ||
+			(job.Status == models.JobStatusRunning && !job.LockedUntil.After(now))
+		if isDue && (due == nil || job.RunAt.Before(due.RunAt)) {
+			due = job
+		}
+	}
+	if due == nil {
+		return nil, nil
+	}
+
+	claimed, err := clone(&models.Job{LockedUntil: now.Add(lease), UpdatedAt: now})
+	if err != nil {
+		return nil, err
+	}
+	due.Status = models.JobStatusRunning
+	due.WorkerID = workerID
+	due.LockedUntil = claimed.LockedUntil
+	due.UpdatedAt = claimed.UpdatedAt
+	due.Attempts++
+	due.Version++
+	return clone(due)
+}
+
+// UpdateJob replaces a job if its version still matches the stored one
+func (s *MemoryStore) UpdateJob(ctx context.Context, job *models.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.jobs[job.ID]
+	if !ok || stored.Version != job.Version {
+		return ErrConflict
+	}
+
+	job.UpdatedAt = time.Now()
+	job.Version++
+	updated, err := clone(job)
+	if err != nil {
+		job.Version--
+		return err
+	}
+	s.jobs[job.ID] = updated
+	return nil
+}
@@ -2,6 +2,9 @@ package store
 
 import (
 	"context"
+	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -68,10 +71,20 @@ func (s *MongoStore) UpdateAccount(ctx context.Context, account *models.Account)
 
 	update := bson.M{
 		"$set": bson.M{
-			"access_token":  account.AccessToken,
-			"refresh_token": account.RefreshToken,
-			"token_expiry":  account.TokenExpiry,
-			"updated_at":    account.UpdatedAt,
+			"access_token":       account.AccessToken,
+			"refresh_token":      account.RefreshToken,
+			"token_expiry":       account.TokenExpiry,
+			"history_id":         account.HistoryID,
+			"gmail_watch":        account.GmailWatch,
+			"delta_links":        account.DeltaLinks,
+			"graph_subscription": account.GraphSubscription,
+			"imap":               account.IMAP,
+			"name":               account.Name,
+			"picture":            account.Picture,
+			"token_type":         account.TokenType,
+			"is_active":          account.IsActive,
+			"disabled_reason":    account.DisabledReason,
+			"updated_at":         account.UpdatedAt,
 		},
 	}
 
@@ -83,8 +96,55 @@ func (s *MongoStore) UpdateAccount(ctx context.Context, account *models.Account)
 	return err
 }
 
-// DeleteAccount deletes an account by ID
+// UpsertAccount creates an account or updates the user's existing account
+// for the same mailbox
+func (s *MongoStore) UpsertAccount(ctx context.Context, account *models.Account) error {
+	now := time.Now()
+	set := bson.M{
+		"access_token":    account.AccessToken,
+		"token_expiry":    account.TokenExpiry,
+		"token_type":      account.TokenType,
+		"name":            account.Name,
+		"picture":         account.Picture,
+		"is_active":       true,
+		"disabled_reason": "",
+		"updated_at":      now,
+	}
+	// Providers only issue a refresh token on the first consent
+	if account.RefreshToken != "" {
+		set["refresh_token"] = account.RefreshToken
+	}
+
+	filter := bson.M{
+		"user_id":  account.UserID,
+		"provider": account.Provider,
+		"email":    account.Email,
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"created_at": now},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var stored models.Account
+	if err := s.db.Collection("accounts").FindOneAndUpdate(ctx, filter, update, opts).Decode(&stored); err != nil {
+		return err
+	}
+	*account = stored
+	return nil
+}
+
+// DeleteAccount deletes an account along with its emails and threads. The
+// account goes last, so a failed delete can be retried.
 func (s *MongoStore) DeleteAccount(ctx context.Context, id primitive.ObjectID) error {
+	if err := s.DeleteAccountEmails(ctx, id); err != nil {
+		return err
+	}
+	if err := s.DeleteAccountThreads(ctx, id); err != nil {
+		return err
+	}
 	_, err := s.db.Collection("accounts").DeleteOne(ctx, bson.M{"_id": id})
 	return err
 }
@@ -103,7 +163,7 @@ func (s *MongoStore) ListAccounts(ctx context.Context, page, limit int) ([]model
 	opts := options.Find().
 		SetSkip(int64(skip)).
 		SetLimit(int64(limit)).
-		SetSort(bson.M{"created_at": -1})
+		SetSort(newestFirst("created_at"))
 
 	cursor, err := s.db.Collection("accounts").Find(ctx, bson.M{}, opts)
 	if err != nil {
@@ -119,6 +179,82 @@ func (s *MongoStore) ListAccounts(ctx context.Context, page, limit int) ([]model
 	return accounts, total, nil
 }
 
+// ListAccountsAfter lists the accounts after a cursor
+func (s *MongoStore) ListAccountsAfter(ctx context.Context, after string, limit int) ([]models.Account, string, error) {
+	filter, err := afterCursor("created_at", after)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// One extra account tells whether there is a next page
+	opts := options.Find().
+		SetLimit(int64(limit + 1)).
+		SetSort(newestFirst("created_at"))
+
+	cursor, err := s.db.Collection("accounts").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	var accounts []models.Account
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, "", err
+	}
+
+	if len(accounts) <= limit {
+		return accounts, "", nil
+	}
+	last := accounts[limit-1]
+	return accounts[:limit], EncodeCursor(last.CreatedAt, last.ID), nil
+}
+
+// ListActiveAccounts lists every account that should be synced
+func (s *MongoStore) ListActiveAccounts(ctx context.Context) ([]models.Account, error) {
+	cursor, err := s.db.Collection("accounts").Find(ctx, bson.M{"is_active": true})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var accounts []models.Account
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// UpdateSyncStatus records the outcome of an account sync
+func (s *MongoStore) UpdateSyncStatus(ctx context.Context, id primitive.ObjectID, lastSyncAt time.Time, status *models.SyncStatus) error {
+	set := bson.M{"sync_status": status}
+	if !lastSyncAt.IsZero() {
+		set["last_sync_at"] = lastSyncAt
+	}
+
+	_, err := s.db.Collection("accounts").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+// CreateOAuthState records a pending OAuth connect flow
+func (s *MongoStore) CreateOAuthState(ctx context.Context, state *models.OAuthState) error {
+	state.CreatedAt = time.Now()
+	_, err := s.db.Collection("oauth_states").InsertOne(ctx, state)
+	return err
+}
+
+// ConsumeOAuthState deletes and returns a pending OAuth state
+func (s *MongoStore) ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error) {
+	var pending models.OAuthState
+	err := s.db.Collection("oauth_states").FindOneAndDelete(ctx, bson.M{"_id": state}).Decode(&pending)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &pending, nil
+}
+
 // CreateEmail creates a new email
 func (s *MongoStore) CreateEmail(ctx context.Context, email *models.Email) error {
 	email.CreatedAt = time.Now()
@@ -133,6 +269,53 @@ func (s *MongoStore) CreateEmail(ctx context.Context, email *models.Email) error
 	return nil
 }
 
+// BulkUpsertEmails inserts the emails an account does not have yet with an
+// unordered bulk write of upserts, so a failed email does not stop the
+// others
+func (s *MongoStore) BulkUpsertEmails(ctx context.Context, emails []*models.Email) ([]BulkEmailResult, error) {
+	results := make([]BulkEmailResult, len(emails))
+	if len(emails) == 0 {
+		return results, nil
+	}
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, len(emails))
+	for i, email := range emails {
+		if email.ID.IsZero() {
+			email.ID = primitive.NewObjectID()
+		}
+		email.CreatedAt = now
+		email.UpdatedAt = now
+
+		writes[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"account_id": email.AccountID, "message_id": email.MessageID}).
+			SetUpdate(bson.M{"$setOnInsert": email}).
+			SetUpsert(true)
+	}
+
+	result, err := s.db.Collection("emails").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bulkErr) {
+		return nil, err
+	}
+	if result != nil {
+		for index := range result.UpsertedIDs {
+			results[index].Created = true
+		}
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		// A concurrent write stored the message between match and insert
+		if writeErr.Code == duplicateKeyCode {
+			continue
+		}
+		results[writeErr.Index].Err = writeErr
+	}
+	return results, nil
+}
+
+// duplicateKeyCode is the code of MongoDB's unique index violations
+const duplicateKeyCode = 11000
+
 // GetEmail retrieves an email by ID
 func (s *MongoStore) GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error) {
 	var email models.Email
@@ -194,29 +377,144 @@ func (s *MongoStore) DeleteEmail(ctx context.Context, id primitive.ObjectID) err
 // ListEmails lists emails with filtering and pagination
 func (s *MongoStore) ListEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.Email, int64, error) {
 	skip := (page - 1) * limit
+	mongoFilter := emailFilter(filter)
 
-	// Build filter
-	mongoFilter := bson.M{}
+	// Get total count
+	total, err := s.db.Collection("emails").CountDocuments(ctx, mongoFilter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Find emails
+	opts := options.Find().
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit)).
+		SetSort(newestFirst("received_at"))
+
+	cursor, err := s.db.Collection("emails").Find(ctx, mongoFilter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var emails []models.Email
+	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, 0, err
+	}
+
+	return emails, total, nil
+}
+
+// ListEmailsAfter lists the emails matching filter after a cursor
+func (s *MongoStore) ListEmailsAfter(ctx context.Context, filter models.EmailFilter, after string, limit int) ([]models.Email, string, error) {
+	position, err := afterCursor("received_at", after)
+	if err != nil {
+		return nil, "", err
+	}
+	mongoFilter := allOf([]bson.M{emailFilter(filter), position})
+
+	// One extra email tells whether there is a next page
+	opts := options.Find().
+		SetLimit(int64(limit + 1)).
+		SetSort(newestFirst("received_at"))
+
+	cursor, err := s.db.Collection("emails").Find(ctx, mongoFilter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	var emails []models.Email
+	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, "", err
+	}
+
+	if len(emails) <= limit {
+		return emails, "", nil
+	}
+	last := emails[limit-1]
+	return emails[:limit], EncodeCursor(last.ReceivedAt, last.ID), nil
+}
+
+// SearchEmails runs a ranked full-text search over the emails matching
+// filter, ordered by the text index's score
+func (s *MongoStore) SearchEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.EmailSearchResult, int64, error) {
+	skip := (page - 1) * limit
+	mongoFilter := emailFilter(filter)
+
+	total, err := s.db.Collection("emails").CountDocuments(ctx, mongoFilter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "received_at", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit))
+
+	cursor, err := s.db.Collection("emails").Find(ctx, mongoFilter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []struct {
+		models.Email `bson:",inline"`
+		Score        float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]models.EmailSearchResult, len(docs))
+	for i, doc := range docs {
+		results[i] = models.EmailSearchResult{Email: doc.Email, Score: doc.Score}
+	}
+	return results, total, nil
+}
+
+// emailFilter translates an EmailFilter into a MongoDB query. Its full-text
+// terms go through the text index.
+func emailFilter(filter models.EmailFilter) bson.M {
+	conditions := emailConditions(filter)
+	if len(filter.Text) > 0 {
+		conditions = append(conditions, bson.M{"$text": bson.M{"$search": textSearch(filter.Text)}})
+	}
+	return allOf(conditions)
+}
+
+// emailConditions translates the conditions of an EmailFilter other than
+// its full-text terms
+func emailConditions(filter models.EmailFilter) []bson.M {
+	var conditions []bson.M
 	if filter.AccountID != nil {
-		mongoFilter["account_id"] = *filter.AccountID
+		conditions = append(conditions, bson.M{"account_id": *filter.AccountID})
 	}
 	if filter.From != nil {
-		mongoFilter["from"] = bson.M{"$regex": *filter.From, "$options": "i"}
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"from": containsRegex(*filter.From)},
+			bson.M{"from_address.name": containsRegex(*filter.From)},
+		}})
 	}
 	if filter.To != nil {
-		mongoFilter["to"] = bson.M{"$regex": *filter.To, "$options": "i"}
+		conditions = append(conditions, bson.M{"to": containsRegex(*filter.To)})
 	}
 	if filter.Subject != nil {
-		mongoFilter["subject"] = bson.M{"$regex": *filter.Subject, "$options": "i"}
+		conditions = append(conditions, bson.M{"subject": containsRegex(*filter.Subject)})
 	}
 	if filter.Label != nil {
-		mongoFilter["labels"] = *filter.Label
+		conditions = append(conditions, bson.M{"labels": *filter.Label})
 	}
 	if filter.Read != nil {
-		mongoFilter["read"] = *filter.Read
+		conditions = append(conditions, bson.M{"read": *filter.Read})
 	}
 	if filter.Starred != nil {
-		mongoFilter["starred"] = *filter.Starred
+		conditions = append(conditions, bson.M{"starred": *filter.Starred})
+	}
+	if filter.HasAttachment != nil {
+		conditions = append(conditions, bson.M{"attachments.0": bson.M{"$exists": *filter.HasAttachment}})
 	}
 	if filter.StartDate != nil || filter.EndDate != nil {
 		dateFilter := bson.M{}
@@ -226,37 +524,313 @@ func (s *MongoStore) ListEmails(ctx context.Context, filter models.EmailFilter,
 		if filter.EndDate != nil {
 			dateFilter["$lte"] = *filter.EndDate
 		}
-		mongoFilter["received_at"] = dateFilter
+		conditions = append(conditions, bson.M{"received_at": dateFilter})
 	}
 
-	// Get total count
-	total, err := s.db.Collection("emails").CountDocuments(ctx, mongoFilter)
+	// $text cannot be negated, so negated terms are matched field by field
+	for _, not := range filter.Not {
+		negated := emailConditions(not)
+		for _, term := range not.Text {
+			negated = append(negated, textMatch(term))
+		}
+		conditions = append(conditions, bson.M{"$nor": bson.A{allOf(negated)}})
+	}
+	return conditions
+}
+
+// newestFirst sorts by a timestamp field and then by ID, newest first, which
+// is the order cursors are positions in
+func newestFirst(field string) bson.D {
+	return bson.D{{Key: field, Value: -1}, {Key: "_id", Value: -1}}
+}
+
+// afterCursor matches the documents that come after cursor when sorted
+// newestFirst by field. An empty cursor matches every document.
+func afterCursor(field, cursor string) (bson.M, error) {
+	if cursor == "" {
+		return bson.M{}, nil
+	}
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{"$lt": c.Time}},
+		bson.M{field: c.Time, "_id": bson.M{"$lt": c.ID}},
+	}}, nil
+}
+
+// allOf combines conditions into one query
+func allOf(conditions []bson.M) bson.M {
+	switch len(conditions) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return conditions[0]
+	}
+	return bson.M{"$and": conditions}
+}
+
+// textMatch matches emails that contain term in a searchable field
+func textMatch(term string) bson.M {
+	regex := containsRegex(term)
+	return bson.M{"$or": bson.A{
+		bson.M{"subject": regex},
+		bson.M{"from": regex},
+		bson.M{"from_address.name": regex},
+		bson.M{"body": regex},
+		bson.M{"html_text": regex},
+	}}
+}
+
+// containsRegex matches values that contain s, ignoring case
+func containsRegex(s string) primitive.Regex {
+	return primitive.Regex{Pattern: regexp.QuoteMeta(s), Options: "i"}
+}
+
+// textSearch builds a $text search string that requires every term. Quoting
+// each term makes MongoDB match all of them instead of any.
+func textSearch(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, "") + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// DeleteAccountEmails deletes all emails for an account
+func (s *MongoStore) DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error {
+	_, err := s.db.Collection("emails").DeleteMany(ctx, bson.M{"account_id": accountID})
+	return err
+}
+
+// CreateThread creates a new thread
+func (s *MongoStore) CreateThread(ctx context.Context, thread *models.Thread) error {
+	if thread.ID.IsZero() {
+		thread.ID = primitive.NewObjectID()
+	}
+	thread.CreatedAt = time.Now()
+	thread.UpdatedAt = thread.CreatedAt
+
+	_, err := s.db.Collection("threads").InsertOne(ctx, thread)
+	return err
+}
+
+// GetThread retrieves a thread by ID
+func (s *MongoStore) GetThread(ctx context.Context, id primitive.ObjectID) (*models.Thread, error) {
+	var thread models.Thread
+	err := s.db.Collection("threads").FindOne(ctx, bson.M{"_id": id}).Decode(&thread)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// UpdateThread saves a thread
+func (s *MongoStore) UpdateThread(ctx context.Context, thread *models.Thread) error {
+	thread.UpdatedAt = time.Now()
+	_, err := s.db.Collection("threads").ReplaceOne(ctx, bson.M{"_id": thread.ID}, thread)
+	return err
+}
+
+// DeleteThread deletes a thread by ID
+func (s *MongoStore) DeleteThread(ctx context.Context, id primitive.ObjectID) error {
+	_, err := s.db.Collection("threads").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// FindThread finds the account's most recently active thread with any of
+// the keys
+func (s *MongoStore) FindThread(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	opts := options.FindOne().SetSort(bson.M{"last_activity_at": -1})
+	var thread models.Thread
+	err := s.db.Collection("threads").FindOne(ctx, bson.M{
+		"account_id": accountID,
+		"keys":       bson.M{"$in": keys},
+	}, opts).Decode(&thread)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// ListThreads lists threads by last activity with pagination
+func (s *MongoStore) ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) ([]models.Thread, int64, error) {
+	skip := (page - 1) * limit
+	filter := bson.M{}
+	if accountID != nil {
+		filter["account_id"] = *accountID
+	}
+
+	total, err := s.db.Collection("threads").CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	// Find emails
 	opts := options.Find().
 		SetSkip(int64(skip)).
 		SetLimit(int64(limit)).
-		SetSort(bson.M{"received_at": -1})
+		SetSort(newestFirst("last_activity_at"))
 
-	cursor, err := s.db.Collection("emails").Find(ctx, mongoFilter, opts)
+	cursor, err := s.db.Collection("threads").Find(ctx, filter, opts)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer cursor.Close(ctx)
 
+	var threads []models.Thread
+	if err := cursor.All(ctx, &threads); err != nil {
+		return nil, 0, err
+	}
+
+	return threads, total, nil
+}
+
+// ListThreadEmails lists the emails of a thread, oldest first
+func (s *MongoStore) ListThreadEmails(ctx context.Context, accountID, threadID primitive.ObjectID) ([]models.Email, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "received_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.db.Collection("emails").Find(ctx, bson.M{"account_id": accountID, "thread_ref": threadID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
 	var emails []models.Email
 	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// DeleteAccountThreads deletes every thread of an account
+func (s *MongoStore) DeleteAccountThreads(ctx context.Context, accountID primitive.ObjectID) error {
+	_, err := s.db.Collection("threads").DeleteMany(ctx, bson.M{"account_id": accountID})
+	return err
+}
+
+// CreateJob enqueues a new job
+func (s *MongoStore) CreateJob(ctx context.Context, job *models.Job) error {
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	job.Version = 1
+
+	result, err := s.db.Collection("jobs").InsertOne(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	job.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetJob retrieves a job by ID
+func (s *MongoStore) GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	var job models.Job
+	err := s.db.Collection("jobs").FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs lists jobs with filtering and pagination, newest first
+func (s *MongoStore) ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error) {
+	skip := (page - 1) * limit
+
+	mongoFilter := bson.M{}
+	if filter.Type != nil {
+		mongoFilter["type"] = *filter.Type
+	}
+	if filter.Status != nil {
+		mongoFilter["status"] = *filter.Status
+	}
+
+	total, err := s.db.Collection("jobs").CountDocuments(ctx, mongoFilter)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	return emails, total, nil
+	opts := options.Find().
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit)).
+		SetSort(bson.M{"created_at": -1})
+
+	cursor, err := s.db.Collection("jobs").Find(ctx, mongoFilter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []models.Job
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, 0, err
+	}
+
+	return jobs, total, nil
 }
 
-// DeleteAccountEmails deletes all emails for an account
-func (s *MongoStore) DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error {
-	_, err := s.db.Collection("emails").DeleteMany(ctx, bson.M{"account_id": accountID})
-	return err
-} 
\ No newline at end of file
+// ClaimJob leases the job that has been due the longest with a single
+// findOneAndUpdate, so two workers can never claim the same job
+func (s *MongoStore) ClaimJob(ctx context.Context, workerID string, lease time.Duration) (*models.Job, error) {
+	now := time.Now()
+
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"status": models.JobStatusPending, "run_at": bson.M{"$lte": now}},
+			bson.M{"status": models.JobStatusRunning, "locked_until": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":       models.JobStatusRunning,
+			"worker_id":    workerID,
+			"locked_until": now.Add(lease),
+			"updated_at":   now,
+		},
+		"$inc": bson.M{"attempts": 1, "version": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"run_at": 1}).
+		SetReturnDocument(options.After)
+
+	var job models.Job
+	err := s.db.Collection("jobs").FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJob replaces a job if its version still matches the stored one
+func (s *MongoStore) UpdateJob(ctx context.Context, job *models.Job) error {
+	job.UpdatedAt = time.Now()
+	version := job.Version
+	job.Version++
+
+	result, err := s.db.Collection("jobs").ReplaceOne(ctx, bson.M{"_id": job.ID, "version": version}, job)
+	if err != nil {
+		job.Version = version
+		return err
+	}
+	if result.MatchedCount == 0 {
+		job.Version = version
+		return ErrConflict
+	}
+	return nil
+}
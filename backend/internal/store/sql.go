@@ -0,0 +1,1682 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // Registers the "pgx" driver
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite" // Registers the "sqlite" driver
+
+	"email-harvester/internal/migrations"
+	"email-harvester/internal/models"
+	"email-harvester/internal/search"
+)
+
+// SQLStore implements the Store interface on PostgreSQL or SQLite, with the
+// relational schema of the migrations package. Timestamps are stored as
+// Unix milliseconds, so they come back in UTC and truncated the way MongoDB
+// returns them.
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// NewPostgresStore connects to the PostgreSQL database at dsn and migrates
+// its schema if needed
+func NewPostgresStore(dsn string) (*SQLStore, error) {
+	db, err := OpenPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, postgresDialect{})
+}
+
+// NewSQLiteStore opens the SQLite database file at path, creating it and
+// migrating the schema if needed. Use ":memory:" for a database that lives
+// as long as the store.
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, sqliteDialect{})
+}
+
+// OpenPostgres opens the PostgreSQL database at dsn the way the store does
+func OpenPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PostgreSQL database: %w", err)
+	}
+	return db, nil
+}
+
+// OpenSQLite opens the SQLite database file at path the way the store does
+func OpenSQLite(path string) (*sql.DB, error) {
+	// Foreign keys are off unless enabled, and they cascade deletes
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	// SQLite has a single writer, and every connection to ":memory:" opens a
+	// database of its own
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) (*SQLStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", dialect.name(), err)
+	}
+
+	migrator, err := migrations.NewSQLMigrator(ctx, db, dialect.name())
+	if err == nil {
+		_, err = migrator.Up(ctx)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate %s schema: %w", dialect.name(), err)
+	}
+	return &SQLStore{db: db, dialect: dialect}, nil
+}
+
+// Close closes the database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlDialect covers what PostgreSQL and SQLite do differently. Queries are
+// written with PostgreSQL's numbered $n parameters.
+type sqlDialect interface {
+	// name is the dialect's name in the migrations package
+	name() string
+	// rebind rewrites the parameters of query for the database
+	rebind(query string) string
+	// textMatch returns the condition that email e contains a full-text term
+	textMatch(q *sqlQuery, term string) string
+	// searchRank returns what ranks email e by how well it matches terms: a
+	// join, a condition for it and the score, higher for better matches
+	searchRank(q *sqlQuery, terms []string) (join, condition, score string)
+	// lockDue is appended to the selection of the job to claim, so that
+	// concurrent claims pass over each other's job
+	lockDue() string
+}
+
+// postgresDialect searches the weighted tsvector column of emails
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return migrations.DialectPostgres }
+
+func (postgresDialect) rebind(query string) string { return query }
+
+func (postgresDialect) textMatch(q *sqlQuery, term string) string {
+	return fmt.Sprintf("e.search @@ phraseto_tsquery('english', %s)", q.param(term))
+}
+
+// postgresRankWeights are ts_rank's weights of the D, C, B and A labels the
+// body, sender and subject are indexed with, relative to the subject's
+var postgresRankWeights = fmt.Sprintf("'{0, %g, %g, 1}'",
+	float64(search.BodyWeight)/search.SubjectWeight, float64(search.FromWeight)/search.SubjectWeight)
+
+func (postgresDialect) searchRank(q *sqlQuery, terms []string) (string, string, string) {
+	queries := make([]string, len(terms))
+	for i, term := range terms {
+		queries[i] = fmt.Sprintf("phraseto_tsquery('english', %s)", q.param(term))
+	}
+	return "", "", fmt.Sprintf("ts_rank(%s, e.search, %s)", postgresRankWeights, strings.Join(queries, " && "))
+}
+
+func (postgresDialect) lockDue() string { return " FOR UPDATE SKIP LOCKED" }
+
+// sqliteDialect searches the emails_fts FTS5 table, whose rowids are those
+// of emails
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return migrations.DialectSQLite }
+
+var postgresParam = regexp.MustCompile(`\$(\d+)`)
+
+// rebind turns $n into ?n, which SQLite binds to the nth argument too
+func (sqliteDialect) rebind(query string) string {
+	return postgresParam.ReplaceAllString(query, "?$1")
+}
+
+func (sqliteDialect) textMatch(q *sqlQuery, term string) string {
+	return fmt.Sprintf("e.rowid IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH %s)", q.param(ftsPhrase(term)))
+}
+
+func (sqliteDialect) searchRank(q *sqlQuery, terms []string) (string, string, string) {
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = ftsPhrase(term)
+	}
+	// bm25 is lower for better matches
+	score := fmt.Sprintf("-bm25(emails_fts, %d, %d, %d)", search.SubjectWeight, search.FromWeight, search.BodyWeight)
+	return "JOIN emails_fts ON emails_fts.rowid = e.rowid", "emails_fts MATCH " + q.param(strings.Join(phrases, " ")), score
+}
+
+func (sqliteDialect) lockDue() string { return "" }
+
+// ftsPhrase quotes term as an FTS5 phrase
+func ftsPhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// sqlQuery collects the parameters of a query as its conditions are built
+type sqlQuery struct {
+	dialect sqlDialect
+	args    []interface{}
+}
+
+// param adds a parameter and returns its placeholder
+func (q *sqlQuery) param(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// params adds a parameter for each value and returns their placeholders as a
+// list
+func (q *sqlQuery) params(values []string) string {
+	placeholders := make([]string, len(values))
+	for i, value := range values {
+		placeholders[i] = q.param(value)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// emailConditions translates an EmailFilter into conditions on emails e
+func (q *sqlQuery) emailConditions(filter models.EmailFilter) []string {
+	var conditions []string
+	if filter.AccountID != nil {
+		conditions = append(conditions, "e.account_id = "+q.param(filter.AccountID.Hex()))
+	}
+	if filter.From != nil {
+		from := q.param(likePattern(*filter.From))
+		conditions = append(conditions, fmt.Sprintf(`(LOWER(e.from_email) LIKE %[1]s ESCAPE '\' OR LOWER(e.from_name) LIKE %[1]s ESCAPE '\')`, from))
+	}
+	if filter.To != nil {
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (SELECT 1 FROM email_recipients r WHERE r.email_id = e.id AND r.field = 'to' AND LOWER(r.address) LIKE %s ESCAPE '\')`, q.param(likePattern(*filter.To))))
+	}
+	if filter.Subject != nil {
+		conditions = append(conditions, fmt.Sprintf(`LOWER(e.subject) LIKE %s ESCAPE '\'`, q.param(likePattern(*filter.Subject))))
+	}
+	if filter.Label != nil {
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM email_labels l WHERE l.email_id = e.id AND l.label = %s)", q.param(*filter.Label)))
+	}
+	if filter.Read != nil {
+		conditions = append(conditions, "e.read = "+q.param(*filter.Read))
+	}
+	if filter.Starred != nil {
+		conditions = append(conditions, "e.starred = "+q.param(*filter.Starred))
+	}
+	if filter.HasAttachment != nil {
+		exists := "EXISTS (SELECT 1 FROM email_attachments a WHERE a.email_id = e.id)"
+		if !*filter.HasAttachment {
+			exists = "NOT " + exists
+		}
+		conditions = append(conditions, exists)
+	}
+	if filter.StartDate != nil {
+		conditions = append(conditions, "e.received_at >= "+q.param(filter.StartDate.UnixMilli()))
+	}
+	if filter.EndDate != nil {
+		conditions = append(conditions, "e.received_at <= "+q.param(filter.EndDate.UnixMilli()))
+	}
+	for _, term := range filter.Text {
+		conditions = append(conditions, q.dialect.textMatch(q, term))
+	}
+
+	for _, not := range filter.Not {
+		if negated := q.emailConditions(not); len(negated) > 0 {
+			conditions = append(conditions, fmt.Sprintf("NOT (%s)", strings.Join(negated, " AND ")))
+		}
+	}
+	return conditions
+}
+
+// afterCursor returns the condition matching the rows of table alias that
+// come after cursor when sorted by the timestamp column and then by ID,
+// newest first
+func (q *sqlQuery) afterCursor(alias, column, cursor string) (string, error) {
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	t := q.param(c.Time.UnixMilli())
+	id := q.param(c.ID.Hex())
+	return fmt.Sprintf("(%[1]s.%[2]s < %[3]s OR (%[1]s.%[2]s = %[3]s AND %[1]s.id < %[4]s))", alias, column, t, id), nil
+}
+
+// where joins conditions into a WHERE clause, which is empty without them
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// likePattern matches values that contain s, once they are lowercased
+func likePattern(s string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(s))
+	return "%" + escaped + "%"
+}
+
+// sqlConn is what both a database and a transaction run queries with
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlScanner is a *sql.Row or *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *SQLStore) exec(ctx context.Context, conn sqlConn, query string, args ...interface{}) (sql.Result, error) {
+	return conn.ExecContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *SQLStore) query(ctx context.Context, conn sqlConn, query string, args ...interface{}) (*sql.Rows, error) {
+	return conn.QueryContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, conn sqlConn, query string, args ...interface{}) *sql.Row {
+	return conn.QueryRowContext(ctx, s.dialect.rebind(query), args...)
+}
+
+// inTx runs fn in a transaction, which is committed if fn succeeds
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// values returns the placeholders $first to $first+n-1 as a list
+func values(first, n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", first+i)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// millis converts t to Unix milliseconds, or NULL for the zero time
+func millis(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
+
+// fromMillis converts Unix milliseconds back to a UTC time
+func fromMillis(ms sql.NullInt64) time.Time {
+	if !ms.Valid {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms.Int64).UTC()
+}
+
+// nullID stores the zero ID as NULL
+func nullID(id primitive.ObjectID) sql.NullString {
+	if id.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: id.Hex(), Valid: true}
+}
+
+// parseID parses a stored ID, which is the zero ID when NULL
+func parseID(hex sql.NullString) (primitive.ObjectID, error) {
+	if !hex.Valid {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(hex.String)
+}
+
+// nullString stores the empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// jsonArray stores values as a JSON array, or NULL when there are none
+func jsonArray[T any](values []T) (sql.NullString, error) {
+	if len(values) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// parseJSONArray parses a column written by jsonArray
+func parseJSONArray[T any](column sql.NullString) ([]T, error) {
+	if !column.Valid {
+		return nil, nil
+	}
+	var values []T
+	if err := json.Unmarshal([]byte(column.String), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// accountColumns are the columns of accounts in the order accountValues
+// returns them and scanAccount reads them
+const accountColumns = `id, user_id, provider, email, access_token, refresh_token, token_expiry, token_type,
+	history_id, gmail_watch, graph_subscription_id, graph_client_state, graph_expires_at,
+	imap_host, imap_port, imap_tls, imap_username, imap_password, imap_auth_method, imap_mailbox,
+	imap_uid_validity, imap_uid_next, imap_highest_modseq, name, picture, is_active, disabled_reason,
+	last_sync_at, sync_last_attempt_at, sync_last_success_at, sync_last_error_at, sync_last_error,
+	sync_messages_added, sync_duration, created_at, updated_at`
+
+// accountColumnCount is the number of accountColumns
+const accountColumnCount = 36
+
+func accountValues(account *models.Account) []interface{} {
+	values := []interface{}{
+		account.ID.Hex(), account.UserID.Hex(), account.Provider, account.Email,
+		account.AccessToken, account.RefreshToken, millis(account.TokenExpiry), account.TokenType,
+		int64(account.HistoryID), millis(account.GmailWatch),
+	}
+	values = append(values, graphSubscriptionValues(account.GraphSubscription)...)
+	values = append(values, imapValues(account.IMAP)...)
+	values = append(values, account.Name, account.Picture, account.IsActive, account.DisabledReason, millis(account.LastSyncAt))
+	values = append(values, syncStatusValues(account.SyncStatus)...)
+	return append(values, millis(account.CreatedAt), millis(account.UpdatedAt))
+}
+
+// graphSubscriptionValues are the graph_ columns, all NULL without a
+// subscription
+func graphSubscriptionValues(sub *models.GraphSubscription) []interface{} {
+	if sub == nil {
+		return []interface{}{nil, nil, nil}
+	}
+	return []interface{}{sub.ID, sub.ClientState, millis(sub.ExpiresAt)}
+}
+
+// imapValues are the imap_ columns, all NULL for accounts of other providers
+func imapValues(imap *models.IMAPSettings) []interface{} {
+	if imap == nil {
+		return []interface{}{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil}
+	}
+	return []interface{}{
+		imap.Host, imap.Port, imap.TLS, imap.Username, imap.Password, imap.AuthMethod, imap.Mailbox,
+		int64(imap.UIDValidity), int64(imap.UIDNext), int64(imap.HighestModSeq),
+	}
+}
+
+// syncStatusValues are the sync_ columns, all NULL before the first sync
+func syncStatusValues(status *models.SyncStatus) []interface{} {
+	if status == nil {
+		return []interface{}{nil, nil, nil, nil, nil, nil}
+	}
+	return []interface{}{
+		millis(status.LastAttemptAt), millis(status.LastSuccessAt), millis(status.LastErrorAt),
+		status.LastError, status.MessagesAdded, status.Duration,
+	}
+}
+
+// scanAccount reads a row of accountColumns
+func scanAccount(row sqlScanner) (models.Account, error) {
+	var (
+		account                                            models.Account
+		id, userID                                         string
+		historyID                                          int64
+		tokenExpiry, gmailWatch, lastSyncAt                sql.NullInt64
+		createdAt, updatedAt                               sql.NullInt64
+		graphID, graphClientState                          sql.NullString
+		graphExpiresAt                                     sql.NullInt64
+		imapHost, imapTLS, imapUsername, imapPassword      sql.NullString
+		imapAuthMethod, imapMailbox                        sql.NullString
+		imapPort, imapUIDValidity, imapUIDNext, imapModSeq sql.NullInt64
+		syncAttemptAt, syncSuccessAt, syncErrorAt          sql.NullInt64
+		syncError, syncDuration                            sql.NullString
+		syncMessagesAdded                                  sql.NullInt64
+	)
+	err := row.Scan(
+		&id, &userID, &account.Provider, &account.Email, &account.AccessToken, &account.RefreshToken, &tokenExpiry, &account.TokenType,
+		&historyID, &gmailWatch, &graphID, &graphClientState, &graphExpiresAt,
+		&imapHost, &imapPort, &imapTLS, &imapUsername, &imapPassword, &imapAuthMethod, &imapMailbox,
+		&imapUIDValidity, &imapUIDNext, &imapModSeq, &account.Name, &account.Picture, &account.IsActive, &account.DisabledReason,
+		&lastSyncAt, &syncAttemptAt, &syncSuccessAt, &syncErrorAt, &syncError,
+		&syncMessagesAdded, &syncDuration, &createdAt, &updatedAt,
+	)
+	if err != nil {
+		return account, err
+	}
+
+	if account.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return account, err
+	}
+	if account.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return account, err
+	}
+	account.TokenExpiry = fromMillis(tokenExpiry)
+	account.HistoryID = uint64(historyID)
+	account.GmailWatch = fromMillis(gmailWatch)
+	if graphID.Valid {
+		account.GraphSubscription = &models.GraphSubscription{
+			ID:          graphID.String,
+			ClientState: graphClientState.String,
+			ExpiresAt:   fromMillis(graphExpiresAt),
+		}
+	}
+	if imapHost.Valid {
+		account.IMAP = &models.IMAPSettings{
+			Host:          imapHost.String,
+			Port:          int(imapPort.Int64),
+			TLS:           imapTLS.String,
+			Username:      imapUsername.String,
+			Password:      imapPassword.String,
+			AuthMethod:    imapAuthMethod.String,
+			Mailbox:       imapMailbox.String,
+			UIDValidity:   uint32(imapUIDValidity.Int64),
+			UIDNext:       uint32(imapUIDNext.Int64),
+			HighestModSeq: uint64(imapModSeq.Int64),
+		}
+	}
+	account.LastSyncAt = fromMillis(lastSyncAt)
+	if syncAttemptAt.Valid {
+		account.SyncStatus = &models.SyncStatus{
+			LastAttemptAt: fromMillis(syncAttemptAt),
+			LastSuccessAt: fromMillis(syncSuccessAt),
+			LastErrorAt:   fromMillis(syncErrorAt),
+			LastError:     syncError.String,
+			MessagesAdded: int(syncMessagesAdded.Int64),
+			Duration:      syncDuration.String,
+		}
+	}
+	account.CreatedAt = fromMillis(createdAt)
+	account.UpdatedAt = fromMillis(updatedAt)
+	return account, nil
+}
+
+// queryAccounts runs a query for accountColumns and loads the accounts'
+// delta links
+func (s *SQLStore) queryAccounts(ctx context.Context, query string, args ...interface{}) ([]models.Account, error) {
+	rows, err := s.query(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []models.Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(accounts) == 0 {
+		return accounts, nil
+	}
+	q := sqlQuery{dialect: s.dialect}
+	byID := make(map[string]*models.Account, len(accounts))
+	ids := make([]string, len(accounts))
+	for i := range accounts {
+		ids[i] = accounts[i].ID.Hex()
+		byID[ids[i]] = &accounts[i]
+	}
+	rows, err = s.query(ctx, s.db, "SELECT account_id, folder_id, delta_link FROM account_delta_links WHERE account_id IN ("+q.params(ids)+")", q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var accountID, folderID, deltaLink string
+		if err := rows.Scan(&accountID, &folderID, &deltaLink); err != nil {
+			return nil, err
+		}
+		account := byID[accountID]
+		if account.DeltaLinks == nil {
+			account.DeltaLinks = make(map[string]string)
+		}
+		account.DeltaLinks[folderID] = deltaLink
+	}
+	return accounts, rows.Err()
+}
+
+// queryAccount runs a query for at most one account
+func (s *SQLStore) queryAccount(ctx context.Context, query string, args ...interface{}) (*models.Account, error) {
+	accounts, err := s.queryAccounts(ctx, query, args...)
+	if err != nil || len(accounts) == 0 {
+		return nil, err
+	}
+	return &accounts[0], nil
+}
+
+// writeDeltaLinks replaces the delta links of an account
+func (s *SQLStore) writeDeltaLinks(ctx context.Context, tx *sql.Tx, account *models.Account) error {
+	if _, err := s.exec(ctx, tx, "DELETE FROM account_delta_links WHERE account_id = $1", account.ID.Hex()); err != nil {
+		return err
+	}
+	for folderID, deltaLink := range account.DeltaLinks {
+		_, err := s.exec(ctx, tx, "INSERT INTO account_delta_links (account_id, folder_id, delta_link) VALUES ($1, $2, $3)",
+			account.ID.Hex(), folderID, deltaLink)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAccount creates a new email account
+func (s *SQLStore) CreateAccount(ctx context.Context, account *models.Account) error {
+	if account.ID.IsZero() {
+		account.ID = primitive.NewObjectID()
+	}
+	account.CreatedAt = time.Now()
+	account.UpdatedAt = account.CreatedAt
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		query := fmt.Sprintf("INSERT INTO accounts (%s) VALUES (%s)", accountColumns, values(1, accountColumnCount))
+		if _, err := s.exec(ctx, tx, query, accountValues(account)...); err != nil {
+			return err
+		}
+		return s.writeDeltaLinks(ctx, tx, account)
+	})
+}
+
+// GetAccount retrieves an account by ID
+func (s *SQLStore) GetAccount(ctx context.Context, id primitive.ObjectID) (*models.Account, error) {
+	return s.queryAccount(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1", id.Hex())
+}
+
+// GetAccountByEmail retrieves the oldest account of an email address
+func (s *SQLStore) GetAccountByEmail(ctx context.Context, email string) (*models.Account, error) {
+	return s.queryAccount(ctx, "SELECT "+accountColumns+" FROM accounts WHERE email = $1 ORDER BY created_at, id LIMIT 1", email)
+}
+
+// UpdateAccount updates the credentials, sync cursors and profile of an
+// existing account, the fields MongoStore updates
+func (s *SQLStore) UpdateAccount(ctx context.Context, account *models.Account) error {
+	account.UpdatedAt = time.Now()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		args := []interface{}{
+			account.ID.Hex(), account.AccessToken, account.RefreshToken, millis(account.TokenExpiry), account.TokenType,
+			int64(account.HistoryID), millis(account.GmailWatch),
+		}
+		args = append(args, graphSubscriptionValues(account.GraphSubscription)...)
+		args = append(args, imapValues(account.IMAP)...)
+		args = append(args, account.Name, account.Picture, account.IsActive, account.DisabledReason, millis(account.UpdatedAt))
+
+		result, err := s.exec(ctx, tx, `UPDATE accounts SET
+			access_token = $2, refresh_token = $3, token_expiry = $4, token_type = $5, history_id = $6, gmail_watch = $7,
+			graph_subscription_id = $8, graph_client_state = $9, graph_expires_at = $10,
+			imap_host = $11, imap_port = $12, imap_tls = $13, imap_username = $14, imap_password = $15,
+			imap_auth_method = $16, imap_mailbox = $17, imap_uid_validity = $18, imap_uid_next = $19, imap_highest_modseq = $20,
+			name = $21, picture = $22, is_active = $23, disabled_reason = $24, updated_at = $25
+			WHERE id = $1`, args...)
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+			return err
+		}
+		return s.writeDeltaLinks(ctx, tx, account)
+	})
+}
+
+// UpsertAccount creates an account or updates the user's existing account
+// for the same mailbox in a single statement
+func (s *SQLStore) UpsertAccount(ctx context.Context, account *models.Account) error {
+	now := millis(time.Now())
+
+	// Providers only issue a refresh token on the first consent
+	var id string
+	err := s.queryRow(ctx, s.db, `INSERT INTO accounts
+		(id, user_id, provider, email, access_token, refresh_token, token_expiry, token_type, name, picture, is_active, disabled_reason, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, TRUE, '', $11, $11)
+		ON CONFLICT (user_id, provider, email) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = CASE WHEN excluded.refresh_token = '' THEN accounts.refresh_token ELSE excluded.refresh_token END,
+			token_expiry = excluded.token_expiry,
+			token_type = excluded.token_type,
+			name = excluded.name,
+			picture = excluded.picture,
+			is_active = TRUE,
+			disabled_reason = '',
+			updated_at = excluded.updated_at
+		RETURNING id`,
+		primitive.NewObjectID().Hex(), account.UserID.Hex(), account.Provider, account.Email,
+		account.AccessToken, account.RefreshToken, millis(account.TokenExpiry), account.TokenType,
+		account.Name, account.Picture, now,
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.queryAccount(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return fmt.Errorf("account %s disappeared after its upsert", id)
+	}
+	*account = *stored
+	return nil
+}
+
+// DeleteAccount deletes an account along with its emails and threads
+func (s *SQLStore) DeleteAccount(ctx context.Context, id primitive.ObjectID) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM emails WHERE account_id = $1",
+			"DELETE FROM threads WHERE account_id = $1",
+			"DELETE FROM accounts WHERE id = $1",
+		} {
+			if _, err := s.exec(ctx, tx, query, id.Hex()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListAccounts lists all accounts with pagination
+func (s *SQLStore) ListAccounts(ctx context.Context, page, limit int) ([]models.Account, int64, error) {
+	var total int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM accounts").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	accounts, err := s.queryAccounts(ctx, "SELECT "+accountColumns+" FROM accounts ORDER BY created_at DESC, id DESC LIMIT $1 OFFSET $2",
+		limit, (page-1)*limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	return accounts, total, nil
+}
+
+// ListAccountsAfter lists the accounts after a cursor
+func (s *SQLStore) ListAccountsAfter(ctx context.Context, cursor string, limit int) ([]models.Account, string, error) {
+	q := sqlQuery{dialect: s.dialect}
+	var conditions []string
+	if cursor != "" {
+		after, err := q.afterCursor("a", "created_at", cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions = append(conditions, after)
+	}
+	query := fmt.Sprintf("SELECT %s FROM accounts a%s ORDER BY a.created_at DESC, a.id DESC LIMIT %s",
+		accountColumns, where(conditions), q.param(limit+1))
+
+	accounts, err := s.queryAccounts(ctx, query, q.args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+		last := accounts[limit-1]
+		next = EncodeCursor(last.CreatedAt, last.ID)
+	}
+	return accounts, next, nil
+}
+
+// ListActiveAccounts lists every account that should be synced
+func (s *SQLStore) ListActiveAccounts(ctx context.Context) ([]models.Account, error) {
+	return s.queryAccounts(ctx, "SELECT "+accountColumns+" FROM accounts WHERE is_active = $1 ORDER BY created_at DESC, id DESC", true)
+}
+
+// UpdateSyncStatus records the outcome of an account sync
+func (s *SQLStore) UpdateSyncStatus(ctx context.Context, id primitive.ObjectID, lastSyncAt time.Time, status *models.SyncStatus) error {
+	args := append([]interface{}{id.Hex(), millis(lastSyncAt)}, syncStatusValues(status)...)
+	_, err := s.exec(ctx, s.db, `UPDATE accounts SET
+		last_sync_at = COALESCE($2, last_sync_at),
+		sync_last_attempt_at = $3, sync_last_success_at = $4, sync_last_error_at = $5,
+		sync_last_error = $6, sync_messages_added = $7, sync_duration = $8
+		WHERE id = $1`, args...)
+	return err
+}
+
+// CreateOAuthState records a pending OAuth connect flow
+func (s *SQLStore) CreateOAuthState(ctx context.Context, state *models.OAuthState) error {
+	state.CreatedAt = time.Now()
+
+	_, err := s.exec(ctx, s.db, `INSERT INTO oauth_states (state, user_id, provider, code_verifier, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		state.State, state.UserID.Hex(), state.Provider, state.CodeVerifier, millis(state.ExpiresAt), millis(state.CreatedAt))
+	return err
+}
+
+// ConsumeOAuthState deletes and returns a pending OAuth state
+func (s *SQLStore) ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error) {
+	var (
+		pending              models.OAuthState
+		userID               string
+		expiresAt, createdAt sql.NullInt64
+	)
+	err := s.queryRow(ctx, s.db, `DELETE FROM oauth_states WHERE state = $1
+		RETURNING state, user_id, provider, code_verifier, expires_at, created_at`, state).
+		Scan(&pending.State, &userID, &pending.Provider, &pending.CodeVerifier, &expiresAt, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if pending.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return nil, err
+	}
+	pending.ExpiresAt = fromMillis(expiresAt)
+	pending.CreatedAt = fromMillis(createdAt)
+	return &pending, nil
+}
+
+// emailColumns are the columns of emails e in the order scanEmail reads them
+const emailColumns = `e.id, e.account_id, e.message_id, e.thread_id, e.thread_ref,
+	e.from_email, e.from_name, e.from_address, e.to_addresses, e.cc_addresses, e.bcc_addresses,
+	e.subject, e.internet_message_id, e.in_reply_to, e.reference_ids, e.body, e.html_body, e.html_text,
+	e.summary, e.read, e.starred, e.received_at, e.created_at, e.updated_at`
+
+// scanEmail reads a row of emailColumns followed by extra columns into
+// dest. The email's recipients, labels, attachments and entities are loaded
+// separately by loadEmailDetails.
+func scanEmail(row sqlScanner, dest ...interface{}) (models.Email, error) {
+	var (
+		email                                  models.Email
+		id, accountID                          string
+		threadRef                              sql.NullString
+		toAddresses, ccAddresses, bccAddresses sql.NullString
+		references                             sql.NullString
+		receivedAt, createdAt, updatedAt       sql.NullInt64
+	)
+	err := row.Scan(append([]interface{}{
+		&id, &accountID, &email.MessageID, &email.ThreadID, &threadRef,
+		&email.From, &email.FromAddress.Name, &email.FromAddress.Address, &toAddresses, &ccAddresses, &bccAddresses,
+		&email.Subject, &email.InternetMessageID, &email.InReplyTo, &references, &email.Body, &email.HTMLBody, &email.HTMLText,
+		&email.Summary, &email.Read, &email.Starred, &receivedAt, &createdAt, &updatedAt,
+	}, dest...)...)
+	if err != nil {
+		return email, err
+	}
+
+	if email.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return email, err
+	}
+	if email.AccountID, err = primitive.ObjectIDFromHex(accountID); err != nil {
+		return email, err
+	}
+	if email.ThreadRef, err = parseID(threadRef); err != nil {
+		return email, err
+	}
+	if email.ToAddresses, err = parseJSONArray[models.EmailAddress](toAddresses); err != nil {
+		return email, err
+	}
+	if email.CcAddresses, err = parseJSONArray[models.EmailAddress](ccAddresses); err != nil {
+		return email, err
+	}
+	if email.BccAddresses, err = parseJSONArray[models.EmailAddress](bccAddresses); err != nil {
+		return email, err
+	}
+	if email.References, err = parseJSONArray[string](references); err != nil {
+		return email, err
+	}
+	email.ReceivedAt = fromMillis(receivedAt)
+	email.CreatedAt = fromMillis(createdAt)
+	email.UpdatedAt = fromMillis(updatedAt)
+	return email, nil
+}
+
+// queryEmails runs a query for emailColumns and loads the emails' details
+func (s *SQLStore) queryEmails(ctx context.Context, query string, args ...interface{}) ([]models.Email, error) {
+	rows, err := s.query(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var emails []models.Email
+	for rows.Next() {
+		email, err := scanEmail(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadEmailDetails(ctx, emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// queryEmail runs a query for at most one email
+func (s *SQLStore) queryEmail(ctx context.Context, query string, args ...interface{}) (*models.Email, error) {
+	emails, err := s.queryEmails(ctx, query, args...)
+	if err != nil || len(emails) == 0 {
+		return nil, err
+	}
+	return &emails[0], nil
+}
+
+// loadEmailDetails loads the recipients, labels, attachments and entities
+// of emails, in the order they were written
+func (s *SQLStore) loadEmailDetails(ctx context.Context, emails []models.Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	byID := make(map[string]*models.Email, len(emails))
+	ids := make([]string, len(emails))
+	for i := range emails {
+		ids[i] = emails[i].ID.Hex()
+		byID[ids[i]] = &emails[i]
+	}
+
+	err := s.eachEmailRow(ctx, "email_recipients", "field, address", ids, func(rows *sql.Rows) error {
+		var emailID, field, address string
+		if err := rows.Scan(&emailID, &field, &address); err != nil {
+			return err
+		}
+		email := byID[emailID]
+		switch field {
+		case "to":
+			email.To = append(email.To, address)
+		case "cc":
+			email.Cc = append(email.Cc, address)
+		case "bcc":
+			email.Bcc = append(email.Bcc, address)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.eachEmailRow(ctx, "email_labels", "label", ids, func(rows *sql.Rows) error {
+		var emailID, label string
+		if err := rows.Scan(&emailID, &label); err != nil {
+			return err
+		}
+		byID[emailID].Labels = append(byID[emailID].Labels, label)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.eachEmailRow(ctx, "email_attachments", "attachment_id, filename, content_type, size, content_id, is_inline, sha256", ids, func(rows *sql.Rows) error {
+		var emailID string
+		var a models.Attachment
+		if err := rows.Scan(&emailID, &a.ID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.Inline, &a.SHA256); err != nil {
+			return err
+		}
+		byID[emailID].Attachments = append(byID[emailID].Attachments, a)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.eachEmailRow(ctx, "email_entities", "text, type, start_pos, end_pos, confidence", ids, func(rows *sql.Rows) error {
+		var emailID string
+		var entity models.NEREntity
+		if err := rows.Scan(&emailID, &entity.Text, &entity.Type, &entity.StartPos, &entity.EndPos, &entity.Confidence); err != nil {
+			return err
+		}
+		byID[emailID].Entities = append(byID[emailID].Entities, entity)
+		return nil
+	})
+}
+
+// eachEmailRow calls fn with each row of a table that hangs off the emails
+// with ids, which holds the email_id followed by columns
+func (s *SQLStore) eachEmailRow(ctx context.Context, table, columns string, ids []string, fn func(rows *sql.Rows) error) error {
+	q := sqlQuery{dialect: s.dialect}
+	query := fmt.Sprintf("SELECT email_id, %s FROM %s WHERE email_id IN (%s) ORDER BY email_id, position", columns, table, q.params(ids))
+	rows, err := s.query(ctx, s.db, query, q.args...)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return fmt.Errorf("failed to load %s: %w", table, err)
+		}
+	}
+	return rows.Err()
+}
+
+// writeRecipients inserts the bare To, Cc and Bcc addresses of an email
+func (s *SQLStore) writeRecipients(ctx context.Context, tx *sql.Tx, email *models.Email) error {
+	for field, addresses := range map[string][]string{"to": email.To, "cc": email.Cc, "bcc": email.Bcc} {
+		for i, address := range addresses {
+			_, err := s.exec(ctx, tx, "INSERT INTO email_recipients (email_id, field, position, address) VALUES ($1, $2, $3, $4)",
+				email.ID.Hex(), field, i, address)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeLabels replaces the labels of an email
+func (s *SQLStore) writeLabels(ctx context.Context, tx *sql.Tx, email *models.Email) error {
+	if _, err := s.exec(ctx, tx, "DELETE FROM email_labels WHERE email_id = $1", email.ID.Hex()); err != nil {
+		return err
+	}
+	for i, label := range email.Labels {
+		_, err := s.exec(ctx, tx, "INSERT INTO email_labels (email_id, position, label) VALUES ($1, $2, $3)",
+			email.ID.Hex(), i, label)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAttachments inserts the attachments of an email
+func (s *SQLStore) writeAttachments(ctx context.Context, tx *sql.Tx, email *models.Email) error {
+	for i, a := range email.Attachments {
+		_, err := s.exec(ctx, tx, `INSERT INTO email_attachments
+			(email_id, position, attachment_id, filename, content_type, size, content_id, is_inline, sha256)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			email.ID.Hex(), i, a.ID, a.Filename, a.ContentType, a.Size, a.ContentID, a.Inline, a.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntities replaces the named entities of an email
+func (s *SQLStore) writeEntities(ctx context.Context, tx *sql.Tx, email *models.Email) error {
+	if _, err := s.exec(ctx, tx, "DELETE FROM email_entities WHERE email_id = $1", email.ID.Hex()); err != nil {
+		return err
+	}
+	for i, entity := range email.Entities {
+		_, err := s.exec(ctx, tx, `INSERT INTO email_entities (email_id, position, text, type, start_pos, end_pos, confidence)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			email.ID.Hex(), i, entity.Text, entity.Type, entity.StartPos, entity.EndPos, entity.Confidence)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateEmail creates a new email along with its recipients, labels,
+// attachments and entities
+func (s *SQLStore) CreateEmail(ctx context.Context, email *models.Email) error {
+	if email.ID.IsZero() {
+		email.ID = primitive.NewObjectID()
+	}
+	email.CreatedAt = time.Now()
+	email.UpdatedAt = email.CreatedAt
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := s.insertEmail(ctx, tx, email, "")
+		return err
+	})
+}
+
+// BulkUpsertEmails creates the emails in one transaction. Each is inserted
+// under a savepoint, as a failed statement would otherwise abort the whole
+// transaction on PostgreSQL.
+func (s *SQLStore) BulkUpsertEmails(ctx context.Context, emails []*models.Email) ([]BulkEmailResult, error) {
+	results := make([]BulkEmailResult, len(emails))
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for i, email := range emails {
+			if email.ID.IsZero() {
+				email.ID = primitive.NewObjectID()
+			}
+			email.CreatedAt = time.Now()
+			email.UpdatedAt = email.CreatedAt
+
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_email"); err != nil {
+				return err
+			}
+			created, err := s.insertEmail(ctx, tx, email, " ON CONFLICT (account_id, message_id) DO NOTHING")
+			if err != nil {
+				results[i].Err = err
+				if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_email"); err != nil {
+					return err
+				}
+			}
+			results[i].Created = created
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT bulk_email"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// insertEmail inserts an email with its recipients, labels, attachments and
+// entities, completing the INSERT statement with onConflict. It reports
+// whether the email was inserted.
+func (s *SQLStore) insertEmail(ctx context.Context, tx *sql.Tx, email *models.Email, onConflict string) (bool, error) {
+	toAddresses, err := jsonArray(email.ToAddresses)
+	if err != nil {
+		return false, err
+	}
+	ccAddresses, err := jsonArray(email.CcAddresses)
+	if err != nil {
+		return false, err
+	}
+	bccAddresses, err := jsonArray(email.BccAddresses)
+	if err != nil {
+		return false, err
+	}
+	references, err := jsonArray(email.References)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.exec(ctx, tx, `INSERT INTO emails (id, account_id, message_id, thread_id, thread_ref,
+		from_email, from_name, from_address, to_addresses, cc_addresses, bcc_addresses,
+		subject, internet_message_id, in_reply_to, reference_ids, body, html_body, html_text,
+		summary, read, starred, received_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)`+onConflict,
+		email.ID.Hex(), email.AccountID.Hex(), email.MessageID, email.ThreadID, nullID(email.ThreadRef),
+		email.From, email.FromAddress.Name, email.FromAddress.Address, toAddresses, ccAddresses, bccAddresses,
+		email.Subject, email.InternetMessageID, email.InReplyTo, references, email.Body, email.HTMLBody, email.HTMLText,
+		email.Summary, email.Read, email.Starred, millis(email.ReceivedAt), millis(email.CreatedAt), millis(email.UpdatedAt),
+	)
+	if err != nil {
+		return false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return false, err
+	}
+
+	if err := s.writeRecipients(ctx, tx, email); err != nil {
+		return false, err
+	}
+	if err := s.writeLabels(ctx, tx, email); err != nil {
+		return false, err
+	}
+	if err := s.writeAttachments(ctx, tx, email); err != nil {
+		return false, err
+	}
+	if err := s.writeEntities(ctx, tx, email); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetEmail retrieves an email by ID
+func (s *SQLStore) GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error) {
+	return s.queryEmail(ctx, "SELECT "+emailColumns+" FROM emails e WHERE e.id = $1", id.Hex())
+}
+
+// GetEmailByMessageID retrieves an email by message ID
+func (s *SQLStore) GetEmailByMessageID(ctx context.Context, accountID primitive.ObjectID, messageID string) (*models.Email, error) {
+	return s.queryEmail(ctx, "SELECT "+emailColumns+" FROM emails e WHERE e.account_id = $1 AND e.message_id = $2",
+		accountID.Hex(), messageID)
+}
+
+// UpdateEmail updates the enrichment and flags of an existing email, the
+// fields MongoStore updates
+func (s *SQLStore) UpdateEmail(ctx context.Context, email *models.Email) error {
+	email.UpdatedAt = time.Now()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := s.exec(ctx, tx, "UPDATE emails SET summary = $2, read = $3, starred = $4, updated_at = $5 WHERE id = $1",
+			email.ID.Hex(), email.Summary, email.Read, email.Starred, millis(email.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+			return err
+		}
+		if err := s.writeLabels(ctx, tx, email); err != nil {
+			return err
+		}
+		return s.writeEntities(ctx, tx, email)
+	})
+}
+
+// DeleteEmail deletes an email by ID
+func (s *SQLStore) DeleteEmail(ctx context.Context, id primitive.ObjectID) error {
+	_, err := s.exec(ctx, s.db, "DELETE FROM emails WHERE id = $1", id.Hex())
+	return err
+}
+
+// ListEmails lists emails with filtering and pagination
+func (s *SQLStore) ListEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.Email, int64, error) {
+	q := sqlQuery{dialect: s.dialect}
+	conditions := where(q.emailConditions(filter))
+
+	var total int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM emails e"+conditions, q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM emails e%s ORDER BY e.received_at DESC, e.id DESC LIMIT %s OFFSET %s",
+		emailColumns, conditions, q.param(limit), q.param((page-1)*limit))
+	emails, err := s.queryEmails(ctx, query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return emails, total, nil
+}
+
+// ListEmailsAfter lists the emails matching filter after a cursor
+func (s *SQLStore) ListEmailsAfter(ctx context.Context, filter models.EmailFilter, cursor string, limit int) ([]models.Email, string, error) {
+	q := sqlQuery{dialect: s.dialect}
+	conditions := q.emailConditions(filter)
+	if cursor != "" {
+		after, err := q.afterCursor("e", "received_at", cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions = append(conditions, after)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM emails e%s ORDER BY e.received_at DESC, e.id DESC LIMIT %s",
+		emailColumns, where(conditions), q.param(limit+1))
+	emails, err := s.queryEmails(ctx, query, q.args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(emails) > limit {
+		emails = emails[:limit]
+		last := emails[limit-1]
+		next = EncodeCursor(last.ReceivedAt, last.ID)
+	}
+	return emails, next, nil
+}
+
+// SearchEmails ranks the emails matching filter with the database's
+// full-text index, weighted like the search package
+func (s *SQLStore) SearchEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.EmailSearchResult, int64, error) {
+	q := sqlQuery{dialect: s.dialect}
+	conditions := q.emailConditions(filter)
+
+	var total int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM emails e"+where(conditions), q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	join, score := "", "0"
+	if len(filter.Text) > 0 {
+		var condition string
+		join, condition, score = s.dialect.searchRank(&q, filter.Text)
+		if condition != "" {
+			conditions = append(conditions, condition)
+		}
+	}
+	query := fmt.Sprintf("SELECT %s, %s AS score FROM emails e %s%s ORDER BY score DESC, e.received_at DESC, e.id DESC LIMIT %s OFFSET %s",
+		emailColumns, score, join, where(conditions), q.param(limit), q.param((page-1)*limit))
+
+	rows, err := s.query(ctx, s.db, query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	var emails []models.Email
+	var scores []float64
+	for rows.Next() {
+		var score float64
+		email, err := scanEmail(rows, &score)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		emails = append(emails, email)
+		scores = append(scores, score)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.loadEmailDetails(ctx, emails); err != nil {
+		return nil, 0, err
+	}
+	results := make([]models.EmailSearchResult, len(emails))
+	for i := range emails {
+		results[i] = models.EmailSearchResult{Email: emails[i], Score: scores[i]}
+	}
+	return results, total, nil
+}
+
+// DeleteAccountEmails deletes all emails for an account
+func (s *SQLStore) DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error {
+	_, err := s.exec(ctx, s.db, "DELETE FROM emails WHERE account_id = $1", accountID.Hex())
+	return err
+}
+
+// threadColumns are the columns of threads t in the order scanThread reads
+// them
+const threadColumns = "t.id, t.account_id, t.subject, t.participants, t.message_count, t.last_activity_at, t.created_at, t.updated_at"
+
+func scanThread(row sqlScanner) (models.Thread, error) {
+	var (
+		thread                               models.Thread
+		id, accountID                        string
+		participants                         sql.NullString
+		lastActivityAt, createdAt, updatedAt sql.NullInt64
+	)
+	err := row.Scan(&id, &accountID, &thread.Subject, &participants, &thread.MessageCount, &lastActivityAt, &createdAt, &updatedAt)
+	if err != nil {
+		return thread, err
+	}
+
+	if thread.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return thread, err
+	}
+	if thread.AccountID, err = primitive.ObjectIDFromHex(accountID); err != nil {
+		return thread, err
+	}
+	if thread.Participants, err = parseJSONArray[models.EmailAddress](participants); err != nil {
+		return thread, err
+	}
+	thread.LastActivityAt = fromMillis(lastActivityAt)
+	thread.CreatedAt = fromMillis(createdAt)
+	thread.UpdatedAt = fromMillis(updatedAt)
+	return thread, nil
+}
+
+// queryThreads runs a query for threadColumns and loads the threads' keys
+func (s *SQLStore) queryThreads(ctx context.Context, query string, args ...interface{}) ([]models.Thread, error) {
+	rows, err := s.query(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var threads []models.Thread
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(threads) == 0 {
+		return threads, nil
+	}
+	q := sqlQuery{dialect: s.dialect}
+	byID := make(map[string]*models.Thread, len(threads))
+	ids := make([]string, len(threads))
+	for i := range threads {
+		ids[i] = threads[i].ID.Hex()
+		byID[ids[i]] = &threads[i]
+	}
+	rows, err = s.query(ctx, s.db, "SELECT thread_id, thread_key FROM thread_keys WHERE thread_id IN ("+q.params(ids)+") ORDER BY thread_id, thread_key", q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var threadID, key string
+		if err := rows.Scan(&threadID, &key); err != nil {
+			return nil, err
+		}
+		byID[threadID].Keys = append(byID[threadID].Keys, key)
+	}
+	return threads, rows.Err()
+}
+
+// writeThreadKeys replaces the keys of a thread
+func (s *SQLStore) writeThreadKeys(ctx context.Context, tx *sql.Tx, thread *models.Thread) error {
+	if _, err := s.exec(ctx, tx, "DELETE FROM thread_keys WHERE thread_id = $1", thread.ID.Hex()); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(thread.Keys))
+	for _, key := range thread.Keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, err := s.exec(ctx, tx, "INSERT INTO thread_keys (thread_id, thread_key) VALUES ($1, $2)", thread.ID.Hex(), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateThread creates a new thread
+func (s *SQLStore) CreateThread(ctx context.Context, thread *models.Thread) error {
+	if thread.ID.IsZero() {
+		thread.ID = primitive.NewObjectID()
+	}
+	thread.CreatedAt = time.Now()
+	thread.UpdatedAt = thread.CreatedAt
+
+	participants, err := jsonArray(thread.Participants)
+	if err != nil {
+		return err
+	}
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := s.exec(ctx, tx, `INSERT INTO threads (id, account_id, subject, participants, message_count, last_activity_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			thread.ID.Hex(), thread.AccountID.Hex(), thread.Subject, participants, thread.MessageCount,
+			millis(thread.LastActivityAt), millis(thread.CreatedAt), millis(thread.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		return s.writeThreadKeys(ctx, tx, thread)
+	})
+}
+
+// GetThread retrieves a thread by ID
+func (s *SQLStore) GetThread(ctx context.Context, id primitive.ObjectID) (*models.Thread, error) {
+	threads, err := s.queryThreads(ctx, "SELECT "+threadColumns+" FROM threads t WHERE t.id = $1", id.Hex())
+	if err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	return &threads[0], nil
+}
+
+// UpdateThread saves an existing thread
+func (s *SQLStore) UpdateThread(ctx context.Context, thread *models.Thread) error {
+	thread.UpdatedAt = time.Now()
+
+	participants, err := jsonArray(thread.Participants)
+	if err != nil {
+		return err
+	}
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := s.exec(ctx, tx, `UPDATE threads SET account_id = $2, subject = $3, participants = $4, message_count = $5,
+			last_activity_at = $6, created_at = $7, updated_at = $8 WHERE id = $1`,
+			thread.ID.Hex(), thread.AccountID.Hex(), thread.Subject, participants, thread.MessageCount,
+			millis(thread.LastActivityAt), millis(thread.CreatedAt), millis(thread.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+			return err
+		}
+		return s.writeThreadKeys(ctx, tx, thread)
+	})
+}
+
+// DeleteThread deletes a thread by ID
+func (s *SQLStore) DeleteThread(ctx context.Context, id primitive.ObjectID) error {
+	_, err := s.exec(ctx, s.db, "DELETE FROM threads WHERE id = $1", id.Hex())
+	return err
+}
+
+// FindThread finds the account's most recently active thread with any of
+// the keys
+func (s *SQLStore) FindThread(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	q := sqlQuery{dialect: s.dialect}
+	query := fmt.Sprintf(`SELECT %s FROM threads t WHERE t.account_id = %s
+		AND EXISTS (SELECT 1 FROM thread_keys k WHERE k.thread_id = t.id AND k.thread_key IN (%s))
+		ORDER BY t.last_activity_at DESC, t.id DESC LIMIT 1`, threadColumns, q.param(accountID.Hex()), q.params(keys))
+	threads, err := s.queryThreads(ctx, query, q.args...)
+	if err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	return &threads[0], nil
+}
+
+// ListThreads lists threads by last activity with pagination
+func (s *SQLStore) ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) ([]models.Thread, int64, error) {
+	q := sqlQuery{dialect: s.dialect}
+	var conditions []string
+	if accountID != nil {
+		conditions = append(conditions, "t.account_id = "+q.param(accountID.Hex()))
+	}
+
+	var total int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM threads t"+where(conditions), q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM threads t%s ORDER BY t.last_activity_at DESC, t.id DESC LIMIT %s OFFSET %s",
+		threadColumns, where(conditions), q.param(limit), q.param((page-1)*limit))
+	threads, err := s.queryThreads(ctx, query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return threads, total, nil
+}
+
+// ListThreadEmails lists the emails of a thread, oldest first
+func (s *SQLStore) ListThreadEmails(ctx context.Context, accountID, threadID primitive.ObjectID) ([]models.Email, error) {
+	return s.queryEmails(ctx, "SELECT "+emailColumns+" FROM emails e WHERE e.account_id = $1 AND e.thread_ref = $2 ORDER BY e.received_at, e.id",
+		accountID.Hex(), threadID.Hex())
+}
+
+// DeleteAccountThreads deletes every thread of an account
+func (s *SQLStore) DeleteAccountThreads(ctx context.Context, accountID primitive.ObjectID) error {
+	_, err := s.exec(ctx, s.db, "DELETE FROM threads WHERE account_id = $1", accountID.Hex())
+	return err
+}
+
+// jobColumns are the columns of jobs in the order jobValues returns them and
+// scanJob reads them
+const jobColumns = `id, type, status, account_id, message_ids, email_id, attempts, max_attempts, run_at,
+	locked_until, worker_id, last_error, version, finished_at, created_at, updated_at`
+
+func jobValues(job *models.Job) ([]interface{}, error) {
+	messageIDs, err := jsonArray(job.MessageIDs)
+	if err != nil {
+		return nil, err
+	}
+	var accountID, emailID sql.NullString
+	if job.AccountID != nil {
+		accountID = nullID(*job.AccountID)
+	}
+	if job.EmailID != nil {
+		emailID = nullID(*job.EmailID)
+	}
+	return []interface{}{
+		job.ID.Hex(), string(job.Type), string(job.Status), accountID, messageIDs, emailID, job.Attempts, job.MaxAttempts,
+		millis(job.RunAt), millis(job.LockedUntil), job.WorkerID, job.LastError, job.Version, millis(job.FinishedAt),
+		millis(job.CreatedAt), millis(job.UpdatedAt),
+	}, nil
+}
+
+func scanJob(row sqlScanner) (models.Job, error) {
+	var (
+		job                            models.Job
+		id, jobType, status            string
+		accountID, emailID, messageIDs sql.NullString
+		runAt, lockedUntil, finishedAt sql.NullInt64
+		createdAt, updatedAt           sql.NullInt64
+	)
+	err := row.Scan(&id, &jobType, &status, &accountID, &messageIDs, &emailID, &job.Attempts, &job.MaxAttempts, &runAt,
+		&lockedUntil, &job.WorkerID, &job.LastError, &job.Version, &finishedAt, &createdAt, &updatedAt)
+	if err != nil {
+		return job, err
+	}
+
+	if job.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return job, err
+	}
+	job.Type = models.JobType(jobType)
+	job.Status = models.JobStatus(status)
+	if accountID.Valid {
+		id, err := parseID(accountID)
+		if err != nil {
+			return job, err
+		}
+		job.AccountID = &id
+	}
+	if emailID.Valid {
+		id, err := parseID(emailID)
+		if err != nil {
+			return job, err
+		}
+		job.EmailID = &id
+	}
+	if job.MessageIDs, err = parseJSONArray[string](messageIDs); err != nil {
+		return job, err
+	}
+	job.RunAt = fromMillis(runAt)
+	job.LockedUntil = fromMillis(lockedUntil)
+	job.FinishedAt = fromMillis(finishedAt)
+	job.CreatedAt = fromMillis(createdAt)
+	job.UpdatedAt = fromMillis(updatedAt)
+	return job, nil
+}
+
+// CreateJob enqueues a new job
+func (s *SQLStore) CreateJob(ctx context.Context, job *models.Job) error {
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	job.Version = 1
+
+	args, err := jobValues(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, s.db, fmt.Sprintf("INSERT INTO jobs (%s) VALUES (%s)", jobColumns, values(1, len(args))), args...)
+	return err
+}
+
+// GetJob retrieves a job by ID
+func (s *SQLStore) GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	job, err := scanJob(s.queryRow(ctx, s.db, "SELECT "+jobColumns+" FROM jobs WHERE id = $1", id.Hex()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs lists jobs with filtering and pagination, newest first
+func (s *SQLStore) ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error) {
+	q := sqlQuery{dialect: s.dialect}
+	var conditions []string
+	if filter.Type != nil {
+		conditions = append(conditions, "type = "+q.param(string(*filter.Type)))
+	}
+	if filter.Status != nil {
+		conditions = append(conditions, "status = "+q.param(string(*filter.Status)))
+	}
+
+	var total int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM jobs"+where(conditions), q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM jobs%s ORDER BY created_at DESC, id DESC LIMIT %s OFFSET %s",
+		jobColumns, where(conditions), q.param(limit), q.param((page-1)*limit))
+	rows, err := s.query(ctx, s.db, query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var jobs []models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return jobs, total, nil
+}
+
+// ClaimJob leases the job that has been due the longest with a single
+// UPDATE, so two workers can never claim the same job
+func (s *SQLStore) ClaimJob(ctx context.Context, workerID string, lease time.Duration) (*models.Job, error) {
+	now := time.Now()
+
+	query := fmt.Sprintf(`UPDATE jobs SET status = $1, worker_id = $2, locked_until = $3, updated_at = $4,
+		attempts = attempts + 1, version = version + 1
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = $5 AND run_at <= $4) OR (status = $1 AND locked_until <= $4)
+			ORDER BY run_at LIMIT 1%s
+		)
+		RETURNING %s`, s.dialect.lockDue(), jobColumns)
+	job, err := scanJob(s.queryRow(ctx, s.db, query,
+		string(models.JobStatusRunning), workerID, millis(now.Add(lease)), millis(now), string(models.JobStatusPending)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJob replaces a job if its version still matches the stored one
+func (s *SQLStore) UpdateJob(ctx context.Context, job *models.Job) error {
+	job.UpdatedAt = time.Now()
+	version := job.Version
+	job.Version++
+
+	args, err := jobValues(job)
+	if err != nil {
+		job.Version = version
+		return err
+	}
+	result, err := s.exec(ctx, s.db, `UPDATE jobs SET type = $2, status = $3, account_id = $4, message_ids = $5, email_id = $6,
+		attempts = $7, max_attempts = $8, run_at = $9, locked_until = $10, worker_id = $11, last_error = $12,
+		version = $13, finished_at = $14, created_at = $15, updated_at = $16
+		WHERE id = $1 AND version = $17`, append(args, version)...)
+	if err != nil {
+		job.Version = version
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		job.Version = version
+		return err
+	}
+	if updated == 0 {
+		job.Version = version
+		return ErrConflict
+	}
+	return nil
+}
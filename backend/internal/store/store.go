@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,24 +11,102 @@ import (
 	"email-harvester/internal/models"
 )
 
-// Store defines the interface for data storage operations
+// Store defines the interface for data storage operations. Lookups of a
+// single item return nil, not an error, when there is no such item, and
+// updates and deletes of unknown items do nothing. The storetest package
+// checks that an implementation behaves like the others.
 type Store interface {
 	// Account operations
 	CreateAccount(ctx context.Context, account *models.Account) error
 	GetAccount(ctx context.Context, id primitive.ObjectID) (*models.Account, error)
 	GetAccountByEmail(ctx context.Context, email string) (*models.Account, error)
 	UpdateAccount(ctx context.Context, account *models.Account) error
+	// UpsertAccount creates an account, or when its user already has an
+	// account for the same provider and email, updates that account's tokens
+	// and profile and reactivates it. The refresh token is kept when the new
+	// one is empty. Either way account is left holding the stored account.
+	UpsertAccount(ctx context.Context, account *models.Account) error
+	// DeleteAccount deletes an account along with its emails and threads
 	DeleteAccount(ctx context.Context, id primitive.ObjectID) error
+	// ListAccounts lists accounts by creation time and ID, newest first
 	ListAccounts(ctx context.Context, page, limit int) ([]models.Account, int64, error)
+	// ListAccountsAfter lists up to limit accounts in ListAccounts order,
+	// starting after cursor, or at the newest account when cursor is empty.
+	// It returns the cursor of the next page, which is empty on the last one.
+	ListAccountsAfter(ctx context.Context, cursor string, limit int) ([]models.Account, string, error)
+	ListActiveAccounts(ctx context.Context) ([]models.Account, error)
+	// UpdateSyncStatus records the outcome of a sync without touching the
+	// account's credentials or sync cursors
+	UpdateSyncStatus(ctx context.Context, id primitive.ObjectID, lastSyncAt time.Time, status *models.SyncStatus) error
+
+	// OAuth state operations
+	CreateOAuthState(ctx context.Context, state *models.OAuthState) error
+	// ConsumeOAuthState deletes and returns a pending OAuth state, so every
+	// state is accepted at most once. It returns nil for unknown states.
+	ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error)
 
 	// Email operations
 	CreateEmail(ctx context.Context, email *models.Email) error
+	// BulkUpsertEmails stores emails in as few round trips as the backend
+	// allows. An email whose account already has its message ID is left as
+	// stored, which is what the unique (account_id, message_id) index
+	// decides rather than a read. It returns the result of every email, in
+	// order, and an error only when nothing could be written.
+	BulkUpsertEmails(ctx context.Context, emails []*models.Email) ([]BulkEmailResult, error)
 	GetEmail(ctx context.Context, id primitive.ObjectID) (*models.Email, error)
 	GetEmailByMessageID(ctx context.Context, accountID primitive.ObjectID, messageID string) (*models.Email, error)
 	UpdateEmail(ctx context.Context, email *models.Email) error
 	DeleteEmail(ctx context.Context, id primitive.ObjectID) error
+	// ListEmails lists the emails matching filter by received time and ID,
+	// newest first. Its full-text terms must all occur in the subject, sender,
+	// body or HTML text.
 	ListEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.Email, int64, error)
+	// ListEmailsAfter lists up to limit emails in ListEmails order, starting
+	// after cursor, or at the newest email when cursor is empty. It returns
+	// the cursor of the next page, which is empty on the last one. Unlike
+	// pages, cursors do not shift when new emails arrive.
+	ListEmailsAfter(ctx context.Context, filter models.EmailFilter, cursor string, limit int) ([]models.Email, string, error)
+	// SearchEmails is ListEmails ranked by how well the emails match the
+	// filter's full-text terms
+	SearchEmails(ctx context.Context, filter models.EmailFilter, page, limit int) ([]models.EmailSearchResult, int64, error)
 	DeleteAccountEmails(ctx context.Context, accountID primitive.ObjectID) error
+
+	// Thread operations
+	CreateThread(ctx context.Context, thread *models.Thread) error
+	// GetThread returns nil for unknown threads
+	GetThread(ctx context.Context, id primitive.ObjectID) (*models.Thread, error)
+	UpdateThread(ctx context.Context, thread *models.Thread) error
+	DeleteThread(ctx context.Context, id primitive.ObjectID) error
+	// FindThread returns the account's most recently active thread that has
+	// any of keys, or nil when there is none
+	FindThread(ctx context.Context, accountID primitive.ObjectID, keys []string) (*models.Thread, error)
+	// ListThreads lists threads, optionally of one account, by last activity,
+	// newest first
+	ListThreads(ctx context.Context, accountID *primitive.ObjectID, page, limit int) ([]models.Thread, int64, error)
+	// ListThreadEmails lists the emails of a thread, oldest first
+	ListThreadEmails(ctx context.Context, accountID, threadID primitive.ObjectID) ([]models.Email, error)
+	DeleteAccountThreads(ctx context.Context, accountID primitive.ObjectID) error
+
+	// Job operations
+	CreateJob(ctx context.Context, job *models.Job) error
+	GetJob(ctx context.Context, id primitive.ObjectID) (*models.Job, error)
+	ListJobs(ctx context.Context, filter models.JobFilter, page, limit int) ([]models.Job, int64, error)
+	// ClaimJob atomically leases the next due job to workerID for the given
+	// visibility timeout. Running jobs whose lease expired are due again. It
+	// returns nil when no job is due.
+	ClaimJob(ctx context.Context, workerID string, lease time.Duration) (*models.Job, error)
+	// UpdateJob saves a job only if nobody else changed it since it was read,
+	// and returns ErrConflict otherwise
+	UpdateJob(ctx context.Context, job *models.Job) error
+}
+
+// ErrConflict is returned when an optimistic update lost to a concurrent write
+var ErrConflict = errors.New("conflicting update")
+
+// BulkEmailResult is the outcome for one email of BulkUpsertEmails
+type BulkEmailResult struct {
+	Created bool  // False when the account already had the message, or on error
+	Err     error // Why the email could not be written
 }
 
 // StoreType represents the type of store to use
@@ -36,6 +115,9 @@ type StoreType string
 const (
 	StoreTypeMongoDB    StoreType = "mongodb"
 	StoreTypeCosmosDB   StoreType = "cosmosdb"
+	StoreTypePostgres   StoreType = "postgres"
+	StoreTypeSQLite     StoreType = "sqlite"
+	StoreTypeMemory     StoreType = "memory" // Nothing survives a restart
 )
 
 // StoreConfig holds configuration for the store
@@ -48,6 +130,9 @@ type StoreConfig struct {
 	CosmosEndpoint string
 	CosmosKey      string
 	CosmosDatabase string
+	// PostgreSQL and SQLite specific config
+	PostgresDSN string
+	SQLitePath  string
 }
 
 // NewStore creates a new store instance based on the configuration
@@ -57,6 +142,12 @@ func NewStore(cfg StoreConfig) (Store, error) {
 		return NewMongoStore(cfg.MongoURI, cfg.MongoDatabase)
 	case StoreTypeCosmosDB:
 		return NewCosmosStore(cfg.CosmosEndpoint, cfg.CosmosKey, cfg.CosmosDatabase)
+	case StoreTypePostgres:
+		return NewPostgresStore(cfg.PostgresDSN)
+	case StoreTypeSQLite:
+		return NewSQLiteStore(cfg.SQLitePath)
+	case StoreTypeMemory:
+		return NewMemoryStore(), nil
 	default:
 		return nil, fmt.Errorf("unsupported store type: %s", cfg.Type)
 	}
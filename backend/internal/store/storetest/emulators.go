@@ -0,0 +1,90 @@
+package storetest
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"email-harvester/internal/migrations"
+	"email-harvester/internal/store"
+)
+
+// Environment variables pointing the suite at local emulators
+const (
+	MongoURIEnv       = "STORETEST_MONGODB_URI"     // e.g. mongodb://localhost:27017
+	CosmosEndpointEnv = "STORETEST_COSMOS_ENDPOINT" // e.g. https://localhost:8081/
+	CosmosKeyEnv      = "STORETEST_COSMOS_KEY"      // The emulator's well-known key
+)
+
+// MongoDB opens a MongoStore on a new database of the MongoDB server at
+// $STORETEST_MONGODB_URI, with the migrated schema, and drops the
+// database after the test. It skips the test when the variable is unset.
+func MongoDB(t *testing.T) store.Store {
+	uri := os.Getenv(MongoURIEnv)
+	if uri == "" {
+		t.Skipf("%s is not set", MongoURIEnv)
+	}
+	ctx := context.Background()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("failed to connect to MongoDB: %v", err)
+	}
+	db := client.Database("storetest_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		if err := db.Drop(context.Background()); err != nil {
+			t.Logf("failed to drop %s: %v", db.Name(), err)
+		}
+		client.Disconnect(context.Background())
+	})
+
+	if _, err := migrations.NewMongoDBMigrator(db).Up(ctx); err != nil {
+		t.Fatalf("failed to migrate the MongoDB schema: %v", err)
+	}
+	return store.NewMongoStore(db)
+}
+
+// CosmosDB opens a CosmosStore on a new database of the Cosmos DB emulator
+// at $STORETEST_COSMOS_ENDPOINT and deletes the database after the test. It
+// skips the test when the endpoint or $STORETEST_COSMOS_KEY is unset.
+func CosmosDB(t *testing.T) store.Store {
+	endpoint, key := os.Getenv(CosmosEndpointEnv), os.Getenv(CosmosKeyEnv)
+	if endpoint == "" || key == "" {
+		t.Skipf("%s and %s are not set", CosmosEndpointEnv, CosmosKeyEnv)
+	}
+	ctx := context.Background()
+
+	cred, err := azcosmos.NewKeyCredential(key)
+	if err != nil {
+		t.Fatalf("failed to create credential: %v", err)
+	}
+	client, err := azcosmos.NewClientWithKey(endpoint, cred, nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	name := "storetest_" + primitive.NewObjectID().Hex()
+	if _, err := client.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: name}, nil); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	t.Cleanup(func() {
+		database, err := client.NewDatabase(name)
+		if err == nil {
+			_, err = database.Delete(context.Background(), nil)
+		}
+		if err != nil {
+			t.Logf("failed to delete %s: %v", name, err)
+		}
+	})
+
+	s, err := store.NewCosmosStore(endpoint, key, name)
+	if err != nil {
+		t.Fatalf("failed to open Cosmos DB store: %v", err)
+	}
+	return s
+}
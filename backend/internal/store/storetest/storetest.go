@@ -0,0 +1,981 @@
+// Package storetest is a conformance suite for implementations of
+// store.Store. Every backend must pass it, so that services behave the same
+// whichever store they run on. A backend's test runs it with a function that
+// opens an empty store:
+//
+//	func TestMemoryStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			return store.NewMemoryStore()
+//		})
+//	}
+//
+// MongoDB and CosmosDB open stores on local emulators, and skip the suite
+// when none is configured.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"email-harvester/internal/models"
+	"email-harvester/internal/store"
+)
+
+// Opener opens an empty store for one test
+type Opener func(t *testing.T) store.Store
+
+// base is the time the emails and threads of the suite are received around.
+// It has no sub-millisecond part, which MongoDB would drop.
+var base = time.Date(2024, 3, 4, 9, 30, 0, 0, time.UTC)
+
+// Run runs the conformance suite against the stores open returns. Every
+// subtest gets a store of its own.
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s store.Store)
+	}{
+		{"Accounts", testAccounts},
+		{"UpsertAccount", testUpsertAccount},
+		{"ListAccounts", testListAccounts},
+		{"OAuthStates", testOAuthStates},
+		{"Emails", testEmails},
+		{"BulkUpsertEmails", testBulkUpsertEmails},
+		{"EmailFilters", testEmailFilters},
+		{"ListEmails", testListEmails},
+		{"SearchEmails", testSearchEmails},
+		{"Threads", testThreads},
+		{"Jobs", testJobs},
+		{"ClaimJob", testClaimJob},
+		{"DeleteAccount", testDeleteAccount},
+		{"NotFound", testNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, open(t))
+		})
+	}
+}
+
+func testAccounts(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	account := &models.Account{
+		UserID:       primitive.NewObjectID(),
+		Provider:     string(models.AccountTypeOutlook),
+		Email:        "alice@example.com",
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		TokenExpiry:  base.Add(time.Hour),
+		DeltaLinks:   map[string]string{"inbox": "https://graph.example.com/delta"},
+		GraphSubscription: &models.GraphSubscription{
+			ID:          "subscription",
+			ClientState: "secret",
+			ExpiresAt:   base.Add(24 * time.Hour),
+		},
+		Name:     "Alice",
+		IsActive: true,
+	}
+	mustNoError(t, s.CreateAccount(ctx, account))
+	if account.ID.IsZero() {
+		t.Fatal("CreateAccount did not set the ID")
+	}
+
+	got, err := s.GetAccount(ctx, account.ID)
+	mustNoError(t, err)
+	if got == nil {
+		t.Fatal("GetAccount returned nil for a stored account")
+	}
+	if got.Email != account.Email || got.UserID != account.UserID || got.Name != "Alice" || !got.IsActive {
+		t.Errorf("GetAccount = %+v, want the stored account", got)
+	}
+	// Credentials and sync state are hidden from API responses, but must be
+	// stored all the same
+	if got.AccessToken != "access" || got.RefreshToken != "refresh" || !got.TokenExpiry.Equal(account.TokenExpiry) {
+		t.Errorf("stored tokens = %q, %q, %v; want access, refresh, %v", got.AccessToken, got.RefreshToken, got.TokenExpiry, account.TokenExpiry)
+	}
+	if got.DeltaLinks["inbox"] != account.DeltaLinks["inbox"] {
+		t.Errorf("stored delta links = %v, want %v", got.DeltaLinks, account.DeltaLinks)
+	}
+	if got.GraphSubscription == nil || got.GraphSubscription.ClientState != "secret" {
+		t.Errorf("stored Graph subscription = %+v, want client state secret", got.GraphSubscription)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Error("CreateAccount did not set the creation time")
+	}
+
+	byEmail, err := s.GetAccountByEmail(ctx, "alice@example.com")
+	mustNoError(t, err)
+	if byEmail == nil || byEmail.ID != account.ID {
+		t.Errorf("GetAccountByEmail = %v, want account %s", byEmail, account.ID.Hex())
+	}
+
+	got.AccessToken = "rotated"
+	got.IsActive = false
+	got.DisabledReason = "revoked"
+	mustNoError(t, s.UpdateAccount(ctx, got))
+	updated, err := s.GetAccount(ctx, account.ID)
+	mustNoError(t, err)
+	if updated.AccessToken != "rotated" || updated.IsActive || updated.DisabledReason != "revoked" {
+		t.Errorf("UpdateAccount stored %+v, want the new token and the account deactivated", updated)
+	}
+
+	active := &models.Account{UserID: account.UserID, Provider: string(models.AccountTypeGmail), Email: "bob@example.com", IsActive: true}
+	mustNoError(t, s.CreateAccount(ctx, active))
+	accounts, err := s.ListActiveAccounts(ctx)
+	mustNoError(t, err)
+	if ids := accountIDs(accounts); len(ids) != 1 || ids[0] != active.ID {
+		t.Errorf("ListActiveAccounts = %v, want only %s", ids, active.ID.Hex())
+	}
+
+	status := &models.SyncStatus{LastAttemptAt: base, LastSuccessAt: base, MessagesAdded: 7}
+	mustNoError(t, s.UpdateSyncStatus(ctx, active.ID, base, status))
+	synced, err := s.GetAccount(ctx, active.ID)
+	mustNoError(t, err)
+	if synced.SyncStatus == nil || synced.SyncStatus.MessagesAdded != 7 || !synced.LastSyncAt.Equal(base) {
+		t.Errorf("UpdateSyncStatus stored %+v at %v, want 7 messages at %v", synced.SyncStatus, synced.LastSyncAt, base)
+	}
+
+	// A failed sync leaves the last sync time alone
+	mustNoError(t, s.UpdateSyncStatus(ctx, active.ID, time.Time{}, &models.SyncStatus{LastAttemptAt: base, LastError: "timeout"}))
+	failed, err := s.GetAccount(ctx, active.ID)
+	mustNoError(t, err)
+	if failed.SyncStatus == nil || failed.SyncStatus.LastError != "timeout" || !failed.LastSyncAt.Equal(base) {
+		t.Errorf("UpdateSyncStatus stored %+v at %v, want the error and the last sync at %v", failed.SyncStatus, failed.LastSyncAt, base)
+	}
+}
+
+func testUpsertAccount(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	account := &models.Account{
+		UserID:       userID,
+		Provider:     string(models.AccountTypeGmail),
+		Email:        "alice@example.com",
+		AccessToken:  "first",
+		RefreshToken: "refresh",
+		TokenExpiry:  base,
+	}
+	mustNoError(t, s.UpsertAccount(ctx, account))
+	if account.ID.IsZero() || !account.IsActive {
+		t.Fatalf("UpsertAccount left %+v, want a stored, active account", account)
+	}
+	id := account.ID
+
+	mustNoError(t, s.UpdateAccount(ctx, &models.Account{ID: id, Email: account.Email, AccessToken: "first", RefreshToken: "refresh", DisabledReason: "revoked"}))
+
+	// Reconnecting without a new refresh token keeps the stored one
+	again := &models.Account{
+		UserID:      userID,
+		Provider:    string(models.AccountTypeGmail),
+		Email:       "alice@example.com",
+		AccessToken: "second",
+		TokenExpiry: base.Add(time.Hour),
+	}
+	mustNoError(t, s.UpsertAccount(ctx, again))
+	if again.ID != id {
+		t.Errorf("UpsertAccount stored account %s, want the existing %s", again.ID.Hex(), id.Hex())
+	}
+
+	stored, err := s.GetAccount(ctx, id)
+	mustNoError(t, err)
+	if stored.AccessToken != "second" || stored.RefreshToken != "refresh" || !stored.IsActive || stored.DisabledReason != "" {
+		t.Errorf("UpsertAccount stored %+v, want the new access token, the old refresh token and the account reactivated", stored)
+	}
+
+	// Another user connecting the same mailbox gets an account of their own
+	other := &models.Account{UserID: primitive.NewObjectID(), Provider: string(models.AccountTypeGmail), Email: "alice@example.com", AccessToken: "other"}
+	mustNoError(t, s.UpsertAccount(ctx, other))
+	if other.ID == id {
+		t.Error("UpsertAccount reused another user's account")
+	}
+}
+
+func testListAccounts(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	var want []primitive.ObjectID
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		account := &models.Account{UserID: primitive.NewObjectID(), Provider: string(models.AccountTypeGmail), Email: email}
+		mustNoError(t, s.CreateAccount(ctx, account))
+		want = append([]primitive.ObjectID{account.ID}, want...)
+	}
+
+	var got []primitive.ObjectID
+	for page := 1; page <= 3; page++ {
+		accounts, total, err := s.ListAccounts(ctx, page, 2)
+		mustNoError(t, err)
+		if total != 5 {
+			t.Errorf("ListAccounts page %d total = %d, want 5", page, total)
+		}
+		got = append(got, accountIDs(accounts)...)
+	}
+	assertIDs(t, "ListAccounts", got, want)
+
+	accounts, _, err := s.ListAccounts(ctx, 4, 2)
+	mustNoError(t, err)
+	if len(accounts) != 0 {
+		t.Errorf("ListAccounts past the last page = %v, want none", accountIDs(accounts))
+	}
+
+	got = nil
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("ListAccountsAfter did not stop after the last page")
+		}
+		accounts, next, err := s.ListAccountsAfter(ctx, cursor, 2)
+		mustNoError(t, err)
+		got = append(got, accountIDs(accounts)...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assertIDs(t, "ListAccountsAfter", got, want)
+
+	if _, _, err := s.ListAccountsAfter(ctx, "not a cursor", 2); !errors.Is(err, store.ErrInvalidCursor) {
+		t.Errorf("ListAccountsAfter with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testOAuthStates(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	state := &models.OAuthState{
+		State:        "state",
+		UserID:       primitive.NewObjectID(),
+		Provider:     string(models.AccountTypeGmail),
+		CodeVerifier: "verifier",
+		ExpiresAt:    base.Add(10 * time.Minute),
+	}
+	mustNoError(t, s.CreateOAuthState(ctx, state))
+
+	pending, err := s.ConsumeOAuthState(ctx, "state")
+	mustNoError(t, err)
+	if pending == nil {
+		t.Fatal("ConsumeOAuthState returned nil for a pending state")
+	}
+	if pending.UserID != state.UserID || pending.Provider != state.Provider || pending.CodeVerifier != "verifier" || !pending.ExpiresAt.Equal(state.ExpiresAt) {
+		t.Errorf("ConsumeOAuthState = %+v, want %+v", pending, state)
+	}
+
+	again, err := s.ConsumeOAuthState(ctx, "state")
+	mustNoError(t, err)
+	if again != nil {
+		t.Error("ConsumeOAuthState accepted a state twice")
+	}
+}
+
+func testEmails(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountID := primitive.NewObjectID()
+
+	email := &models.Email{
+		AccountID:   accountID,
+		MessageID:   "message-1",
+		ThreadID:    "thread-1",
+		From:        "alice@example.com",
+		FromAddress: models.EmailAddress{Name: "Alice", Address: "alice@example.com"},
+		To:          []string{"bob@example.com"},
+		Subject:     "Hello",
+		Body:        "Hi Bob",
+		Labels:      []string{"INBOX"},
+		Attachments: []models.Attachment{{ID: "1", Filename: "notes.txt", ContentType: "text/plain", Size: 5, SHA256: "digest"}},
+		ReceivedAt:  base,
+	}
+	mustNoError(t, s.CreateEmail(ctx, email))
+	if email.ID.IsZero() {
+		t.Fatal("CreateEmail did not set the ID")
+	}
+
+	got, err := s.GetEmail(ctx, email.ID)
+	mustNoError(t, err)
+	if got == nil {
+		t.Fatal("GetEmail returned nil for a stored email")
+	}
+	if got.AccountID != accountID || got.MessageID != "message-1" || got.Subject != "Hello" || got.FromAddress.Name != "Alice" ||
+		!got.ReceivedAt.Equal(base) || len(got.Attachments) != 1 || got.Attachments[0].SHA256 != "digest" {
+		t.Errorf("GetEmail = %+v, want the stored email", got)
+	}
+
+	byMessageID, err := s.GetEmailByMessageID(ctx, accountID, "message-1")
+	mustNoError(t, err)
+	if byMessageID == nil || byMessageID.ID != email.ID {
+		t.Errorf("GetEmailByMessageID = %v, want email %s", byMessageID, email.ID.Hex())
+	}
+	otherAccount, err := s.GetEmailByMessageID(ctx, primitive.NewObjectID(), "message-1")
+	mustNoError(t, err)
+	if otherAccount != nil {
+		t.Error("GetEmailByMessageID found the email of another account")
+	}
+
+	// Updates only touch the enrichment and flags
+	got.Subject = "Changed"
+	got.Summary = "A greeting"
+	got.Labels = []string{"INBOX", "IMPORTANT"}
+	got.Read = true
+	got.Starred = true
+	mustNoError(t, s.UpdateEmail(ctx, got))
+	updated, err := s.GetEmail(ctx, email.ID)
+	mustNoError(t, err)
+	if updated.Summary != "A greeting" || len(updated.Labels) != 2 || !updated.Read || !updated.Starred {
+		t.Errorf("UpdateEmail stored %+v, want the new summary, labels and flags", updated)
+	}
+	if updated.Subject != "Hello" {
+		t.Errorf("UpdateEmail changed the subject to %q", updated.Subject)
+	}
+
+	mustNoError(t, s.DeleteEmail(ctx, email.ID))
+	deleted, err := s.GetEmail(ctx, email.ID)
+	mustNoError(t, err)
+	if deleted != nil {
+		t.Error("GetEmail found a deleted email")
+	}
+}
+
+func testBulkUpsertEmails(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountA, accountB := primitive.NewObjectID(), primitive.NewObjectID()
+
+	stored := createEmail(t, s, &models.Email{AccountID: accountA, MessageID: "stored", Subject: "Original", ReceivedAt: base})
+
+	emails := []*models.Email{
+		{AccountID: accountA, MessageID: "new", Subject: "New", Labels: []string{"INBOX"}, ReceivedAt: base},
+		{AccountID: accountA, MessageID: "stored", Subject: "Again", ReceivedAt: base},
+		{AccountID: accountB, MessageID: "stored", Subject: "Other account", ReceivedAt: base},
+	}
+	results, err := s.BulkUpsertEmails(ctx, emails)
+	mustNoError(t, err)
+	if len(results) != len(emails) {
+		t.Fatalf("BulkUpsertEmails returned %d results, want %d", len(results), len(emails))
+	}
+	for i, want := range []bool{true, false, true} {
+		if results[i].Err != nil || results[i].Created != want {
+			t.Errorf("result %d = %+v, want created %v", i, results[i], want)
+		}
+	}
+
+	created, err := s.GetEmail(ctx, emails[0].ID)
+	mustNoError(t, err)
+	if created == nil || created.MessageID != "new" || len(created.Labels) != 1 || !created.ReceivedAt.Equal(base) {
+		t.Errorf("GetEmail of a created email = %+v, want the new email", created)
+	}
+	kept, err := s.GetEmailByMessageID(ctx, accountA, "stored")
+	mustNoError(t, err)
+	if kept == nil || kept.ID != stored.ID || kept.Subject != "Original" {
+		t.Errorf("GetEmailByMessageID = %+v, want the email stored before", kept)
+	}
+	other, err := s.GetEmailByMessageID(ctx, accountB, "stored")
+	mustNoError(t, err)
+	if other == nil || other.Subject != "Other account" {
+		t.Errorf("GetEmailByMessageID of another account = %+v, want its own email", other)
+	}
+
+	// Writing the same batch again creates nothing
+	again := []*models.Email{
+		{AccountID: accountA, MessageID: "new", ReceivedAt: base},
+		{AccountID: accountB, MessageID: "stored", ReceivedAt: base},
+	}
+	results, err = s.BulkUpsertEmails(ctx, again)
+	mustNoError(t, err)
+	for i, result := range results {
+		if result.Err != nil || result.Created {
+			t.Errorf("result %d of a repeated batch = %+v, want not created", i, result)
+		}
+	}
+	_, total, err := s.ListEmails(ctx, models.EmailFilter{}, 1, 10)
+	mustNoError(t, err)
+	if total != 3 {
+		t.Errorf("ListEmails total = %d after repeated batches, want 3", total)
+	}
+}
+
+func testEmailFilters(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountA := primitive.NewObjectID()
+	accountB := primitive.NewObjectID()
+
+	report := createEmail(t, s, &models.Email{
+		AccountID:   accountA,
+		MessageID:   "report",
+		From:        "alice@example.com",
+		FromAddress: models.EmailAddress{Name: "Alice Smith", Address: "alice@example.com"},
+		To:          []string{"bob@example.com"},
+		Subject:     "Quarterly report",
+		Body:        "The numbers are attached",
+		Labels:      []string{"INBOX", "work"},
+		Starred:     true,
+		Attachments: []models.Attachment{{ID: "1", Filename: "report.pdf", ContentType: "application/pdf", Size: 10, SHA256: "digest"}},
+		ReceivedAt:  base,
+	})
+	lunch := createEmail(t, s, &models.Email{
+		AccountID:   accountA,
+		MessageID:   "lunch",
+		From:        "carol@example.com",
+		FromAddress: models.EmailAddress{Address: "carol@example.com"},
+		To:          []string{"dave@example.com"},
+		Subject:     "Lunch plans",
+		Body:        "Pizza on Friday",
+		Labels:      []string{"INBOX"},
+		Read:        true,
+		ReceivedAt:  base.Add(time.Hour),
+	})
+	draft := createEmail(t, s, &models.Email{
+		AccountID:   accountB,
+		MessageID:   "draft",
+		From:        "alice@example.com",
+		FromAddress: models.EmailAddress{Address: "alice@example.com"},
+		To:          []string{"erin@example.com"},
+		Subject:     "Report draft",
+		Body:        "See the quarterly numbers",
+		Labels:      []string{"SENT"},
+		Read:        true,
+		ReceivedAt:  base.Add(2 * time.Hour),
+	})
+
+	yes, no := true, false
+	start, end := base.Add(30*time.Minute), base.Add(2*time.Hour)
+	tests := []struct {
+		name   string
+		filter models.EmailFilter
+		want   []*models.Email
+	}{
+		{"none", models.EmailFilter{}, []*models.Email{draft, lunch, report}},
+		{"account", models.EmailFilter{AccountID: &accountA}, []*models.Email{lunch, report}},
+		{"from address", models.EmailFilter{From: ptr("ALICE@")}, []*models.Email{draft, report}},
+		{"from name", models.EmailFilter{From: ptr("smith")}, []*models.Email{report}},
+		{"to", models.EmailFilter{To: ptr("dave")}, []*models.Email{lunch}},
+		{"subject", models.EmailFilter{Subject: ptr("report")}, []*models.Email{draft, report}},
+		{"label", models.EmailFilter{Label: ptr("work")}, []*models.Email{report}},
+		{"unread", models.EmailFilter{Read: &no}, []*models.Email{report}},
+		{"starred", models.EmailFilter{Starred: &yes}, []*models.Email{report}},
+		{"with attachments", models.EmailFilter{HasAttachment: &yes}, []*models.Email{report}},
+		{"without attachments", models.EmailFilter{HasAttachment: &no}, []*models.Email{draft, lunch}},
+		{"dates", models.EmailFilter{StartDate: &start, EndDate: &end}, []*models.Email{draft, lunch}},
+		{"text", models.EmailFilter{Text: []string{"numbers"}}, []*models.Email{draft, report}},
+		{"all text terms", models.EmailFilter{Text: []string{"quarterly", "attached"}}, []*models.Email{report}},
+		{"text in sender", models.EmailFilter{Text: []string{"carol"}}, []*models.Email{lunch}},
+		{"negated label", models.EmailFilter{Not: []models.EmailFilter{{Label: ptr("work")}}}, []*models.Email{draft, lunch}},
+		{"negated text", models.EmailFilter{Not: []models.EmailFilter{{Text: []string{"pizza"}}}}, []*models.Email{draft, report}},
+		{"combined", models.EmailFilter{AccountID: &accountA, Read: &yes}, []*models.Email{lunch}},
+		{"no match", models.EmailFilter{AccountID: &accountB, Label: ptr("work")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emails, total, err := s.ListEmails(ctx, tt.filter, 1, 10)
+			mustNoError(t, err)
+			assertIDs(t, "ListEmails", emailIDs(emails), emailIDs(deref(tt.want)))
+			if total != int64(len(tt.want)) {
+				t.Errorf("ListEmails total = %d, want %d", total, len(tt.want))
+			}
+
+			emails, next, err := s.ListEmailsAfter(ctx, tt.filter, "", 10)
+			mustNoError(t, err)
+			assertIDs(t, "ListEmailsAfter", emailIDs(emails), emailIDs(deref(tt.want)))
+			if next != "" {
+				t.Errorf("ListEmailsAfter returned cursor %q for the only page", next)
+			}
+		})
+	}
+}
+
+func testListEmails(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountID := primitive.NewObjectID()
+
+	// Two emails received at the same time are ordered by ID
+	var emails []models.Email
+	for i, at := range []time.Duration{0, time.Minute, 2 * time.Minute, 2 * time.Minute, 5 * time.Minute, time.Hour, 2 * time.Hour} {
+		email := createEmail(t, s, &models.Email{
+			AccountID:  accountID,
+			MessageID:  string(rune('a' + i)),
+			Subject:    "Email",
+			ReceivedAt: base.Add(at),
+		})
+		emails = append(emails, *email)
+	}
+	createEmail(t, s, &models.Email{AccountID: primitive.NewObjectID(), MessageID: "other", ReceivedAt: base})
+
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].ReceivedAt.Equal(emails[j].ReceivedAt) {
+			return emails[i].ReceivedAt.After(emails[j].ReceivedAt)
+		}
+		return bytes.Compare(emails[i].ID[:], emails[j].ID[:]) > 0
+	})
+	want := emailIDs(emails)
+	filter := models.EmailFilter{AccountID: &accountID}
+
+	var got []primitive.ObjectID
+	for page := 1; page <= 3; page++ {
+		emails, total, err := s.ListEmails(ctx, filter, page, 3)
+		mustNoError(t, err)
+		if total != 7 {
+			t.Errorf("ListEmails page %d total = %d, want 7", page, total)
+		}
+		got = append(got, emailIDs(emails)...)
+	}
+	assertIDs(t, "ListEmails", got, want)
+
+	past, _, err := s.ListEmails(ctx, filter, 4, 3)
+	mustNoError(t, err)
+	if len(past) != 0 {
+		t.Errorf("ListEmails past the last page = %v, want none", emailIDs(past))
+	}
+
+	got = nil
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("ListEmailsAfter did not stop after the last page")
+		}
+		emails, next, err := s.ListEmailsAfter(ctx, filter, cursor, 3)
+		mustNoError(t, err)
+		got = append(got, emailIDs(emails)...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assertIDs(t, "ListEmailsAfter", got, want)
+
+	// Cursors keep their position while newer emails arrive
+	first, cursor, err := s.ListEmailsAfter(ctx, filter, "", 3)
+	mustNoError(t, err)
+	createEmail(t, s, &models.Email{AccountID: accountID, MessageID: "newer", ReceivedAt: base.Add(3 * time.Hour)})
+	second, _, err := s.ListEmailsAfter(ctx, filter, cursor, 3)
+	mustNoError(t, err)
+	assertIDs(t, "ListEmailsAfter", append(emailIDs(first), emailIDs(second)...), want[:6])
+
+	if _, _, err := s.ListEmailsAfter(ctx, filter, "not a cursor", 3); !errors.Is(err, store.ErrInvalidCursor) {
+		t.Errorf("ListEmailsAfter with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testSearchEmails(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountID := primitive.NewObjectID()
+
+	inBody := createEmail(t, s, &models.Email{
+		AccountID:  accountID,
+		MessageID:  "body",
+		From:       "billing@example.com",
+		Subject:    "March",
+		Body:       "Your invoice is ready",
+		ReceivedAt: base.Add(time.Hour),
+	})
+	inSubject := createEmail(t, s, &models.Email{
+		AccountID:  accountID,
+		MessageID:  "subject",
+		From:       "billing@example.com",
+		Subject:    "Invoice",
+		Body:       "Your invoice is ready",
+		ReceivedAt: base,
+	})
+	createEmail(t, s, &models.Email{
+		AccountID:  accountID,
+		MessageID:  "unrelated",
+		From:       "alice@example.com",
+		Subject:    "Lunch",
+		Body:       "Pizza on Friday",
+		ReceivedAt: base.Add(2 * time.Hour),
+	})
+
+	results, total, err := s.SearchEmails(ctx, models.EmailFilter{AccountID: &accountID, Text: []string{"invoice"}}, 1, 10)
+	mustNoError(t, err)
+	if total != 2 {
+		t.Errorf("SearchEmails total = %d, want 2", total)
+	}
+	var got []primitive.ObjectID
+	for _, result := range results {
+		got = append(got, result.Email.ID)
+	}
+	// Matches in the subject rank first
+	assertIDs(t, "SearchEmails", got, []primitive.ObjectID{inSubject.ID, inBody.ID})
+	if len(results) == 2 && results[0].Score <= results[1].Score {
+		t.Errorf("SearchEmails scores = %v, %v; want the subject match to score higher", results[0].Score, results[1].Score)
+	}
+}
+
+func testThreads(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountA := primitive.NewObjectID()
+	accountB := primitive.NewObjectID()
+
+	older := createThread(t, s, &models.Thread{AccountID: accountA, Subject: "Older", MessageCount: 2, Keys: []string{"k1", "k2"}, LastActivityAt: base})
+	newer := createThread(t, s, &models.Thread{AccountID: accountA, Subject: "Newer", MessageCount: 1, Keys: []string{"k2"}, LastActivityAt: base.Add(time.Hour)})
+	other := createThread(t, s, &models.Thread{AccountID: accountB, Subject: "Other", MessageCount: 1, Keys: []string{"k1"}, LastActivityAt: base.Add(2 * time.Hour)})
+
+	got, err := s.GetThread(ctx, older.ID)
+	mustNoError(t, err)
+	if got == nil {
+		t.Fatal("GetThread returned nil for a stored thread")
+	}
+	if got.Subject != "Older" || got.MessageCount != 2 || len(got.Keys) != 2 || !got.LastActivityAt.Equal(base) {
+		t.Errorf("GetThread = %+v, want the stored thread with its keys", got)
+	}
+
+	for _, tt := range []struct {
+		keys []string
+		want *models.Thread
+	}{
+		{[]string{"k1"}, older},
+		{[]string{"k2"}, newer}, // The most recently active one
+		{[]string{"k3", "k1"}, older},
+		{[]string{"k3"}, nil},
+		{nil, nil},
+	} {
+		found, err := s.FindThread(ctx, accountA, tt.keys)
+		mustNoError(t, err)
+		switch {
+		case tt.want == nil && found != nil:
+			t.Errorf("FindThread(%v) = %s, want none", tt.keys, found.ID.Hex())
+		case tt.want != nil && (found == nil || found.ID != tt.want.ID):
+			t.Errorf("FindThread(%v) = %v, want %s", tt.keys, found, tt.want.ID.Hex())
+		}
+	}
+
+	threads, total, err := s.ListThreads(ctx, nil, 1, 10)
+	mustNoError(t, err)
+	if total != 3 {
+		t.Errorf("ListThreads total = %d, want 3", total)
+	}
+	assertIDs(t, "ListThreads", threadIDs(threads), []primitive.ObjectID{other.ID, newer.ID, older.ID})
+
+	threads, total, err = s.ListThreads(ctx, &accountA, 2, 1)
+	mustNoError(t, err)
+	if total != 2 {
+		t.Errorf("ListThreads of an account total = %d, want 2", total)
+	}
+	assertIDs(t, "ListThreads of an account", threadIDs(threads), []primitive.ObjectID{older.ID})
+
+	first := createEmail(t, s, &models.Email{AccountID: accountA, MessageID: "first", ThreadRef: older.ID, ReceivedAt: base.Add(-time.Hour)})
+	second := createEmail(t, s, &models.Email{AccountID: accountA, MessageID: "second", ThreadRef: older.ID, ReceivedAt: base})
+	createEmail(t, s, &models.Email{AccountID: accountA, MessageID: "elsewhere", ThreadRef: newer.ID, ReceivedAt: base})
+	emails, err := s.ListThreadEmails(ctx, accountA, older.ID)
+	mustNoError(t, err)
+	assertIDs(t, "ListThreadEmails", emailIDs(emails), []primitive.ObjectID{first.ID, second.ID})
+
+	got.MessageCount = 3
+	got.Keys = append(got.Keys, "k3")
+	got.LastActivityAt = base.Add(3 * time.Hour)
+	mustNoError(t, s.UpdateThread(ctx, got))
+	found, err := s.FindThread(ctx, accountA, []string{"k2"})
+	mustNoError(t, err)
+	if found == nil || found.ID != older.ID || found.MessageCount != 3 || len(found.Keys) != 3 {
+		t.Errorf("FindThread after UpdateThread = %+v, want the updated thread", found)
+	}
+
+	mustNoError(t, s.DeleteThread(ctx, newer.ID))
+	deleted, err := s.GetThread(ctx, newer.ID)
+	mustNoError(t, err)
+	if deleted != nil {
+		t.Error("GetThread found a deleted thread")
+	}
+
+	mustNoError(t, s.DeleteAccountThreads(ctx, accountA))
+	threads, _, err = s.ListThreads(ctx, nil, 1, 10)
+	mustNoError(t, err)
+	assertIDs(t, "ListThreads after DeleteAccountThreads", threadIDs(threads), []primitive.ObjectID{other.ID})
+}
+
+func testJobs(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	accountID := primitive.NewObjectID()
+
+	sync := &models.Job{Type: models.JobTypeSync, Status: models.JobStatusPending, AccountID: &accountID, MaxAttempts: 3, RunAt: base}
+	mustNoError(t, s.CreateJob(ctx, sync))
+	if sync.ID.IsZero() || sync.Version != 1 {
+		t.Fatalf("CreateJob left ID %s and version %d, want an ID and version 1", sync.ID.Hex(), sync.Version)
+	}
+	summarize := &models.Job{Type: models.JobTypeSummarize, Status: models.JobStatusSucceeded, MaxAttempts: 3, RunAt: base}
+	mustNoError(t, s.CreateJob(ctx, summarize))
+
+	got, err := s.GetJob(ctx, sync.ID)
+	mustNoError(t, err)
+	if got == nil {
+		t.Fatal("GetJob returned nil for a stored job")
+	}
+	if got.Type != models.JobTypeSync || got.AccountID == nil || *got.AccountID != accountID || !got.RunAt.Equal(base) {
+		t.Errorf("GetJob = %+v, want the stored job", got)
+	}
+
+	jobType := models.JobTypeSync
+	jobs, total, err := s.ListJobs(ctx, models.JobFilter{Type: &jobType}, 1, 10)
+	mustNoError(t, err)
+	if total != 1 || len(jobs) != 1 || jobs[0].ID != sync.ID {
+		t.Errorf("ListJobs by type = %d jobs of %d, want the sync job", len(jobs), total)
+	}
+	status := models.JobStatusSucceeded
+	jobs, total, err = s.ListJobs(ctx, models.JobFilter{Status: &status}, 1, 10)
+	mustNoError(t, err)
+	if total != 1 || len(jobs) != 1 || jobs[0].ID != summarize.ID {
+		t.Errorf("ListJobs by status = %d jobs of %d, want the summarize job", len(jobs), total)
+	}
+	jobs, total, err = s.ListJobs(ctx, models.JobFilter{}, 1, 10)
+	mustNoError(t, err)
+	if total != 2 || len(jobs) != 2 {
+		t.Errorf("ListJobs = %d jobs of %d, want both", len(jobs), total)
+	}
+
+	// Only the writer that read the current version gets to save
+	stale := *got
+	got.LastError = "first"
+	mustNoError(t, s.UpdateJob(ctx, got))
+	if got.Version != 2 {
+		t.Errorf("UpdateJob left version %d, want 2", got.Version)
+	}
+	stale.LastError = "second"
+	if err := s.UpdateJob(ctx, &stale); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("UpdateJob of a stale job returned %v, want ErrConflict", err)
+	}
+	stored, err := s.GetJob(ctx, sync.ID)
+	mustNoError(t, err)
+	if stored.LastError != "first" {
+		t.Errorf("stored job has last error %q, want first", stored.LastError)
+	}
+}
+
+func testClaimJob(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	none, err := s.ClaimJob(ctx, "worker", time.Minute)
+	mustNoError(t, err)
+	if none != nil {
+		t.Fatal("ClaimJob claimed a job from an empty queue")
+	}
+
+	later := &models.Job{Type: models.JobTypeSync, Status: models.JobStatusPending, MaxAttempts: 3, RunAt: now.Add(time.Hour)}
+	mustNoError(t, s.CreateJob(ctx, later))
+	due := &models.Job{Type: models.JobTypeSync, Status: models.JobStatusPending, MaxAttempts: 3, RunAt: now.Add(-time.Minute)}
+	mustNoError(t, s.CreateJob(ctx, due))
+	overdue := &models.Job{Type: models.JobTypeNER, Status: models.JobStatusPending, MaxAttempts: 3, RunAt: now.Add(-time.Hour)}
+	mustNoError(t, s.CreateJob(ctx, overdue))
+
+	// The job due the longest goes first
+	claimed, err := s.ClaimJob(ctx, "worker", time.Minute)
+	mustNoError(t, err)
+	if claimed == nil || claimed.ID != overdue.ID {
+		t.Fatalf("ClaimJob = %v, want job %s", claimed, overdue.ID.Hex())
+	}
+	if claimed.Status != models.JobStatusRunning || claimed.WorkerID != "worker" || claimed.Attempts != 1 || !claimed.LockedUntil.After(now) {
+		t.Errorf("ClaimJob = %+v, want the job running and leased to worker", claimed)
+	}
+
+	// A lease that already ran out makes the job due again
+	expired, err := s.ClaimJob(ctx, "worker", -time.Second)
+	mustNoError(t, err)
+	if expired == nil || expired.ID != due.ID {
+		t.Fatalf("ClaimJob = %v, want job %s", expired, due.ID.Hex())
+	}
+	reclaimed, err := s.ClaimJob(ctx, "other", time.Minute)
+	mustNoError(t, err)
+	if reclaimed == nil || reclaimed.ID != due.ID || reclaimed.WorkerID != "other" || reclaimed.Attempts != 2 {
+		t.Errorf("ClaimJob = %+v, want job %s on its second attempt", reclaimed, due.ID.Hex())
+	}
+
+	none, err = s.ClaimJob(ctx, "worker", time.Minute)
+	mustNoError(t, err)
+	if none != nil {
+		t.Errorf("ClaimJob claimed job %s, which is leased or not due", none.ID.Hex())
+	}
+
+	// The claim counts as a write, so the claimed copy is the current one
+	claimed.Status = models.JobStatusSucceeded
+	if err := s.UpdateJob(ctx, claimed); err != nil {
+		t.Errorf("UpdateJob of a claimed job returned %v", err)
+	}
+}
+
+func testDeleteAccount(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	deleted := &models.Account{UserID: primitive.NewObjectID(), Provider: string(models.AccountTypeGmail), Email: "deleted@example.com"}
+	mustNoError(t, s.CreateAccount(ctx, deleted))
+	kept := &models.Account{UserID: primitive.NewObjectID(), Provider: string(models.AccountTypeGmail), Email: "kept@example.com"}
+	mustNoError(t, s.CreateAccount(ctx, kept))
+
+	for _, account := range []*models.Account{deleted, kept} {
+		thread := createThread(t, s, &models.Thread{AccountID: account.ID, Subject: "Hello", MessageCount: 2, Keys: []string{"k"}, LastActivityAt: base})
+		createEmail(t, s, &models.Email{AccountID: account.ID, MessageID: "1", ThreadRef: thread.ID, ReceivedAt: base})
+		createEmail(t, s, &models.Email{AccountID: account.ID, MessageID: "2", ThreadRef: thread.ID, ReceivedAt: base})
+	}
+
+	mustNoError(t, s.DeleteAccount(ctx, deleted.ID))
+	account, err := s.GetAccount(ctx, deleted.ID)
+	mustNoError(t, err)
+	if account != nil {
+		t.Error("GetAccount found a deleted account")
+	}
+	assertCounts(t, s, deleted.ID, 0, 0)
+	assertCounts(t, s, kept.ID, 2, 1)
+
+	// Deleting the emails of an account leaves the account and its threads
+	mustNoError(t, s.DeleteAccountEmails(ctx, kept.ID))
+	assertCounts(t, s, kept.ID, 0, 1)
+	account, err = s.GetAccount(ctx, kept.ID)
+	mustNoError(t, err)
+	if account == nil {
+		t.Error("DeleteAccountEmails deleted the account")
+	}
+}
+
+// testNotFound checks that lookups of unknown items return nil and that
+// updates and deletes of them do nothing
+func testNotFound(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+
+	account, err := s.GetAccount(ctx, id)
+	if err != nil || account != nil {
+		t.Errorf("GetAccount of an unknown account = %v, %v; want nil, nil", account, err)
+	}
+	account, err = s.GetAccountByEmail(ctx, "nobody@example.com")
+	if err != nil || account != nil {
+		t.Errorf("GetAccountByEmail of an unknown address = %v, %v; want nil, nil", account, err)
+	}
+	email, err := s.GetEmail(ctx, id)
+	if err != nil || email != nil {
+		t.Errorf("GetEmail of an unknown email = %v, %v; want nil, nil", email, err)
+	}
+	email, err = s.GetEmailByMessageID(ctx, id, "unknown")
+	if err != nil || email != nil {
+		t.Errorf("GetEmailByMessageID of an unknown message = %v, %v; want nil, nil", email, err)
+	}
+	thread, err := s.GetThread(ctx, id)
+	if err != nil || thread != nil {
+		t.Errorf("GetThread of an unknown thread = %v, %v; want nil, nil", thread, err)
+	}
+	job, err := s.GetJob(ctx, id)
+	if err != nil || job != nil {
+		t.Errorf("GetJob of an unknown job = %v, %v; want nil, nil", job, err)
+	}
+	state, err := s.ConsumeOAuthState(ctx, "unknown")
+	if err != nil || state != nil {
+		t.Errorf("ConsumeOAuthState of an unknown state = %v, %v; want nil, nil", state, err)
+	}
+
+	if err := s.UpdateSyncStatus(ctx, id, base, &models.SyncStatus{LastAttemptAt: base}); err != nil {
+		t.Errorf("UpdateSyncStatus of an unknown account returned %v", err)
+	}
+	if err := s.DeleteAccount(ctx, id); err != nil {
+		t.Errorf("DeleteAccount of an unknown account returned %v", err)
+	}
+	if err := s.DeleteEmail(ctx, id); err != nil {
+		t.Errorf("DeleteEmail of an unknown email returned %v", err)
+	}
+	if err := s.DeleteThread(ctx, id); err != nil {
+		t.Errorf("DeleteThread of an unknown thread returned %v", err)
+	}
+	if err := s.DeleteAccountEmails(ctx, id); err != nil {
+		t.Errorf("DeleteAccountEmails of an unknown account returned %v", err)
+	}
+	if err := s.DeleteAccountThreads(ctx, id); err != nil {
+		t.Errorf("DeleteAccountThreads of an unknown account returned %v", err)
+	}
+	if err := s.UpdateJob(ctx, &models.Job{ID: id, Version: 1}); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("UpdateJob of an unknown job returned %v, want ErrConflict", err)
+	}
+}
+
+// assertCounts checks how many emails and threads an account has left
+func assertCounts(t *testing.T, s store.Store, accountID primitive.ObjectID, emails, threads int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, total, err := s.ListEmails(ctx, models.EmailFilter{AccountID: &accountID}, 1, 10)
+	mustNoError(t, err)
+	if total != emails {
+		t.Errorf("account %s has %d emails, want %d", accountID.Hex(), total, emails)
+	}
+	_, total, err = s.ListThreads(ctx, &accountID, 1, 10)
+	mustNoError(t, err)
+	if total != threads {
+		t.Errorf("account %s has %d threads, want %d", accountID.Hex(), total, threads)
+	}
+}
+
+func createEmail(t *testing.T, s store.Store, email *models.Email) *models.Email {
+	t.Helper()
+	mustNoError(t, s.CreateEmail(context.Background(), email))
+	return email
+}
+
+func createThread(t *testing.T, s store.Store, thread *models.Thread) *models.Thread {
+	t.Helper()
+	mustNoError(t, s.CreateThread(context.Background(), thread))
+	return thread
+}
+
+func assertIDs(t *testing.T, what string, got, want []primitive.ObjectID) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s returned %d items %v, want %d %v", what, len(got), hexes(got), len(want), hexes(want))
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s returned %v, want %v", what, hexes(got), hexes(want))
+			return
+		}
+	}
+}
+
+func mustNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func accountIDs(accounts []models.Account) []primitive.ObjectID {
+	var ids []primitive.ObjectID
+	for _, account := range accounts {
+		ids = append(ids, account.ID)
+	}
+	return ids
+}
+
+func emailIDs(emails []models.Email) []primitive.ObjectID {
+	var ids []primitive.ObjectID
+	for _, email := range emails {
+		ids = append(ids, email.ID)
+	}
+	return ids
+}
+
+func threadIDs(threads []models.Thread) []primitive.ObjectID {
+	var ids []primitive.ObjectID
+	for _, thread := range threads {
+		ids = append(ids, thread.ID)
+	}
+	return ids
+}
+
+func hexes(ids []primitive.ObjectID) []string {
+	var s []string
+	for _, id := range ids {
+		s = append(s, id.Hex())
+	}
+	return s
+}
+
+func deref(emails []*models.Email) []models.Email {
+	var values []models.Email
+	for _, email := range emails {
+		values = append(values, *email)
+	}
+	return values
+}
+
+func ptr(s string) *string {
+	return &s
+}
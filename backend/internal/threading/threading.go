@@ -0,0 +1,208 @@
+// Package threading holds the store-independent parts of grouping emails
+// into threads: the keys an email is recognized by, normalizing subjects and
+// the heuristics for emails that carry no usable headers.
+//
+// An email joins the thread of the provider's thread ID when it has one.
+// Otherwise it joins the thread holding any message it replies to or
+// references, or a message that references it. Emails without either join a
+// recent thread with the same subject and an overlapping participant, but
+// only when they are replies or forwards themselves.
+package threading
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"email-harvester/internal/models"
+)
+
+// Key prefixes keep the kinds of keys apart
+const (
+	providerPrefix = "provider:"
+	messagePrefix  = "message:"
+	subjectPrefix  = "subject:"
+)
+
+// SubjectWindow is how long after its last activity a thread can still gain
+// emails by subject alone
+const SubjectWindow = 30 * 24 * time.Hour
+
+// subjectPrefixes matches the reply and forward markers in front of a
+// subject, in the languages mail clients commonly use, along with mailing
+// list tags such as "[team]"
+var subjectPrefixes = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|vs|antw|rif|tr|r)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+
+// replyPrefix matches the reply and forward markers only
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(\[[^\]]*\]\s*)*(re|fw|fwd|aw|wg|sv|vs|antw|rif|tr|r)(\[\d+\])?\s*:`)
+
+// ProviderKey returns the key of the provider's thread ID of email, or ""
+// when the provider does not thread
+func ProviderKey(email *models.Email) string {
+	if email.ThreadID == "" {
+		return ""
+	}
+	return providerPrefix + email.ThreadID
+}
+
+// MessageKeys returns the keys of the email's own Message-ID and of the
+// messages it replies to or references
+func MessageKeys(email *models.Email) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			keys = append(keys, messagePrefix+id)
+		}
+	}
+	add(email.InternetMessageID)
+	add(email.InReplyTo)
+	for _, id := range email.References {
+		add(id)
+	}
+	return keys
+}
+
+// SubjectKey returns the key of the email's normalized subject, or "" when
+// it has none
+func SubjectKey(email *models.Email) string {
+	subject := NormalizeSubject(email.Subject)
+	if subject == "" {
+		return ""
+	}
+	return subjectPrefix + subject
+}
+
+// StripSubject removes the reply and forward markers and list tags from the
+// front of a subject and collapses its whitespace
+func StripSubject(subject string) string {
+	for {
+		stripped := subjectPrefixes.ReplaceAllString(subject, "")
+		if stripped == subject {
+			break
+		}
+		subject = stripped
+	}
+	return strings.Join(strings.Fields(subject), " ")
+}
+
+// NormalizeSubject is StripSubject in lowercase, which replies to the same
+// email have in common
+func NormalizeSubject(subject string) string {
+	return strings.ToLower(StripSubject(subject))
+}
+
+// IsReply reports whether a subject marks its email as a reply or forward
+func IsReply(subject string) bool {
+	return replyPrefix.MatchString(subject)
+}
+
+// Conflicts reports whether the provider put email into another thread than
+// thread, which the headers or subject alone must not override
+func Conflicts(thread *models.Thread, email *models.Email) bool {
+	key := ProviderKey(email)
+	if key == "" {
+		return false
+	}
+	for _, k := range thread.Keys {
+		if strings.HasPrefix(k, providerPrefix) && k != key {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesSubject reports whether email can join thread by its subject alone:
+// the email must be a reply or forward, or reference a message, the thread
+// must have been active within SubjectWindow of it, and the email's sender or
+// a recipient must already take part in the thread
+func MatchesSubject(thread *models.Thread, email *models.Email) bool {
+	if !IsReply(email.Subject) && email.InReplyTo == "" && len(email.References) == 0 {
+		return false
+	}
+	if NormalizeSubject(thread.Subject) != NormalizeSubject(email.Subject) {
+		return false
+	}
+	if gap := email.ReceivedAt.Sub(thread.LastActivityAt); gap > SubjectWindow || gap < -SubjectWindow {
+		return false
+	}
+
+	participants := make(map[string]bool, len(thread.Participants))
+	for _, p := range thread.Participants {
+		participants[p.Address] = true
+	}
+	for _, addr := range addresses(email) {
+		if participants[addr.Address] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add counts email towards thread, merging its participants and keys and
+// moving the thread's last activity forward
+func Add(thread *models.Thread, email *models.Email) {
+	if thread.MessageCount == 0 || thread.Subject == "" {
+		thread.Subject = StripSubject(email.Subject)
+	}
+	thread.MessageCount++
+	if email.ReceivedAt.After(thread.LastActivityAt) {
+		thread.LastActivityAt = email.ReceivedAt
+	}
+
+	known := make(map[string]bool, len(thread.Participants))
+	for _, p := range thread.Participants {
+		known[p.Address] = true
+	}
+	for _, addr := range addresses(email) {
+		if !known[addr.Address] {
+			known[addr.Address] = true
+			thread.Participants = append(thread.Participants, addr)
+		}
+	}
+
+	keys := make(map[string]bool, len(thread.Keys))
+	for _, k := range thread.Keys {
+		keys[k] = true
+	}
+	for _, k := range append([]string{ProviderKey(email), SubjectKey(email)}, MessageKeys(email)...) {
+		if k != "" && !keys[k] {
+			keys[k] = true
+			thread.Keys = append(thread.Keys, k)
+		}
+	}
+}
+
+// addresses returns the sender and recipients of an email, lowercased
+func addresses(email *models.Email) []models.EmailAddress {
+	var all []models.EmailAddress
+	add := func(addr models.EmailAddress) {
+		addr.Address = strings.ToLower(strings.TrimSpace(addr.Address))
+		if addr.Address != "" {
+			all = append(all, addr)
+		}
+	}
+
+	if email.FromAddress.Address != "" {
+		add(email.FromAddress)
+	} else {
+		add(models.EmailAddress{Address: email.From})
+	}
+	if len(email.ToAddresses) > 0 || len(email.CcAddresses) > 0 {
+		for _, addr := range email.ToAddresses {
+			add(addr)
+		}
+		for _, addr := range email.CcAddresses {
+			add(addr)
+		}
+	} else {
+		for _, addr := range email.To {
+			add(models.EmailAddress{Address: addr})
+		}
+		for _, addr := range email.Cc {
+			add(models.EmailAddress{Address: addr})
+		}
+	}
+	return all
+}
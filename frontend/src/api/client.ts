@@ -9,6 +9,15 @@ const client = axios.create({
   },
 });
 
+// Send the login token with every request
+client.interceptors.request.use(config => {
+  const token = localStorage.getItem('token');
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
 // Add response interceptor for error handling
 client.interceptors.response.use(
   response => response,
@@ -33,6 +42,7 @@ export interface Account {
   updatedAt: string;
   lastSyncAt: string;
   isActive: boolean;
+  disabledReason?: string;
 }
 
 export interface Email {
@@ -61,9 +71,10 @@ export interface NEREntity {
 
 export interface EmailListResponse {
   emails: Email[];
-  total: number;
-  page: number;
+  total?: number;
+  page?: number;
   limit: number;
+  next_cursor?: string;
   hasMore: boolean;
 }
 
@@ -121,6 +132,7 @@ export interface AuthURLResponse {
 }
 
 export interface EmailListParams {
+  cursor?: string;
   page?: number;
   limit?: number;
   search?: string;
@@ -136,30 +148,7 @@ export const api = {
   },
 
   handleCallback: async (provider: 'google' | 'microsoft', code: string, state: string) => {
-    const response = await client.post<{
-      tokens: {
-        access_token: string;
-        refresh_token: string;
-        expires_at: string;
-        token_type: string;
-      };
-      user_info: {
-        id: string;
-        email: string;
-        name: string;
-        picture?: string;
-      };
-      account: {
-        provider: string;
-        email: string;
-        name: string;
-        picture?: string;
-        access_token: string;
-        refresh_token: string;
-        expires_at: string;
-        token_type: string;
-      };
-    }>(`/oauth/callback/${provider}`, { code, state });
+    const response = await client.post<Account>(`/oauth/callback/${provider}`, { code, state });
     return response.data;
   },
 
@@ -194,13 +183,15 @@ export const api = {
     return response.data;
   },
 
-  listEmails: async ({ page = 1, limit = 20, search, provider }: EmailListParams = {}) => {
-    const params = new URLSearchParams({
-      page: page.toString(),
-      limit: limit.toString(),
-    });
+  listEmails: async ({ cursor, page = 1, limit = 20, search, provider }: EmailListParams = {}) => {
+    const params = new URLSearchParams({ limit: limit.toString() });
+    if (cursor) {
+      params.append('cursor', cursor);
+    } else {
+      params.append('page', page.toString());
+    }
     if (search) {
-      params.append('search', search);
+      params.append('q', search);
     }
     if (provider) {
       params.append('provider', provider);